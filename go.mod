@@ -1,8 +1,6 @@
 module main
 
-go 1.24.0
-
-toolchain go1.24.2
+go 1.25.6
 
 require (
 	github.com/Eyevinn/mp4ff v0.50.0
@@ -13,7 +11,6 @@ require (
 	github.com/spf13/pflag v1.0.5
 	google.golang.org/protobuf v1.36.2
 	lukechampine.com/frand v1.5.1
-
 )
 
 require (
@@ -93,7 +90,6 @@ require (
 	golang.org/x/sync v0.13.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/term v0.31.0 // indirect
-	golang.org/x/text v0.24.0 // indirect
 	golang.org/x/tools v0.32.0 // indirect
 )
 
@@ -101,8 +97,9 @@ require (
 	github.com/beevik/etree v1.3.0
 	github.com/fatih/color v1.18.0
 	github.com/olekukonko/tablewriter v0.0.5
+	github.com/skrashevich/go-aac v0.1.0
 	github.com/vbauerster/mpb/v8 v8.11.2
-	github.com/zhaarey/go-mp4tag v0.0.0-20250210094042-22578afc09bf
+	golang.org/x/text v0.24.0
 	gopkg.in/yaml.v2 v2.2.8
 )
 
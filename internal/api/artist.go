@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"main/internal/core"
+	"main/internal/discography"
+	"main/internal/parser"
+	"main/utils/structs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+)
+
+// CheckArtist lists the albums or music videos of an artist page, filtered
+// by core.ArtistFilter, and returns the URLs to download. With --all-album or
+// --artist-filter everything that passes the filter is returned; otherwise
+// the user picks from the table and may change the filter there.
+func CheckArtist(artistUrl string, account *structs.Account, relationship string) ([]string, error) {
+	storefront, artistId := parser.CheckUrlArtist(artistUrl)
+	filter := core.ArtistFilter
+	releases, err := fetchDiscography(storefront, artistId, relationship, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	enriched := false
+	for {
+		if filter.Dedup && !enriched && relationship == "albums" {
+			enrichReleases(storefront, releases)
+			enriched = true
+		}
+		kept, skipped := filter.Apply(releases, func(albumId, upc string) bool {
+			return core.History.Has(albumId, upc, core.JobFormats())
+		})
+		printReleases(kept, relationship)
+		printSkipped(skipped)
+		var urls []string
+		for _, r := range kept {
+			urls = append(urls, r.URL)
+		}
+		if core.Artist_select || core.Artist_filter != "" {
+			fmt.Println("You have selected all options:")
+			return urls, nil
+		}
+
+		fmt.Println("Please select from the " + relationship + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
+		fmt.Println("Type 'filter <options>' to change the filter, e.g. filter include=album,ep from=2015 prefer=explicit dedup skip-history")
+		cyanColor := color.New(color.FgCyan)
+		cyanColor.Print("Enter your choice: ")
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		if input == "filter" || strings.HasPrefix(input, "filter ") {
+			f, err := discography.Parse(strings.TrimPrefix(input, "filter"))
+			if err != nil {
+				fmt.Println("Invalid filter:", err)
+				continue
+			}
+			f.Policy = core.EditionPolicy
+			if f.Wants(discography.AppearsOn) != filter.Wants(discography.AppearsOn) {
+				if releases, err = fetchDiscography(storefront, artistId, relationship, f); err != nil {
+					return nil, err
+				}
+				enriched = false
+			}
+			filter = f
+			continue
+		}
+		if input == "all" {
+			fmt.Println("You have selected all options:")
+			return urls, nil
+		}
+		return selectReleases(input, kept), nil
+	}
+}
+
+// selectReleases parses a selection such as "1,3,5-7" against the table.
+func selectReleases(input string, options []discography.Release) []string {
+	var args []string
+	fmt.Println("You have selected the following options:")
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		start, end, isRange := strings.Cut(part, "-")
+		if !isRange {
+			end = start
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(start))
+		to, err2 := strconv.Atoi(strings.TrimSpace(end))
+		if err1 != nil || err2 != nil {
+			fmt.Println("Invalid option:", part)
+			continue
+		}
+		if from < 1 || to > len(options) || from > to {
+			fmt.Println("Option out of range:", part)
+			continue
+		}
+		for i := from; i <= to; i++ {
+			r := options[i-1]
+			fmt.Println([]string{fmt.Sprint(i), r.Name, r.ReleaseDate, r.ID})
+			args = append(args, r.URL)
+		}
+	}
+	return args
+}
+
+// fetchDiscography returns the music videos, or the albums of an artist
+// sorted by release date. Albums are typed from their catalog flags and the
+// live-albums view; appears-on albums are only fetched when filter wants
+// them.
+func fetchDiscography(storefront, artistId, relationship string, filter discography.Filter) ([]discography.Release, error) {
+	if relationship == "music-videos" {
+		return artistReleases(storefront, artistId, relationship, discography.MusicVideo)
+	}
+	releases, err := artistReleases(storefront, artistId, relationship, "")
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := artistReleases(storefront, artistId, "view/live-albums", discography.Live)
+	if err != nil {
+		slog.Debug("live albums view unavailable", "artist", artistId, "err", err)
+	}
+	for i := range releases {
+		if slices.ContainsFunc(live, func(l discography.Release) bool { return l.ID == releases[i].ID }) {
+			releases[i].Type = discography.Live
+		}
+	}
+
+	if filter.Wants(discography.AppearsOn) {
+		appearsOn, err := artistReleases(storefront, artistId, "view/appears-on-albums", discography.AppearsOn)
+		if err != nil {
+			slog.Warn("appears-on albums unavailable", "artist", artistId, "err", err)
+		}
+		for _, r := range appearsOn {
+			if !slices.ContainsFunc(releases, func(o discography.Release) bool { return o.ID == r.ID }) {
+				releases = append(releases, r)
+			}
+		}
+	}
+
+	slices.SortStableFunc(releases, func(a, b discography.Release) int { return strings.Compare(a.ReleaseDate, b.ReleaseDate) })
+	return releases, nil
+}
+
+// artistReleases walks every page of a relationship or view of an artist.
+// An empty releaseType types each album from its catalog attributes.
+func artistReleases(storefront, artistId, path, releaseType string) ([]discography.Release, error) {
+	var releases []discography.Release
+	for offset := 0; ; offset += 100 {
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/%s?limit=100&offset=%d&l=%s", storefront, artistId, path, offset, core.Config.Language), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", core.DeveloperToken))
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+		req.Header.Set("Origin", "https://music.apple.com")
+		do, err := apiClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if do.StatusCode != http.StatusOK {
+			do.Body.Close()
+			return nil, statusError(do)
+		}
+		obj := new(structs.AutoGeneratedArtist)
+		err = json.NewDecoder(do.Body).Decode(&obj)
+		do.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range obj.Data {
+			a := item.Attributes
+			r := discography.Release{
+				ID:            item.ID,
+				Type:          releaseType,
+				Name:          a.Name,
+				ArtistName:    a.ArtistName,
+				ReleaseDate:   a.ReleaseDate,
+				ContentRating: a.ContentRating,
+				TrackCount:    a.TrackCount,
+				UPC:           a.Upc,
+				URL:           a.URL,
+			}
+			if r.Type == "" {
+				r.Type = albumType(a.Name, a.IsSingle, a.IsCompilation)
+			}
+			releases = append(releases, r)
+		}
+		if len(obj.Next) == 0 {
+			return releases, nil
+		}
+	}
+}
+
+func albumType(name string, isSingle, isCompilation bool) string {
+	switch {
+	case isCompilation:
+		return discography.Compilation
+	case strings.HasSuffix(name, " - EP"):
+		return discography.EP
+	case isSingle || strings.HasSuffix(name, " - Single"):
+		return discography.Single
+	}
+	return discography.Album
+}
+
+func printReleases(releases []discography.Release, relationship string) {
+	table := tablewriter.NewWriter(os.Stdout)
+	if relationship == "albums" {
+		table.SetHeader([]string{"", "Album Name", "Type", "Date", "Rating", "Album ID"})
+	} else {
+		table.SetHeader([]string{"", "MV Name", "Type", "Date", "Rating", "MV ID"})
+	}
+	table.SetRowLine(false)
+	table.SetHeaderColor(tablewriter.Colors{},
+		tablewriter.Colors{tablewriter.FgRedColor, tablewriter.Bold},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor})
+
+	table.SetColumnColor(tablewriter.Colors{tablewriter.FgCyanColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgRedColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
+		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor})
+	for i, r := range releases {
+		table.Append([]string{fmt.Sprint(i + 1), r.Name, r.Type, r.ReleaseDate, r.ContentRating, r.ID})
+	}
+	table.Render()
+}
+
+func printSkipped(skipped []discography.Skipped) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("已按筛选条件跳过 %d 项:\n", len(skipped))
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Type", "Date", "ID", "Reason"})
+	for _, s := range skipped {
+		table.Append([]string{s.Name, s.Type, s.ReleaseDate, s.ID, s.Reason})
+	}
+	table.Render()
+}
@@ -1,25 +1,20 @@
 package api
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"main/internal/core"
+	"main/internal/errs"
 	"main/internal/parser"
 	"main/utils/structs"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
-	"sort"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/fatih/color"
-	"github.com/olekukonko/tablewriter"
 )
 
 var apiClient = &http.Client{
@@ -35,11 +30,24 @@ var apiClient = &http.Client{
 	Timeout: 30 * time.Second,
 }
 
+// statusError classifies a non-200 amp-api response.
+func statusError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return errs.New(errs.CodeTokenInvalid, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return errs.New(errs.CodeNotFound, resp.Status)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return errs.New(errs.CodeNetwork, resp.Status)
+	}
+	return errors.New(resp.Status)
+}
+
 func GetUrlSong(songUrl string, account *structs.Account) (string, error) {
 	storefront, songId := parser.CheckUrlSong(songUrl)
 	manifest, err := GetInfoFromAdam(songId, account, storefront)
 	if err != nil {
-		fmt.Println("\u26A0 Failed to get manifest:", err)
+		slog.Warn("failed to get manifest", "songId", songId, "account", *account, "err", err)
 		core.SharedLock.Lock()
 		core.Counter.NotSong++
 		core.SharedLock.Unlock()
@@ -71,7 +79,7 @@ func GetUrlArtistName(artistUrl string, account *structs.Account) (string, strin
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		return "", "", errors.New(do.Status)
+		return "", "", statusError(do)
 	}
 	obj := new(structs.AutoGeneratedArtist)
 	err = json.NewDecoder(do.Body).Decode(&obj)
@@ -81,133 +89,13 @@ func GetUrlArtistName(artistUrl string, account *structs.Account) (string, strin
 	return obj.Data[0].Attributes.Name, obj.Data[0].ID, nil
 }
 
-func CheckArtist(artistUrl string, account *structs.Account, relationship string) ([]string, error) {
-	storefront, artistId := parser.CheckUrlArtist(artistUrl)
-	Num := 0
-	var args []string
-	var urls []string
-	var options [][]string
-	for {
-		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/%s?limit=100&offset=%d&l=%s", storefront, artistId, relationship, Num, core.Config.Language), nil)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", core.DeveloperToken))
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-		req.Header.Set("Origin", "https://music.apple.com")
-		do, err := apiClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		defer do.Body.Close()
-		if do.StatusCode != http.StatusOK {
-			return nil, errors.New(do.Status)
-		}
-		obj := new(structs.AutoGeneratedArtist)
-		err = json.NewDecoder(do.Body).Decode(&obj)
-		if err != nil {
-			return nil, err
-		}
-		for _, album := range obj.Data {
-			options = append(options, []string{album.Attributes.Name, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
-		}
-		Num = Num + 100
-		if len(obj.Next) == 0 {
-			break
-		}
-	}
-	sort.Slice(options, func(i, j int) bool {
-		dateI, _ := time.Parse("2006-01-02", options[i][1])
-		dateJ, _ := time.Parse("2006-01-02", options[j][1])
-		return dateI.Before(dateJ)
-	})
-
-	table := tablewriter.NewWriter(os.Stdout)
-	if relationship == "albums" {
-		table.SetHeader([]string{"", "Album Name", "Date", "Album ID"})
-	} else if relationship == "music-videos" {
-		table.SetHeader([]string{"", "MV Name", "Date", "MV ID"})
-	}
-	table.SetRowLine(false)
-	table.SetHeaderColor(tablewriter.Colors{},
-		tablewriter.Colors{tablewriter.FgRedColor, tablewriter.Bold},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor})
-
-	table.SetColumnColor(tablewriter.Colors{tablewriter.FgCyanColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgRedColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor},
-		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor})
-	for i, v := range options {
-		urls = append(urls, v[3])
-		options[i] = append([]string{fmt.Sprint(i + 1)}, v[:3]...)
-		table.Append(options[i])
-	}
-	table.Render()
-	if core.Artist_select {
-		fmt.Println("You have selected all options:")
-		return urls, nil
-	}
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Please select from the " + relationship + " options above (multiple options separated by commas, ranges supported, or type 'all' to select all)")
-	cyanColor := color.New(color.FgCyan)
-	cyanColor.Print("Enter your choice: ")
-	input, _ := reader.ReadString('\n')
-
-	input = strings.TrimSpace(input)
-	if input == "all" {
-		fmt.Println("You have selected all options:")
-		return urls, nil
-	}
-
-	selectedOptions := [][]string{}
-	parts := strings.Split(input, ",")
-	for _, part := range parts {
-		if strings.Contains(part, "-") {
-			rangeParts := strings.Split(part, "-")
-			selectedOptions = append(selectedOptions, rangeParts)
-		} else {
-			selectedOptions = append(selectedOptions, []string{part})
-		}
-	}
-
-	fmt.Println("You have selected the following options:")
-	for _, opt := range selectedOptions {
-		if len(opt) == 1 {
-			num, err := strconv.Atoi(opt[0])
-			if err != nil {
-				fmt.Println("Invalid option:", opt[0])
-				continue
-			}
-			if num > 0 && num <= len(options) {
-				fmt.Println(options[num-1])
-				args = append(args, urls[num-1])
-			} else {
-				fmt.Println("Option out of range:", opt[0])
-			}
-		} else if len(opt) == 2 {
-			start, err1 := strconv.Atoi(opt[0])
-			end, err2 := strconv.Atoi(opt[1])
-			if err1 != nil || err2 != nil {
-				fmt.Println("Invalid range:", opt)
-				continue
-			}
-			if start < 1 || end > len(options) || start > end {
-				fmt.Println("Range out of range:", opt)
-				continue
-			}
-			for i := start; i <= end; i++ {
-				fmt.Println(options[i-1])
-				args = append(args, urls[i-1])
-			}
-		} else {
-			fmt.Println("Invalid option:", opt)
-		}
-	}
-	return args, nil
+func GetMeta(albumId string, account *structs.Account, storefront string) (*structs.AutoGenerated, error) {
+	return GetMetaInLanguage(albumId, account, storefront, core.Config.Language)
 }
 
-func GetMeta(albumId string, account *structs.Account, storefront string) (*structs.AutoGenerated, error) {
+// GetMetaInLanguage fetches an album or playlist like GetMeta, with names in
+// the given catalog language.
+func GetMetaInLanguage(albumId string, account *structs.Account, storefront, language string) (*structs.AutoGenerated, error) {
 	var mtype string
 	var next string
 	if strings.Contains(albumId, "pl.") {
@@ -230,7 +118,7 @@ func GetMeta(albumId string, account *structs.Account, storefront string) (*stru
 	query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url")
 	query.Set("fields[record-labels]", "name")
 	query.Set("extend", "editorialVideo")
-	query.Set("l", core.Config.Language)
+	query.Set("l", language)
 	req.URL.RawQuery = query.Encode()
 	do, err := apiClient.Do(req)
 	if err != nil {
@@ -238,7 +126,7 @@ func GetMeta(albumId string, account *structs.Account, storefront string) (*stru
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, statusError(do)
 	}
 	obj := new(structs.AutoGenerated)
 	err = json.NewDecoder(do.Body).Decode(&obj)
@@ -251,7 +139,7 @@ func GetMeta(albumId string, account *structs.Account, storefront string) (*stru
 	if len(obj.Data[0].Relationships.Tracks.Next) > 0 {
 		next = obj.Data[0].Relationships.Tracks.Next
 		for {
-			req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/%s&l=%s&include=albums", next, core.Config.Language), nil)
+			req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/%s&l=%s&include=albums", next, language), nil)
 			if err != nil {
 				return nil, err
 			}
@@ -264,7 +152,7 @@ func GetMeta(albumId string, account *structs.Account, storefront string) (*stru
 			}
 			defer do.Body.Close()
 			if do.StatusCode != http.StatusOK {
-				return nil, errors.New(do.Status)
+				return nil, statusError(do)
 			}
 			obj2 := new(structs.AutoGeneratedTrack)
 			err = json.NewDecoder(do.Body).Decode(&obj2)
@@ -304,7 +192,7 @@ func GetInfoFromAdam(adamId string, account *structs.Account, storefront string)
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, statusError(do)
 	}
 
 	obj := new(structs.ApiResult)
@@ -318,7 +206,7 @@ func GetInfoFromAdam(adamId string, account *structs.Account, storefront string)
 			return &d, nil
 		}
 	}
-	return nil, nil
+	return nil, errs.New(errs.CodeGeoUnavailable, fmt.Sprintf("song %s not available in storefront %s", adamId, storefront))
 }
 
 func GetMVInfoFromAdam(adamId string, account *structs.Account, storefront string) (*structs.AutoGeneratedMusicVideo, error) {
@@ -339,7 +227,7 @@ func GetMVInfoFromAdam(adamId string, account *structs.Account, storefront strin
 	}
 	defer do.Body.Close()
 	if do.StatusCode != http.StatusOK {
-		return nil, errors.New(do.Status)
+		return nil, statusError(do)
 	}
 
 	obj := new(structs.AutoGeneratedMusicVideo)
@@ -368,7 +256,7 @@ func GetToken() (string, error) {
 	regex := regexp.MustCompile(`/assets/index~[^/]+\.js`)
 	indexJsUri := regex.FindString(string(body))
 	if indexJsUri == "" {
-		return "", errors.New("could not find JS asset URL in HTML")
+		return "", errs.New(errs.CodeTokenInvalid, "could not find JS asset URL in HTML")
 	}
 	req, err = http.NewRequest("GET", "https://music.apple.com"+indexJsUri, nil)
 	if err != nil {
@@ -386,7 +274,7 @@ func GetToken() (string, error) {
 	regex = regexp.MustCompile(`eyJ[A-Za-z0-9-_=]+\.[A-Za-z0-9-_=]+\.[A-Za-z0-9-_=]+`)
 	token := regex.FindString(string(body))
 	if token == "" {
-		return "", errors.New("could not find developer token in JS file")
+		return "", errs.New(errs.CodeTokenInvalid, "could not find developer token in JS file")
 	}
 	return token, nil
 }
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"main/internal/core"
+	"main/internal/editions"
+	"main/utils/ampapi"
+	"main/utils/structs"
+	"strings"
+)
+
+// counterpartSearchLimit is how many search results are checked for the
+// other version of an album or song.
+const counterpartSearchLimit = 25
+
+// FindAlbumCounterpart looks for the explicit or clean version (want) of an
+// album in storefront: an album by the same artist, with the same title
+// apart from edition notes, rated want, and with the same track list. It
+// returns the counterpart's metadata, or nil when there is none.
+func FindAlbumCounterpart(meta *structs.AutoGenerated, storefront, want string, account *structs.Account) (*structs.AutoGenerated, error) {
+	album := meta.Data[0].Attributes
+	title := editions.NormalizeTitle(album.Name)
+	resp, err := ampapi.Search(storefront, album.ArtistName+" "+title, "albums", core.Config.Language, core.DeveloperToken, counterpartSearchLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Results.Albums == nil {
+		return nil, nil
+	}
+	for _, candidate := range resp.Results.Albums.Data {
+		a := candidate.Attributes
+		if candidate.ID == meta.Data[0].ID || a.ContentRating != want || !strings.EqualFold(a.ArtistName, album.ArtistName) || editions.NormalizeTitle(a.Name) != title {
+			continue
+		}
+		candidateMeta, err := GetMeta(candidate.ID, account, storefront)
+		if err != nil {
+			slog.Debug("counterpart candidate unavailable", "album", candidate.ID, "err", err)
+			continue
+		}
+		if sameTrackList(meta.Data[0].Relationships.Tracks.Data, candidateMeta.Data[0].Relationships.Tracks.Data) {
+			return candidateMeta, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameTrackList reports whether two albums have the same songs in the same
+// order, comparing titles without edition notes such as "(Clean)".
+func sameTrackList(a, b []structs.TrackData) bool {
+	if len(a) != len(b) || len(a) == 0 {
+		return false
+	}
+	same := 0
+	for i := range a {
+		if a[i].Attributes.DiscNumber == b[i].Attributes.DiscNumber && editions.NormalizeTitle(a[i].Attributes.Name) == editions.NormalizeTitle(b[i].Attributes.Name) {
+			same++
+		}
+	}
+	// Clean edits are sometimes retitled, e.g. with asterisks; allow a few.
+	return same*10 >= len(a)*9
+}
+
+// FindSongCounterpart looks for the explicit or clean version (want) of a
+// song in storefront: a song by the same artist, with the same title apart
+// from edition notes, rated want, and no more than three seconds longer or
+// shorter. It returns nil when there is none.
+func FindSongCounterpart(track structs.TrackData, storefront, want string) (*structs.TrackData, error) {
+	t := track.Attributes
+	name := editions.NormalizeTitle(t.Name)
+	resp, err := ampapi.Search(storefront, t.ArtistName+" "+name, "songs", core.Config.Language, core.DeveloperToken, counterpartSearchLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Results.Songs == nil {
+		return nil, nil
+	}
+	for _, candidate := range resp.Results.Songs.Data {
+		c := candidate.Attributes
+		if candidate.ID == track.ID || c.ContentRating != want || !strings.EqualFold(c.ArtistName, t.ArtistName) || editions.NormalizeTitle(c.Name) != name {
+			continue
+		}
+		if diff := c.DurationInMillis - t.DurationInMillis; diff > 3000 || diff < -3000 {
+			continue
+		}
+		song, err := ampapi.GetSongResp(storefront, candidate.ID, core.Config.Language, core.DeveloperToken)
+		if err != nil || len(song.Data) == 0 {
+			slog.Debug("counterpart candidate unavailable", "song", candidate.ID, "err", err)
+			continue
+		}
+		// SongRespData and TrackData share their JSON layout.
+		raw, err := json.Marshal(song.Data[0])
+		if err != nil {
+			return nil, err
+		}
+		var counterpart structs.TrackData
+		if err := json.Unmarshal(raw, &counterpart); err != nil {
+			return nil, err
+		}
+		return &counterpart, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"main/internal/core"
+	"main/utils/structs"
+	"net/http"
+	"net/url"
+)
+
+// creditsResponse is the credits view of a song: one credit category, such
+// as Performers or Composition & Lyrics, per entry.
+type creditsResponse struct {
+	Data []struct {
+		Attributes struct {
+			Title string `json:"title"`
+			Kind  string `json:"kind"`
+		} `json:"attributes"`
+		Relationships struct {
+			CreditArtists struct {
+				Data []struct {
+					Attributes struct {
+						Name      string   `json:"name"`
+						RoleNames []string `json:"roleNames"`
+					} `json:"attributes"`
+				} `json:"data"`
+			} `json:"credit-artists"`
+		} `json:"relationships"`
+	} `json:"data"`
+}
+
+// GetSongCredits fetches the credits of a song. Songs without credits
+// return an empty list rather than an error. Credits are always fetched in
+// English: roles are matched by name, and performers' names rarely differ
+// between languages.
+func GetSongCredits(storefront, songId string) ([]structs.Credit, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/songs/%s/credits", storefront, songId), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", core.DeveloperToken))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("l", "en-US")
+	req.URL.RawQuery = query.Encode()
+	do, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if do.StatusCode != http.StatusOK {
+		return nil, statusError(do)
+	}
+	obj := new(creditsResponse)
+	if err := json.NewDecoder(do.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	var credits []structs.Credit
+	for _, category := range obj.Data {
+		name := category.Attributes.Kind
+		if name == "" {
+			name = category.Attributes.Title
+		}
+		for _, a := range category.Relationships.CreditArtists.Data {
+			credits = append(credits, structs.Credit{Name: a.Attributes.Name, Category: name, Roles: a.Attributes.RoleNames})
+		}
+	}
+	return credits, nil
+}
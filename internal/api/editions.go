@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"main/internal/core"
+	"main/internal/discography"
+	"main/internal/editions"
+	"main/internal/parser"
+	"main/utils/structs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// albumsPerRequest is how many albums, with their tracks, are fetched in
+// one catalog request.
+const albumsPerRequest = 20
+
+// EditionSkip is an album left out because another edition of the same
+// release was kept.
+type EditionSkip struct {
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+	Kept   string `json:"kept"`
+	Reason string `json:"reason"`
+}
+
+// EditionReport lists the skipped editions of a run with --json-output.
+type EditionReport struct {
+	Status  string        `json:"status"`
+	Policy  []string      `json:"policy"`
+	Skipped []EditionSkip `json:"skipped"`
+}
+
+// GetAlbumEditions fetches albums with their tracks and returns them as
+// editions by album ID. Albums the storefront does not carry are missing
+// from the result.
+func GetAlbumEditions(storefront string, ids []string) (map[string]editions.Edition, error) {
+	result := make(map[string]editions.Edition)
+	for start := 0; start < len(ids); start += albumsPerRequest {
+		chunk := ids[start:min(start+albumsPerRequest, len(ids))]
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums", storefront), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", core.DeveloperToken))
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+		req.Header.Set("Origin", "https://music.apple.com")
+		query := url.Values{}
+		query.Set("ids", strings.Join(chunk, ","))
+		query.Set("include", "tracks")
+		query.Set("l", core.Config.Language)
+		req.URL.RawQuery = query.Encode()
+		do, err := apiClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if do.StatusCode != http.StatusOK {
+			do.Body.Close()
+			return nil, statusError(do)
+		}
+		obj := new(structs.AutoGenerated)
+		err = json.NewDecoder(do.Body).Decode(&obj)
+		do.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for i := range obj.Data {
+			e := editionOf(obj, i)
+			result[e.ID] = e
+		}
+	}
+	return result, nil
+}
+
+func editionOf(meta *structs.AutoGenerated, i int) editions.Edition {
+	album := meta.Data[i]
+	a := album.Attributes
+	kind := albumType(a.Name, a.IsSingle, a.IsCompilation)
+	e := editions.Edition{
+		ID:            album.ID,
+		Name:          a.Name,
+		Artist:        a.ArtistName,
+		Single:        kind == discography.Single || kind == discography.EP,
+		ReleaseDate:   a.ReleaseDate,
+		ContentRating: a.ContentRating,
+		UPC:           a.Upc,
+		TrackCount:    a.TrackCount,
+		Quality:       traitQuality(a.AudioTraits),
+	}
+	for _, t := range album.Relationships.Tracks.Data {
+		if t.Attributes.Isrc != "" {
+			e.ISRCs = append(e.ISRCs, t.Attributes.Isrc)
+		}
+		e.Quality = max(e.Quality, traitQuality(t.Attributes.AudioTraits))
+	}
+	return e
+}
+
+func traitQuality(traits []string) int {
+	for _, t := range traits {
+		if t == "hi-res-lossless" {
+			return editions.HiRes
+		}
+	}
+	for _, t := range traits {
+		if t == "lossless" {
+			return editions.Lossless
+		}
+	}
+	return editions.AAC
+}
+
+// enrichReleases sets the ISRCs and quality the edition grouping needs on
+// the albums of an artist page.
+func enrichReleases(storefront string, releases []discography.Release) {
+	var ids []string
+	for _, r := range releases {
+		if r.Type != discography.MusicVideo {
+			ids = append(ids, r.ID)
+		}
+	}
+	details, err := GetAlbumEditions(storefront, ids)
+	if err != nil {
+		slog.Warn("album details unavailable, grouping editions by title and UPC only", "storefront", storefront, "err", err)
+		return
+	}
+	for i := range releases {
+		if e, ok := details[releases[i].ID]; ok {
+			releases[i].ISRCs, releases[i].Quality = e.ISRCs, e.Quality
+		}
+	}
+}
+
+// DedupEditions drops the album URLs that are another edition of an album
+// kept from urls. Songs, playlists and music videos are always kept.
+func DedupEditions(urls []string, policy editions.Policy) ([]string, []EditionSkip) {
+	type album struct {
+		index      int
+		storefront string
+		id         string
+	}
+	var albums []album
+	byStorefront := make(map[string][]string)
+	for i, u := range urls {
+		storefront, id := parser.CheckUrl(u)
+		if id == "" || strings.Contains(u, "?i=") || strings.Contains(u, "&i=") {
+			continue
+		}
+		albums = append(albums, album{i, storefront, id})
+		byStorefront[storefront] = append(byStorefront[storefront], id)
+	}
+	if len(albums) < 2 {
+		return urls, nil
+	}
+
+	details := make(map[string]editions.Edition)
+	for storefront, ids := range byStorefront {
+		found, err := GetAlbumEditions(storefront, ids)
+		if err != nil {
+			slog.Warn("album details unavailable, editions not grouped", "storefront", storefront, "err", err)
+			continue
+		}
+		for id, e := range found {
+			details[storefront+"/"+id] = e
+		}
+	}
+
+	var eds []editions.Edition
+	var known []album
+	for _, a := range albums {
+		if e, ok := details[a.storefront+"/"+a.id]; ok {
+			eds = append(eds, e)
+			known = append(known, a)
+		}
+	}
+	_, dropped := editions.Dedup(eds, policy)
+	if len(dropped) == 0 {
+		return urls, nil
+	}
+
+	drop := make(map[int]bool)
+	var skipped []EditionSkip
+	for _, d := range dropped {
+		a := known[d.Index]
+		drop[a.index] = true
+		skipped = append(skipped, EditionSkip{URL: urls[a.index], Name: eds[d.Index].Name, Kept: urls[known[d.Kept].index], Reason: d.Reason})
+	}
+	var kept []string
+	for i, u := range urls {
+		if !drop[i] {
+			kept = append(kept, u)
+		}
+	}
+	return kept, skipped
+}
+
+// PrintEditionReport shows which editions were skipped and why.
+func PrintEditionReport(skipped []EditionSkip, policy editions.Policy, jsonOutput bool) {
+	if jsonOutput {
+		out, _ := json.Marshal(EditionReport{Status: "edition-dedup", Policy: policy, Skipped: skipped})
+		fmt.Println(string(out))
+		return
+	}
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("版本去重 (%s): 跳过 %d 个重复版本\n", strings.Join(policy, ", "), len(skipped))
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Skipped", "Reason", "Kept"})
+	table.SetAutoWrapText(false)
+	for _, s := range skipped {
+		table.Append([]string{s.Name + "\n" + s.URL, s.Reason, s.Kept})
+	}
+	table.Render()
+}
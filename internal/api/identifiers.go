@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"main/internal/core"
+	"main/utils/ampapi"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// IdentifierMatch is the resolution of one ISRC or UPC.
+type IdentifierMatch struct {
+	Kind       string   `json:"kind"` // isrc or upc
+	Code       string   `json:"code"`
+	Storefront string   `json:"storefront,omitempty"`
+	URL        string   `json:"url,omitempty"`     // what is downloaded
+	Matches    []string `json:"matches,omitempty"` // every match in Storefront
+	Error      string   `json:"error,omitempty"`
+}
+
+// IdentifierReport lists the identifiers of a run with --json-output.
+type IdentifierReport struct {
+	Status string            `json:"status"`
+	Items  []IdentifierMatch `json:"items"`
+}
+
+// ResolveIdentifier looks an ISRC up as songs, or a UPC as albums, in the
+// storefront of every configured account in config order, and stops at the
+// first storefront that has a match. ISRCs resolve to song URLs, UPCs to
+// album URLs. When a storefront has several matches the first is used and
+// all are listed; songs from original albums come before the same recording
+// on compilations.
+func ResolveIdentifier(kind, code string) IdentifierMatch {
+	m := IdentifierMatch{Kind: kind, Code: code}
+	var seen []string
+	var lastErr error
+	for _, acc := range core.Config.Accounts {
+		sf := strings.ToLower(acc.Storefront)
+		if sf == "" || slices.Contains(seen, sf) {
+			continue
+		}
+		seen = append(seen, sf)
+
+		var urls []string
+		if kind == "isrc" {
+			resp, err := ampapi.GetSongsByIsrc(sf, code, core.Config.Language, core.DeveloperToken)
+			if err != nil {
+				lastErr = err
+				slog.Debug("isrc lookup failed", "isrc", code, "storefront", sf, "err", err)
+				continue
+			}
+			songs := resp.Data
+			slices.SortStableFunc(songs, func(a, b ampapi.SongRespData) int {
+				return compareBool(onCompilation(a), onCompilation(b))
+			})
+			for _, s := range songs {
+				urls = append(urls, fmt.Sprintf("https://music.apple.com/%s/song/%s", sf, s.ID))
+			}
+		} else {
+			resp, err := ampapi.GetAlbumsByUpc(sf, code, core.Config.Language, core.DeveloperToken)
+			if err != nil {
+				lastErr = err
+				slog.Debug("upc lookup failed", "upc", code, "storefront", sf, "err", err)
+				continue
+			}
+			for _, a := range resp.Data {
+				urls = append(urls, fmt.Sprintf("https://music.apple.com/%s/album/%s", sf, a.ID))
+			}
+		}
+		if len(urls) > 0 {
+			m.Storefront, m.URL, m.Matches = sf, urls[0], urls
+			return m
+		}
+	}
+	m.Error = "所有区域均未找到"
+	if lastErr != nil {
+		m.Error = fmt.Sprintf("所有区域均未找到 (最后的错误: %v)", lastErr)
+	}
+	return m
+}
+
+// onCompilation reports whether song is from a compilation album.
+func onCompilation(song ampapi.SongRespData) bool {
+	albums := song.Relationships.Albums.Data
+	return len(albums) > 0 && albums[0].Attributes.IsCompilation
+}
+
+// compareBool orders false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// PrintIdentifierReport shows how every identifier was resolved. Only
+// identifiers without a match or with several matches are listed in the
+// table; JSON output lists all of them.
+func PrintIdentifierReport(items []IdentifierMatch, jsonOutput bool) {
+	if jsonOutput {
+		out, _ := json.Marshal(IdentifierReport{Status: "identifier-resolution", Items: items})
+		fmt.Println(string(out))
+		return
+	}
+
+	resolved := 0
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Type", "Code", "Storefront", "Result"})
+	table.SetAutoWrapText(false)
+	for _, m := range items {
+		switch {
+		case m.Error != "":
+			table.Append([]string{strings.ToUpper(m.Kind), m.Code, "-", m.Error})
+			continue
+		case len(m.Matches) > 1:
+			table.Append([]string{strings.ToUpper(m.Kind), m.Code, strings.ToUpper(m.Storefront), fmt.Sprintf("%d 个匹配，下载第一个 (优先非合辑):\n%s", len(m.Matches), strings.Join(m.Matches, "\n"))})
+		}
+		resolved++
+	}
+	fmt.Printf("ISRC/UPC 解析: %d 个标识，%d 个已匹配\n", len(items), resolved)
+	if table.NumLines() > 0 {
+		table.Render()
+	}
+}
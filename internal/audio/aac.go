@@ -0,0 +1,90 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/skrashevich/go-aac/pkg/decoder"
+)
+
+// aacConfig returns the AudioSpecificConfig of an AAC sample entry.
+func aacConfig(entry mp4.Box) []byte {
+	e, ok := entry.(*mp4.AudioSampleEntryBox)
+	if !ok || e.Type() != "mp4a" || e.Esds == nil || e.Esds.DecConfigDescriptor == nil || e.Esds.DecConfigDescriptor.DecSpecificInfo == nil {
+		return nil
+	}
+	return e.Esds.DecConfigDescriptor.DecSpecificInfo.DecConfig
+}
+
+// newAacStream returns a decoder for AAC-LC, the profile of the catalog's
+// AAC streams. Other profiles and channel layouts are reported as
+// ErrUnsupported, for Open to hand to ffmpeg.
+func newAacStream(f *os.File, asc []byte, ranges []mp4.DataRange) (*aacStream, error) {
+	dec := decoder.New()
+	if err := dec.SetASC(asc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if dec.Config.ChanConfig < 1 || dec.Config.ChanConfig > 2 {
+		return nil, fmt.Errorf("%w: aac channel configuration %d", ErrUnsupported, dec.Config.ChanConfig)
+	}
+	return &aacStream{f: f, dec: dec, ranges: ranges}, nil
+}
+
+// aacStream decodes an AAC track frame by frame.
+type aacStream struct {
+	f      *os.File
+	dec    *decoder.Decoder
+	ranges []mp4.DataRange
+	next   int
+	frame  []byte
+
+	pending []float32 // decoded interleaved samples not yet read
+	pos     int
+}
+
+func (s *aacStream) Format() Format {
+	return Format{SampleRate: s.dec.Config.SampleRate, Channels: s.dec.Config.ChanConfig}
+}
+
+func (s *aacStream) Read(buf []float64) (int, error) {
+	channels := s.dec.Config.ChanConfig
+	if len(buf) < channels {
+		return 0, io.ErrShortBuffer
+	}
+	for s.pos == len(s.pending) {
+		if s.next == len(s.ranges) {
+			return 0, io.EOF
+		}
+		r := s.ranges[s.next]
+		s.next++
+		if uint64(cap(s.frame)) < r.Size {
+			s.frame = make([]byte, r.Size)
+		}
+		s.frame = s.frame[:r.Size]
+		if _, err := s.f.ReadAt(s.frame, int64(r.Offset)); err != nil {
+			return 0, err
+		}
+		out, err := s.dec.DecodeFrame(s.frame)
+		if err != nil {
+			return 0, fmt.Errorf("aac frame %d: %w", s.next, err)
+		}
+		if len(out)%channels != 0 {
+			return 0, errors.New("aac frame is not a whole number of frames")
+		}
+		s.pending, s.pos = out, 0
+	}
+
+	n := min(len(buf)/channels*channels, len(s.pending)-s.pos)
+	for i := range n {
+		buf[i] = float64(s.pending[s.pos+i])
+	}
+	s.pos += n
+	return n, nil
+}
+
+func (s *aacStream) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,437 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// alacConfig is the ALACSpecificConfig of a track, the payload of its alac
+// box after version and flags.
+type alacConfig struct {
+	frameLength uint32
+	bitDepth    int
+	pb, mb, kb  uint32
+	channels    int
+	sampleRate  int
+}
+
+func parseAlacConfig(p []byte) (alacConfig, error) {
+	if len(p) < 24 {
+		return alacConfig{}, errors.New("short alac config")
+	}
+	c := alacConfig{
+		frameLength: binary.BigEndian.Uint32(p[0:4]),
+		bitDepth:    int(p[5]),
+		pb:          uint32(p[6]),
+		mb:          uint32(p[7]),
+		kb:          uint32(p[8]),
+		channels:    int(p[9]),
+		sampleRate:  int(binary.BigEndian.Uint32(p[20:24])),
+	}
+	switch {
+	case c.frameLength == 0 || c.frameLength > 1<<16:
+		return alacConfig{}, fmt.Errorf("unsupported alac frame length %d", c.frameLength)
+	case c.bitDepth != 16 && c.bitDepth != 20 && c.bitDepth != 24 && c.bitDepth != 32:
+		return alacConfig{}, fmt.Errorf("unsupported alac bit depth %d", c.bitDepth)
+	case c.channels < 1 || c.channels > 8:
+		return alacConfig{}, fmt.Errorf("unsupported alac channel count %d", c.channels)
+	}
+	return c, nil
+}
+
+// ALAC element tags.
+const (
+	alacSCE = 0 // single channel
+	alacCPE = 1 // channel pair
+	alacCCE = 2
+	alacLFE = 3
+	alacDSE = 4
+	alacPCE = 5
+	alacFIL = 6
+	alacEND = 7
+)
+
+// alacDecoder decodes ALAC frames, following the reference decoder Apple
+// published with the format.
+type alacDecoder struct {
+	cfg       alacConfig
+	predictor []int32
+	mixU      []int32
+	mixV      []int32
+	shift     []uint32
+	out       [][]int32 // per channel
+}
+
+func newAlacDecoder(cfg alacConfig) *alacDecoder {
+	n := int(cfg.frameLength)
+	d := &alacDecoder{
+		cfg:       cfg,
+		predictor: make([]int32, n),
+		mixU:      make([]int32, n),
+		mixV:      make([]int32, n),
+		shift:     make([]uint32, 2*n),
+		out:       make([][]int32, cfg.channels),
+	}
+	for i := range d.out {
+		d.out[i] = make([]int32, n)
+	}
+	return d
+}
+
+// decode decodes one frame. It returns the samples of each channel, valid
+// until the next call, as signed integers of cfg.bitDepth bits.
+func (d *alacDecoder) decode(frame []byte) ([][]int32, int, error) {
+	r := &bitReader{b: frame}
+	channel := 0
+	frameSamples := -1
+	for channel < d.cfg.channels {
+		tag := r.read(3)
+		switch tag {
+		case alacSCE, alacLFE, alacCPE:
+			pair := tag == alacCPE
+			if pair && channel+2 > d.cfg.channels {
+				return nil, 0, errors.New("alac channel pair beyond channel count")
+			}
+			n, err := d.element(r, pair, channel)
+			if err != nil {
+				return nil, 0, err
+			}
+			if frameSamples >= 0 && n != frameSamples {
+				return nil, 0, errors.New("alac elements differ in length")
+			}
+			frameSamples = n
+			channel++
+			if pair {
+				channel++
+			}
+		case alacDSE:
+			r.read(4) // element instance tag
+			align := r.read(1) == 1
+			count := r.read(8)
+			if count == 255 {
+				count += r.read(8)
+			}
+			if align {
+				r.byteAlign()
+			}
+			r.skip(int(count) * 8)
+		case alacFIL:
+			count := r.read(4)
+			if count == 15 {
+				count += r.read(8) - 1
+			}
+			r.skip(int(count) * 8)
+		case alacEND:
+			if channel == 0 {
+				return nil, 0, errors.New("alac frame without audio")
+			}
+			channel = d.cfg.channels
+		default:
+			return nil, 0, fmt.Errorf("unsupported alac element %d", tag)
+		}
+		if r.short {
+			return nil, 0, errors.New("truncated alac frame")
+		}
+	}
+	out := d.out
+	for i := range out {
+		out[i] = out[i][:frameSamples]
+	}
+	return out, frameSamples, nil
+}
+
+// element decodes a single channel or channel pair element into the
+// channels starting at channel and returns its sample count.
+func (d *alacDecoder) element(r *bitReader, pair bool, channel int) (int, error) {
+	r.read(4) // element instance tag
+	if r.read(12) != 0 {
+		return 0, errors.New("invalid alac element header")
+	}
+	header := r.read(4)
+	partial := header&8 != 0
+	bytesShifted := int(header>>1) & 3
+	escape := header&1 != 0
+	if bytesShifted == 3 {
+		return 0, errors.New("invalid alac shift")
+	}
+
+	numSamples := int(d.cfg.frameLength)
+	if partial {
+		numSamples = int(r.read(16)<<16 | r.read(16))
+		if numSamples > int(d.cfg.frameLength) {
+			return 0, errors.New("alac frame longer than frame length")
+		}
+	}
+	channels := 1
+	if pair {
+		channels = 2
+	}
+	mix := [2][]int32{d.mixU[:numSamples], d.mixV[:numSamples]}
+	var mixBits, mixRes int32
+
+	if escape {
+		// Uncompressed samples, interleaved for a pair.
+		chanBits := d.cfg.bitDepth
+		for i := range numSamples {
+			for c := range channels {
+				mix[c][i] = r.readSigned(chanBits)
+			}
+		}
+		bytesShifted = 0
+	} else {
+		chanBits := d.cfg.bitDepth - bytesShifted*8
+		if pair {
+			chanBits++
+			mixBits = int32(r.read(8))
+			mixRes = int32(int8(r.read(8)))
+		}
+		var mode, denShift, pbFactor [2]uint32
+		var coefs [2][]int32
+		for c := range channels {
+			h := r.read(8)
+			mode[c], denShift[c] = h>>4, h&15
+			h = r.read(8)
+			pbFactor[c] = h >> 5
+			coefs[c] = make([]int32, h&31)
+			for k := range coefs[c] {
+				coefs[c][k] = int32(int16(r.read(16)))
+			}
+		}
+		var shiftBits bitReader
+		if bytesShifted > 0 {
+			shiftBits = *r
+			r.skip(bytesShifted * 8 * channels * numSamples)
+		}
+		for c := range channels {
+			pc := d.predictor[:numSamples]
+			if err := d.rice(r, pc, chanBits, d.cfg.pb*pbFactor[c]/4); err != nil {
+				return 0, err
+			}
+			if mode[c] != 0 {
+				unpcBlock(pc, pc, nil, chanBits, 0)
+			}
+			unpcBlock(pc, mix[c], coefs[c], chanBits, denShift[c])
+		}
+		if bytesShifted > 0 {
+			n := bytesShifted * 8
+			for i := range numSamples * channels {
+				d.shift[i] = shiftBits.read(n)
+			}
+		}
+	}
+
+	shift := uint(bytesShifted * 8)
+	if !pair {
+		out := d.out[channel][:numSamples]
+		for i, v := range mix[0] {
+			if shift > 0 {
+				v = v<<shift | int32(d.shift[i])
+			}
+			out[i] = v
+		}
+		return numSamples, nil
+	}
+	left, right := d.out[channel][:numSamples], d.out[channel+1][:numSamples]
+	for i := range numSamples {
+		u, v := mix[0][i], mix[1][i]
+		l, r := u, v
+		if mixRes != 0 {
+			l = u + v - (mixRes*v)>>mixBits
+			r = l - v
+		}
+		if shift > 0 {
+			l = l<<shift | int32(d.shift[2*i])
+			r = r<<shift | int32(d.shift[2*i+1])
+		}
+		left[i], right[i] = l, r
+	}
+	return numSamples, nil
+}
+
+// rice reads the adaptive Golomb coded prediction residuals of one channel.
+func (d *alacDecoder) rice(r *bitReader, out []int32, chanBits int, mult uint32) error {
+	history := d.cfg.mb
+	limit := int(d.cfg.kb)
+	var zmode uint32
+	for i := 0; i < len(out); i++ {
+		k := min(bits.Len32(history>>9+3)-1, limit)
+		n := r.scalar(k, chanBits)
+		x := n + zmode
+		out[i] = int32(x>>1) ^ -int32(x&1)
+		if n > 0xffff {
+			history = 0xffff
+		} else {
+			history += x*mult - (history*mult)>>9
+		}
+
+		zmode = 0
+		if history < 128 && i+1 < len(out) {
+			// A run of zero residuals follows.
+			k := bits.LeadingZeros32(history) - 24 + int((history+16)>>6)
+			run := int(r.scalar(k, 16))
+			if i+1+run > len(out) {
+				return errors.New("alac zero run beyond frame")
+			}
+			for j := range run {
+				out[i+1+j] = 0
+			}
+			i += run
+			if run < 0xffff {
+				zmode = 1
+			}
+			history = 0
+		}
+		if r.short {
+			return errors.New("truncated alac frame")
+		}
+	}
+	return nil
+}
+
+// unpcBlock undoes the adaptive FIR prediction of a channel. With coefs nil
+// it undoes the first order prediction used by mode 1, in place.
+func unpcBlock(pc, out []int32, coefs []int32, chanBits int, denShift uint32) {
+	shift := uint(32 - min(chanBits, 32))
+	wrap := func(v int32) int32 { return v << shift >> shift }
+	num := len(pc)
+	if num == 0 {
+		return
+	}
+	out[0] = pc[0]
+	if coefs == nil {
+		for j := 1; j < num; j++ {
+			out[j] = wrap(pc[j] + out[j-1])
+		}
+		return
+	}
+	active := len(coefs)
+	if active == 0 {
+		copy(out[1:], pc[1:])
+		return
+	}
+	for j := 1; j <= active && j < num; j++ {
+		out[j] = wrap(pc[j] + out[j-1])
+	}
+	var denHalf int32
+	if denShift > 0 {
+		denHalf = 1 << (denShift - 1)
+	}
+	lim := active + 1
+	for j := lim; j < num; j++ {
+		top := out[j-lim]
+		var sum int32
+		for k := range active {
+			sum += coefs[k] * (out[j-1-k] - top)
+		}
+		del := pc[j]
+		del0 := del
+		sg := sign(del)
+		del += top + (sum+denHalf)>>denShift
+		out[j] = wrap(del)
+
+		if sg > 0 {
+			for k := active - 1; k >= 0; k-- {
+				dd := top - out[j-1-k]
+				sgn := sign(dd)
+				coefs[k] = int32(int16(coefs[k] - sgn))
+				del0 -= int32(active-k) * ((sgn * dd) >> denShift)
+				if del0 <= 0 {
+					break
+				}
+			}
+		} else if sg < 0 {
+			for k := active - 1; k >= 0; k-- {
+				dd := top - out[j-1-k]
+				sgn := sign(dd)
+				coefs[k] = int32(int16(coefs[k] + sgn))
+				del0 -= int32(active-k) * ((-sgn * dd) >> denShift)
+				if del0 >= 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+func sign(v int32) int32 {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// bitReader reads big-endian bit fields. Reading past the end yields zero
+// bits and sets short.
+type bitReader struct {
+	b     []byte
+	pos   int
+	short bool
+}
+
+// peek returns the next 32 bits.
+func (r *bitReader) peek() uint32 {
+	i := r.pos >> 3
+	var v uint64
+	for k := range 5 {
+		v <<= 8
+		if i+k < len(r.b) {
+			v |= uint64(r.b[i+k])
+		}
+	}
+	return uint32(v >> (8 - uint(r.pos&7)))
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.b)*8 {
+		r.short = true
+	}
+}
+
+// read reads n bits, n at most 32.
+func (r *bitReader) read(n int) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek() >> (32 - n)
+	r.skip(n)
+	return v
+}
+
+// readSigned reads an n-bit two's complement value, n at most 32.
+func (r *bitReader) readSigned(n int) int32 {
+	shift := uint(32 - n)
+	return int32(r.read(n)<<shift) >> shift
+}
+
+func (r *bitReader) byteAlign() {
+	r.skip((8 - r.pos&7) & 7)
+}
+
+// scalar reads one adaptive Golomb code with parameter k: a unary prefix of
+// up to nine ones, then k bits, or an escaped value of escBits bits.
+func (r *bitReader) scalar(k, escBits int) uint32 {
+	pre := bits.LeadingZeros32(^r.peek())
+	if pre >= 9 {
+		r.skip(9)
+		return r.read(min(escBits, 32))
+	}
+	r.skip(pre + 1)
+	x := uint32(pre)
+	if k <= 1 {
+		return x
+	}
+	x = x<<k - x
+	if extra := r.peek() >> (32 - k); extra > 1 {
+		x += extra - 1
+		r.skip(k)
+	} else {
+		r.skip(k - 1)
+	}
+	return x
+}
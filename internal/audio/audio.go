@@ -0,0 +1,257 @@
+// Package audio decodes the audio track of a downloaded file to PCM for
+// loudness analysis. ALAC and AAC-LC are decoded in-process. AAC the Go
+// decoder does not handle, such as HE-AAC, is decoded by ffmpeg into a WAV
+// stream that is read the same way.
+//
+// Samples are returned as stored, priming and padding included; the caller
+// trims them.
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Format describes decoded audio.
+type Format struct {
+	SampleRate int
+	Channels   int
+}
+
+// Stream is decoded audio.
+type Stream interface {
+	Format() Format
+	// Read fills buf with interleaved samples scaled to [-1, 1] and returns
+	// how many it wrote, a whole number of frames. It returns io.EOF after
+	// the last sample.
+	Read(buf []float64) (int, error)
+	Close() error
+}
+
+// ErrUnsupported is returned by Open for audio it cannot decode.
+var ErrUnsupported = errors.New("unsupported audio codec")
+
+// Open opens the first audio track of the MP4 file at path for decoding.
+func Open(path string) (Stream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := mp4.DecodeFile(f, mp4.WithDecodeMode(mp4.DecModeLazyMdat))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	trak := audioTrak(file.Moov)
+	if trak == nil {
+		f.Close()
+		return nil, errors.New("no audio track")
+	}
+	stsd := trak.Mdia.Minf.Stbl.Stsd
+	if stsd == nil || len(stsd.Children) == 0 {
+		f.Close()
+		return nil, errors.New("no sample description")
+	}
+
+	entry := stsd.Children[0]
+	if cookie := alacCookie(entry); cookie != nil {
+		cfg, err := parseAlacConfig(cookie)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		ranges, err := sampleRanges(file, trak)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &alacStream{f: f, cfg: cfg, dec: newAlacDecoder(cfg), ranges: ranges}, nil
+	}
+	if asc := aacConfig(entry); asc != nil {
+		ranges, err := sampleRanges(file, trak)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		s, err := newAacStream(f, asc, ranges)
+		if err == nil {
+			return s, nil
+		}
+		if !errors.Is(err, ErrUnsupported) {
+			f.Close()
+			return nil, err
+		}
+	}
+	f.Close()
+	if entry.Type() == "mp4a" {
+		return openFfmpeg(path)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupported, entry.Type())
+}
+
+func audioTrak(moov *mp4.MoovBox) *mp4.TrakBox {
+	if moov == nil {
+		return nil
+	}
+	for _, trak := range moov.Traks {
+		if trak.Mdia != nil && trak.Mdia.Hdlr != nil && trak.Mdia.Hdlr.HandlerType == "soun" &&
+			trak.Mdia.Minf != nil && trak.Mdia.Minf.Stbl != nil {
+			return trak
+		}
+	}
+	return nil
+}
+
+// alacCookie returns the alac box payload, after version and flags, of an
+// ALAC sample entry. mp4ff does not know ALAC, so the sample entry arrives
+// as an UnknownBox.
+func alacCookie(entry mp4.Box) []byte {
+	u, ok := entry.(*mp4.UnknownBox)
+	if !ok || u.Type() != "alac" {
+		return nil
+	}
+	p := u.Payload()
+	const sampleEntryLen = 28 // reserved, data reference index, channels, sample size, rate
+	if len(p) < sampleEntryLen+8+4 {
+		return nil
+	}
+	inner := p[sampleEntryLen:]
+	size := int(inner[0])<<24 | int(inner[1])<<16 | int(inner[2])<<8 | int(inner[3])
+	if string(inner[4:8]) != "alac" || size > len(inner) || size < 12 {
+		return nil
+	}
+	return inner[12:size]
+}
+
+// sampleRanges returns where every sample of the track is in the file, in
+// decoding order, from the sample table or from the track fragments.
+func sampleRanges(file *mp4.File, trak *mp4.TrakBox) ([]mp4.DataRange, error) {
+	if !file.IsFragmented() {
+		stbl := trak.Mdia.Minf.Stbl
+		if stbl.Stsz == nil || stbl.Stsc == nil {
+			return nil, errors.New("missing sample table")
+		}
+		n := stbl.Stsz.GetNrSamples()
+		if n == 0 {
+			return nil, nil
+		}
+		chunks, err := stbl.Stsc.GetContainingChunks(1, n)
+		if err != nil {
+			return nil, err
+		}
+		ranges := make([]mp4.DataRange, 0, n)
+		for _, chunk := range chunks {
+			var offset uint64
+			switch {
+			case stbl.Stco != nil:
+				offset, err = stbl.Stco.GetOffset(int(chunk.ChunkNr))
+			case stbl.Co64 != nil:
+				offset, err = stbl.Co64.GetOffset(int(chunk.ChunkNr))
+			default:
+				err = errors.New("missing chunk offsets")
+			}
+			if err != nil {
+				return nil, err
+			}
+			for nr := chunk.StartSampleNr; nr < chunk.StartSampleNr+chunk.NrSamples && nr <= n; nr++ {
+				size := uint64(stbl.Stsz.GetSampleSize(int(nr)))
+				ranges = append(ranges, mp4.DataRange{Offset: offset, Size: size})
+				offset += size
+			}
+		}
+		return ranges, nil
+	}
+
+	trackID := trak.Tkhd.TrackID
+	var trex *mp4.TrexBox
+	if file.Moov.Mvex != nil {
+		trex, _ = file.Moov.Mvex.GetTrex(trackID)
+	}
+	var ranges []mp4.DataRange
+	for _, seg := range file.Segments {
+		for _, frag := range seg.Fragments {
+			for _, traf := range frag.Moof.Trafs {
+				if traf.Tfhd.TrackID != trackID {
+					continue
+				}
+				base := frag.Moof.StartPos
+				if traf.Tfhd.HasBaseDataOffset() {
+					base = traf.Tfhd.BaseDataOffset
+				}
+				for _, trun := range traf.Truns {
+					trun.AddSampleDefaultValues(traf.Tfhd, trex)
+					offset := base
+					if trun.HasDataOffset() {
+						offset = uint64(int64(base) + int64(trun.DataOffset))
+					}
+					for _, s := range trun.Samples {
+						ranges = append(ranges, mp4.DataRange{Offset: offset, Size: uint64(s.Size)})
+						offset += uint64(s.Size)
+					}
+				}
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// alacStream decodes an ALAC track frame by frame.
+type alacStream struct {
+	f      *os.File
+	cfg    alacConfig
+	dec    *alacDecoder
+	ranges []mp4.DataRange
+	next   int
+	frame  []byte
+
+	pending [][]int32 // decoded channels not yet read
+	pos     int
+}
+
+func (s *alacStream) Format() Format {
+	return Format{SampleRate: s.cfg.sampleRate, Channels: s.cfg.channels}
+}
+
+func (s *alacStream) Read(buf []float64) (int, error) {
+	channels := s.cfg.channels
+	if len(buf) < channels {
+		return 0, io.ErrShortBuffer
+	}
+	for s.pending == nil || s.pos == len(s.pending[0]) {
+		if s.next == len(s.ranges) {
+			return 0, io.EOF
+		}
+		r := s.ranges[s.next]
+		s.next++
+		if uint64(cap(s.frame)) < r.Size {
+			s.frame = make([]byte, r.Size)
+		}
+		s.frame = s.frame[:r.Size]
+		if _, err := s.f.ReadAt(s.frame, int64(r.Offset)); err != nil {
+			return 0, err
+		}
+		out, _, err := s.dec.decode(s.frame)
+		if err != nil {
+			return 0, fmt.Errorf("alac frame %d: %w", s.next, err)
+		}
+		s.pending, s.pos = out, 0
+	}
+
+	scale := 1 / float64(int64(1)<<(s.cfg.bitDepth-1))
+	n := 0
+	for ; n+channels <= len(buf) && s.pos < len(s.pending[0]); s.pos++ {
+		for c := range channels {
+			buf[n+c] = float64(s.pending[c][s.pos]) * scale
+		}
+		n += channels
+	}
+	return n, nil
+}
+
+func (s *alacStream) Close() error {
+	return s.f.Close()
+}
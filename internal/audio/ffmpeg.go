@@ -0,0 +1,152 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strings"
+
+	"main/internal/errs"
+)
+
+// ffmpegStream reads the 32-bit float WAV that ffmpeg decodes a track to.
+type ffmpegStream struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	r      *bufio.Reader
+	format Format
+	raw    []byte
+}
+
+func openFfmpeg(path string) (Stream, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errs.Wrap(errs.CodeDependencyMissing, err, "ffmpeg")
+	}
+	s := &ffmpegStream{}
+	s.cmd = exec.Command("ffmpeg", "-v", "error", "-nostdin", "-ignore_editlist", "1", "-i", path, "-map", "0:a:0", "-c:a", "pcm_f32le", "-f", "wav", "-")
+	s.cmd.Stderr = &s.stderr
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdout = stdout
+	if err := s.cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.r = bufio.NewReaderSize(stdout, 64*1024)
+	if err := s.readHeader(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// readHeader reads the RIFF header up to the data chunk. ffmpeg cannot seek
+// back to fill in sizes when writing to a pipe, so the data chunk is read to
+// the end of the stream.
+func (s *ffmpegStream) readHeader() error {
+	var riff [12]byte
+	if _, err := io.ReadFull(s.r, riff[:]); err != nil {
+		return s.failed(err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return errors.New("ffmpeg did not write a WAV stream")
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			return s.failed(err)
+		}
+		size := binary.LittleEndian.Uint32(hdr[4:8])
+		switch string(hdr[0:4]) {
+		case "data":
+			if s.format.Channels == 0 {
+				return errors.New("WAV data before fmt chunk")
+			}
+			return nil
+		case "fmt ":
+			if size < 16 {
+				return errors.New("short WAV fmt chunk")
+			}
+			p := make([]byte, size+size&1)
+			if _, err := io.ReadFull(s.r, p); err != nil {
+				return s.failed(err)
+			}
+			tag := binary.LittleEndian.Uint16(p[0:2])
+			bitsPerSample := binary.LittleEndian.Uint16(p[14:16])
+			if (tag != 3 && tag != 0xfffe) || bitsPerSample != 32 {
+				return fmt.Errorf("unexpected WAV format %#x with %d bits", tag, bitsPerSample)
+			}
+			s.format = Format{
+				Channels:   int(binary.LittleEndian.Uint16(p[2:4])),
+				SampleRate: int(binary.LittleEndian.Uint32(p[4:8])),
+			}
+			if s.format.Channels == 0 || s.format.SampleRate == 0 {
+				return errors.New("invalid WAV fmt chunk")
+			}
+		default:
+			if _, err := s.r.Discard(int(size + size&1)); err != nil {
+				return s.failed(err)
+			}
+		}
+	}
+}
+
+// failed adds what ffmpeg printed to an error reading its output.
+func (s *ffmpegStream) failed(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		s.cmd.Wait()
+		s.cmd = nil
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			return fmt.Errorf("ffmpeg: %s", msg)
+		}
+	}
+	return err
+}
+
+func (s *ffmpegStream) Format() Format {
+	return s.format
+}
+
+func (s *ffmpegStream) Read(buf []float64) (int, error) {
+	frames := len(buf) / s.format.Channels
+	if frames == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	need := frames * s.format.Channels * 4
+	if cap(s.raw) < need {
+		s.raw = make([]byte, need)
+	}
+	raw := s.raw[:need]
+	n, err := io.ReadFull(s.r, raw)
+	n -= n % (s.format.Channels * 4)
+	for i := 0; i < n/4; i++ {
+		buf[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:])))
+	}
+	switch {
+	case n > 0:
+		return n / 4, nil
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		if werr := s.cmd.Wait(); werr != nil {
+			return 0, fmt.Errorf("ffmpeg: %w: %s", werr, strings.TrimSpace(s.stderr.String()))
+		}
+		s.cmd = nil
+		return 0, io.EOF
+	}
+	return 0, err
+}
+
+func (s *ffmpegStream) Close() error {
+	s.stdout.Close()
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Package classical recognises classical releases and derives what the
+// catalog does not tag directly: the conductor, orchestra and soloists of a
+// recording from its credits, and the classical naming presets.
+package classical
+
+import (
+	"slices"
+	"strings"
+
+	"main/internal/credits"
+	"main/utils/structs"
+)
+
+// Values accepted by classical-mode.
+const (
+	Off    = "off"
+	Auto   = "auto"
+	Always = "always"
+)
+
+// Modes are the values accepted by classical-mode; "" means off.
+var Modes = []string{Off, Auto, Always}
+
+// Values accepted by classical-naming.
+const (
+	ComposerFirst = "composer-first"
+	WorkGrouped   = "work-grouped"
+)
+
+// Preset is a classical naming preset. Empty formats keep the configured
+// ones.
+type Preset struct {
+	ArtistFolderFormat string
+	SongFileFormat     string
+}
+
+// Presets are the values accepted by classical-naming.
+var Presets = map[string]Preset{
+	// Composer/Album/01. Title, falling back to the album artist on albums
+	// without composers.
+	ComposerFirst: {
+		ArtistFolderFormat: `{{default .ArtistName .AlbumComposer}}`,
+	},
+	// Composer/Album/01. Work - Movement, with the movements of a work next
+	// to each other and named the way the catalog groups them.
+	WorkGrouped: {
+		ArtistFolderFormat: `{{default .ArtistName .AlbumComposer}}`,
+		SongFileFormat:     `{{.SongNumer}}. {{if .Work}}{{.Work}}{{with .Movement}} - {{.}}{{end}}{{else}}{{.SongName}}{{end}}`,
+	},
+}
+
+// IsClassicalURL reports whether rawURL is an Apple Music Classical link.
+func IsClassicalURL(rawURL string) bool {
+	return strings.Contains(rawURL, "classical.music.apple.com")
+}
+
+// IsClassical reports whether a track is classical in auto mode: it belongs
+// to a work or is in a classical genre.
+func IsClassical(track structs.TrackData) bool {
+	return track.Attributes.WorkName != "" || slices.ContainsFunc(track.Attributes.GenreNames, IsClassicalGenre)
+}
+
+// IsClassicalGenre reports whether a catalog genre is Classical or one of
+// its subgenres, in English or Chinese.
+func IsClassicalGenre(genre string) bool {
+	return strings.EqualFold(genre, "Classical") || strings.HasPrefix(strings.ToLower(genre), "classical ") || strings.HasPrefix(genre, "古典")
+}
+
+// ensembleRoles mark a credit as the orchestra or ensemble of a recording.
+var ensembleRoles = []string{"orchestra", "ensemble", "choir", "chorus", "quartet", "trio", "consort", "band"}
+
+// Performers splits the performer credits of a recording into its
+// conductor, orchestra and soloists. Several conductors or ensembles are
+// joined with ", ".
+func Performers(trackCredits []structs.Credit) (conductor, orchestra string, soloists []string) {
+	var conductors, ensembles []string
+	for _, c := range trackCredits {
+		switch {
+		case hasRole(c, "conductor"):
+			conductors = append(conductors, c.Name)
+		case slices.ContainsFunc(ensembleRoles, func(r string) bool { return hasRole(c, r) }):
+			ensembles = append(ensembles, c.Name)
+		case credits.IsPerformer(c):
+			soloists = append(soloists, c.Name)
+		}
+	}
+	return strings.Join(conductors, ", "), strings.Join(ensembles, ", "), soloists
+}
+
+func hasRole(c structs.Credit, role string) bool {
+	return slices.ContainsFunc(c.Roles, func(r string) bool { return strings.Contains(strings.ToLower(r), role) })
+}
+
+// AlbumComposer is the composer credited on the most tracks, the first of
+// them on a tie.
+func AlbumComposer(tracks []structs.TrackData) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, t := range tracks {
+		name := t.Attributes.ComposerName
+		if name == "" {
+			continue
+		}
+		counts[name]++
+		if counts[name] > counts[best] {
+			best = name
+		}
+	}
+	return best
+}
@@ -0,0 +1,45 @@
+// Package compilation recognises compilation albums: the catalog flags them,
+// or their tracks are by many different artists.
+package compilation
+
+import (
+	"strings"
+
+	"main/internal/naming"
+	"main/utils/structs"
+)
+
+// Detect reports whether the album in meta is a compilation. Besides the
+// catalog flag, an album counts as one when its tracks have at least
+// minArtists different primary artists; minArtists 0 trusts the flag alone.
+// Playlists are never compilations.
+func Detect(meta *structs.AutoGenerated, minArtists int) bool {
+	if len(meta.Data) == 0 || strings.Contains(meta.Data[0].ID, "pl.") || meta.Data[0].Type == "playlists" {
+		return false
+	}
+	if meta.Data[0].Attributes.IsCompilation {
+		return true
+	}
+	if minArtists <= 0 {
+		return false
+	}
+	return len(TrackArtists(meta.Data[0].Relationships.Tracks.Data)) >= minArtists
+}
+
+// TrackArtists are the different primary artists of tracks, in track order.
+// Featured artists are not counted, so an album where one artist is joined
+// by a different guest on every track is not a compilation.
+func TrackArtists(tracks []structs.TrackData) []string {
+	var artists []string
+	seen := map[string]bool{}
+	for _, t := range tracks {
+		primary := strings.TrimSpace(naming.SplitArtists(t.Attributes.ArtistName)[0])
+		key := strings.ToLower(primary)
+		if primary == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		artists = append(artists, primary)
+	}
+	return artists
+}
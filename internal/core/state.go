@@ -1,12 +1,24 @@
 package core
 
 import (
-	"errors"
 	"fmt"
+	"log/slog"
+	"main/internal/classical"
+	"main/internal/credits"
+	"main/internal/discography"
+	"main/internal/editions"
+	"main/internal/errs"
+	"main/internal/history"
+	"main/internal/logging"
+	"main/internal/musicbrainz"
+	"main/internal/naming"
+	"main/internal/retry"
+	"main/internal/routing"
+	"main/internal/sanitize"
 	"main/utils/structs"
 	"os"
-	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 
@@ -16,13 +28,19 @@ import (
 )
 
 var (
-	ForbiddenNames = regexp.MustCompile(`[/\\<>:"|?*]`)
 	Dl_atmos       bool
 	Dl_aac         bool
 	Dl_select      bool
 	Dl_song        bool
 	Artist_select  bool
+	Artist_filter  string
+	Dedup_editions bool
+	Content_rating string
 	Debug_mode     bool
+	Dry_run        bool
+	Debug_json     string
+	Undo_journal   string
+	Dl_formats     []string
 	Alac_max       *int
 	Atmos_max      *int
 	Mv_max         *int
@@ -37,8 +55,61 @@ var (
 	SharedLock     sync.Mutex
 	DeveloperToken string
 	MaxPathLength  int
+	Failures       = make(map[errs.Code]int)
+	LogLevel       string
+	LogFile        string
+	RetryPolicy    = retry.New(structs.RetryConfig{})
+	Fallbacks      []Fallback
+	RatingMisses   []RatingMiss
+	UrlArtistName  string // name and ID of the first artist URL, for {UrlArtistName} / {ArtistId}
+	UrlArtistId    string
+	ArtistFilter   discography.Filter // --artist-filter, or artist-filter from config.yaml
+	History        *history.Store     // nil when history-file is empty
+	EditionPolicy  = editions.DefaultPolicy
+	CreditTags     = credits.DefaultTags // credits-tags applied to the default role mapping
 )
 
+// Sanitizer makes rendered names safe for the file system chosen in the
+// sanitize section of config.yaml.
+var Sanitizer, _ = sanitize.New(structs.SanitizeConfig{})
+
+// OutputFormats are the formats accepted by --formats.
+var OutputFormats = []string{"alac", "atmos", "aac", "aac-lc", "aac-binaural", "aac-downmix"}
+
+// FallbackCodecs are the codec names accepted in codec-fallback.
+var FallbackCodecs = []string{"atmos", "dolby-audio", "alac-hires", "alac", "aac", "aac-binaural", "aac-downmix", "aac-lc"}
+
+// ContentRatings are the values accepted by content-rating.
+var ContentRatings = []string{"explicit", "clean"}
+
+// MetadataLanguages are the values accepted by tag-language and
+// folder-language.
+var MetadataLanguages = []string{"primary", "secondary"}
+
+// SecondaryLanguageTags are the values accepted by secondary-language-tags.
+var SecondaryLanguageTags = []string{"sort", "custom"}
+
+// DiscLayouts are the values accepted by disc-layout.
+var DiscLayouts = []string{"folder", "flat", "none"}
+
+// Fallback records a track that was saved in a codec other than the first
+// one of its chain.
+type Fallback struct {
+	AlbumID   string
+	TrackName string
+	Requested string
+	Obtained  string
+}
+
+// RatingMiss records an album or playlist track that has no version with
+// the content rating asked for by content-rating.
+type RatingMiss struct {
+	AlbumID string
+	Name    string
+	Rating  string
+	Wanted  string
+}
+
 type TrackStatus struct {
 	Index       int
 	TrackNum    int
@@ -62,13 +133,22 @@ func InitCounter() structs.Counter {
 func InitFlags() {
 	pflag.StringVar(&ConfigPath, "config", "", "指定要使用的配置文件路径 (例如: configs/cn.yaml)")
 	pflag.StringVar(&OutputPath, "output", "", "指定本次任务的唯一输出目录")
+	pflag.StringVar(&LogLevel, "log-level", "warn", "日志级别: debug, info, warn, error")
+	pflag.StringVar(&LogFile, "log-file", "", "将日志追加写入到指定文件 (JSON 格式)")
 
 	pflag.BoolVar(&Dl_atmos, "atmos", false, "Enable atmos download mode")
 	pflag.BoolVar(&Dl_aac, "aac", false, "Enable adm-aac download mode")
 	pflag.BoolVar(&Dl_select, "select", false, "Enable selective download")
 	pflag.BoolVar(&Dl_song, "song", false, "Enable single song download mode")
 	pflag.BoolVar(&Artist_select, "all-album", false, "Download all artist albums")
+	pflag.BoolVar(&Dedup_editions, "dedup-editions", false, "Keep one edition of albums that are the same release (see edition-policy)")
+	pflag.StringVar(&Content_rating, "content-rating", "", "Download the explicit or clean version of albums and songs when the catalog has one")
+	pflag.StringVar(&Artist_filter, "artist-filter", "", "Filter artist releases and download all that remain without asking, e.g. \"include=album,ep from=2015 prefer=explicit dedup skip-history\"")
 	pflag.BoolVar(&Debug_mode, "debug", false, "Enable debug mode to show audio quality information")
+	pflag.StringVar(&Debug_json, "debug-json", "", "With --debug, append the per-track quality matrix to this file as JSON lines")
+	pflag.StringSliceVar(&Dl_formats, "formats", nil, "Download several formats in one pass, e.g. alac,atmos,aac-binaural")
+	pflag.BoolVar(&Dry_run, "dry-run", false, "Resolve albums, tracks, qualities and paths without downloading anything")
+	pflag.StringVar(&Undo_journal, "undo", "", "With reorganize, move files back using this journal")
 	pflag.IntVar(&TaggingThreads, "tagging-threads", 8, "Specify the max threads for tagging")
 	Alac_max = pflag.Int("alac-max", 0, "Specify the max quality for download alac")
 	Atmos_max = pflag.Int("atmos-max", 0, "Specify the max quality for download atmos")
@@ -90,58 +170,158 @@ func LoadConfig(configPath string) error {
 	}
 	err = yaml.Unmarshal(data, &Config)
 	if err != nil {
-		return err
+		return errs.Wrap(errs.CodeConfig, err, "解析配置文件失败")
 	}
 
-	green := color.New(color.FgGreen).SprintFunc()
 	red := color.New(color.FgRed).SprintFunc()
 
 	if len(Config.Accounts) == 0 {
-		return errors.New(red("配置错误: 'accounts' 列表为空，请在 config.yaml 中至少配置一个账户"))
+		return errs.New(errs.CodeConfig, red("配置错误: 'accounts' 列表为空，请在 config.yaml 中至少配置一个账户"))
+	}
+	for _, acc := range Config.Accounts {
+		logging.AddSecret(acc.MediaUserToken, acc.AuthorizationToken)
+	}
+	logging.AddSecret(Config.QobuzUsername, Config.QobuzPassword)
+
+	if err := retry.Validate(Config.Retry); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("配置错误"))
+	}
+	RetryPolicy = retry.New(Config.Retry)
+
+	if Sanitizer, err = sanitize.New(Config.Sanitize); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("配置错误"))
+	}
+
+	for _, format := range Dl_formats {
+		if !slices.Contains(OutputFormats, format) {
+			return errs.New(errs.CodeConfig, fmt.Sprintf("%s --formats 中的格式 %q 无效，可选: %s", red("参数错误"), format, strings.Join(OutputFormats, ", ")))
+		}
+	}
+	if len(Dl_formats) > 0 && (Dl_atmos || Dl_aac) {
+		return errs.New(errs.CodeConfig, red("参数错误: --formats 不能与 --atmos / --aac 同时使用"))
+	}
+	if Config.AacSaveFolder == "" {
+		Config.AacSaveFolder = Config.AlacSaveFolder
+	}
+
+	for _, codec := range Config.CodecFallback {
+		if !slices.Contains(FallbackCodecs, codec) {
+			return errs.New(errs.CodeConfig, fmt.Sprintf("%s codec-fallback 中的编码 %q 无效，可选: %s", red("配置错误"), codec, strings.Join(FallbackCodecs, ", ")))
+		}
+	}
+
+	if err := routing.Validate(Config.OutputRoutes); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("配置错误"))
+	}
+
+	formats := []string{Config.ArtistFolderFormat, Config.AlbumFolderFormat, Config.PlaylistFolderFormat, Config.SongFileFormat, Config.CompilationFolderFormat}
+	for _, r := range Config.OutputRoutes {
+		formats = append(formats, r.ArtistFolderFormat, r.AlbumFolderFormat, r.PlaylistFolderFormat, r.SongFileFormat)
+	}
+	for _, format := range formats {
+		if err := naming.Validate(format); err != nil {
+			return errs.Wrap(errs.CodeConfig, err, fmt.Sprintf("%s 命名格式 %q 无效", red("配置错误"), format))
+		}
+	}
+
+	if Content_rating != "" {
+		Config.ContentRating = Content_rating
+	}
+	if Config.ContentRating != "" && !slices.Contains(ContentRatings, Config.ContentRating) {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s content-rating %q 无效，可选: %s", red("配置错误"), Config.ContentRating, strings.Join(ContentRatings, ", ")))
+	}
+
+	if Config.ClassicalMode != "" && !slices.Contains(classical.Modes, Config.ClassicalMode) {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s classical-mode %q 无效，可选: %s", red("配置错误"), Config.ClassicalMode, strings.Join(classical.Modes, ", ")))
+	}
+	if _, ok := classical.Presets[Config.ClassicalNaming]; Config.ClassicalNaming != "" && !ok {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s classical-naming %q 无效，可选: %s, %s", red("配置错误"), Config.ClassicalNaming, classical.ComposerFirst, classical.WorkGrouped))
+	}
+
+	if Config.CompilationMinArtists < 0 {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s compilation-min-artists 不能为负数", red("配置错误")))
+	}
+	if Config.MusicBrainzLookup && strings.TrimSpace(Config.MusicBrainzContact) == "" {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s musicbrainz-lookup 需要设置 musicbrainz-contact (邮箱或网址)，MusicBrainz 要求请求中附带联系方式", red("配置错误")))
+	}
+	musicbrainz.Contact = strings.TrimSpace(Config.MusicBrainzContact)
+
+	for key, value := range map[string]string{"tag-language": Config.TagLanguage, "folder-language": Config.FolderLanguage} {
+		if value != "" && !slices.Contains(MetadataLanguages, value) {
+			return errs.New(errs.CodeConfig, fmt.Sprintf("%s %s %q 无效，可选: %s", red("配置错误"), key, value, strings.Join(MetadataLanguages, ", ")))
+		}
+	}
+	if Config.SecondaryLanguageTags != "" && !slices.Contains(SecondaryLanguageTags, Config.SecondaryLanguageTags) {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s secondary-language-tags %q 无效，可选: %s", red("配置错误"), Config.SecondaryLanguageTags, strings.Join(SecondaryLanguageTags, ", ")))
+	}
+
+	CreditTags = credits.Mapping(Config.CreditsTags)
+
+	if EditionPolicy, err = editions.ParsePolicy(Config.EditionPolicy); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("配置错误"))
+	}
+	if Dedup_editions {
+		Config.EditionDedup = true
+	}
+
+	artistFilter := Config.ArtistFilter
+	if Artist_filter != "" {
+		artistFilter = Artist_filter
+	}
+	if ArtistFilter, err = discography.Parse(artistFilter); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("歌手筛选条件无效"))
+	}
+	ArtistFilter.Policy = EditionPolicy
+
+	if Config.HistoryFile != "" {
+		if History, err = history.Open(Config.HistoryFile); err != nil {
+			return errs.Wrap(errs.CodeConfig, err, red("读取下载历史失败"))
+		}
+	}
+
+	if Config.DiscLayout == "" {
+		Config.DiscLayout = "folder"
+	}
+	if Config.DiscFolderFormat == "" {
+		Config.DiscFolderFormat = "CD{n}"
+	}
+	if !slices.Contains(DiscLayouts, Config.DiscLayout) {
+		return errs.New(errs.CodeConfig, fmt.Sprintf("%s disc-layout %q 无效，可选: %s", red("配置错误"), Config.DiscLayout, strings.Join(DiscLayouts, ", ")))
+	}
+	if err := naming.ValidateDiscFolder(Config.DiscFolderFormat); err != nil {
+		return errs.Wrap(errs.CodeConfig, err, red("配置错误"))
 	}
 
 	if Config.TxtDownloadThreads <= 0 {
 		Config.TxtDownloadThreads = 5
-		fmt.Println(green("配置文件中未设置 'txtDownloadThreads'，自动设为默认值 5"))
+		slog.Info("txtDownloadThreads not set, using the default", "value", Config.TxtDownloadThreads)
 	}
 
 	if Config.BufferSizeKB <= 0 {
 		Config.BufferSizeKB = 4096
-		fmt.Println(green("配置文件中未设置 'BufferSizeKB'，自动设为默认值 4096KB (4MB)"))
+		slog.Info("BufferSizeKB not set, using the default", "value", Config.BufferSizeKB)
 	}
 
 	if Config.NetworkReadBufferKB <= 0 {
 		Config.NetworkReadBufferKB = 4096
-		fmt.Println(green("配置文件中未设置 'NetworkReadBufferKB'，自动设为默认值 4096KB (4MB)"))
+		slog.Info("NetworkReadBufferKB not set, using the default", "value", Config.NetworkReadBufferKB)
 	}
 
-	fmt.Printf("%s : %s\n", green("全区域账号解密"), red(Config.GlobalDecryption))
+	slog.Info("global decryption", "value", Config.GlobalDecryption)
 	useAutoDetect := true
 	if Config.MaxPathLength > 0 {
 		MaxPathLength = Config.MaxPathLength
 		useAutoDetect = false
-		fmt.Printf("%s : %s\n",
-			green("从配置文件强制使用最大路径长度限制"),
-			red(fmt.Sprintf("%d", MaxPathLength)),
-		)
+		slog.Info("max path length set in config", "value", MaxPathLength)
 	}
 
 	if useAutoDetect {
 		if runtime.GOOS == "windows" {
 			MaxPathLength = 255
-			fmt.Printf("%s%d\n",
-				green("检测到 Windows 系统, 已自动设置最大路径长度限制为: "),
-				MaxPathLength,
-			)
 		} else {
 			MaxPathLength = 4096
-			fmt.Printf("%s%s%s%d\n",
-				green("检测到 "),
-				red(runtime.GOOS),
-				green(" 系统, 已自动设置最大路径长度限制为: "),
-				MaxPathLength,
-			)
 		}
+		slog.Info("max path length detected", "os", runtime.GOOS, "value", MaxPathLength)
 	}
 
 	if Config.EnableCdnOverride && Config.CdnIp != "" {
@@ -191,10 +371,10 @@ func LoadConfig(configPath string) error {
 		}
 
 		if showAudio && audioCdnIp != "" {
-			fmt.Printf("%s : %s\n", green("[Audio_CDN 劫持] aod.itunes.apple.com"), red(audioCdnIp))
+			slog.Info("audio CDN override", "host", "aod.itunes.apple.com", "ip", audioCdnIp)
 		}
 		if showVideo && mvCdnIp != "" {
-			fmt.Printf("%s : %s\n", green("[Video_CDN 劫持] mvod.itunes.apple.com"), red(mvCdnIp))
+			slog.Info("video CDN override", "host", "mvod.itunes.apple.com", "ip", mvCdnIp)
 		}
 	}
 
@@ -216,9 +396,24 @@ func LoadConfig(configPath string) error {
 	return nil
 }
 
+// JobFormats returns the output formats of this run: the --formats list, or
+// the single format chosen by --atmos / --aac.
+func JobFormats() []string {
+	if len(Dl_formats) > 0 {
+		return Dl_formats
+	}
+	switch {
+	case Dl_atmos:
+		return []string{"atmos"}
+	case Dl_aac:
+		return []string{*Aac_type}
+	}
+	return []string{"alac"}
+}
+
 func GetAccountForStorefront(storefront string) (*structs.Account, error) {
 	if len(Config.Accounts) == 0 {
-		return nil, errors.New("无可用账户")
+		return nil, errs.New(errs.CodeConfig, "无可用账户")
 	}
 
 	for i := range Config.Accounts {
@@ -228,14 +423,7 @@ func GetAccountForStorefront(storefront string) (*structs.Account, error) {
 		}
 	}
 
-	red := color.New(color.FgRed).SprintFunc()
-	yellow := color.New(color.FgYellow).SprintFunc()
-	fmt.Printf(
-		"%s 未找到与 %s 匹配的账户,将尝试使用 %s 等区域进行下载\n",
-		red("警告:"),
-		red(storefront),
-		yellow(Config.Accounts[0].Name),
-	)
+	slog.Warn("no account matches the storefront, using the first account", "storefront", storefront, "account", Config.Accounts[0].Name)
 	return &Config.Accounts[0], nil
 }
 
@@ -245,3 +433,48 @@ func LimitString(s string) string {
 	}
 	return s
 }
+
+// RecordFailure counts a failed task under its error class. It must not be
+// called with SharedLock held.
+func RecordFailure(err error) {
+	if err == nil {
+		return
+	}
+	SharedLock.Lock()
+	Failures[errs.CodeOf(err)]++
+	SharedLock.Unlock()
+}
+
+// RecordFallback adds f to the end-of-run fallback summary. It must not be
+// called with SharedLock held.
+func RecordFallback(f Fallback) {
+	SharedLock.Lock()
+	Fallbacks = append(Fallbacks, f)
+	SharedLock.Unlock()
+}
+
+// RecordRatingMiss adds m to the end-of-run content rating summary. It must
+// not be called with SharedLock held.
+func RecordRatingMiss(m RatingMiss) {
+	SharedLock.Lock()
+	RatingMisses = append(RatingMisses, m)
+	SharedLock.Unlock()
+}
+
+// ExitCode derives the process exit code from the failures recorded so far.
+func ExitCode() int {
+	SharedLock.Lock()
+	defer SharedLock.Unlock()
+	switch len(Failures) {
+	case 0:
+		if Counter.Error > 0 {
+			return errs.ExitUnknown
+		}
+		return errs.ExitOK
+	case 1:
+		for code := range Failures {
+			return errs.ExitCode(code)
+		}
+	}
+	return errs.ExitMixed
+}
@@ -0,0 +1,128 @@
+// Package credits maps the per-track credits of the catalog to tags and
+// renders the credits.txt written next to an album.
+package credits
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"main/utils/structs"
+)
+
+// PerformerTag receives the performers whose role is not mapped, as
+// "Name (Role)".
+const PerformerTag = "PERFORMER"
+
+// DefaultTags maps catalog role names, compared case-insensitively, to the
+// freeform tags they are written to. credits-tags in config.yaml adds to
+// and overrides it; mapping a role to "" drops it.
+var DefaultTags = map[string]string{
+	"producer":            "PRODUCER",
+	"co-producer":         "PRODUCER",
+	"additional producer": "PRODUCER",
+	"executive producer":  "EXECUTIVE PRODUCER",
+	"engineer":            "ENGINEER",
+	"recording engineer":  "ENGINEER",
+	"assistant engineer":  "ENGINEER",
+	"mixing engineer":     "MIXER",
+	"mastering engineer":  "MASTERING ENGINEER",
+	"lyricist":            "LYRICIST",
+	"songwriter":          "SONGWRITER",
+	"arranger":            "ARRANGER",
+	"conductor":           "CONDUCTOR",
+	// Composers are written to ©wrt already.
+	"composer": "",
+}
+
+// Mapping returns DefaultTags with the configured entries applied.
+func Mapping(configured map[string]string) map[string]string {
+	m := make(map[string]string, len(DefaultTags)+len(configured))
+	for role, tag := range DefaultTags {
+		m[role] = tag
+	}
+	for role, tag := range configured {
+		m[strings.ToLower(strings.TrimSpace(role))] = strings.TrimSpace(tag)
+	}
+	return m
+}
+
+// IsPerformer reports whether a credit is in the performers category, as
+// opposed to composers, producers and engineers.
+func IsPerformer(c structs.Credit) bool {
+	return strings.Contains(strings.ToLower(c.Category), "perform")
+}
+
+// Tag is one tag built from credits, with its values in credit order.
+type Tag struct {
+	Name   string
+	Values []string
+}
+
+// Tags groups credits by the tag of each role. Roles that are not mapped
+// go to PerformerTag for performers and are dropped otherwise. Tags are
+// returned in the order they first appear and hold each value once.
+func Tags(credits []structs.Credit, mapping map[string]string) []Tag {
+	var tags []Tag
+	add := func(name, value string) {
+		i := slices.IndexFunc(tags, func(t Tag) bool { return t.Name == name })
+		if i < 0 {
+			tags = append(tags, Tag{Name: name})
+			i = len(tags) - 1
+		}
+		if !slices.Contains(tags[i].Values, value) {
+			tags[i].Values = append(tags[i].Values, value)
+		}
+	}
+	for _, c := range credits {
+		for _, role := range c.Roles {
+			tag, ok := mapping[strings.ToLower(role)]
+			switch {
+			case ok && tag != "":
+				add(tag, c.Name)
+			case !ok && IsPerformer(c):
+				add(PerformerTag, fmt.Sprintf("%s (%s)", c.Name, role))
+			}
+		}
+	}
+	return tags
+}
+
+// Text renders the credits of an album's tracks, one block per track with
+// a line per role:
+//
+//  01. Song
+//     Producer: Name A, Name B
+//     Vocals: Name C
+//
+// Tracks without credits are left out.
+func Text(albumName, artistName string, tracks []structs.TrackData) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s\n", artistName, albumName)
+	for _, t := range tracks {
+		if len(t.Credits) == 0 {
+			continue
+		}
+		number := fmt.Sprintf("%02d", t.Attributes.TrackNumber)
+		if tracks[len(tracks)-1].Attributes.DiscNumber > 1 {
+			number = fmt.Sprintf("%d-%s", t.Attributes.DiscNumber, number)
+		}
+		fmt.Fprintf(&b, "\n%s. %s\n", number, t.Attributes.Name)
+		var roles []string
+		names := make(map[string][]string)
+		for _, c := range t.Credits {
+			for _, role := range c.Roles {
+				if _, ok := names[role]; !ok {
+					roles = append(roles, role)
+				}
+				if !slices.Contains(names[role], c.Name) {
+					names[role] = append(names[role], c.Name)
+				}
+			}
+		}
+		for _, role := range roles {
+			fmt.Fprintf(&b, "    %s: %s\n", role, strings.Join(names[role], ", "))
+		}
+	}
+	return b.String()
+}
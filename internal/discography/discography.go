@@ -0,0 +1,241 @@
+// Package discography filters the releases of an artist page: by release
+// type, release date and content rating, dropping duplicate editions (see
+// package editions) and albums that are already in the download history.
+//
+// A filter is written as space or semicolon separated options, for example
+//
+//	include=album,ep exclude=live from=2015 to=2020-06 prefer=explicit no-compilations dedup skip-history
+package discography
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"main/internal/editions"
+)
+
+// Release types. MusicVideo releases are never filtered by type.
+const (
+	Album       = "album"
+	EP          = "ep"
+	Single      = "single"
+	Compilation = "compilation"
+	Live        = "live"
+	AppearsOn   = "appears-on"
+	MusicVideo  = "music-video"
+)
+
+// Types are the release types accepted by include and exclude.
+var Types = []string{Album, EP, Single, Compilation, Live, AppearsOn}
+
+// defaultTypes is what an artist page listed before types could be chosen.
+var defaultTypes = []string{Album, EP, Single, Compilation, Live}
+
+// Release is one album or music video of an artist.
+type Release struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	ArtistName    string `json:"artistName"`
+	ReleaseDate   string `json:"releaseDate"`
+	ContentRating string `json:"contentRating,omitempty"`
+	TrackCount    int    `json:"trackCount,omitempty"`
+	UPC           string `json:"upc,omitempty"`
+	URL           string `json:"url"`
+
+	// Set before Apply when Dedup is on.
+	ISRCs   []string `json:"-"`
+	Quality int      `json:"-"`
+}
+
+// Skipped is a release the filter dropped.
+type Skipped struct {
+	Release
+	Reason string `json:"reason"`
+}
+
+// Filter selects releases. The zero Filter keeps every release type except
+// appears-on.
+type Filter struct {
+	Include     []string // empty: defaultTypes
+	Exclude     []string
+	From, To    string // inclusive; YYYY, YYYY-MM or YYYY-MM-DD
+	Prefer      string // explicit or clean: drop the other version of a release
+	Dedup       bool   // keep one edition of each release, chosen by Policy
+	SkipHistory bool   // drop albums already in the download history
+
+	Policy editions.Policy // set from edition-policy, not by Parse
+}
+
+var datePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// Parse reads a filter. The empty string is the zero Filter.
+func Parse(s string) (Filter, error) {
+	var f Filter
+	for _, opt := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ';' }) {
+		key, value, hasValue := strings.Cut(opt, "=")
+		key = strings.ToLower(key)
+		switch key {
+		case "include", "exclude":
+			if !hasValue || value == "" {
+				return Filter{}, fmt.Errorf("%s 需要类型列表, 如 %s=album,ep", key, key)
+			}
+			for _, t := range strings.Split(strings.ToLower(value), ",") {
+				t = strings.TrimSpace(t)
+				if !slices.Contains(Types, t) {
+					return Filter{}, fmt.Errorf("未知的发行类型 %q，可选: %s", t, strings.Join(Types, ", "))
+				}
+				if key == "include" {
+					f.Include = append(f.Include, t)
+				} else {
+					f.Exclude = append(f.Exclude, t)
+				}
+			}
+		case "from", "to":
+			if !datePattern.MatchString(value) {
+				return Filter{}, fmt.Errorf("%s 的日期 %q 无效，格式为 YYYY, YYYY-MM 或 YYYY-MM-DD", key, value)
+			}
+			if key == "from" {
+				f.From = value
+			} else {
+				f.To = value
+			}
+		case "prefer":
+			value = strings.ToLower(value)
+			if value != "explicit" && value != "clean" {
+				return Filter{}, fmt.Errorf("prefer 的值 %q 无效，可选: explicit, clean", value)
+			}
+			f.Prefer = value
+		case "no-compilations":
+			f.Exclude = append(f.Exclude, Compilation)
+		case "dedup":
+			f.Dedup = true
+		case "skip-history":
+			f.SkipHistory = true
+		default:
+			return Filter{}, fmt.Errorf("未知的筛选选项 %q，可选: include, exclude, from, to, prefer, no-compilations, dedup, skip-history", opt)
+		}
+	}
+	if f.From != "" && f.To != "" && datePrefix(f.From, f.To) > datePrefix(f.To, f.From) {
+		return Filter{}, fmt.Errorf("from %s 晚于 to %s", f.From, f.To)
+	}
+	return f, nil
+}
+
+// Wants reports whether releases of type t pass the type filter.
+func (f Filter) Wants(t string) bool {
+	if t == MusicVideo {
+		return true
+	}
+	include := f.Include
+	if len(include) == 0 {
+		include = defaultTypes
+	}
+	return slices.Contains(include, t) && !slices.Contains(f.Exclude, t)
+}
+
+// Apply filters releases, in this order: type, date, content rating,
+// duplicate editions, history. inHistory may be nil.
+func (f Filter) Apply(releases []Release, inHistory func(albumId, upc string) bool) (kept []Release, skipped []Skipped) {
+	for _, r := range releases {
+		switch {
+		case !f.Wants(r.Type):
+			skipped = append(skipped, Skipped{r, "类型 " + r.Type})
+		case f.From != "" && r.ReleaseDate != "" && datePrefix(r.ReleaseDate, f.From) < f.From:
+			skipped = append(skipped, Skipped{r, "早于 " + f.From})
+		case f.To != "" && r.ReleaseDate != "" && datePrefix(r.ReleaseDate, f.To) > f.To:
+			skipped = append(skipped, Skipped{r, "晚于 " + f.To})
+		default:
+			kept = append(kept, r)
+		}
+	}
+
+	if f.Prefer != "" {
+		other := "clean"
+		if f.Prefer == "clean" {
+			other = "explicit"
+		}
+		preferred := make(map[string]bool)
+		for _, r := range kept {
+			if r.ContentRating == f.Prefer {
+				preferred[groupKey(r)] = true
+			}
+		}
+		kept, skipped = partition(kept, skipped, func(r Release) string {
+			if r.ContentRating == other && preferred[groupKey(r)] {
+				return "已有 " + f.Prefer + " 版本"
+			}
+			return ""
+		})
+	}
+
+	if f.Dedup {
+		var eds []editions.Edition
+		var index []int
+		for i, r := range kept {
+			if r.Type == MusicVideo {
+				continue
+			}
+			index = append(index, i)
+			eds = append(eds, editions.Edition{
+				ID:            r.ID,
+				Name:          r.Name,
+				Artist:        r.ArtistName,
+				Single:        r.Type == Single || r.Type == EP,
+				ReleaseDate:   r.ReleaseDate,
+				ContentRating: r.ContentRating,
+				UPC:           r.UPC,
+				TrackCount:    r.TrackCount,
+				ISRCs:         r.ISRCs,
+				Quality:       r.Quality,
+			})
+		}
+		policy := f.Policy
+		if len(policy) == 0 {
+			policy = editions.DefaultPolicy
+		}
+		_, dropped := editions.Dedup(eds, policy)
+		reasons := make(map[string]string)
+		for _, d := range dropped {
+			reasons[kept[index[d.Index]].ID] = "重复版本: " + d.Reason
+		}
+		kept, skipped = partition(kept, skipped, func(r Release) string { return reasons[r.ID] })
+	}
+
+	if f.SkipHistory && inHistory != nil {
+		kept, skipped = partition(kept, skipped, func(r Release) string {
+			if r.Type != MusicVideo && inHistory(r.ID, r.UPC) {
+				return "已在下载历史中"
+			}
+			return ""
+		})
+	}
+	return kept, skipped
+}
+
+// partition moves the releases for which reason returns a non-empty reason
+// from kept to skipped.
+func partition(kept []Release, skipped []Skipped, reason func(Release) string) ([]Release, []Skipped) {
+	var out []Release
+	for _, r := range kept {
+		if why := reason(r); why != "" {
+			skipped = append(skipped, Skipped{r, why})
+		} else {
+			out = append(out, r)
+		}
+	}
+	return out, skipped
+}
+
+func datePrefix(date, bound string) string {
+	if len(date) > len(bound) {
+		return date[:len(bound)]
+	}
+	return date
+}
+
+func groupKey(r Release) string {
+	return r.Type + "\x00" + editions.NormalizeTitle(r.Name)
+}
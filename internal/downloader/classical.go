@@ -0,0 +1,77 @@
+package downloader
+
+import (
+	"log/slog"
+	"main/internal/classical"
+	"main/internal/core"
+	"main/internal/metadata"
+	"main/utils/structs"
+	"slices"
+	"strings"
+)
+
+// markClassical flags the classical tracks of an album or playlist for
+// classical-mode; fetchCredits then fetches their credits. In auto mode an
+// album is classical as a whole when it is opened from Apple Music
+// Classical, is in a classical genre or has a track that belongs to a work;
+// playlist tracks are judged one by one.
+func markClassical(meta *structs.AutoGenerated, albumId, urlRaw string, logger *slog.Logger) {
+	mode := core.Config.ClassicalMode
+	if mode == "" || mode == classical.Off {
+		return
+	}
+	tracks := meta.Data[0].Relationships.Tracks.Data
+	whole := mode == classical.Always || classical.IsClassicalURL(urlRaw)
+	if !whole && !strings.Contains(albumId, "pl.") {
+		whole = slices.ContainsFunc(meta.Data[0].Attributes.GenreNames, classical.IsClassicalGenre) ||
+			slices.ContainsFunc(tracks, func(t structs.TrackData) bool { return t.Attributes.WorkName != "" })
+	}
+
+	marked := 0
+	for i := range tracks {
+		t := &tracks[i]
+		if t.Type == "music-videos" || !(whole || classical.IsClassical(*t)) {
+			continue
+		}
+		t.Classical = true
+		marked++
+	}
+	if marked > 0 {
+		logger.Debug("classical tracks marked", "tracks", marked)
+	}
+}
+
+// classicalItems are the work, movement and performer atoms of a classical
+// track: ©wrk, ©mvn, ©mvi, ©mvc and shwm, which players use to show the work
+// and movement instead of the title, and freeform CONDUCTOR, ORCHESTRA and
+// SOLOISTS items.
+func classicalItems(track structs.TrackData) []metadata.Item {
+	if !track.Classical {
+		return nil
+	}
+	a := track.Attributes
+	var items []metadata.Item
+	if a.WorkName != "" {
+		items = append(items, metadata.Item{Name: "©wrk", Value: a.WorkName}, metadata.Item{Name: "shwm", Value: uint8(1)})
+		if a.MovementName != "" {
+			items = append(items, metadata.Item{Name: "©mvn", Value: a.MovementName})
+		}
+		if a.MovementNumber > 0 {
+			items = append(items, metadata.Item{Name: "©mvi", Value: uint16(a.MovementNumber)})
+		}
+		if a.MovementCount > 0 {
+			items = append(items, metadata.Item{Name: "©mvc", Value: uint16(a.MovementCount)})
+		}
+	}
+	conductor, orchestra, soloists := classical.Performers(track.Credits)
+	if conductor != "" {
+		items = append(items, metadata.Item{Name: "----:CONDUCTOR", Value: conductor})
+	}
+	if orchestra != "" {
+		items = append(items, metadata.Item{Name: "----:ORCHESTRA", Value: orchestra})
+	}
+	if len(soloists) > 0 {
+		items = append(items, metadata.Item{Name: "----:SOLOISTS", Value: strings.Join(soloists, "; ")})
+	}
+	return items
+}
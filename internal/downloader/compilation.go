@@ -0,0 +1,31 @@
+package downloader
+
+import (
+	"main/internal/compilation"
+	"main/internal/core"
+	"main/internal/metadata"
+	"main/utils/structs"
+)
+
+// isCompilation reports whether the album in meta is a compilation under
+// compilation-min-artists.
+func isCompilation(meta *structs.AutoGenerated) bool {
+	return compilation.Detect(meta, core.Config.CompilationMinArtists)
+}
+
+// albumArtist is the album artist of the album in meta, whose catalog
+// artist is artist: compilation-artist on compilations when it is set.
+func albumArtist(meta *structs.AutoGenerated, artist string) string {
+	if core.Config.CompilationArtist != "" && isCompilation(meta) {
+		return core.Config.CompilationArtist
+	}
+	return artist
+}
+
+// compilationItems is the cpil atom of a track on a compilation.
+func compilationItems(meta *structs.AutoGenerated) []metadata.Item {
+	if !isCompilation(meta) {
+		return nil
+	}
+	return []metadata.Item{{Name: "cpil", Value: uint8(1)}}
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"log/slog"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/credits"
+	"main/internal/metadata"
+	"main/utils/structs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fetchCredits fetches the credits of every track with credits or
+// credits-file on, or of the classical tracks otherwise. With songId set only
+// that track is fetched. Up to aac_downloadthreads tracks are fetched at
+// once.
+func fetchCredits(meta *structs.AutoGenerated, storefront, songId string, logger *slog.Logger) {
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, max(core.Config.AacDownloadThreads, 1))
+	tracks := meta.Data[0].Relationships.Tracks.Data
+	for i := range tracks {
+		t := &tracks[i]
+		if t.Type == "music-videos" || !(core.Config.Credits || core.Config.CreditsFile || t.Classical) || (songId != "" && t.ID != songId) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			trackCredits, err := api.GetSongCredits(storefront, t.ID)
+			if err != nil {
+				logger.Warn("credits unavailable", "trackId", t.ID, "err", err)
+				return
+			}
+			t.Credits = trackCredits
+		}()
+	}
+	wg.Wait()
+}
+
+// creditItems are the freeform items credits-tags maps the credits of a
+// track to, with several names in one item joined by "; ".
+func creditItems(track structs.TrackData) []metadata.Item {
+	if !core.Config.Credits {
+		return nil
+	}
+	var items []metadata.Item
+	for _, tag := range credits.Tags(track.Credits, core.CreditTags) {
+		items = append(items, metadata.Item{Name: "----:" + tag.Name, Value: strings.Join(tag.Values, "; ")})
+	}
+	return items
+}
+
+// writeCreditsFile saves the credits of an album's tracks as credits.txt in
+// the album folder and returns its path, or "" when no track has credits.
+func writeCreditsFile(meta *structs.AutoGenerated, albumFolder string) (string, error) {
+	tracks := meta.Data[0].Relationships.Tracks.Data
+	hasCredits := false
+	for _, t := range tracks {
+		hasCredits = hasCredits || len(t.Credits) > 0
+	}
+	if !hasCredits {
+		return "", nil
+	}
+	path := filepath.Join(albumFolder, "credits.txt")
+	text := credits.Text(meta.Data[0].Attributes.Name, meta.Data[0].Attributes.ArtistName, tracks)
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"main/internal/api"
 	"main/internal/core"
+	"main/internal/errs"
+	"main/internal/history"
 	"main/internal/metadata"
+	"main/internal/nfo"
 	"main/internal/parser"
 	"main/internal/qobuz"
+	"main/internal/retry"
 	"main/internal/ui"
 	"main/internal/utils"
 	"main/utils/lyrics"
@@ -24,20 +29,20 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/fatih/color"
 )
 
 type JsonStatus struct {
-	Status     string `json:"status"`
-	TrackNum   int    `json:"trackNum"`
-	TrackName  string `json:"trackName"`
-	Percentage int    `json:"percentage"`
-	Speed      string `json:"speed"`
-	Message    string `json:"message"`
-	AlbumID    string `json:"albumId"`
-	AlbumName  string `json:"albumName,omitempty"`
+	Status     string    `json:"status"`
+	TrackNum   int       `json:"trackNum"`
+	TrackName  string    `json:"trackName"`
+	Percentage int       `json:"percentage"`
+	Speed      string    `json:"speed"`
+	Message    string    `json:"message"`
+	AlbumID    string    `json:"albumId"`
+	AlbumName  string    `json:"albumName,omitempty"`
+	Code       errs.Code `json:"code,omitempty"`
 }
 
 func formatAudioQuality(raw string) string {
@@ -67,6 +72,20 @@ func printJSON(albumId string, trackNum int, trackName string, albumName string,
 	fmt.Println(string(statusJSON))
 }
 
+// printJSONError emits an "error" event carrying the class of err in "code".
+func printJSONError(albumId string, trackNum int, trackName string, albumName string, message string, err error) {
+	statusJSON, _ := json.Marshal(JsonStatus{
+		AlbumID:   albumId,
+		TrackNum:  trackNum,
+		TrackName: trackName,
+		AlbumName: albumName,
+		Status:    "error",
+		Message:   message,
+		Code:      errs.CodeOf(err),
+	})
+	fmt.Println(string(statusJSON))
+}
+
 func checkAndReEncodeTrack(trackPath string, updateStatus func(status string, sColor func(a ...interface{}) string), jsonOutput bool, albumId string, trackNum int, trackName string) (bool, error) {
 	if !jsonOutput {
 		updateStatus("正在检测...", color.New(color.FgCyan).SprintFunc())
@@ -102,7 +121,10 @@ func checkAndReEncodeTrack(trackPath string, updateStatus func(status string, sC
 	err = encodeCmd.Run()
 
 	if err != nil {
-		return true, fmt.Errorf("重新编码失败: %v, FFMPEG输出: %s", err, encodeStderr.String())
+		if errors.Is(err, exec.ErrNotFound) {
+			return true, errs.Wrap(errs.CodeDependencyMissing, err, "ffmpeg")
+		}
+		return true, errs.Wrap(errs.CodeIntegrityFailed, err, fmt.Sprintf("重新编码失败, FFMPEG输出: %s", encodeStderr.String()))
 	}
 
 	if err := os.Remove(trackPath); err != nil {
@@ -115,325 +137,144 @@ func checkAndReEncodeTrack(trackPath string, updateStatus func(status string, sC
 	return true, nil
 }
 
-func downloadTrackWithFallback(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront, baseSaveFolder, Codec, covPath string, qobuzDesc string, lyricAccount *structs.Account, workingAccounts []structs.Account, initialAccountIndex int, updateStatus func(status string, sColor func(a ...interface{}) string), progressChan chan runv14.ProgressUpdate, jsonOutput bool, trackNum int) (string, error) {
-	maxRetries := 3
+// downloadTrackWithFallback is the only retry loop of a track. It tries the
+// working accounts in turn, starting at initialAccountIndex, and repeats or
+// moves on as the retry policy says for each failure. verify, if not nil,
+// checks a downloaded file; a failed check counts as a failed attempt.
+// Geo-unavailable gives up on the storefront of the account, not the track.
+// sources, if not nil, holds the catalog entry each working account fetches
+// the track from.
+func downloadTrackWithFallback(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront, format, covPath string, qobuzDesc string, lyricAccount *structs.Account, workingAccounts []structs.Account, sources []structs.TrackSource, initialAccountIndex int, updateStatus func(status string, sColor func(a ...interface{}) string), progressChan chan runv14.ProgressUpdate, jsonOutput bool, trackNum int, verify func(trackPath string) error) (string, error) {
+	policy := core.RetryPolicy
 	var lastError error
+	totalAttempts := 0
+	geoBlocked := make(map[string]bool)
 
-	for i := 0; i < len(workingAccounts); i++ {
+	for i := 0; i < len(workingAccounts) && totalAttempts < policy.MaxTotalAttempts(); i++ {
 		accountIndex := (initialAccountIndex + i) % len(workingAccounts)
 		account := &workingAccounts[accountIndex]
+		if geoBlocked[account.Storefront] {
+			continue
+		}
+		if sources != nil {
+			track.Source = sources[accountIndex]
+		}
 
 		if !jsonOutput {
 			updateStatus(fmt.Sprintf("%s 账号下载中", strings.ToUpper(account.Storefront)), nil)
 		}
 
-		for attempt := 0; attempt <= maxRetries; attempt++ {
-			trackPath, err := downloadTrackSilently(track, meta, albumId, storefront, baseSaveFolder, Codec, covPath, qobuzDesc, lyricAccount, account, progressChan, jsonOutput)
+	attempts:
+		for attempt := 1; attempt <= policy.MaxAttempts() && totalAttempts < policy.MaxTotalAttempts(); attempt++ {
+			totalAttempts++
+			trackPath, err := downloadTrackSilently(track, meta, albumId, storefront, format, covPath, qobuzDesc, lyricAccount, account, progressChan, jsonOutput)
+			if err == nil && verify != nil {
+				err = verify(trackPath)
+			}
 			if err == nil {
 				return trackPath, nil
 			}
 			lastError = err
-			if attempt < maxRetries {
-				time.Sleep(2 * time.Second)
+			action := policy.Action(err)
+			slog.Info("track attempt failed", "album", albumId, "track", trackNum, "trackId", track.ID, "account", *account, "attempt", attempt, "action", action.String(), "err", err)
+			switch {
+			case errs.CodeOf(err) == errs.CodeGeoUnavailable:
+				geoBlocked[account.Storefront] = true
+				break attempts
+			case action == retry.FailFast:
+				return "", fmt.Errorf("不可重试的错误: %w", err)
+			case action == retry.SwitchAccount:
+				break attempts
+			}
+			if attempt < policy.MaxAttempts() {
+				policy.Sleep(attempt)
 			}
 		}
+		if !hasNextAccount(workingAccounts, initialAccountIndex, i, geoBlocked) || totalAttempts >= policy.MaxTotalAttempts() {
+			break
+		}
+		slog.Warn("account exhausted, switching", "album", albumId, "track", trackNum, "trackId", track.ID, "account", *account, "err", lastError)
 		warningMsg := fmt.Sprintf("账户 %s 失败, 尝试下一个...", account.Name)
 		if jsonOutput {
-			printJSON(albumId, trackNum, track.Attributes.Name, "", "error", 0, "", warningMsg)
+			printJSONError(albumId, trackNum, track.Attributes.Name, "", warningMsg, lastError)
 		} else {
 			updateStatus(warningMsg, color.New(color.FgRed).SprintFunc())
 		}
-		time.Sleep(1 * time.Second)
+		policy.Sleep(1)
 	}
 
+	if errs.CodeOf(lastError) == errs.CodeGeoUnavailable {
+		return "", fmt.Errorf("所有可用账户的地区均无法获取: %w", lastError)
+	}
 	return "", fmt.Errorf("所有可用账户均尝试失败: %w", lastError)
 }
 
-func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront, baseSaveFolder, Codec, covPath string, qobuzDesc string, lyricAccount *structs.Account, account *structs.Account, progressChan chan runv14.ProgressUpdate, jsonOutput bool) (string, error) {
+// hasNextAccount reports whether an account after the i-th one tried is left
+// whose storefront is not geo-blocked.
+func hasNextAccount(accounts []structs.Account, start, i int, geoBlocked map[string]bool) bool {
+	for k := i + 1; k < len(accounts); k++ {
+		if !geoBlocked[accounts[(start+k)%len(accounts)].Storefront] {
+			return true
+		}
+	}
+	return false
+}
+
+// lyricsCache keeps fetched lyrics per storefront and track so that every
+// format of a --formats job reuses one lookup. Failures are not cached.
+var lyricsCache sync.Map
+
+func getLyrics(storefront, trackId string, lyricAccount *structs.Account) (string, error) {
+	key := storefront + "/" + trackId
+	if v, ok := lyricsCache.Load(key); ok {
+		return v.(string), nil
+	}
+	lrc, err := lyrics.Get(storefront, trackId, core.Config.LrcType, core.Config.Language, core.Config.LrcFormat, core.DeveloperToken, lyricAccount.MediaUserToken, core.Config.EnableTranslation, core.Config.TranslationLanguage)
+	if err != nil {
+		return "", err
+	}
+	lyricsCache.Store(key, lrc)
+	return lrc, nil
+}
+
+func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront, format, covPath string, qobuzDesc string, lyricAccount *structs.Account, account *structs.Account, progressChan chan runv14.ProgressUpdate, jsonOutput bool) (string, error) {
 	if track.Type == "music-videos" {
 		if !core.Config.DownloadVideos {
 			core.SharedLock.Lock()
-			core.OkDict[albumId] = append(core.OkDict[albumId], -1)
+			core.OkDict[okKey(albumId, format)] = append(core.OkDict[okKey(albumId, format)], -1)
 			core.SharedLock.Unlock()
 			return "", nil
 		}
 
 		if len(account.MediaUserToken) <= 50 {
-			return "", errors.New("media-user-token is not set, skip MV dl")
+			return "", errs.New(errs.CodeTokenInvalid, "media-user-token is not set, skip MV dl")
 		}
 		if _, err := exec.LookPath("mp4decrypt"); err != nil {
-			return "", errors.New("mp4decrypt is not found, skip MV dl")
-		}
-
-		var singerFoldername, albumFoldername string
-		if core.Config.ArtistFolderFormat != "" {
-			if strings.Contains(albumId, "pl.") {
-				singerFoldername = strings.NewReplacer(
-					"{ArtistName}", "Apple Music", "{ArtistId}", "", "{UrlArtistName}", "Apple Music",
-				).Replace(core.Config.ArtistFolderFormat)
-			} else if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-				singerFoldername = strings.NewReplacer(
-					"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-					"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-					"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
-				).Replace(core.Config.ArtistFolderFormat)
-			} else {
-				singerFoldername = strings.NewReplacer(
-					"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-					"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-					"{ArtistId}", "",
-				).Replace(core.Config.ArtistFolderFormat)
-			}
+			return "", errs.New(errs.CodeDependencyMissing, "mp4decrypt is not found, skip MV dl")
 		}
 
-		Quality := "Video"
-		MVCodec := "H.264"
-		Tag_string := ""
-
-		if strings.Contains(albumId, "pl.") {
-			albumFoldername = strings.NewReplacer(
-				"{PlaylistName}", core.LimitString(meta.Data[0].Attributes.Name),
-				"{PlaylistId}", albumId, "{Quality}", Quality, "{Codec}", MVCodec, "{Tag}", Tag_string,
-			).Replace(core.Config.PlaylistFolderFormat)
-		} else {
-			albumFoldername = strings.NewReplacer(
-				"{ReleaseDate}", meta.Data[0].Attributes.ReleaseDate, "{ReleaseYear}", meta.Data[0].Attributes.ReleaseDate[:4],
-				"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName), "{AlbumName}", core.LimitString(meta.Data[0].Attributes.Name),
-				"{UPC}", meta.Data[0].Attributes.Upc, "{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
-				"{Copyright}", meta.Data[0].Attributes.Copyright, "{AlbumId}", albumId,
-				"{Quality}", Quality, "{Codec}", MVCodec, "{Tag}", Tag_string,
-			).Replace(core.Config.AlbumFolderFormat)
-		}
-
-		sanitizedSingerFolder := core.ForbiddenNames.ReplaceAllString(singerFoldername, "_")
-		sanitizedAlbumFolder := core.ForbiddenNames.ReplaceAllString(albumFoldername, "_")
-		mvOutPath, err := MvDownloader(track.ID, baseSaveFolder, sanitizedSingerFolder, sanitizedAlbumFolder, storefront, meta, account, progressChan, jsonOutput)
+		layout := routeLayout(format, trackFacts(track, meta, albumId, storefront))
+		fields := albumNameFields(meta, albumId, storefront, format, account)
+		artistDir, albumDir := albumDirs(layout, fields, songFields(fields, longestTrack(meta), meta))
+		mvOutPath, err := MvDownloader(track.ID, layout.Root, artistDir, albumDir, discFolder(meta, albumId, track.Attributes.DiscNumber), storefront, meta, account, progressChan, jsonOutput)
 		if err != nil {
 			return "", fmt.Errorf("failed to dl MV: %w", err)
 		}
 		return mvOutPath, nil
 	}
 
-	manifest, err := api.GetInfoFromAdam(track.ID, account, storefront)
+	plan, err := planTrack(track, meta, albumId, storefront, format, account)
 	if err != nil {
-		return "", fmt.Errorf("failed to get manifest with account %s: %w", account.Name, err)
-	}
-
-	needDlAacLc := false
-	if core.Dl_aac && *core.Aac_type == "aac-lc" {
-		needDlAacLc = true
-	}
-	if manifest.Attributes.ExtendedAssetUrls.EnhancedHls == "" {
-		if core.Dl_atmos {
-			return "", errors.New("atmos unavailable")
-		}
-		needDlAacLc = true
-	}
-	needCheck := false
-
-	if core.Config.GetM3u8Mode == "all" {
-		needCheck = true
-	} else if core.Config.GetM3u8Mode == "hires" && utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") {
-		needCheck = true
-	}
-	var EnhancedHls_m3u8 string
-	if needCheck && !needDlAacLc {
-		EnhancedHls_m3u8, _ = parser.CheckM3u8(track.ID, "song", account)
-		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
-			manifest.Attributes.ExtendedAssetUrls.EnhancedHls = EnhancedHls_m3u8
-		}
-	}
-
-	var TrackQuality string
-	if core.Dl_atmos {
-		TrackQuality = fmt.Sprintf("%dkbps", *core.Atmos_max-2000)
-	} else if needDlAacLc {
-		TrackQuality = "256kbps"
-	} else {
-		var rawQuality string
-		_, rawQuality, _, err = parser.ExtractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, true)
-		if err != nil {
-			if utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") {
-				TrackQuality = "Hi-Res Lossless"
-			} else {
-				TrackQuality = "Lossless"
-			}
-		} else {
-			TrackQuality = formatAudioQuality(rawQuality)
-		}
-	}
-
-	var AlbumQuality string
-	if core.Dl_atmos {
-		AlbumQuality = fmt.Sprintf("%dkbps", *core.Atmos_max-2000)
-	} else if core.Dl_aac {
-		AlbumQuality = "256kbps"
-	} else {
-		bestTrackID := track.ID
-		if len(meta.Data[0].Relationships.Tracks.Data) > 0 {
-			for _, t := range meta.Data[0].Relationships.Tracks.Data {
-				if utils.Contains(t.Attributes.AudioTraits, "hi-res-lossless") {
-					bestTrackID = t.ID
-					break
-				}
-			}
-		}
-
-		if bestTrackID == track.ID {
-			AlbumQuality = TrackQuality
-		} else {
-			bestManifest, err := api.GetInfoFromAdam(bestTrackID, account, storefront)
-			if err == nil {
-				_, bestRawQ, _, _ := parser.ExtractMedia(bestManifest.Attributes.ExtendedAssetUrls.EnhancedHls, true)
-				if bestRawQ != "" {
-					AlbumQuality = formatAudioQuality(bestRawQ)
-				}
-			}
-			if AlbumQuality == "" {
-				isHires := false
-				for _, tr := range meta.Data[0].Relationships.Tracks.Data {
-					if utils.Contains(tr.Attributes.AudioTraits, "hi-res-lossless") {
-						isHires = true
-						break
-					}
-				}
-				if isHires {
-					AlbumQuality = "Hi-Res Lossless"
-				} else {
-					AlbumQuality = "Lossless"
-				}
-			}
-		}
-	}
-
-	trackSpecificTags := []string{}
-	if track.Attributes.IsAppleDigitalMaster && core.Config.AppleMasterChoice != "" {
-		trackSpecificTags = append(trackSpecificTags, core.Config.AppleMasterChoice)
-	}
-	if track.Attributes.ContentRating == "explicit" && core.Config.ExplicitChoice != "" {
-		trackSpecificTags = append(trackSpecificTags, core.Config.ExplicitChoice)
-	} else if track.Attributes.ContentRating == "clean" && core.Config.CleanChoice != "" {
-		trackSpecificTags = append(trackSpecificTags, core.Config.CleanChoice)
-	}
-	Track_Tag_String := strings.Join(trackSpecificTags, " ")
-
-	albumTags := []string{}
-	hasMaster := false
-	hasExplicit := false
-	hasClean := false
-	for _, t := range meta.Data[0].Relationships.Tracks.Data {
-		if t.Attributes.IsAppleDigitalMaster {
-			hasMaster = true
-		}
-		if t.Attributes.ContentRating == "explicit" {
-			hasExplicit = true
-		}
-		if t.Attributes.ContentRating == "clean" {
-			hasClean = true
-		}
-	}
-	if hasMaster && core.Config.AppleMasterChoice != "" {
-		albumTags = append(albumTags, core.Config.AppleMasterChoice)
-	}
-	if hasExplicit && core.Config.ExplicitChoice != "" {
-		albumTags = append(albumTags, core.Config.ExplicitChoice)
-	} else if hasClean && core.Config.CleanChoice != "" {
-		albumTags = append(albumTags, core.Config.CleanChoice)
-	}
-	Album_Tag_String := strings.Join(albumTags, " ")
-
-	trackNum := -1
-	for i, t := range meta.Data[0].Relationships.Tracks.Data {
-		if t.ID == track.ID {
-			trackNum = i + 1
-			break
-		}
-	}
-	if trackNum == -1 {
-		return "", errors.New("track not found in metadata")
-	}
-
-	currentDiscNum := track.Attributes.DiscNumber
-	currentTrackNum := track.Attributes.TrackNumber
-	maxDiscNum := 0
-	tracksOnCurrentDisc := 0
-
-	for _, t := range meta.Data[0].Relationships.Tracks.Data {
-		if t.Attributes.DiscNumber > maxDiscNum {
-			maxDiscNum = t.Attributes.DiscNumber
-		}
-		if t.Attributes.DiscNumber == currentDiscNum {
-			tracksOnCurrentDisc++
-		}
-	}
-
-	var singerFoldername, albumFoldername string
-	if core.Config.ArtistFolderFormat != "" {
-		if strings.Contains(albumId, "pl.") {
-			singerFoldername = strings.NewReplacer(
-				"{ArtistName}", "Apple Music", "{ArtistId}", "", "{UrlArtistName}", "Apple Music",
-			).Replace(core.Config.ArtistFolderFormat)
-		} else if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
-			).Replace(core.Config.ArtistFolderFormat)
-		} else {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", "",
-			).Replace(core.Config.ArtistFolderFormat)
-		}
-	}
-
-	if strings.Contains(albumId, "pl.") {
-		albumFoldername = strings.NewReplacer(
-			"{PlaylistName}", core.LimitString(meta.Data[0].Attributes.Name),
-			"{PlaylistId}", albumId, "{Quality}", AlbumQuality, "{Codec}", Codec, "{Tag}", Album_Tag_String,
-		).Replace(core.Config.PlaylistFolderFormat)
-	} else {
-		albumFoldername = strings.NewReplacer(
-			"{ReleaseDate}", meta.Data[0].Attributes.ReleaseDate, "{ReleaseYear}", meta.Data[0].Attributes.ReleaseDate[:4],
-			"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName), "{AlbumName}", core.LimitString(meta.Data[0].Attributes.Name),
-			"{UPC}", meta.Data[0].Attributes.Upc, "{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
-			"{Copyright}", meta.Data[0].Attributes.Copyright, "{AlbumId}", albumId,
-			"{Quality}", AlbumQuality, "{Codec}", Codec, "{Tag}", Album_Tag_String,
-		).Replace(core.Config.AlbumFolderFormat)
-	}
-
-	songName := strings.NewReplacer(
-		"{SongId}", track.ID,
-		"{SongNumer}", fmt.Sprintf("%02d", currentTrackNum),
-		"{SongName}", core.LimitString(track.Attributes.Name),
-		"{DiscNumber}", fmt.Sprintf("%0d", track.Attributes.DiscNumber),
-		"{TrackNumber}", fmt.Sprintf("%0d", track.Attributes.TrackNumber),
-		"{Quality}", TrackQuality,
-		"{Tag}", Track_Tag_String,
-		"{Codec}", Codec,
-	).Replace(core.Config.SongFileFormat)
-
-	sanitizedSingerFolder := core.ForbiddenNames.ReplaceAllString(singerFoldername, "_")
-	sanitizedAlbumFolder := core.ForbiddenNames.ReplaceAllString(albumFoldername, "_")
-	sanitizedSongName := core.ForbiddenNames.ReplaceAllString(songName, "_")
-	filenameWithExt := fmt.Sprintf("%s.m4a", sanitizedSongName)
-
-	finalArtistDir, finalAlbumDir, finalFilename := utils.EnsureSafePath(baseSaveFolder, sanitizedSingerFolder, sanitizedAlbumFolder, filenameWithExt)
-	var finalSingerFolder string
-	if finalArtistDir != "" {
-		finalSingerFolder = filepath.Join(baseSaveFolder, finalArtistDir)
-	} else {
-		finalSingerFolder = baseSaveFolder
-	}
-	finalAlbumFolder := filepath.Join(finalSingerFolder, finalAlbumDir)
-
-	if maxDiscNum > 1 {
-		finalAlbumFolder = filepath.Join(finalAlbumFolder, fmt.Sprintf("CD%d", currentDiscNum))
+		return "", err
 	}
+	needDlAacLc := plan.needDlAacLc
+	trackNum := plan.trackNum
+	tracksOnCurrentDisc := plan.tracksOnCurrentDisc
+	finalArtistDir, finalAlbumDir := plan.finalArtistDir, plan.finalAlbumDir
+	finalAlbumFolder := plan.finalAlbumFolder
+	trackPath := plan.trackPath
 
 	os.MkdirAll(finalAlbumFolder, os.ModePerm)
-	trackPath := filepath.Join(finalAlbumFolder, finalFilename)
 	tempTrackPath := trackPath + ".tmp"
 	defer func() {
 		_ = os.Remove(tempTrackPath)
@@ -445,74 +286,67 @@ func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated,
 	}
 	if exists {
 		core.SharedLock.Lock()
-		core.OkDict[albumId] = append(core.OkDict[albumId], trackNum)
+		core.OkDict[okKey(albumId, format)] = append(core.OkDict[okKey(albumId, format)], trackNum)
 		core.SharedLock.Unlock()
 		return trackPath, nil
 	}
 
 	if needDlAacLc {
 		if len(account.MediaUserToken) <= 50 {
-			return "", errors.New("invalid media-user-token")
+			return "", errs.New(errs.CodeTokenInvalid, "invalid media-user-token")
 		}
-		_, err := runv3.Run(track.ID, tempTrackPath, core.DeveloperToken, account.MediaUserToken, false)
+		catalogId, _ := catalogEntry(track, storefront)
+		_, err := runv3.Run(catalogId, tempTrackPath, core.DeveloperToken, account.MediaUserToken, false)
 		if err != nil {
 			return "", fmt.Errorf("failed to dl aac-lc: %w", err)
 		}
 	} else {
-		trackM3u8Url, _, _, err := parser.ExtractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, false)
-		if err != nil {
-			return "", fmt.Errorf("failed to extract info from manifest: %w", err)
-		}
-		err = runv14.Run(track.ID, trackM3u8Url, tempTrackPath, account, core.Config, progressChan)
+		catalogId, _ := catalogEntry(track, storefront)
+		err = runv14.Run(catalogId, plan.streamUrl, tempTrackPath, account, core.Config, progressChan)
 		if err != nil {
 			return "", fmt.Errorf("failed to run v14 with account %s: %w", account.Name, err)
 		}
 	}
 
+	gapless := sourceGapless(tempTrackPath, slog.With("album", albumId, "trackId", track.ID))
+
 	var trackCovPath string
 	trackIndexInMeta := trackNum
 	var finalLrc string
 	if lyricAccount != nil && (core.Config.EmbedLrc || core.Config.SaveLrcFile) {
-		lrcStr, lrcErr := lyrics.Get(storefront, track.ID, core.Config.LrcType, core.Config.Language, core.Config.LrcFormat, core.DeveloperToken, lyricAccount.MediaUserToken, core.Config.EnableTranslation, core.Config.TranslationLanguage)
+		// Songs filled in from another storefront only exist in that catalog.
+		lrcId, lrcStorefront := track.ID, storefront
+		if track.Source.ID == track.ID {
+			lrcStorefront = track.Source.Storefront
+		}
+		lrcStr, lrcErr := getLyrics(lrcStorefront, lrcId, lyricAccount)
 		if lrcErr == nil {
 			if core.Config.SaveLrcFile {
 				lrcFilename := fmt.Sprintf("%s.lrc", strings.TrimSuffix(filepath.Base(trackPath), filepath.Ext(filepath.Base(trackPath))))
-				_ = metadata.WriteLyrics(filepath.Dir(trackPath), lrcFilename, lrcStr)
+				if err := metadata.WriteLyrics(filepath.Dir(trackPath), lrcFilename, lrcStr); err != nil {
+					slog.Warn("write lrc failed", "album", albumId, "trackId", track.ID, "err", err)
+				}
 			}
 			if core.Config.EmbedLrc {
 				finalLrc = lrcStr
 			}
+		} else {
+			slog.Debug("lyrics unavailable", "album", albumId, "trackId", track.ID, "account", *lyricAccount, "err", lrcErr)
 		}
 	}
 
-	var appleDesc string
-	var finalComment string
-	if meta.Data[0].Attributes.EditorialNotes != nil && meta.Data[0].Attributes.EditorialNotes.Standard != "" {
-		reHTML := regexp.MustCompile("<[^>]*>")
-		textWithoutHTML := reHTML.ReplaceAllString(meta.Data[0].Attributes.EditorialNotes.Standard, "")
-		reNewlines := regexp.MustCompile(`\n{2,}`)
-		appleDesc = strings.TrimSpace(reNewlines.ReplaceAllString(textWithoutHTML, "\n"))
-	}
-
-	if appleDesc != "" {
-		finalComment = "©Copyright Apple Music：" + appleDesc
-	}
-	if qobuzDesc != "" {
-		if finalComment != "" {
-			finalComment += "\n——————————————————\n"
-		}
-		finalComment += "©Copyright Qobuz：" + qobuzDesc
-	}
+	finalComment := albumReview(meta, qobuzDesc)
 
+	names := trackTagNames(meta, meta.Data[0].Relationships.Tracks.Data[trackIndexInMeta-1])
 	tags := []string{
 		"tool=",
-		fmt.Sprintf("artist=%s", meta.Data[0].Attributes.ArtistName),
-		fmt.Sprintf("title=%s", meta.Data[0].Relationships.Tracks.Data[trackIndexInMeta-1].Attributes.Name),
-		fmt.Sprintf("album=%s", meta.Data[0].Attributes.Name),
-		fmt.Sprintf("album_artist=%s", meta.Data[0].Attributes.ArtistName),
+		fmt.Sprintf("artist=%s", names.artist),
+		fmt.Sprintf("title=%s", names.title),
+		fmt.Sprintf("album=%s", names.album),
+		fmt.Sprintf("album_artist=%s", names.albumArtist),
 		fmt.Sprintf("genre=%s", meta.Data[0].Relationships.Tracks.Data[trackIndexInMeta-1].Attributes.GenreNames[0]),
 		fmt.Sprintf("created=%s", meta.Data[0].Attributes.ReleaseDate),
-		fmt.Sprintf("writer=%s", meta.Data[0].Relationships.Tracks.Data[trackIndexInMeta-1].Attributes.ComposerName),
+		fmt.Sprintf("writer=%s", names.composer),
 	}
 
 	var dNum, dTotal, tNum, tTotal int
@@ -552,10 +386,12 @@ func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated,
 
 	if core.Config.EmbedCover {
 		if strings.Contains(albumId, "pl.") && core.Config.DlAlbumcoverForPlaylist {
-			_, _, safeCoverFilename := utils.EnsureSafePath(baseSaveFolder, finalArtistDir, finalAlbumDir, track.ID+".jpg")
+			_, safeCoverPath := albumPath(plan.root, finalArtistDir, finalAlbumDir, plan.discDir, track.ID+".jpg")
 			var err error
-			trackCovPath, err = metadata.WriteCover(finalAlbumFolder, strings.TrimSuffix(safeCoverFilename, ".jpg"), track.Attributes.Artwork.URL)
-			if err == nil && trackCovPath != "" {
+			trackCovPath, err = metadata.WriteCover(finalAlbumFolder, strings.TrimSuffix(filepath.Base(safeCoverPath), ".jpg"), track.Attributes.Artwork.URL)
+			if err != nil {
+				slog.Warn("track cover download failed", "album", albumId, "trackId", track.ID, "err", err)
+			} else if trackCovPath != "" {
 				tags = append(tags, fmt.Sprintf("cover=%s", trackCovPath))
 			}
 		} else {
@@ -571,10 +407,26 @@ func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated,
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		if !jsonOutput {
-			fmt.Printf("\n[警告] MP4Box 执行失败: %v, 输出: %s\n", err, stderr.String())
+		slog.Warn("MP4Box failed", "album", albumId, "trackId", track.ID, "err", err, "stderr", stderr.String())
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errs.Wrap(errs.CodeDependencyMissing, err, "MP4Box")
 		}
-		return "", fmt.Errorf("元数据写入失败，文件可能不完整: %v", err)
+		return "", errs.Wrap(errs.CodeTaggingFailed, err, "元数据写入失败，文件可能不完整")
+	}
+
+	items := append(creditItems(track), classicalItems(track)...)
+	items = append(items, languageItems(names)...)
+	items = append(items, compilationItems(meta)...)
+	items = append(items, catalogItems(meta, track)...)
+	items = append(items, codecItems(plan.codec, plan.trackQuality)...)
+	if items = append(items, gaplessItems(gapless)...); len(items) > 0 {
+		if err := metadata.WriteItems(tempTrackPath, items); err != nil {
+			slog.Warn("extra atoms failed", "album", albumId, "trackId", track.ID, "err", err)
+			return "", errs.Wrap(errs.CodeTaggingFailed, err, "元数据写入失败，文件可能不完整")
+		}
+	}
+	if err := restoreEditList(tempTrackPath, gapless); err != nil {
+		slog.Warn("edit list not restored, saved without iTunSMPB", "album", albumId, "trackId", track.ID, "err", err)
 	}
 
 	if strings.Contains(albumId, "pl.") && core.Config.DlAlbumcoverForPlaylist && trackCovPath != "" {
@@ -586,21 +438,38 @@ func downloadTrackSilently(track structs.TrackData, meta *structs.AutoGenerated,
 	}
 
 	core.SharedLock.Lock()
-	core.OkDict[albumId] = append(core.OkDict[albumId], trackNum)
+	core.OkDict[okKey(albumId, format)] = append(core.OkDict[okKey(albumId, format)], trackNum)
 	core.SharedLock.Unlock()
+
+	if plan.codec != plan.requestedCodec {
+		core.RecordFallback(core.Fallback{AlbumID: albumId, TrackName: track.Attributes.Name, Requested: plan.requestedCodec, Obtained: plan.codec})
+		slog.Info("codec fallback", "album", albumId, "trackId", track.ID, "requested", plan.requestedCodec, "obtained", plan.codec)
+		if jsonOutput {
+			printJSON(albumId, trackNum, track.Attributes.Name, meta.Data[0].Attributes.Name, "fallback", 100, "", fmt.Sprintf("%s -> %s", plan.requestedCodec, plan.codec))
+		}
+	}
 	return trackPath, nil
 }
 
 func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, jsonOutput bool) error {
-	mainAccount, err := core.GetAccountForStorefront(storefront)
+	mainAccount, err := ripAccount(albumId, storefront)
 	if err != nil {
 		return err
 	}
 
+	logger := slog.With("album", albumId, "storefront", storefront)
 	meta, err := api.GetMeta(albumId, mainAccount, storefront)
 	if err != nil {
 		return err
 	}
+	logger.Debug("album metadata fetched", "account", *mainAccount, "tracks", len(meta.Data[0].Relationships.Tracks.Data))
+	if core.Config.ContentRating != "" {
+		albumId, urlArg_i, meta = applyContentRating(meta, albumId, storefront, urlArg_i, mainAccount, jsonOutput, logger)
+		logger = slog.With("album", albumId, "storefront", storefront)
+	}
+	markClassical(meta, albumId, urlRaw, logger)
+	fetchCredits(meta, storefront, urlArg_i, logger)
+	fetchSecondaryNames(meta, albumId, storefront, mainAccount, logger)
 	var lyricAccount *structs.Account
 	for i := range core.Config.Accounts {
 		acc := &core.Config.Accounts[i]
@@ -621,163 +490,11 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 	}
 
 	if core.Debug_mode {
-		if len(meta.Data[0].Relationships.Tracks.Data) > 0 {
-			firstTrack := meta.Data[0].Relationships.Tracks.Data[0]
-			manifest, err := api.GetInfoFromAdam(firstTrack.ID, mainAccount, storefront)
-			if err == nil && manifest.Attributes.ExtendedAssetUrls.EnhancedHls != "" {
-				_, _, _, _ = parser.ExtractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, true)
-			}
-		}
-		return nil
-	}
-
-	var Codec string
-	if core.Dl_atmos {
-		Codec = "ATMOS"
-	} else if core.Dl_aac {
-		Codec = "AAC"
-	} else {
-		Codec = "ALAC"
-	}
-
-	var baseSaveFolder string
-	if core.Dl_atmos {
-		baseSaveFolder = core.Config.AtmosSaveFolder
-	} else {
-		baseSaveFolder = core.Config.AlacSaveFolder
-	}
-
-	var Quality string
-	if core.Dl_atmos {
-		Quality = fmt.Sprintf("%dkbps", *core.Atmos_max-2000)
-	} else if core.Dl_aac {
-		Quality = "256kbps"
-	} else {
-		bestTrackID := meta.Data[0].Relationships.Tracks.Data[0].ID
-		for _, t := range meta.Data[0].Relationships.Tracks.Data {
-			if utils.Contains(t.Attributes.AudioTraits, "hi-res-lossless") {
-				bestTrackID = t.ID
-				break
-			}
-		}
-
-		manifest, err := api.GetInfoFromAdam(bestTrackID, mainAccount, storefront)
-		var rawQuality string
-		if err == nil {
-			_, rawQuality, _, _ = parser.ExtractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, true)
-		}
-
-		if rawQuality != "" {
-			Quality = formatAudioQuality(rawQuality)
-		} else {
-			isHires := false
-			isLossless := false
-			for _, track := range meta.Data[0].Relationships.Tracks.Data {
-				if utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") {
-					isHires = true
-					break
-				}
-				if utils.Contains(track.Attributes.AudioTraits, "lossless") {
-					isLossless = true
-				}
-			}
-			if isHires {
-				Quality = "Hi-Res Lossless"
-			} else if isLossless {
-				Quality = "Lossless"
-			} else {
-				Quality = "AAC"
-			}
-		}
-	}
-	var singerFoldername, albumFoldername string
-	if core.Config.ArtistFolderFormat != "" {
-		if strings.Contains(albumId, "pl.") {
-			singerFoldername = strings.NewReplacer(
-				"{ArtistName}", "Apple Music", "{ArtistId}", "", "{UrlArtistName}", "Apple Music",
-			).Replace(core.Config.ArtistFolderFormat)
-		} else if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
-			).Replace(core.Config.ArtistFolderFormat)
-		} else {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", "",
-			).Replace(core.Config.ArtistFolderFormat)
-		}
-	}
-
-	albumTags := []string{}
-	hasMaster := false
-	hasExplicit := false
-	hasClean := false
-	for _, t := range meta.Data[0].Relationships.Tracks.Data {
-		if t.Attributes.IsAppleDigitalMaster {
-			hasMaster = true
-		}
-		if t.Attributes.ContentRating == "explicit" {
-			hasExplicit = true
-		}
-		if t.Attributes.ContentRating == "clean" {
-			hasClean = true
-		}
-	}
-	if hasMaster && core.Config.AppleMasterChoice != "" {
-		albumTags = append(albumTags, core.Config.AppleMasterChoice)
-	}
-	if hasExplicit && core.Config.ExplicitChoice != "" {
-		albumTags = append(albumTags, core.Config.ExplicitChoice)
-	} else if hasClean && core.Config.CleanChoice != "" {
-		albumTags = append(albumTags, core.Config.CleanChoice)
-	}
-	Tag_string := strings.Join(albumTags, " ")
-
-	if strings.Contains(albumId, "pl.") {
-		albumFoldername = strings.NewReplacer(
-			"{PlaylistName}", core.LimitString(meta.Data[0].Attributes.Name),
-			"{PlaylistId}", albumId, "{Quality}", Quality, "{Codec}", Codec, "{Tag}", Tag_string,
-		).Replace(core.Config.PlaylistFolderFormat)
-	} else {
-		albumFoldername = strings.NewReplacer(
-			"{ReleaseDate}", meta.Data[0].Attributes.ReleaseDate, "{ReleaseYear}", meta.Data[0].Attributes.ReleaseDate[:4],
-			"{ArtistName}", core.LimitString(meta.Data[0].Attributes.ArtistName), "{AlbumName}", core.LimitString(meta.Data[0].Attributes.Name),
-			"{UPC}", meta.Data[0].Attributes.Upc, "{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
-			"{Copyright}", meta.Data[0].Attributes.Copyright, "{AlbumId}", albumId,
-			"{Quality}", Quality, "{Codec}", Codec, "{Tag}", Tag_string,
-		).Replace(core.Config.AlbumFolderFormat)
-	}
-
-	sanitizedSingerFolder := core.ForbiddenNames.ReplaceAllString(singerFoldername, "_")
-	sanitizedAlbumFolder := core.ForbiddenNames.ReplaceAllString(albumFoldername, "_")
-
-	var longestFilename string
-	for i := range meta.Data[0].Relationships.Tracks.Data {
-		if len(meta.Data[0].Relationships.Tracks.Data[i].Attributes.Name) > len(longestFilename) {
-			longestFilename = meta.Data[0].Relationships.Tracks.Data[i].Attributes.Name
+		if !jsonOutput {
+			fmt.Printf("歌手: %s\n专辑: %s\n正在探测每首曲目的可用音质...\n", meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name)
 		}
+		return printQualityMatrix(buildQualityMatrix(meta, albumId, storefront), jsonOutput)
 	}
-	longestFilename = strings.NewReplacer(
-		"{SongName}", longestFilename,
-		"{SongNumer}", "99",
-		"{Quality}", "24B-192.0kHz",
-		"{Tag}", core.Config.AppleMasterChoice+" "+core.Config.ExplicitChoice,
-		"{Codec}", "ATMOS",
-	).Replace(core.Config.SongFileFormat) + ".m4a"
-
-	finalArtistDir, finalAlbumDir, _ := utils.EnsureSafePath(baseSaveFolder, sanitizedSingerFolder, sanitizedAlbumFolder, longestFilename)
-
-	var finalSingerFolder string
-	if finalArtistDir != "" {
-		finalSingerFolder = filepath.Join(baseSaveFolder, finalArtistDir)
-	} else {
-		finalSingerFolder = baseSaveFolder
-	}
-	finalAlbumFolder := filepath.Join(finalSingerFolder, finalAlbumDir)
-	os.MkdirAll(finalAlbumFolder, os.ModePerm)
 
 	if !jsonOutput {
 		fmt.Printf("歌手: %s\n", meta.Data[0].Attributes.ArtistName)
@@ -786,92 +503,28 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 		printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", "专辑信息已获取")
 	}
 
-	if core.Config.SaveArtistCover && !(strings.Contains(albumId, "pl.")) {
-		if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-			_, err = metadata.WriteCover(finalSingerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
-			if err != nil {
-			}
+	var resolution *storefrontResolution
+	if core.Config.CrossStorefront && !strings.Contains(albumId, "pl.") {
+		if !jsonOutput {
+			fmt.Println("正在检查各区域的曲目和音质...")
 		}
-	}
-	covPath, err := metadata.WriteCover(finalAlbumFolder, "cover", meta.Data[0].Attributes.Artwork.URL)
-	if err != nil {
-	}
-
-	var qobuzDesc string
-	var pdfUrls []qobuz.PDFExtra
-	if !strings.Contains(albumId, "pl.") {
-		qobuzDesc, pdfUrls, err = qobuz.GetQobuzExtras(meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name)
-		if err != nil {
+		resolution = resolveStorefronts(meta, albumId, storefront, logger)
+		if !jsonOutput {
+			resolution.print()
+		}
+		if n := resolution.fillMissing(meta); n > 0 {
+			logger.Info("tracks filled from other storefronts", "count", n)
 			if jsonOutput {
-				printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("Qobuz元数据获取失败: %v", err))
+				printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("已从其他区域补全 %d 首缺失曲目", n))
 			} else {
-				fmt.Printf("Qobuz元数据获取失败: %v\n", err)
-			}
-		}
-	}
-
-	if pdfUrls != nil && len(pdfUrls) > 0 {
-		if jsonOutput {
-			printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("正在下载 %d 个 Qobuz PDF...", len(pdfUrls)))
-		} else {
-			fmt.Printf("正在下载 %d 个 Qobuz PDF...\n", len(pdfUrls))
-		}
-		for _, pdf := range pdfUrls {
-			const maxAttempts = 3
-			var err error
-			for attempt := 1; attempt <= maxAttempts; attempt++ {
-				err = qobuz.DownloadPDF(pdf, finalAlbumFolder)
-				if err == nil {
-					break
-				}
-
-				if attempt < maxAttempts {
-					if jsonOutput {
-						printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("PDF下载失败 (尝试 %d/%d), 2秒后重试: %s -> %v", attempt, maxAttempts, pdf.URL, err))
-					} else {
-						fmt.Printf("PDF下载失败 (尝试 %d/%d), 2秒后重试: %s -> %v\n", attempt, maxAttempts, pdf.URL, err)
-					}
-					time.Sleep(2 * time.Second)
-				}
-			}
-
-			if err != nil {
-				if jsonOutput {
-					printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("PDF下载最终失败: %s -> %v", pdf.URL, err))
-				} else {
-					fmt.Printf("PDF下载最终失败: %s -> %v\n", pdf.URL, err)
-				}
-			}
-		}
-	}
-
-	if core.Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
-		motionvideoUrlSquare, err := parser.ExtractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
-		if err == nil {
-			exists, _ := utils.FileExists(filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"))
-			if !exists {
-				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlSquare, "-c", "copy", filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"))
-				_ = cmd.Run()
-			}
-		}
-
-		if core.Config.EmbyAnimatedArtwork {
-			cmd3 := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(finalAlbumFolder, "folder.jpg"))
-			_ = cmd3.Run()
-		}
-
-		motionvideoUrlTall, err := parser.ExtractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
-		if err == nil {
-			exists, _ := utils.FileExists(filepath.Join(finalAlbumFolder, "tall_animated_artwork.mp4"))
-			if !exists {
-				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlTall, "-c", "copy", filepath.Join(finalAlbumFolder, "tall_animated_artwork.mp4"))
-				_ = cmd.Run()
+				fmt.Printf("已从其他区域补全 %d 首缺失曲目\n", n)
 			}
 		}
 	}
 
+	// --dry-run never prompts: it plans every track, or the one in the link.
 	var selected []int
-	if jsonOutput {
+	if jsonOutput || core.Dry_run {
 		trackTotal := len(meta.Data[0].Relationships.Tracks.Data)
 		arr := make([]int, trackTotal)
 		for i := 0; i < trackTotal; i++ {
@@ -888,8 +541,11 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 				}
 			}
 			if !found {
-				printJSON(albumId, 0, meta.Data[0].Attributes.Name, "", "error", 0, "", "指定的单曲ID未在专辑中找到")
-				return errors.New("指定的单曲ID未在专辑中找到")
+				err := errs.New(errs.CodeInvalidURL, "指定的单曲ID未在专辑中找到")
+				if jsonOutput {
+					printJSONError(albumId, 0, meta.Data[0].Attributes.Name, "", err.Error(), err)
+				}
+				return err
 			}
 		} else {
 			selected = arr
@@ -910,27 +566,140 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 	}
 
 	var workingAccounts []structs.Account
-	if len(meta.Data[0].Relationships.Tracks.Data) > 0 {
+	var precheck []accountCheck
+	var precheckErr error
+	if resolution != nil {
+		workingAccounts, precheck, err = resolution.precheck(meta, selected)
+		if err != nil {
+			return err
+		}
+	} else if len(meta.Data[0].Relationships.Tracks.Data) > 0 {
 		firstTrackId := meta.Data[0].Relationships.Tracks.Data[0].ID
 		for _, acc := range core.Config.Accounts {
 			if !core.Config.GlobalDecryption && strings.ToLower(acc.Storefront) != strings.ToLower(storefront) {
 				continue
 			}
 			_, err := api.GetInfoFromAdam(firstTrackId, &acc, acc.Storefront)
+			precheck = append(precheck, newAccountCheck(acc, err))
 			if err == nil {
 				workingAccounts = append(workingAccounts, acc)
 			} else {
+				precheckErr = err
+				logger.Info("account precheck failed", "account", acc, "err", err)
 				if !jsonOutput {
 					fmt.Printf("账户 [%s] 无法访问此专辑 (可能无版权)，本次任务将跳过该账户\n", acc.Name)
 				}
 			}
 		}
 	} else {
-		return errors.New("专辑中没有曲目")
+		return errs.New(errs.CodeNotFound, "专辑中没有曲目")
 	}
 
 	if len(workingAccounts) == 0 {
-		return errors.New("所有账户均无法访问此专辑，任务中止")
+		if precheckErr != nil {
+			return fmt.Errorf("所有账户均无法访问此专辑，任务中止: %w", precheckErr)
+		}
+		return errs.New(errs.CodeGeoUnavailable, "所有账户均无法访问此专辑，任务中止")
+	}
+
+	j := &ripJob{
+		albumId:         albumId,
+		storefront:      storefront,
+		meta:            meta,
+		mainAccount:     mainAccount,
+		lyricAccount:    lyricAccount,
+		selected:        selected,
+		workingAccounts: workingAccounts,
+		precheck:        precheck,
+		resolution:      resolution,
+		jsonOutput:      jsonOutput,
+		logger:          logger,
+	}
+	formats := core.JobFormats()
+	var ripErrs []error
+	for i, format := range formats {
+		if len(formats) > 1 && !jsonOutput {
+			fmt.Printf("格式 [%d/%d]: %s\n", i+1, len(formats), format)
+		}
+		if err := j.ripFormat(format, i == 0); err != nil {
+			if len(formats) == 1 {
+				return err
+			}
+			ripErrs = append(ripErrs, fmt.Errorf("%s: %w", format, err))
+		}
+	}
+	return errors.Join(ripErrs...)
+}
+
+// ripJob is the part of an album job shared by all of its output formats.
+// Metadata, track selection, the account precheck and the album extras are
+// resolved once and reused for every format.
+type ripJob struct {
+	albumId         string
+	storefront      string
+	meta            *structs.AutoGenerated
+	mainAccount     *structs.Account
+	lyricAccount    *structs.Account
+	selected        []int
+	workingAccounts []structs.Account
+	precheck        []accountCheck
+	resolution      *storefrontResolution // nil unless cross-storefront is on
+	jsonOutput      bool
+	logger          *slog.Logger
+	extras          *albumExtras // set by the first format
+	sidecar         *nfo.Album   // album.nfo and album.json, set by the first format
+}
+
+// ripFormat downloads the selected tracks of the job in one output format
+// into that format's save folder. Music videos are only fetched by the first
+// format.
+func (j *ripJob) ripFormat(format string, first bool) error {
+	albumId, storefront, meta := j.albumId, j.storefront, j.meta
+	mainAccount, lyricAccount := j.mainAccount, j.lyricAccount
+	workingAccounts, precheck := j.workingAccounts, j.precheck
+	jsonOutput, logger := j.jsonOutput, j.logger
+
+	selected := j.selected
+	if !first {
+		selected = nil
+		for _, trackNum := range j.selected {
+			if meta.Data[0].Relationships.Tracks.Data[trackNum-1].Type != "music-videos" {
+				selected = append(selected, trackNum)
+			}
+		}
+	}
+
+	_, rawQuality := albumQuality(meta, albumId, storefront, format, mainAccount)
+	layout := routeLayout(format, albumQualityFacts(albumFacts(meta, albumId, storefront), meta, format, rawQuality))
+	baseSaveFolder := layout.Root
+	fields := albumNameFields(meta, albumId, storefront, format, mainAccount)
+	finalArtistDir, finalAlbumDir := albumDirs(layout, fields, songFields(fields, longestTrack(meta), meta))
+
+	var finalSingerFolder string
+	if finalArtistDir != "" {
+		finalSingerFolder = filepath.Join(baseSaveFolder, finalArtistDir)
+	} else {
+		finalSingerFolder = baseSaveFolder
+	}
+	finalAlbumFolder := filepath.Join(finalSingerFolder, finalAlbumDir)
+	if !core.Dry_run {
+		os.MkdirAll(finalAlbumFolder, os.ModePerm)
+	}
+
+	var covPath, qobuzDesc string
+	if !core.Dry_run {
+		if j.extras == nil {
+			j.extras = downloadAlbumExtras(meta, albumId, finalSingerFolder, finalAlbumFolder, jsonOutput, logger)
+			covPath = j.extras.covPath
+		} else {
+			covPath = j.extras.copyTo(finalSingerFolder, finalAlbumFolder, logger)
+		}
+		qobuzDesc = j.extras.qobuzDesc
+	}
+
+	if core.Dry_run {
+		printDryRun(meta, albumId, storefront, format, selected, workingAccounts, precheck, j.resolution, jsonOutput)
+		return nil
 	}
 
 	albumQualityType := "AAC"
@@ -1007,8 +776,10 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 		pui = ui.NewProgressUI(nil)
 	}
 
+	failed := 0 // tracks of this job that failed, under core.SharedLock
 	semaphore := make(chan struct{}, numThreads)
 	var dispatchCounter uint64
+	trackPaths := make(map[int]string) // finished audio tracks, for tagLoudness
 
 	for _, trackNum := range selected {
 		wg.Add(1)
@@ -1036,17 +807,26 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 			}()
 
 			trackData := meta.Data[0].Relationships.Tracks.Data[trackIndexInMeta-1]
+			trackAccounts := workingAccounts
+			var trackSources []structs.TrackSource
+			var sourceErr error
+			if j.resolution != nil && trackData.Type != "music-videos" {
+				trackAccounts, trackSources, sourceErr = j.resolution.pick(trackData, format)
+				if sourceErr == nil {
+					trackData.Source = trackSources[0]
+				}
+			}
 
 			if !jsonOutput && pui != nil {
-				manifest, err := api.GetInfoFromAdam(trackData.ID, mainAccount, storefront)
+				catalogId, catalogStorefront := catalogEntry(trackData, storefront)
 				quality := "N/A"
-				if err == nil && manifest.Attributes.ExtendedAssetUrls.EnhancedHls != "" {
-					_, _, quality, err = parser.ExtractMedia(manifest.Attributes.ExtendedAssetUrls.EnhancedHls, false)
-					if err != nil {
+				if manifest, err := api.GetInfoFromAdam(catalogId, mainAccount, catalogStorefront); err == nil {
+					_, obtained, _, raw, err := selectCodec(codecChain(trackData, format), manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
+					if err == nil {
+						quality = codecLabel(obtained) + " " + trackQuality(obtained, raw)
+					} else {
 						quality = "获取失败"
 					}
-				} else {
-					quality = "AAC 256kbps"
 				}
 
 				qualityStr := fmt.Sprintf("(%s)", quality)
@@ -1061,7 +841,7 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 			}
 
 			core.SharedLock.Lock()
-			isDone := utils.IsInArray(core.OkDict[albumId], trackIndexInMeta)
+			isDone := utils.IsInArray(core.OkDict[okKey(albumId, format)], trackIndexInMeta)
 			core.SharedLock.Unlock()
 
 			if isDone {
@@ -1077,121 +857,118 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 				return
 			}
 
+			if sourceErr != nil {
+				logger.Error("track unavailable", "track", trackIndexInMeta, "trackId", trackData.ID, "err", sourceErr)
+				errMsg := fmt.Sprintln("下载失败:", sourceErr)
+				core.SharedLock.Lock()
+				core.Counter.Total++
+				if jsonOutput {
+					printJSONError(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, errMsg, sourceErr)
+				} else if pui != nil {
+					pui.Abort(trackIndexInMeta, strings.TrimSpace(errMsg))
+				}
+				core.Counter.Error++
+				failed++
+				core.SharedLock.Unlock()
+				core.RecordFailure(sourceErr)
+				return
+			}
+
 			if jsonOutput {
 				printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "start", 0, "", "等待下载...")
 			}
 
-			const PostDownloadMaxRetries = 3
-
-			for attempt := 1; attempt <= PostDownloadMaxRetries; attempt++ {
-				if semaphoreReleased {
-					semaphore <- struct{}{}
-					semaphoreReleased = false
-				}
-
-				if attempt > 1 {
-					if jsonOutput {
-						printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "progress", 0, "", fmt.Sprintf("第 %d/%d 次重试...", attempt, PostDownloadMaxRetries))
-					} else {
-						updateStatus(fmt.Sprintf("第 %d/%d 次重试...", attempt, PostDownloadMaxRetries), nil)
-					}
-					time.Sleep(2 * time.Second)
-				}
-
-				progressChan := make(chan runv14.ProgressUpdate, 10)
-				go func() {
-					accountName := ""
-					if len(workingAccounts) > 0 {
-						account := &workingAccounts[statusIndex%len(workingAccounts)]
-						accountName = strings.ToUpper(account.Storefront)
-					}
-
-					if !jsonOutput && pui != nil {
-						pui.HandleProgress(trackIndexInMeta, progressChan, accountName)
-					} else {
-						for p := range progressChan {
-							status := "progress"
-							if p.Stage == "decrypt" {
-								status = "decrypt"
-							}
-							printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, status, p.Percentage, utils.FormatSpeed(p.SpeedBPS), "")
-						}
-					}
-				}()
-
-				trackPath, err := downloadTrackWithFallback(trackData, meta, albumId, storefront, baseSaveFolder, Codec, covPath, qobuzDesc, lyricAccount, workingAccounts, statusIndex, updateStatus, progressChan, jsonOutput, trackIndexInMeta)
-				close(progressChan)
-
-				if err != nil {
-					core.SharedLock.Lock()
-					core.Counter.Total++
-					errMsg := fmt.Sprintln("下载失败:", err)
-					if jsonOutput {
-						printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "error", 0, "", errMsg)
-					} else if pui != nil {
-						pui.Abort(trackIndexInMeta, strings.TrimSpace(errMsg))
-					}
-					core.Counter.Error++
-					core.SharedLock.Unlock()
-					return
-				}
-
+			// The fix-up and gapless check run outside the download
+			// semaphore. A failed check deletes the file and takes the
+			// semaphore back for the next attempt.
+			wasFixed := false
+			verify := func(trackPath string) error {
 				releaseSem()
-
 				var postDownloadError error
-				wasFixed := false
-				if core.Config.FfmpegFix && trackData.Type != "music-videos" {
-					isAAC := core.Dl_aac && *core.Aac_type == "aac-lc"
-					if !isAAC {
-						var fixErr error
-						wasFixed, fixErr = checkAndReEncodeTrack(trackPath, updateStatus, jsonOutput, albumId, trackIndexInMeta, trackData.Attributes.Name)
-						if fixErr != nil {
-							postDownloadError = fmt.Errorf("修复失败: %w", fixErr)
-						}
+				wasFixed = false
+				if core.Config.FfmpegFix && trackData.Type != "music-videos" && format != "aac-lc" {
+					var fixErr error
+					wasFixed, fixErr = checkAndReEncodeTrack(trackPath, updateStatus, jsonOutput, albumId, trackIndexInMeta, trackData.Attributes.Name)
+					if fixErr != nil {
+						postDownloadError = fmt.Errorf("修复失败: %w", fixErr)
+					}
+				}
+				if postDownloadError == nil && core.Config.Gapless && trackData.Type != "music-videos" {
+					if err := metadata.VerifyGapless(trackPath); err != nil {
+						postDownloadError = errs.Wrap(errs.CodeIntegrityFailed, err, "无缝播放信息校验失败")
 					}
 				}
-
 				if postDownloadError != nil {
 					if jsonOutput {
-						printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "error", 0, "", postDownloadError.Error())
+						printJSONError(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, postDownloadError.Error(), postDownloadError)
 					} else {
 						updateStatus(postDownloadError.Error(), nil)
 					}
-
 					os.Remove(trackPath)
+					semaphore <- struct{}{}
+					semaphoreReleased = false
+				}
+				return postDownloadError
+			}
 
-					if attempt < PostDownloadMaxRetries {
-						continue
-					} else {
-						errMsg := fmt.Sprintln("所有重试均失败:", postDownloadError)
-						if jsonOutput {
-							printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "error", 0, "", errMsg)
-						} else if pui != nil {
-							pui.Abort(trackIndexInMeta, strings.TrimSpace(errMsg))
-						}
+			progressChan := make(chan runv14.ProgressUpdate, 10)
+			go func() {
+				accountName := ""
+				if len(trackAccounts) > 0 {
+					account := &trackAccounts[statusIndex%len(trackAccounts)]
+					accountName = strings.ToUpper(account.Storefront)
+				}
 
-						core.SharedLock.Lock()
-						core.Counter.Total++
-						core.Counter.Error++
-						core.SharedLock.Unlock()
-						return
+				if !jsonOutput && pui != nil {
+					pui.HandleProgress(trackIndexInMeta, progressChan, accountName)
+				} else {
+					for p := range progressChan {
+						status := "progress"
+						if p.Stage == "decrypt" {
+							status = "decrypt"
+						}
+						printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, status, p.Percentage, utils.FormatSpeed(p.SpeedBPS), "")
 					}
 				}
+			}()
+
+			trackPath, err := downloadTrackWithFallback(trackData, meta, albumId, storefront, format, covPath, qobuzDesc, lyricAccount, trackAccounts, trackSources, statusIndex, updateStatus, progressChan, jsonOutput, trackIndexInMeta, verify)
+			close(progressChan)
+			releaseSem()
+
+			if err != nil {
+				logger.Error("track failed", "track", trackIndexInMeta, "trackId", trackData.ID, "err", err)
 				core.SharedLock.Lock()
 				core.Counter.Total++
-				core.Counter.Success++
-				statusMsg := "账号下载完成"
-				if wasFixed {
-					statusMsg = "账号重编码完成"
-				}
+				errMsg := fmt.Sprintln("下载失败:", err)
 				if jsonOutput {
-					printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "complete", 100, "", statusMsg)
+					printJSONError(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, errMsg, err)
 				} else if pui != nil {
-					pui.SetDone(trackIndexInMeta, statusMsg)
+					pui.Abort(trackIndexInMeta, strings.TrimSpace(errMsg))
 				}
+				core.Counter.Error++
+				failed++
 				core.SharedLock.Unlock()
+				core.RecordFailure(err)
 				return
 			}
+
+			core.SharedLock.Lock()
+			core.Counter.Total++
+			core.Counter.Success++
+			if trackData.Type != "music-videos" && trackPath != "" {
+				trackPaths[trackIndexInMeta] = trackPath
+			}
+			statusMsg := "账号下载完成"
+			if wasFixed {
+				statusMsg = "账号重编码完成"
+			}
+			if jsonOutput {
+				printJSON(albumId, trackIndexInMeta, trackData.Attributes.Name, meta.Data[0].Attributes.Name, "complete", 100, "", statusMsg)
+			} else if pui != nil {
+				pui.SetDone(trackIndexInMeta, statusMsg)
+			}
+			core.SharedLock.Unlock()
 		}(trackNum)
 	}
 
@@ -1200,52 +977,204 @@ func Rip(albumId string, storefront string, urlArg_i string, urlRaw string, json
 		pui.Wait()
 		fmt.Println(strings.Repeat("-", 50))
 	}
+
+	j.extras.spread(meta, albumId, finalAlbumFolder, trackPaths, logger)
+	if (core.Config.Nfo || core.Config.AlbumJSON) && !strings.Contains(albumId, "pl.") {
+		if j.sidecar == nil {
+			j.sidecar = sidecarAlbum(meta, albumId, qobuzDesc, logger)
+		}
+		writeSidecars(j.sidecar, finalSingerFolder, finalAlbumFolder, finalArtistDir != "", logger)
+	}
+
+	// Only whole albums count as downloaded; a single song or a partial
+	// selection must not make --artist-filter skip-history skip the album.
+	whole := failed == 0 && !strings.Contains(albumId, "pl.") && len(j.selected) == len(meta.Data[0].Relationships.Tracks.Data)
+	gains := tagLoudness(meta, albumId, format, trackPaths, whole, logger)
+	// A re-run of a recorded album adds a line only for new measurements, and
+	// a playlist or partial download only to keep them.
+	if gains != nil || (whole && !core.History.Recorded(albumId, format)) {
+		entry := history.Entry{
+			AlbumID:    albumId,
+			UPC:        meta.Data[0].Attributes.Upc,
+			Storefront: storefront,
+			Artist:     meta.Data[0].Attributes.ArtistName,
+			Album:      meta.Data[0].Attributes.Name,
+			Format:     format,
+			Tracks:     len(selected),
+			Path:       finalAlbumFolder,
+			Loudness:   gains,
+			Partial:    !whole,
+		}
+		if err := core.History.Add(entry); err != nil {
+			logger.Warn("failed to record download history", "err", err)
+		}
+	}
 	return nil
 }
 
-func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir string, storefront string, meta *structs.AutoGenerated, account *structs.Account, progressChan chan runv14.ProgressUpdate, jsonOutput bool) (string, error) {
-	MVInfo, err := api.GetMVInfoFromAdam(adamID, account, storefront)
+// downloadAlbumExtras saves the artist and album covers, Qobuz PDFs, the
+// animated artwork and credits.txt next to the album, and returns them
+// together with the Qobuz description used when tagging.
+func downloadAlbumExtras(meta *structs.AutoGenerated, albumId, finalSingerFolder, finalAlbumFolder string, jsonOutput bool, logger *slog.Logger) *albumExtras {
+	extras := &albumExtras{singerFolder: finalSingerFolder, albumFolder: finalAlbumFolder}
+	var covPath, qobuzDesc, artistCovPath string
+	var err error
+	if core.Config.SaveArtistCover && !(strings.Contains(albumId, "pl.")) {
+		if len(meta.Data[0].Relationships.Artists.Data) > 0 {
+			artistCovPath, err = metadata.WriteCover(finalSingerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url)
+			if err != nil {
+				logger.Warn("artist cover download failed", "err", err)
+			}
+			extras.add(artistCovPath)
+		}
+	}
+	covPath, err = metadata.WriteCover(finalAlbumFolder, "cover", meta.Data[0].Attributes.Artwork.URL)
 	if err != nil {
-		return "", err
+		logger.Warn("album cover download failed", "err", err)
 	}
+	extras.add(covPath)
 
-	var trackTotal int
-	var trackNum int = 1
-	var index int
-	if meta != nil {
-		trackTotal = len(meta.Data[0].Relationships.Tracks.Data)
-		for i, track := range meta.Data[0].Relationships.Tracks.Data {
-			if adamID == track.ID {
-				index = i
-				trackNum = i + 1
+	var pdfUrls []qobuz.PDFExtra
+	if !strings.Contains(albumId, "pl.") {
+		qobuzDesc, pdfUrls, err = qobuz.GetQobuzExtras(meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name)
+		if err != nil {
+			if jsonOutput {
+				printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("Qobuz元数据获取失败: %v", err))
+			} else {
+				logger.Warn("qobuz metadata lookup failed", "err", err)
 			}
 		}
-		if trackNum == 0 {
-			trackNum = 1
+	}
+
+	if pdfUrls != nil && len(pdfUrls) > 0 {
+		if jsonOutput {
+			printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("正在下载 %d 个 Qobuz PDF...", len(pdfUrls)))
+		} else {
+			logger.Info("downloading qobuz PDFs", "count", len(pdfUrls))
+		}
+		policy := core.RetryPolicy
+		maxAttempts := policy.MaxAttempts()
+		for _, pdf := range pdfUrls {
+			var pdfPath string
+			err := policy.Do(maxAttempts, func(int) error {
+				var err error
+				pdfPath, err = qobuz.DownloadPDF(pdf, finalAlbumFolder)
+				return err
+			}, func(attempt int, err error) {
+				if jsonOutput {
+					printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("PDF下载失败 (尝试 %d/%d), 稍后重试: %s -> %v", attempt, maxAttempts, pdf.URL, err))
+				} else {
+					logger.Warn("PDF download failed, retrying", "attempt", attempt, "maxAttempts", maxAttempts, "url", pdf.URL, "err", err)
+				}
+			})
+
+			if err != nil {
+				if jsonOutput {
+					printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", fmt.Sprintf("PDF下载最终失败: %s -> %v", pdf.URL, err))
+				} else {
+					logger.Warn("PDF download failed", "url", pdf.URL, "err", err)
+				}
+			}
+			extras.add(pdfPath)
 		}
 	}
 
-	var mvSaveName string
-	if meta != nil && trackNum > 0 && trackNum <= len(meta.Data[0].Relationships.Tracks.Data) {
-		mvSaveName = fmt.Sprintf("%02d. %s", trackNum, MVInfo.Data[0].Attributes.Name)
-	} else {
-		mvSaveName = MVInfo.Data[0].Attributes.Name
-		trackNum = 1
+	if core.Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
+		motionvideoUrlSquare, err := parser.ExtractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video)
+		if err == nil {
+			exists, _ := utils.FileExists(filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"))
+			if !exists {
+				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlSquare, "-c", "copy", filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"))
+				_ = cmd.Run()
+			}
+		}
+
+		if core.Config.EmbyAnimatedArtwork {
+			cmd3 := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", filepath.Join(finalAlbumFolder, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(finalAlbumFolder, "folder.jpg"))
+			_ = cmd3.Run()
+		}
+
+		motionvideoUrlTall, err := parser.ExtractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video)
+		if err == nil {
+			exists, _ := utils.FileExists(filepath.Join(finalAlbumFolder, "tall_animated_artwork.mp4"))
+			if !exists {
+				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", motionvideoUrlTall, "-c", "copy", filepath.Join(finalAlbumFolder, "tall_animated_artwork.mp4"))
+				_ = cmd.Run()
+			}
+		}
+	}
+	for _, name := range []string{"square_animated_artwork.mp4", "tall_animated_artwork.mp4"} {
+		if ok, _ := utils.FileExists(filepath.Join(finalAlbumFolder, name)); ok {
+			extras.add(filepath.Join(finalAlbumFolder, name))
+		}
+	}
+	if core.Config.CreditsFile && !strings.Contains(albumId, "pl.") {
+		creditsPath, err := writeCreditsFile(meta, finalAlbumFolder)
+		if err != nil {
+			logger.Warn("credits file failed", "err", err)
+		}
+		extras.add(creditsPath)
+	}
+	if core.Config.EmbyAnimatedArtwork {
+		if ok, _ := utils.FileExists(filepath.Join(finalAlbumFolder, "folder.jpg")); ok {
+			extras.add(filepath.Join(finalAlbumFolder, "folder.jpg"))
+		}
 	}
+	extras.covPath, extras.qobuzDesc = covPath, qobuzDesc
+	return extras
+}
 
-	sanitizedMvSaveName := core.ForbiddenNames.ReplaceAllString(mvSaveName, "_")
-	filenameWithExt := fmt.Sprintf("%s.mp4", sanitizedMvSaveName)
+// mvTarget is the folder and path a music video called saveName is saved
+// to. The folders of an album MV come from albumDirs and are kept; a music
+// video of its own only has an artist folder, shortened like an album's.
+func mvTarget(baseSaveDir, artistDir, albumDir, discDir, saveName string) (string, string) {
+	filenameWithExt := fmt.Sprintf("%s.mp4", core.Sanitizer.Name(saveName))
+	if albumDir == "" {
+		artistDir, _, _ = utils.EnsureSafePath(baseSaveDir, artistDir, "", discDir, filenameWithExt)
+	}
+	return albumPath(baseSaveDir, artistDir, albumDir, discDir, filenameWithExt)
+}
 
-	finalArtistDir, finalAlbumDir, finalFilename := utils.EnsureSafePath(baseSaveDir, artistDir, albumDir, filenameWithExt)
+// mvName is the file name of the music video adamID called name, and its
+// position in meta. Album MVs are numbered like songs: per disc inside a disc
+// folder on multi-disc albums, 1-01 with the flat layout. Without meta the
+// video is not numbered.
+func mvName(meta *structs.AutoGenerated, adamID, name string) (string, int) {
+	if meta == nil {
+		return name, 1
+	}
+	trackNum, index := 1, 0
+	for i, track := range meta.Data[0].Relationships.Tracks.Data {
+		if adamID == track.ID {
+			index = i
+			trackNum = i + 1
+		}
+	}
+	number := fmt.Sprintf("%02d", trackNum)
+	if core.Config.DiscLayout != "none" && discCount(meta, meta.Data[0].ID) > 1 {
+		t := meta.Data[0].Relationships.Tracks.Data[index]
+		number = fmt.Sprintf("%02d", t.Attributes.TrackNumber)
+		if core.Config.DiscLayout == "flat" {
+			number = fmt.Sprintf("%d-%02d", t.Attributes.DiscNumber, t.Attributes.TrackNumber)
+		}
+	}
+	return fmt.Sprintf("%s. %s", number, name), trackNum
+}
 
-	var finalSingerFolder string
-	if finalArtistDir != "" {
-		finalSingerFolder = filepath.Join(baseSaveDir, finalArtistDir)
-	} else {
-		finalSingerFolder = baseSaveDir
+func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir, discDir string, storefront string, meta *structs.AutoGenerated, account *structs.Account, progressChan chan runv14.ProgressUpdate, jsonOutput bool) (string, error) {
+	MVInfo, err := api.GetMVInfoFromAdam(adamID, account, storefront)
+	if err != nil {
+		return "", err
 	}
-	finalAlbumFolder := filepath.Join(finalSingerFolder, finalAlbumDir)
-	mvOutPath := filepath.Join(finalAlbumFolder, finalFilename)
+
+	var trackTotal int
+	if meta != nil {
+		trackTotal = len(meta.Data[0].Relationships.Tracks.Data)
+	}
+	mvSaveName, trackNum := mvName(meta, adamID, MVInfo.Data[0].Attributes.Name)
+	index := trackNum - 1
+
+	finalAlbumFolder, mvOutPath := mvTarget(baseSaveDir, artistDir, albumDir, discDir, mvSaveName)
 	os.MkdirAll(finalAlbumFolder, os.ModePerm)
 	exists, _ := utils.FileExists(mvOutPath)
 	if exists {
@@ -1257,7 +1186,7 @@ func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir string, storef
 		return "", fmt.Errorf("获取MV播放列表失败: %w", err)
 	}
 	if mvm3u8url == "" {
-		return "", errors.New("media-user-token may be wrong or expired")
+		return "", errs.New(errs.CodeTokenInvalid, "media-user-token may be wrong or expired")
 	}
 
 	vidPath := filepath.Join(finalAlbumFolder, fmt.Sprintf("%s_vid.mp4", adamID))
@@ -1324,7 +1253,7 @@ func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir string, storef
 		if meta.Data[0].Type == "playlists" && !core.Config.UseSongInfoForPlaylist {
 			tags = append(tags, "disk=1/1", fmt.Sprintf("album=%s", meta.Data[0].Attributes.Name), fmt.Sprintf("track=%d", trackNum), fmt.Sprintf("tracknum=%d/%d", trackNum, trackTotal), fmt.Sprintf("album_artist=%s", meta.Data[0].Attributes.ArtistName), fmt.Sprintf("performer=%s", meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName), fmt.Sprintf("copyright=%s", meta.Data[0].Attributes.Copyright), fmt.Sprintf("UPC=%s", meta.Data[0].Attributes.Upc))
 		} else {
-			tags = append(tags, fmt.Sprintf("album=%s", meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName), fmt.Sprintf("disk=%d/%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.DiscNumber, meta.Data[0].Relationships.Tracks.Data[trackTotal-1].Attributes.DiscNumber), fmt.Sprintf("track=%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber), fmt.Sprintf("tracknum=%d/%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber, meta.Data[0].Attributes.TrackCount), fmt.Sprintf("album_artist=%s", meta.Data[0].Attributes.ArtistName), fmt.Sprintf("performer=%s", meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName), fmt.Sprintf("copyright=%s", meta.Data[0].Attributes.Copyright), fmt.Sprintf("UPC=%s", meta.Data[0].Attributes.Upc))
+			tags = append(tags, fmt.Sprintf("album=%s", meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName), fmt.Sprintf("disk=%d/%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.DiscNumber, meta.Data[0].Relationships.Tracks.Data[trackTotal-1].Attributes.DiscNumber), fmt.Sprintf("track=%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber), fmt.Sprintf("tracknum=%d/%d", meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber, meta.Data[0].Attributes.TrackCount), fmt.Sprintf("album_artist=%s", albumArtist(meta, meta.Data[0].Attributes.ArtistName)), fmt.Sprintf("performer=%s", meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName), fmt.Sprintf("copyright=%s", meta.Data[0].Attributes.Copyright), fmt.Sprintf("UPC=%s", meta.Data[0].Attributes.Upc))
 		}
 	} else {
 		tags = append(tags, fmt.Sprintf("album=%s", MVInfo.Data[0].Attributes.AlbumName), fmt.Sprintf("disk=%d", MVInfo.Data[0].Attributes.DiscNumber), fmt.Sprintf("track=%d", MVInfo.Data[0].Attributes.TrackNumber), fmt.Sprintf("tracknum=%d", MVInfo.Data[0].Attributes.TrackNumber), fmt.Sprintf("performer=%s", MVInfo.Data[0].Attributes.ArtistName))
@@ -1333,10 +1262,12 @@ func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir string, storef
 	var covPath string
 	if true {
 		thumbURL := MVInfo.Data[0].Attributes.Artwork.URL
-		baseThumbName := core.ForbiddenNames.ReplaceAllString(mvSaveName, "_") + "_thumbnail"
+		baseThumbName := core.Sanitizer.Name(mvSaveName) + "_thumbnail"
 		covPath, err = metadata.WriteCover(finalAlbumFolder, baseThumbName, thumbURL)
 		if err == nil {
 			tags = append(tags, fmt.Sprintf("cover=%s", covPath))
+		} else {
+			slog.Warn("MV thumbnail download failed", "mv", adamID, "err", err)
 		}
 	}
 
@@ -1352,6 +1283,13 @@ func MvDownloader(adamID string, baseSaveDir, artistDir, albumDir string, storef
 	if err := muxCmd.Run(); err != nil {
 		return "", err
 	}
+	if meta != nil {
+		if items := compilationItems(meta); len(items) > 0 {
+			if err := metadata.WriteItems(mvOutPath, items); err != nil {
+				slog.Warn("compilation atom failed", "mv", adamID, "err", err)
+			}
+		}
+	}
 	defer os.Remove(vidPath)
 	defer os.Remove(audPath)
 	if covPath != "" {
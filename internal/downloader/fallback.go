@@ -0,0 +1,191 @@
+package downloader
+
+import (
+	"fmt"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/errs"
+	"main/internal/metadata"
+	"main/internal/parser"
+	"main/internal/utils"
+	"main/utils/structs"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultCodecFallback is used when config.yaml has no codec-fallback list.
+var defaultCodecFallback = []string{"atmos", "dolby-audio", "alac-hires", "alac", "aac", "aac-lc"}
+
+// albumStreams caches the stream of the best track per album and output
+// format, so the album folder is the same for every track. Failures are not
+// cached.
+var albumStreams sync.Map
+
+type albumStreamValue struct{ codec, raw string }
+
+// codecLabels maps a chain codec to the {Codec} value used in file names.
+var codecLabels = map[string]string{
+	"atmos":        "ATMOS",
+	"dolby-audio":  "AC3",
+	"alac-hires":   "ALAC",
+	"alac":         "ALAC",
+	"aac":          "AAC",
+	"aac-binaural": "AAC",
+	"aac-downmix":  "AAC",
+	"aac-lc":       "AAC",
+}
+
+func codecLabel(codec string) string {
+	if label, ok := codecLabels[codec]; ok {
+		return label
+	}
+	return strings.ToUpper(codec)
+}
+
+// requestedCodec is the codec an output format asks for on this track.
+func requestedCodec(track structs.TrackData, format string) string {
+	if format != "alac" {
+		return format
+	}
+	if utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") && *core.Alac_max > 48000 {
+		return "alac-hires"
+	}
+	return "alac"
+}
+
+// codecChain returns the codecs to try for track, best first. The chain starts
+// at the requested codec and continues with the entries after it in
+// codec-fallback; a codec that is not in the list is tried on its own.
+func codecChain(track structs.TrackData, format string) []string {
+	order := core.Config.CodecFallback
+	if len(order) == 0 {
+		order = defaultCodecFallback
+	}
+	requested := requestedCodec(track, format)
+	i := slices.Index(order, requested)
+	if i < 0 {
+		return []string{requested}
+	}
+	return order[i:]
+}
+
+// selectCodec walks chain, best first, and returns the first codec the master
+// playlist hls offers, with its variant playlist and raw quality. The master
+// is fetched once for the whole chain. aac-lc is always available and has no
+// variant; needDlAacLc is set for it instead.
+func selectCodec(chain []string, hls string) (needDlAacLc bool, obtained, streamUrl, rawQuality string, err error) {
+	var master *parser.Master
+	var lastErr error
+	for _, codec := range chain {
+		if codec == "aac-lc" {
+			return true, codec, "", "", nil
+		}
+		if hls == "" {
+			lastErr = errs.New(errs.CodeCodecUnavailable, codec+" unavailable: no enhanced HLS")
+			continue
+		}
+		if master == nil {
+			if master, err = parser.FetchMaster(hls); err != nil {
+				return false, "", "", "", errs.Wrap(errs.CodeManifestMissing, err, "failed to extract info from manifest")
+			}
+		}
+		u, quality, actual, err := master.SelectVariant(codec)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return false, actual, u, quality, nil
+	}
+	return false, "", "", "", errs.Wrap(errs.CodeCodecUnavailable, lastErr, fmt.Sprintf("no codec of %s available", strings.Join(chain, " > ")))
+}
+
+// trackQuality is the {Quality} of a track saved in codec, from the raw
+// quality selectCodec returned for it.
+func trackQuality(codec, rawQuality string) string {
+	switch codec {
+	case "aac-lc":
+		return "256kbps"
+	case "atmos":
+		var kbps int
+		fmt.Sscanf(rawQuality, "%d kbps", &kbps)
+		if kbps > 2000 {
+			kbps -= 2000
+		}
+		return fmt.Sprintf("%dkbps", kbps)
+	case "dolby-audio":
+		return strings.ReplaceAll(rawQuality, " ", "")
+	}
+	return formatAudioQuality(rawQuality)
+}
+
+// albumCodec is the album-level {Codec} of an album saved in format: the
+// codec its best track is actually saved in. It is the codec format asks for
+// when the manifest of that track cannot be read.
+func albumCodec(meta *structs.AutoGenerated, albumId, storefront, format string, account *structs.Account) string {
+	if codec, _, ok := albumStream(meta, albumId, storefront, format, account); ok {
+		return codecLabel(codec)
+	}
+	return formatCodec(format)
+}
+
+// albumStream is the codec and raw quality selectCodec picks for the best
+// track of an album saved in format: its first hi-res track for alac, its
+// first song otherwise. ok is false when the stream could not be resolved.
+func albumStream(meta *structs.AutoGenerated, albumId, storefront, format string, account *structs.Account) (codec, raw string, ok bool) {
+	key := albumId + "#" + format
+	if v, ok := albumStreams.Load(key); ok {
+		s := v.(albumStreamValue)
+		return s.codec, s.raw, true
+	}
+	var best *structs.TrackData
+	for i, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.Type == "music-videos" {
+			continue
+		}
+		if best == nil {
+			best = &meta.Data[0].Relationships.Tracks.Data[i]
+		}
+		if format == "alac" && utils.Contains(t.Attributes.AudioTraits, "hi-res-lossless") {
+			best = &meta.Data[0].Relationships.Tracks.Data[i]
+			break
+		}
+	}
+	if best == nil || account == nil {
+		return "", "", false
+	}
+	catalogId, catalogStorefront := catalogEntry(*best, storefront)
+	manifest, err := api.GetInfoFromAdam(catalogId, account, catalogStorefront)
+	if err != nil {
+		return "", "", false
+	}
+	_, codec, _, raw, err = selectCodec(codecChain(*best, format), manifest.Attributes.ExtendedAssetUrls.EnhancedHls)
+	if err != nil {
+		return "", "", false
+	}
+	albumStreams.Store(key, albumStreamValue{codec, raw})
+	return codec, raw, true
+}
+
+// codecItems record the codec and quality a track was saved in, which
+// reorganize names the file by later.
+func codecItems(codec, quality string) []metadata.Item {
+	return []metadata.Item{
+		{Name: "----:SOURCE_CODEC", Value: codecLabel(codec)},
+		{Name: "----:SOURCE_QUALITY", Value: quality},
+	}
+}
+
+// PrintFallbackSummary lists every track that was saved in a fallback codec.
+func PrintFallbackSummary() {
+	core.SharedLock.Lock()
+	fallbacks := slices.Clone(core.Fallbacks)
+	core.SharedLock.Unlock()
+	if len(fallbacks) == 0 {
+		return
+	}
+	fmt.Printf("\n编码回退 (%d):\n", len(fallbacks))
+	for _, f := range fallbacks {
+		fmt.Printf("  [%s] %s: %s -> %s\n", f.AlbumID, f.TrackName, f.Requested, f.Obtained)
+	}
+}
@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"errors"
+	"log/slog"
+	"main/internal/core"
+	"main/internal/metadata"
+)
+
+// sourceGapless reads the priming and remainder of a freshly decrypted
+// track. The decrypted file still has the init segment of the stream, so
+// its edit list is the one the source was encoded with. It returns nil with
+// gapless off or when the stream trims no samples.
+func sourceGapless(path string, logger *slog.Logger) *metadata.Gapless {
+	if !core.Config.Gapless {
+		return nil
+	}
+	g, ok, err := metadata.ReadGapless(path)
+	if err != nil {
+		logger.Warn("gapless info unavailable", "err", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return &g
+}
+
+// gaplessItems is the iTunSMPB item for g.
+func gaplessItems(g *metadata.Gapless) []metadata.Item {
+	if g == nil {
+		return nil
+	}
+	return []metadata.Item{{Name: "----:iTunSMPB", Value: g.SMPB()}}
+}
+
+// restoreEditList writes the edit list of g again when tagging left the
+// file with one that no longer agrees with iTunSMPB. When that fails the
+// iTunSMPB item is removed, so the file keeps playing as before without
+// gapless info that does not match it, and the error is returned.
+func restoreEditList(path string, g *metadata.Gapless) error {
+	if g == nil || metadata.VerifyGapless(path) == nil {
+		return nil
+	}
+	err := metadata.WriteEditList(path, *g)
+	if err == nil {
+		err = metadata.VerifyGapless(path)
+	}
+	if err != nil {
+		if rmErr := metadata.WriteItems(path, []metadata.Item{{Name: "----:iTunSMPB"}}); rmErr != nil {
+			return errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package downloader
+
+import (
+	"log/slog"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/metadata"
+	"main/utils/structs"
+)
+
+// fetchSecondaryNames fetches the album or playlist again in
+// secondary-language and keeps the album and track names it returns.
+// Tracks are matched by ID; tracks the second fetch does not have keep
+// empty secondary names.
+func fetchSecondaryNames(meta *structs.AutoGenerated, albumId, storefront string, account *structs.Account, logger *slog.Logger) {
+	language := core.Config.SecondaryLanguage
+	if language == "" || language == core.Config.Language {
+		return
+	}
+	other, err := api.GetMetaInLanguage(albumId, account, storefront, language)
+	if err != nil {
+		logger.Warn("secondary language metadata unavailable", "language", language, "err", err)
+		return
+	}
+	a := other.Data[0].Attributes
+	meta.Data[0].Secondary = structs.LocalizedNames{Name: a.Name, ArtistName: a.ArtistName}
+	byID := make(map[string]structs.TrackData)
+	for _, t := range other.Data[0].Relationships.Tracks.Data {
+		byID[t.ID] = t
+	}
+	tracks := meta.Data[0].Relationships.Tracks.Data
+	for i := range tracks {
+		if t, ok := byID[tracks[i].ID]; ok {
+			tracks[i].Secondary = structs.LocalizedNames{
+				Name:         t.Attributes.Name,
+				ArtistName:   t.Attributes.ArtistName,
+				AlbumName:    t.Attributes.AlbumName,
+				ComposerName: t.Attributes.ComposerName,
+			}
+		}
+	}
+}
+
+// localized returns the name in the language chosen by useSecondary and the
+// name in the other one, which is "" when it is not known or the same.
+func localized(primary, secondary string, useSecondary bool) (name, other string) {
+	if secondary == "" || secondary == primary {
+		return primary, ""
+	}
+	if useSecondary {
+		return secondary, primary
+	}
+	return primary, secondary
+}
+
+// tagLocalized is localized for the tags: the other name is kept when it is
+// the same, so reorganize can tell a name that is the same in both languages
+// from one that was never fetched.
+func tagLocalized(primary, secondary string, useSecondary bool) (name, other string) {
+	if secondary == "" {
+		return primary, ""
+	}
+	if useSecondary {
+		return secondary, primary
+	}
+	return primary, secondary
+}
+
+// tagNames are the names written to the title, album, artist, album artist
+// and composer tags of a track in tag-language, and the same names in the
+// other language.
+type tagNames struct {
+	title, album, artist, albumArtist, composer                          string
+	otherTitle, otherAlbum, otherArtist, otherAlbumArtist, otherComposer string
+}
+
+// trackTagNames names a track. The artist is the album artist, except on
+// compilations, where it is the track artist and the album artist is
+// compilation-artist.
+func trackTagNames(meta *structs.AutoGenerated, track structs.TrackData) tagNames {
+	secondary := core.Config.TagLanguage == "secondary"
+	var n tagNames
+	n.title, n.otherTitle = tagLocalized(track.Attributes.Name, track.Secondary.Name, secondary)
+	n.album, n.otherAlbum = tagLocalized(meta.Data[0].Attributes.Name, meta.Data[0].Secondary.Name, secondary)
+	n.albumArtist, n.otherAlbumArtist = tagLocalized(meta.Data[0].Attributes.ArtistName, meta.Data[0].Secondary.ArtistName, secondary)
+	n.artist, n.otherArtist = n.albumArtist, n.otherAlbumArtist
+	n.composer, n.otherComposer = tagLocalized(track.Attributes.ComposerName, track.Secondary.ComposerName, secondary)
+	if isCompilation(meta) {
+		n.artist, n.otherArtist = tagLocalized(track.Attributes.ArtistName, track.Secondary.ArtistName, secondary)
+		if artist := albumArtist(meta, n.albumArtist); artist != n.albumArtist {
+			n.albumArtist, n.otherAlbumArtist = artist, ""
+		}
+	}
+	return n
+}
+
+// languageItems store the names in the other language: in the iTunes sort
+// atoms sonm, soal, soar, soaa and soco with secondary-language-tags
+// "sort", or in freeform ORIGINALTITLE, ORIGINALALBUM, ORIGINALARTIST and
+// ORIGINALCOMPOSER items with "custom".
+func languageItems(n tagNames) []metadata.Item {
+	var items []metadata.Item
+	add := func(sortAtom, custom, value string) {
+		if value == "" {
+			return
+		}
+		if core.Config.SecondaryLanguageTags == "custom" {
+			items = append(items, metadata.Item{Name: "----:" + custom, Value: value})
+		} else {
+			items = append(items, metadata.Item{Name: sortAtom, Value: value})
+		}
+	}
+	add("sonm", "ORIGINALTITLE", n.otherTitle)
+	add("soal", "ORIGINALALBUM", n.otherAlbum)
+	add("soar", "ORIGINALARTIST", n.otherArtist)
+	if core.Config.SecondaryLanguageTags != "custom" {
+		add("soaa", "", n.otherAlbumArtist)
+	}
+	add("soco", "ORIGINALCOMPOSER", n.otherComposer)
+	return items
+}
@@ -0,0 +1,195 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/parser"
+	"main/utils/structs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// matrixTrack is one row of the --debug quality matrix.
+type matrixTrack struct {
+	TrackNum    int                 `json:"trackNum"`
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Type        string              `json:"type"`
+	Formats     parser.Formats      `json:"formats"`
+	Accounts    map[string][]string `json:"accounts,omitempty"`    // format key -> accounts that offer it
+	Storefronts map[string][]string `json:"storefronts,omitempty"` // format key -> storefronts of those accounts
+	Errors      map[string]string   `json:"errors,omitempty"`      // account -> why it could not be probed
+}
+
+// QualityMatrix is the --debug report for one album or playlist.
+type QualityMatrix struct {
+	Status             string            `json:"status"`
+	AlbumID            string            `json:"albumId"`
+	AlbumName          string            `json:"albumName"`
+	Artist             string            `json:"artist"`
+	Storefront         string            `json:"storefront"`
+	Accounts           []string          `json:"accounts"`
+	AccountStorefronts map[string]string `json:"accountStorefronts"` // account -> storefront it was probed in
+	Tracks             []matrixTrack     `json:"tracks"`
+}
+
+// buildQualityMatrix probes every track with every account that may decrypt
+// this album. Identical manifests are only fetched once.
+func buildQualityMatrix(meta *structs.AutoGenerated, albumId, storefront string) *QualityMatrix {
+	m := &QualityMatrix{
+		Status:             "quality-matrix",
+		AlbumID:            albumId,
+		AlbumName:          meta.Data[0].Attributes.Name,
+		Artist:             meta.Data[0].Attributes.ArtistName,
+		Storefront:         storefront,
+		AccountStorefronts: make(map[string]string),
+	}
+
+	var accounts []structs.Account
+	for _, acc := range core.Config.Accounts {
+		if !core.Config.GlobalDecryption && strings.ToLower(acc.Storefront) != strings.ToLower(storefront) {
+			continue
+		}
+		accounts = append(accounts, acc)
+		m.Accounts = append(m.Accounts, acc.Name)
+		m.AccountStorefronts[acc.Name] = strings.ToUpper(acc.Storefront)
+	}
+
+	probed := make(map[string]*parser.Formats)
+	for i, track := range meta.Data[0].Relationships.Tracks.Data {
+		row := matrixTrack{
+			TrackNum:    i + 1,
+			ID:          track.ID,
+			Name:        track.Attributes.Name,
+			Type:        track.Type,
+			Accounts:    make(map[string][]string),
+			Storefronts: make(map[string][]string),
+			Errors:      make(map[string]string),
+		}
+		if track.Type == "music-videos" {
+			m.Tracks = append(m.Tracks, row)
+			continue
+		}
+
+		for _, acc := range accounts {
+			manifest, err := api.GetInfoFromAdam(track.ID, &acc, acc.Storefront)
+			if err != nil {
+				row.Errors[acc.Name] = err.Error()
+				continue
+			}
+			hls := manifest.Attributes.ExtendedAssetUrls.EnhancedHls
+			var formats *parser.Formats
+			if hls == "" {
+				// No enhanced HLS: only the 256 kbps AAC-LC web stream is offered.
+				formats = &parser.Formats{AAC: parser.Format{Available: true, Bitrate: 256, Quality: "256 kbps"}}
+			} else if cached, ok := probed[hls]; ok {
+				formats = cached
+			} else {
+				formats, err = parser.ProbeFormats(hls)
+				if err != nil {
+					slog.Debug("probe formats failed", "album", albumId, "trackId", track.ID, "account", acc, "err", err)
+					row.Errors[acc.Name] = err.Error()
+					continue
+				}
+				probed[hls] = formats
+			}
+
+			row.Formats.Merge(formats)
+			for _, name := range parser.FormatNames {
+				if formats.Get(name).Available {
+					row.Accounts[name] = append(row.Accounts[name], acc.Name)
+					if sf := strings.ToUpper(acc.Storefront); !slices.Contains(row.Storefronts[name], sf) {
+						row.Storefronts[name] = append(row.Storefronts[name], sf)
+					}
+				}
+			}
+		}
+		m.Tracks = append(m.Tracks, row)
+	}
+	return m
+}
+
+// printQualityMatrix prints the matrix as a table, or as JSON with
+// --json-output, and appends it to --debug-json when set.
+func printQualityMatrix(m *QualityMatrix, jsonOutput bool) error {
+	if core.Debug_json != "" {
+		out, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(core.Debug_json, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(out, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		out, _ := json.Marshal(m)
+		fmt.Println(string(out))
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"", "Track Name", "AAC", "Lossless", "Hi-Res", "Atmos", "Dolby Audio"})
+	table.SetAutoWrapText(false)
+	table.SetRowLine(true)
+	accounts := make([]string, len(m.Accounts))
+	for i, name := range m.Accounts {
+		accounts[i] = fmt.Sprintf("%s (%s)", name, m.AccountStorefronts[name])
+	}
+	table.SetCaption(true, fmt.Sprintf("Storefront: %s. Accounts: %s. Formats without an account list are offered by every account.", strings.ToUpper(m.Storefront), strings.Join(accounts, ", ")))
+	for _, row := range m.Tracks {
+		cells := []string{fmt.Sprint(row.TrackNum), row.Name}
+		if row.Type == "music-videos" {
+			cells = append(cells, "MV", "", "", "", "")
+			table.Append(cells)
+			continue
+		}
+		for _, name := range parser.FormatNames {
+			cells = append(cells, matrixCell(row, name, len(m.Accounts)))
+		}
+		table.Append(cells)
+	}
+	table.Render()
+
+	for _, row := range m.Tracks {
+		for acc, msg := range row.Errors {
+			fmt.Printf("%02d. %s [%s]: %s\n", row.TrackNum, row.Name, acc, msg)
+		}
+	}
+	return nil
+}
+
+func matrixCell(row matrixTrack, name string, accountTotal int) string {
+	f := row.Formats.Get(name)
+	if !f.Available {
+		return "-"
+	}
+	cell := f.Quality
+	if f.Verified {
+		cell += " [REAL]"
+	}
+	if name == "lossless" || name == "hiRes" {
+		cell = fmt.Sprintf("%s\n%d kbps", cell, f.Bitrate)
+	}
+	if accs := row.Accounts[name]; len(accs) < accountTotal {
+		cell += "\n(" + strings.Join(accs, ", ") + ")"
+	}
+	if sfs := row.Storefronts[name]; len(sfs) > 0 {
+		cell += "\n[" + strings.Join(sfs, ", ") + "]"
+	}
+	return cell
+}
@@ -0,0 +1,247 @@
+package downloader
+
+import (
+	"fmt"
+	"log/slog"
+	"main/internal/classical"
+	"main/internal/core"
+	"main/internal/naming"
+	"main/internal/routing"
+	"main/internal/utils"
+	"main/utils/structs"
+	"path/filepath"
+	"strings"
+)
+
+// albumQualities caches the album-level quality per album and output format.
+// albumQuality is the album-level {Quality} of an album saved in format: the
+// quality of the stream its best track is saved in. raw is the raw quality of
+// that stream, which routing classifies the album by. Without it the quality
+// is guessed from the audio traits.
+func albumQuality(meta *structs.AutoGenerated, albumId, storefront, format string, account *structs.Account) (quality, raw string) {
+	if codec, raw, ok := albumStream(meta, albumId, storefront, format, account); ok {
+		return trackQuality(codec, raw), raw
+	}
+	switch {
+	case format == "atmos":
+		return "Dolby Atmos", ""
+	case isAacFormat(format):
+		return "256kbps", ""
+	}
+
+	quality = "AAC"
+	for _, track := range meta.Data[0].Relationships.Tracks.Data {
+		if utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+			return "Hi-Res Lossless", ""
+		}
+		if utils.Contains(track.Attributes.AudioTraits, "lossless") {
+			quality = "Lossless"
+		}
+	}
+	return quality, ""
+}
+
+// albumTag is the album-level {Tag}: the Apple Digital Master choice when
+// any track is a master, and the explicit or clean choice when any track
+// carries that rating.
+func albumTag(meta *structs.AutoGenerated) string {
+	hasMaster, hasExplicit, hasClean := false, false, false
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		hasMaster = hasMaster || t.Attributes.IsAppleDigitalMaster
+		hasExplicit = hasExplicit || t.Attributes.ContentRating == "explicit"
+		hasClean = hasClean || t.Attributes.ContentRating == "clean"
+	}
+	var tags []string
+	if hasMaster && core.Config.AppleMasterChoice != "" {
+		tags = append(tags, core.Config.AppleMasterChoice)
+	}
+	if hasExplicit && core.Config.ExplicitChoice != "" {
+		tags = append(tags, core.Config.ExplicitChoice)
+	} else if hasClean && core.Config.CleanChoice != "" {
+		tags = append(tags, core.Config.CleanChoice)
+	}
+	return strings.Join(tags, " ")
+}
+
+// albumNameFields are the naming fields every file of an album saved in
+// format shares: the album fields with the album-level quality, codec and
+// tag.
+func albumNameFields(meta *structs.AutoGenerated, albumId, storefront, format string, account *structs.Account) naming.Fields {
+	quality, _ := albumQuality(meta, albumId, storefront, format, account)
+	return albumFields(meta, albumId, quality, albumCodec(meta, albumId, storefront, format, account), albumTag(meta))
+}
+
+// longestTrack is the track of the album in meta with the longest title.
+func longestTrack(meta *structs.AutoGenerated) structs.TrackData {
+	longest := meta.Data[0].Relationships.Tracks.Data[0]
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if len(t.Attributes.Name) > len(longest.Attributes.Name) {
+			longest = t
+		}
+	}
+	return longest
+}
+
+// albumDirs returns the artist and album folder names of an album in layout,
+// shortened so that the longest file name any of its tracks can get still
+// fits the path limit. longest are the song fields of its track with the
+// longest title. Tracks, covers and music videos of an album all take their
+// folders from here, so a long file name never sends one of them to a
+// differently shortened folder.
+func albumDirs(layout routing.Layout, album, longest naming.Fields) (artistDir, albumDir string) {
+	singer, name := folderNames(layout, album)
+	longest.TrackNumber, longest.DiscNumber = 99, max(longest.DiscCount, 1)
+	longest.SongNumer = "99"
+	if core.Config.DiscLayout == "flat" {
+		longest.SongNumer = longest.DiscTrack()
+	}
+	longest.Quality, longest.Codec = "24B-192.0kHz", "ATMOS"
+	longest.Tag = core.Config.AppleMasterChoice + " " + core.Config.ExplicitChoice
+	fileName := renderName(layout.SongFileFormat, longest) + ".m4a"
+	artistDir, albumDir, _ = utils.EnsureSafePath(layout.Root, singer, name, discFolderName(longest.DiscCount, longest.DiscNumber), fileName)
+	return artistDir, albumDir
+}
+
+// albumPath is the folder of disc discDir in the album folders from
+// albumDirs under root, and the path of fileName in it. Only fileName is
+// shortened to fit the path limit.
+func albumPath(root, artistDir, albumDir, discDir, fileName string) (folder, path string) {
+	_, _, fileName = utils.EnsureSafePath(root, artistDir, albumDir, discDir, fileName)
+	folder = filepath.Join(root, artistDir, albumDir, discDir)
+	return folder, filepath.Join(folder, fileName)
+}
+
+// albumFields are the naming fields of an album or playlist saved with the
+// given album-level quality, codec and tag.
+func albumFields(meta *structs.AutoGenerated, albumId, quality, codec, tag string) naming.Fields {
+	attrs := meta.Data[0].Attributes
+	secondary := core.Config.FolderLanguage == "secondary"
+	albumName, albumNameAlt := localized(attrs.Name, meta.Data[0].Secondary.Name, secondary)
+	artistName, artistNameAlt := localized(attrs.ArtistName, meta.Data[0].Secondary.ArtistName, secondary)
+	f := naming.Fields{
+		AlbumId:       albumId,
+		AlbumName:     core.LimitString(albumName),
+		ArtistName:    core.LimitString(artistName),
+		AlbumNameAlt:  core.LimitString(albumNameAlt),
+		ArtistNameAlt: core.LimitString(artistNameAlt),
+		ReleaseDate:   attrs.ReleaseDate,
+		UPC:           attrs.Upc,
+		RecordLabel:   attrs.RecordLabel,
+		Copyright:     attrs.Copyright,
+		Quality:       quality,
+		Codec:         codec,
+		Tag:           tag,
+	}
+	if len(attrs.ReleaseDate) >= 4 {
+		f.ReleaseYear = attrs.ReleaseDate[:4]
+	}
+	if len(attrs.GenreNames) > 0 {
+		f.Genre = attrs.GenreNames[0]
+	}
+	for _, a := range meta.Data[0].Relationships.Artists.Data {
+		f.Artists = append(f.Artists, a.Attributes.Name)
+	}
+	f.AlbumComposer = core.LimitString(classical.AlbumComposer(meta.Data[0].Relationships.Tracks.Data))
+	f.Compilation = isCompilation(meta)
+	f.AlbumArtist = core.LimitString(albumArtist(meta, artistName))
+
+	if strings.Contains(albumId, "pl.") {
+		f.PlaylistId = albumId
+		f.PlaylistName = f.AlbumName
+		f.ArtistName = "Apple Music"
+		f.ArtistNameAlt = ""
+		f.AlbumArtist = "Apple Music"
+		f.UrlArtistName = "Apple Music"
+		return f
+	}
+	f.UrlArtistName = f.ArtistName
+	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
+		f.ArtistId = meta.Data[0].Relationships.Artists.Data[0].ID
+	}
+	if core.UrlArtistName != "" {
+		f.UrlArtistName = core.LimitString(core.UrlArtistName)
+		f.ArtistId = core.UrlArtistId
+	}
+	return f
+}
+
+// songFields adds the fields of one track to the album fields.
+func songFields(f naming.Fields, track structs.TrackData, meta *structs.AutoGenerated) naming.Fields {
+	f.SongId = track.ID
+	songName, songNameAlt := localized(track.Attributes.Name, track.Secondary.Name, core.Config.FolderLanguage == "secondary")
+	f.SongName = core.LimitString(songName)
+	f.SongNameAlt = core.LimitString(songNameAlt)
+	f.SongArtist = track.Attributes.ArtistName
+	f.Composer = track.Attributes.ComposerName
+	f.SongNumer = fmt.Sprintf("%02d", track.Attributes.TrackNumber)
+	f.TrackNumber = track.Attributes.TrackNumber
+	f.DiscNumber = track.Attributes.DiscNumber
+	f.DiscCount = discCount(meta, f.AlbumId)
+	f.TrackCount = 0
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if f.DiscCount == 1 || t.Attributes.DiscNumber == track.Attributes.DiscNumber {
+			f.TrackCount++
+		}
+	}
+	if core.Config.DiscLayout == "flat" {
+		f.SongNumer = f.DiscTrack()
+	}
+	if track.Classical {
+		f.Work = core.LimitString(track.Attributes.WorkName)
+		f.Movement = core.LimitString(track.Attributes.MovementName)
+		f.MovementNumber = track.Attributes.MovementNumber
+		f.MovementCount = track.Attributes.MovementCount
+		var soloists []string
+		f.Conductor, f.Orchestra, soloists = classical.Performers(track.Credits)
+		f.Soloists = strings.Join(soloists, ", ")
+	}
+	return f
+}
+
+// renderName renders format and replaces characters that are not allowed in
+// a path component.
+func renderName(format string, f naming.Fields) string {
+	name, err := naming.Render(format, f)
+	if err != nil {
+		slog.Warn("render name failed", "format", format, "err", err)
+	}
+	return core.Sanitizer.Name(name)
+}
+
+// folderNames renders the artist and album (or playlist) folder names of an
+// album in layout. The artist folder is empty when its format is.
+func folderNames(layout routing.Layout, f naming.Fields) (singer, album string) {
+	if f.PlaylistId != "" {
+		return renderName(layout.ArtistFolderFormat, f), renderName(layout.PlaylistFolderFormat, f)
+	}
+	return renderName(layout.ArtistFolderFormat, f), renderName(layout.AlbumFolderFormat, f)
+}
+
+// discCount is the number of discs of an album. A playlist counts as one
+// disc: its tracks come from different albums, so their disc numbers are not
+// used for folders or numbering.
+func discCount(meta *structs.AutoGenerated, albumId string) int {
+	if strings.Contains(albumId, "pl.") {
+		return 1
+	}
+	n := 1
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.Attributes.DiscNumber > n {
+			n = t.Attributes.DiscNumber
+		}
+	}
+	return n
+}
+
+// discFolder is the subfolder of disc n on a multi-disc album with
+// disc-layout "folder", and "" otherwise.
+func discFolder(meta *structs.AutoGenerated, albumId string, n int) string {
+	return discFolderName(discCount(meta, albumId), n)
+}
+
+func discFolderName(discs, n int) string {
+	if core.Config.DiscLayout != "folder" || discs < 2 {
+		return ""
+	}
+	return core.Sanitizer.Name(naming.DiscFolder(core.Config.DiscFolderFormat, n))
+}
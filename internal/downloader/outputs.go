@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"io"
+	"log/slog"
+	"main/internal/core"
+	"main/utils/structs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func isAacFormat(format string) bool {
+	return strings.HasPrefix(format, "aac")
+}
+
+// configAacType is aac-type from config.yaml, the AAC variant that shares
+// its root with no other AAC variant. It is aac when not set.
+func configAacType() string {
+	if core.Config.AacType == "" {
+		return "aac"
+	}
+	return core.Config.AacType
+}
+
+// formatFamily is the save folder setting a format uses: alac, atmos or aac.
+func formatFamily(format string) string {
+	if isAacFormat(format) {
+		return "aac"
+	}
+	return format
+}
+
+// formatCodec is the album-level {Codec} of an output format.
+func formatCodec(format string) string {
+	switch {
+	case format == "atmos":
+		return "ATMOS"
+	case isAacFormat(format):
+		return "AAC"
+	}
+	return "ALAC"
+}
+
+// formatSaveFolder is the configured root an output format is saved under.
+func formatSaveFolder(format string) string {
+	switch {
+	case format == "atmos":
+		return core.Config.AtmosSaveFolder
+	case isAacFormat(format) && core.Config.AacSaveFolder != "":
+		return core.Config.AacSaveFolder
+	}
+	return core.Config.AlacSaveFolder
+}
+
+// okKey is the core.OkDict key of an album in one format. A single-format run
+// keeps the plain album ID.
+func okKey(albumId, format string) string {
+	if len(core.JobFormats()) > 1 {
+		return albumId + "#" + format
+	}
+	return albumId
+}
+
+// albumExtras are the covers, PDFs and animated artwork saved by the first
+// format of a job, so later formats can copy them instead of downloading
+// again.
+type albumExtras struct {
+	covPath      string
+	qobuzDesc    string
+	singerFolder string
+	albumFolder  string
+	files        []string
+}
+
+func (e *albumExtras) add(path string) {
+	if path != "" {
+		e.files = append(e.files, path)
+	}
+}
+
+// copyTo copies the saved extras into another format's folders and returns
+// the cover path there.
+func (e *albumExtras) copyTo(singerFolder, albumFolder string, logger *slog.Logger) string {
+	var covPath string
+	for _, src := range e.files {
+		dst := filepath.Join(albumFolder, filepath.Base(src))
+		if filepath.Dir(src) == filepath.Clean(e.singerFolder) && filepath.Dir(src) != filepath.Clean(e.albumFolder) {
+			dst = filepath.Join(singerFolder, filepath.Base(src))
+		}
+		if err := copyFile(src, dst); err != nil {
+			logger.Warn("copy album extra failed", "src", src, "dst", dst, "err", err)
+			continue
+		}
+		if src == e.covPath {
+			covPath = dst
+		}
+	}
+	return covPath
+}
+
+// spread copies the extras into the album folder of every track an output
+// route saved outside albumFolder, so each routed root has its own cover,
+// PDFs and artist image. trackPaths are the finished tracks by their index
+// in meta.
+func (e *albumExtras) spread(meta *structs.AutoGenerated, albumId, albumFolder string, trackPaths map[int]string, logger *slog.Logger) {
+	done := map[string]bool{filepath.Clean(albumFolder): true}
+	for trackNum, path := range trackPaths {
+		dir := filepath.Dir(path)
+		if discFolder(meta, albumId, meta.Data[0].Relationships.Tracks.Data[trackNum-1].Attributes.DiscNumber) != "" {
+			dir = filepath.Dir(dir)
+		}
+		if done[dir] {
+			continue
+		}
+		done[dir] = true
+		e.copyTo(filepath.Dir(dir), dir, logger)
+	}
+}
+
+func copyFile(src, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
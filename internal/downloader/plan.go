@@ -0,0 +1,331 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/errs"
+	"main/internal/parser"
+	"main/internal/utils"
+	"main/utils/structs"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// trackPlan is everything decided about a track before any media is fetched:
+// the manifest, which stream will be used, its quality and the final path.
+type trackPlan struct {
+	manifest            *structs.SongData
+	needDlAacLc         bool
+	trackQuality        string
+	albumQuality        string
+	trackNum            int
+	tracksOnCurrentDisc int
+	root                string // save root chosen by output routing
+	route               string
+	finalArtistDir      string
+	finalAlbumDir       string
+	discDir             string
+	finalAlbumFolder    string
+	trackPath           string
+	requestedCodec      string
+	codec               string // codec actually selected from the chain
+	streamUrl           string // variant playlist, empty for aac-lc
+}
+
+// planTrack resolves the manifest, quality and output path of track without
+// touching the file system. It is shared by the download path and --dry-run.
+func planTrack(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront, format string, account *structs.Account) (*trackPlan, error) {
+	catalogId, catalogStorefront := catalogEntry(track, storefront)
+	manifest, err := api.GetInfoFromAdam(catalogId, account, catalogStorefront)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest with account %s: %w", account.Name, err)
+	}
+
+	hls := manifest.Attributes.ExtendedAssetUrls.EnhancedHls
+	chain := codecChain(track, format)
+	needCheck := false
+
+	if core.Config.GetM3u8Mode == "all" {
+		needCheck = true
+	} else if core.Config.GetM3u8Mode == "hires" && utils.Contains(track.Attributes.AudioTraits, "hi-res-lossless") {
+		needCheck = true
+	}
+	var EnhancedHls_m3u8 string
+	if needCheck && hls != "" && chain[0] != "aac-lc" {
+		EnhancedHls_m3u8, _ = parser.CheckM3u8(catalogId, "song", account)
+		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
+			hls = EnhancedHls_m3u8
+			manifest.Attributes.ExtendedAssetUrls.EnhancedHls = hls
+		}
+	}
+
+	needDlAacLc, obtained, streamUrl, rawQuality, err := selectCodec(chain, hls)
+	if err != nil {
+		return nil, err
+	}
+	TrackQuality := trackQuality(obtained, rawQuality)
+
+	trackSpecificTags := []string{}
+	if track.Attributes.IsAppleDigitalMaster && core.Config.AppleMasterChoice != "" {
+		trackSpecificTags = append(trackSpecificTags, core.Config.AppleMasterChoice)
+	}
+	if track.Attributes.ContentRating == "explicit" && core.Config.ExplicitChoice != "" {
+		trackSpecificTags = append(trackSpecificTags, core.Config.ExplicitChoice)
+	} else if track.Attributes.ContentRating == "clean" && core.Config.CleanChoice != "" {
+		trackSpecificTags = append(trackSpecificTags, core.Config.CleanChoice)
+	}
+	Track_Tag_String := strings.Join(trackSpecificTags, " ")
+
+	trackNum := -1
+	for i, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.ID == track.ID {
+			trackNum = i + 1
+			break
+		}
+	}
+	if trackNum == -1 {
+		return nil, errors.New("track not found in metadata")
+	}
+
+	currentDiscNum := track.Attributes.DiscNumber
+	tracksOnCurrentDisc := 0
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.Attributes.DiscNumber == currentDiscNum {
+			tracksOnCurrentDisc++
+		}
+	}
+
+	facts := trackFacts(track, meta, albumId, storefront)
+	facts.Codec = codecFamily(obtained)
+	facts.Quality, facts.BitDepth = qualityFacts(obtained, rawQuality)
+	layout := routeLayout(format, facts)
+	baseSaveFolder := layout.Root
+
+	fields := albumNameFields(meta, albumId, storefront, format, account)
+	finalArtistDir, finalAlbumDir := albumDirs(layout, fields, songFields(fields, longestTrack(meta), meta))
+	song := songFields(fields, track, meta)
+	song.Quality, song.Codec, song.Tag = TrackQuality, codecLabel(obtained), Track_Tag_String
+	filenameWithExt := fmt.Sprintf("%s.m4a", renderName(layout.SongFileFormat, song))
+
+	discDir := discFolder(meta, albumId, currentDiscNum)
+	finalAlbumFolder, trackPath := albumPath(baseSaveFolder, finalArtistDir, finalAlbumDir, discDir, filenameWithExt)
+
+	return &trackPlan{
+		manifest:            manifest,
+		needDlAacLc:         needDlAacLc,
+		trackQuality:        TrackQuality,
+		albumQuality:        fields.Quality,
+		trackNum:            trackNum,
+		tracksOnCurrentDisc: tracksOnCurrentDisc,
+		root:                baseSaveFolder,
+		route:               layout.Route,
+		finalArtistDir:      finalArtistDir,
+		finalAlbumDir:       finalAlbumDir,
+		discDir:             discDir,
+		finalAlbumFolder:    finalAlbumFolder,
+		trackPath:           trackPath,
+		requestedCodec:      chain[0],
+		codec:               obtained,
+		streamUrl:           streamUrl,
+	}, nil
+}
+
+// accountCheck is the result of the per-album account precheck.
+type accountCheck struct {
+	Name       string `json:"name"`
+	Storefront string `json:"storefront"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newAccountCheck(acc structs.Account, err error) accountCheck {
+	c := accountCheck{Name: acc.Name, Storefront: acc.Storefront, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// dryRunTrack is one selected track as it would be downloaded.
+type dryRunTrack struct {
+	TrackNum  int       `json:"trackNum"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Codec     string    `json:"codec,omitempty"`
+	Quality   string    `json:"quality,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Requested string    `json:"requested,omitempty"`
+	Exists    bool      `json:"exists"`
+	Account   string    `json:"account,omitempty"`
+	Source    string    `json:"source,omitempty"` // storefront the audio comes from, when not the album's
+	Error     string    `json:"error,omitempty"`
+	Code      errs.Code `json:"code,omitempty"`
+}
+
+// DryRunReport is emitted once per album or playlist with --dry-run --json-output.
+type DryRunReport struct {
+	Status      string            `json:"status"`
+	AlbumID     string            `json:"albumId"`
+	AlbumName   string            `json:"albumName"`
+	Artist      string            `json:"artist"`
+	Accounts    []accountCheck    `json:"accounts"`
+	Storefronts []storefrontAlbum `json:"storefronts,omitempty"`
+	Tracks      []dryRunTrack     `json:"tracks"`
+}
+
+// printDryRun plans every selected track with the accounts that passed the
+// precheck and prints the result instead of downloading. Accounts are assigned
+// round-robin, the same way the real download dispatches them.
+func printDryRun(meta *structs.AutoGenerated, albumId, storefront, format string, selected []int, workingAccounts []structs.Account, precheck []accountCheck, resolution *storefrontResolution, jsonOutput bool) {
+	report := DryRunReport{
+		Status:    "dry-run",
+		AlbumID:   albumId,
+		AlbumName: meta.Data[0].Attributes.Name,
+		Artist:    meta.Data[0].Attributes.ArtistName,
+		Accounts:  precheck,
+	}
+	if resolution != nil {
+		report.Storefronts = resolution.Albums
+	}
+
+	for i, trackNum := range selected {
+		track := meta.Data[0].Relationships.Tracks.Data[trackNum-1]
+		accounts := workingAccounts
+		var sources []structs.TrackSource
+		if resolution != nil && track.Type != "music-videos" {
+			var err error
+			accounts, sources, err = resolution.pick(track, format)
+			if err != nil {
+				report.Tracks = append(report.Tracks, dryRunTrack{TrackNum: trackNum, Name: track.Attributes.Name, Type: track.Type, Error: err.Error(), Code: errs.CodeOf(err)})
+				continue
+			}
+		}
+		account := &accounts[i%len(accounts)]
+		if sources != nil {
+			track.Source = sources[i%len(accounts)]
+		}
+		row := dryRunTrack{TrackNum: trackNum, Name: track.Attributes.Name, Type: track.Type, Account: account.Name, Source: strings.ToUpper(track.Source.Storefront)}
+
+		if track.Type == "music-videos" {
+			row.Codec = "MV"
+			if !core.Config.DownloadVideos {
+				row.Error = "download-videos 已关闭，跳过"
+				report.Tracks = append(report.Tracks, row)
+				continue
+			}
+			layout := routeLayout(format, trackFacts(track, meta, albumId, storefront))
+			fields := albumNameFields(meta, albumId, storefront, format, account)
+			artistDir, albumDir := albumDirs(layout, fields, songFields(fields, longestTrack(meta), meta))
+			name, _ := mvName(meta, track.ID, track.Attributes.Name)
+			_, row.Path = mvTarget(layout.Root, artistDir, albumDir, discFolder(meta, albumId, track.Attributes.DiscNumber), name)
+			row.Route = layout.Route
+			row.Exists, _ = utils.FileExists(row.Path)
+			report.Tracks = append(report.Tracks, row)
+			continue
+		}
+
+		plan, err := planTrack(track, meta, albumId, storefront, format, account)
+		if err != nil {
+			row.Error = err.Error()
+			row.Code = errs.CodeOf(err)
+			report.Tracks = append(report.Tracks, row)
+			continue
+		}
+
+		row.Path = plan.trackPath
+		row.Route = plan.route
+		row.Quality = plan.trackQuality
+		row.Codec = plan.codec
+		row.Requested = plan.requestedCodec
+		row.Exists, _ = utils.FileExists(plan.trackPath)
+		report.Tracks = append(report.Tracks, row)
+	}
+
+	if jsonOutput {
+		out, _ := json.Marshal(report)
+		fmt.Println(string(out))
+		return
+	}
+
+	accTable := tablewriter.NewWriter(os.Stdout)
+	accTable.SetHeader([]string{"Account", "Storefront", "Precheck"})
+	for _, c := range precheck {
+		status := "OK"
+		if !c.OK {
+			status = "FAIL: " + c.Error
+		}
+		accTable.Append([]string{c.Name, strings.ToUpper(c.Storefront), status})
+	}
+	accTable.Render()
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"", "Track Name", "Codec", "Quality", "Path", "Exists", "Account"})
+	table.SetAutoWrapText(false)
+	table.SetCaption(true, fmt.Sprintf("dry-run: %s, %d tracks", albumId, len(report.Tracks)))
+	for _, row := range report.Tracks {
+		exists := ""
+		if row.Exists {
+			exists = "yes"
+		}
+		codec := row.Codec
+		if row.Requested != "" && row.Requested != row.Codec {
+			codec = fmt.Sprintf("%s\n(%s 不可用)", row.Codec, row.Requested)
+		}
+		path := row.Path
+		if row.Route != "" {
+			path += "\n(route: " + row.Route + ")"
+		}
+		if row.Error != "" {
+			path = "ERROR: " + row.Error
+		}
+		account := row.Account
+		if row.Source != "" {
+			account += "\n(" + row.Source + ")"
+		}
+		table.Append([]string{fmt.Sprint(row.TrackNum), row.Name, codec, row.Quality, path, exists, account})
+	}
+	table.Render()
+}
+
+// PrintMVDryRun prints where the music video of a music-video URL would be
+// saved, with the account that would download it, instead of downloading.
+// mvInfo is its catalog entry, and root and artistDir come from its layout.
+func PrintMVDryRun(mvInfo *structs.AutoGeneratedMusicVideo, adamID, storefront, root, artistDir, route string, account *structs.Account, jsonOutput bool) {
+	attrs := mvInfo.Data[0].Attributes
+	_, path := mvTarget(root, artistDir, "", "", attrs.Name)
+	row := dryRunTrack{TrackNum: 1, Name: attrs.Name, Type: "music-videos", Codec: "MV", Path: path, Route: route, Account: account.Name, Source: strings.ToUpper(storefront)}
+	row.Exists, _ = utils.FileExists(path)
+	report := DryRunReport{
+		Status:    "dry-run",
+		AlbumID:   adamID,
+		AlbumName: attrs.Name,
+		Artist:    attrs.ArtistName,
+		Tracks:    []dryRunTrack{row},
+	}
+
+	if jsonOutput {
+		out, _ := json.Marshal(report)
+		fmt.Println(string(out))
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"", "MV Name", "Codec", "Path", "Exists", "Account"})
+	table.SetAutoWrapText(false)
+	table.SetCaption(true, fmt.Sprintf("dry-run: MV %s", adamID))
+	exists := ""
+	if row.Exists {
+		exists = "yes"
+	}
+	if route != "" {
+		path += "\n(route: " + route + ")"
+	}
+	table.Append([]string{"1", row.Name, row.Codec, path, exists, row.Account + "\n(" + row.Source + ")"})
+	table.Render()
+}
@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"fmt"
+	"log/slog"
+	"main/internal/api"
+	"main/internal/core"
+	"main/utils/structs"
+	"slices"
+	"strings"
+)
+
+// albumRating is "explicit" when any track of the album is explicit,
+// "clean" when any is clean, and "" for albums without rated content.
+func albumRating(meta *structs.AutoGenerated) string {
+	rating := ""
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		switch t.Attributes.ContentRating {
+		case "explicit":
+			return "explicit"
+		case "clean":
+			rating = "clean"
+		}
+	}
+	return rating
+}
+
+// otherRating is the rating that content-rating want replaces.
+func otherRating(want string) string {
+	if want == "explicit" {
+		return "clean"
+	}
+	return "explicit"
+}
+
+// applyContentRating redirects an album job to the version of the album
+// rated content-rating, and substitutes the tracks of a playlist one by
+// one. It returns the album ID, song ID and metadata to continue with.
+// Albums and tracks without a counterpart are kept and reported.
+func applyContentRating(meta *structs.AutoGenerated, albumId, storefront, songId string, account *structs.Account, jsonOutput bool, logger *slog.Logger) (string, string, *structs.AutoGenerated) {
+	want := core.Config.ContentRating
+	notify := func(msg string) {
+		if jsonOutput {
+			printJSON(albumId, 0, "", meta.Data[0].Attributes.Name, "log", 0, "", msg)
+		} else {
+			fmt.Println(msg)
+		}
+	}
+
+	if strings.Contains(albumId, "pl.") {
+		substituted := 0
+		tracks := meta.Data[0].Relationships.Tracks.Data
+		for i, t := range tracks {
+			if t.Type == "music-videos" || t.Attributes.ContentRating != otherRating(want) {
+				continue
+			}
+			counterpart, err := api.FindSongCounterpart(t, storefront, want)
+			if err != nil {
+				logger.Warn("counterpart search failed", "trackId", t.ID, "err", err)
+			}
+			if counterpart == nil {
+				core.RecordRatingMiss(core.RatingMiss{AlbumID: albumId, Name: t.Attributes.Name, Rating: t.Attributes.ContentRating, Wanted: want})
+				continue
+			}
+			logger.Info("track substituted by content rating", "trackId", t.ID, "counterpart", counterpart.ID, "rating", want)
+			tracks[i] = *counterpart
+			substituted++
+		}
+		if substituted > 0 {
+			notify(fmt.Sprintf("已将 %d 首曲目替换为 %s 版本", substituted, want))
+		}
+		return albumId, songId, meta
+	}
+
+	rating := albumRating(meta)
+	if rating != otherRating(want) {
+		return albumId, songId, meta
+	}
+	counterpart, err := api.FindAlbumCounterpart(meta, storefront, want, account)
+	if err != nil {
+		logger.Warn("counterpart search failed", "err", err)
+	}
+	if counterpart == nil {
+		core.RecordRatingMiss(core.RatingMiss{AlbumID: albumId, Name: meta.Data[0].Attributes.Name, Rating: rating, Wanted: want})
+		notify(fmt.Sprintf("未找到 %s 版本，继续下载 %s 版本", want, rating))
+		return albumId, songId, meta
+	}
+
+	newSongId := songId
+	if songId != "" {
+		// The tracks are in the same order on both versions.
+		i := slices.IndexFunc(meta.Data[0].Relationships.Tracks.Data, func(t structs.TrackData) bool { return t.ID == songId })
+		if i < 0 {
+			return albumId, songId, meta
+		}
+		newSongId = counterpart.Data[0].Relationships.Tracks.Data[i].ID
+	}
+	logger.Info("album redirected by content rating", "counterpart", counterpart.Data[0].ID, "rating", want)
+	notify(fmt.Sprintf("已切换到 %s 版本: %s (%s)", want, counterpart.Data[0].Attributes.Name, counterpart.Data[0].ID))
+	return counterpart.Data[0].ID, newSongId, counterpart
+}
+
+// PrintRatingSummary lists the albums and playlist tracks for which no
+// version with the wanted content rating was found.
+func PrintRatingSummary() {
+	core.SharedLock.Lock()
+	misses := slices.Clone(core.RatingMisses)
+	core.SharedLock.Unlock()
+	if len(misses) == 0 {
+		return
+	}
+	fmt.Printf("\n未找到对应分级版本 (%d):\n", len(misses))
+	for _, m := range misses {
+		fmt.Printf("  [%s] %s: %s, 需要 %s\n", m.AlbumID, m.Name, m.Rating, m.Wanted)
+	}
+}
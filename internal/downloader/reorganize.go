@@ -0,0 +1,765 @@
+package downloader
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"main/internal/core"
+	"main/internal/metadata"
+	"main/internal/naming"
+	"main/internal/routing"
+	"main/internal/utils"
+	"main/utils/structs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// ReorganizeReport is printed by a reorganize run with --json-output.
+type ReorganizeReport struct {
+	Status  string      `json:"status"`
+	Root    string      `json:"root"`
+	DryRun  bool        `json:"dry_run"`
+	Journal string      `json:"journal,omitempty"`
+	Moves   []reorgMove `json:"moves"`
+	Skipped []reorgSkip `json:"skipped,omitempty"`
+}
+
+// reorgMove is one file moved by reorganize. Moves are journaled one JSON
+// object per line, in the order they were made.
+type reorgMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type reorgSkip struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// libraryTrack is a track file found under the library root.
+type libraryTrack struct {
+	path     string
+	albumDir string        // folder holding the album covers and PDFs
+	fields   naming.Fields // album-level quality, codec and tag
+	longest  naming.Fields // the track of the album with the longest title
+	facts    routing.Facts
+	quality  string // from the SOURCE_QUALITY tag or the ALAC config, e.g. "24B-96.0kHz"
+	codec    string // from the SOURCE_CODEC tag or the sample entry, e.g. "ALAC"
+	rating   string // rtng: 1 explicit, 2 clean
+	unnamed  string // why the folder-language names are not known
+}
+
+var (
+	albumIdInName    = regexp.MustCompile(`\((\d{6,})\)`)
+	playlistIdInName = regexp.MustCompile(`(pl\.[0-9A-Za-z-]+)`)
+	discFolderInName = regexp.MustCompile(`(?i)^(cd|disc|disk)[ _-]*\d+$`)
+)
+
+// albumSidecar reports whether name is an album-level file written next to
+// the tracks by downloadAlbumExtras.
+func albumSidecar(name string) bool {
+	lower := strings.ToLower(name)
+	stem := strings.TrimSuffix(lower, filepath.Ext(lower))
+	return stem == "cover" || lower == "square_animated_artwork.mp4" || lower == "tall_animated_artwork.mp4" || lower == "credits.txt" || lower == "album.nfo" || lower == "album.json" || strings.HasSuffix(lower, ".pdf")
+}
+
+// Reorganize moves the .m4a files under root, with their lyrics, covers,
+// PDFs and animated artwork, to the paths the current naming formats,
+// routes, disc layout and sanitize profile give them. Names are rendered
+// from the embedded tags; files saved before the catalog IDs were tagged
+// take the album ID from the old album folder name. With core.Dry_run the
+// moves are only printed. Every move is appended to a journal in root, which
+// UndoReorganize replays backwards.
+func Reorganize(root string, jsonOutput bool) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s 不是目录", root)
+	}
+
+	report := ReorganizeReport{Status: "reorganize", Root: root, DryRun: core.Dry_run}
+	var tracks []*libraryTrack
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".m4a") {
+			return nil
+		}
+		tags, err := metadata.ReadTags(path)
+		if err != nil {
+			report.Skipped = append(report.Skipped, reorgSkip{Path: path, Reason: "读取标签失败: " + err.Error()})
+			return nil
+		}
+		tracks = append(tracks, newLibraryTrack(path, tags))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Album-level fields come from every track of the album, like they do
+	// when the album is downloaded.
+	albums := make(map[string][]*libraryTrack)
+	var keys []string
+	for _, t := range tracks {
+		key := t.fields.AlbumId + t.fields.PlaylistId
+		if key == "" {
+			key = t.albumDir + "\x00" + t.fields.ArtistName + "\x00" + t.fields.AlbumName
+		}
+		if albums[key] == nil {
+			keys = append(keys, key)
+		}
+		albums[key] = append(albums[key], t)
+	}
+
+	// Track of each lyrics file, so a skipped track keeps its lyrics.
+	follows := make(map[string]string)
+	// New album folder of each old album folder, for the sidecars.
+	albumDirs := make(map[string]map[string]bool)
+	for _, key := range keys {
+		album := albums[key]
+		applyAlbumFields(album)
+		for _, t := range album {
+			to, reason := t.targetPath(root)
+			if reason != "" {
+				report.Skipped = append(report.Skipped, reorgSkip{Path: t.path, Reason: reason})
+				continue
+			}
+			if albumDirs[t.albumDir] == nil {
+				albumDirs[t.albumDir] = make(map[string]bool)
+			}
+			albumDir := filepath.Dir(to)
+			if discFolderName(t.fields.DiscCount, t.fields.DiscNumber) != "" {
+				albumDir = filepath.Dir(albumDir)
+			}
+			albumDirs[t.albumDir][albumDir] = true
+			if to == t.path {
+				continue
+			}
+			report.Moves = append(report.Moves, reorgMove{From: t.path, To: to})
+
+			lrc := strings.TrimSuffix(t.path, filepath.Ext(t.path)) + ".lrc"
+			if exists, _ := utils.FileExists(lrc); exists {
+				report.Moves = append(report.Moves, reorgMove{From: lrc, To: strings.TrimSuffix(to, filepath.Ext(to)) + ".lrc"})
+				follows[lrc] = t.path
+			}
+		}
+	}
+
+	report.Moves = append(report.Moves, sidecarMoves(&report, albumDirs, albumSidecar)...)
+	if core.Config.ArtistFolderFormat != "" {
+		// The artist folder.jpg and artist.nfo follow when every album of
+		// the old artist folder went to the same new one.
+		artistDirs := make(map[string]map[string]bool)
+		for dir, newDirs := range albumDirs {
+			old := filepath.Dir(dir)
+			if old == root {
+				continue
+			}
+			if artistDirs[old] == nil {
+				artistDirs[old] = make(map[string]bool)
+			}
+			for d := range newDirs {
+				artistDirs[old][filepath.Dir(d)] = true
+			}
+		}
+		report.Moves = append(report.Moves, sidecarMoves(&report, artistDirs, func(name string) bool {
+			lower := strings.ToLower(name)
+			return strings.HasPrefix(lower, "folder.") || lower == "artist.nfo"
+		})...)
+	}
+	report.Moves = dropBlocked(&report, report.Moves, follows)
+
+	if !core.Dry_run && len(report.Moves) > 0 {
+		report.Journal = filepath.Join(root, fmt.Sprintf(".reorganize-%s.jsonl", time.Now().Format("20060102-150405")))
+		if err := applyMoves(report.Moves, report.Journal); err != nil {
+			return fmt.Errorf("%w (已完成的移动记录在 %s)", err, report.Journal)
+		}
+		var oldDirs []string
+		for _, m := range report.Moves {
+			oldDirs = append(oldDirs, filepath.Dir(m.From))
+		}
+		removeEmptyDirs(root, oldDirs)
+	}
+
+	printReorganize(report, jsonOutput)
+	return nil
+}
+
+// sidecarMoves moves the files accepted by match from each old folder to its
+// new folder. A folder whose tracks went to several new folders keeps them.
+func sidecarMoves(report *ReorganizeReport, dirs map[string]map[string]bool, match func(name string) bool) []reorgMove {
+	old := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		old = append(old, dir)
+	}
+	slices.Sort(old)
+	var moves []reorgMove
+	for _, dir := range old {
+		if len(dirs[dir]) != 1 {
+			report.Skipped = append(report.Skipped, reorgSkip{Path: dir, Reason: "曲目被分到多个文件夹，封面等附件保留原处"})
+			continue
+		}
+		var newDir string
+		for d := range dirs[dir] {
+			newDir = d
+		}
+		if newDir == dir {
+			continue
+		}
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if e.IsDir() || !match(e.Name()) {
+				continue
+			}
+			moves = append(moves, reorgMove{From: filepath.Join(dir, e.Name()), To: filepath.Join(newDir, e.Name())})
+		}
+	}
+	return moves
+}
+
+// dropBlocked skips the moves whose target is taken by an earlier move or by
+// a file that is not moved away itself, until every target left is free.
+// Targets freed by another move are kept, so swaps and chains go through;
+// applyMoves stages them. A skipped track takes its lyrics file with it.
+func dropBlocked(report *ReorganizeReport, moves []reorgMove, follows map[string]string) []reorgMove {
+	for {
+		leaving := make(map[string]bool, len(moves))
+		for _, m := range moves {
+			leaving[m.From] = true
+		}
+		taken := make(map[string]string, len(moves))
+		dropped := make(map[string]bool)
+		var kept []reorgMove
+		for _, m := range moves {
+			reason := ""
+			if from, ok := taken[m.To]; ok {
+				reason = "与 " + from + " 的目标路径相同"
+			} else if exists, _ := utils.FileExists(m.To); exists && !leaving[m.To] {
+				reason = "目标文件已存在: " + m.To
+			} else if track, ok := follows[m.From]; ok && dropped[track] {
+				reason = "所属曲目已跳过"
+			}
+			if reason != "" {
+				report.Skipped = append(report.Skipped, reorgSkip{Path: m.From, Reason: reason})
+				dropped[m.From] = true
+				continue
+			}
+			taken[m.To] = m.From
+			kept = append(kept, m)
+		}
+		if len(kept) == len(moves) {
+			return kept
+		}
+		moves = kept
+	}
+}
+
+// UndoReorganize moves the files of a reorganize journal back, last move
+// first. Files that were moved again or deleted since are reported and left
+// alone.
+func UndoReorganize(journal string, jsonOutput bool) error {
+	journal, err := filepath.Abs(journal)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(journal)
+	if err != nil {
+		return err
+	}
+	var moves []reorgMove
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var m reorgMove
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			f.Close()
+			return fmt.Errorf("日志文件 %s 格式错误: %w", journal, err)
+		}
+		moves = append(moves, m)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	report := ReorganizeReport{Status: "reorganize-undo", Root: filepath.Dir(journal), DryRun: core.Dry_run, Journal: journal}
+	// Paths the moves planned so far fill (true) or empty (false), so a
+	// staged swap or chain is undone through its temporary name.
+	planned := make(map[string]bool)
+	exists := func(path string) bool {
+		if ok, seen := planned[path]; seen {
+			return ok
+		}
+		ok, _ := utils.FileExists(path)
+		return ok
+	}
+	var newDirs []string
+	for i := len(moves) - 1; i >= 0; i-- {
+		back := reorgMove{From: moves[i].To, To: moves[i].From}
+		if !exists(back.From) {
+			report.Skipped = append(report.Skipped, reorgSkip{Path: back.From, Reason: "文件已不存在"})
+			continue
+		}
+		if exists(back.To) {
+			report.Skipped = append(report.Skipped, reorgSkip{Path: back.From, Reason: "原路径已被占用: " + back.To})
+			continue
+		}
+		planned[back.From], planned[back.To] = false, true
+		report.Moves = append(report.Moves, back)
+		newDirs = append(newDirs, filepath.Dir(back.From))
+	}
+
+	if !core.Dry_run {
+		for _, m := range report.Moves {
+			if err := moveFile(m); err != nil {
+				return err
+			}
+		}
+		removeEmptyDirs(report.Root, newDirs)
+		if len(report.Skipped) == 0 {
+			os.Rename(journal, journal+".undone")
+		}
+	}
+
+	printReorganize(report, jsonOutput)
+	return nil
+}
+
+// catalogItems are the catalog IDs of a track on the album in meta, which
+// reorganize renders {SongId}, {ArtistId}, {AlbumId} and {UPC} from: cnID,
+// atID (the first album artist), plID and a UPC freeform item. Playlists get
+// no plID or UPC; their ID is taken from the folder name.
+func catalogItems(meta *structs.AutoGenerated, track structs.TrackData) []metadata.Item {
+	var items []metadata.Item
+	id := func(name, value string) {
+		if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+			items = append(items, metadata.Item{Name: name, Value: uint32(n)})
+		}
+	}
+	id("cnID", track.ID)
+	if artists := meta.Data[0].Relationships.Artists.Data; len(artists) > 0 {
+		id("atID", artists[0].ID)
+	}
+	if !strings.Contains(meta.Data[0].ID, "pl.") {
+		id("plID", meta.Data[0].ID)
+		if upc := meta.Data[0].Attributes.Upc; upc != "" {
+			items = append(items, metadata.Item{Name: "----:UPC", Value: upc})
+		}
+	}
+	return items
+}
+
+// newLibraryTrack maps the tags of one file to naming fields and routing
+// facts. The album-level quality, codec and tag are set by applyAlbumFields.
+func newLibraryTrack(path string, tags map[string]string) *libraryTrack {
+	t := &libraryTrack{path: path, albumDir: filepath.Dir(path), rating: tags["rtng"]}
+	t.codec, t.quality = tags["SOURCE_CODEC"], tags["SOURCE_QUALITY"]
+	if t.codec == "" {
+		// Saved before the codec was tagged: read it from the sample entry.
+		t.codec, t.quality, _ = metadata.ReadCodec(path)
+	}
+	disc, discs := splitPair(tags["disk"])
+	track, tracks := splitPair(tags["trkn"])
+	if discs > 1 && discFolderInName.MatchString(filepath.Base(t.albumDir)) {
+		t.albumDir = filepath.Dir(t.albumDir)
+	}
+
+	artist := tags["aART"]
+	if artist == "" {
+		artist = tags["©ART"]
+	}
+	// languageItems stored the names in the other language in the sort atoms
+	// or in freeform items; the album artist has no freeform item of its own,
+	// but ORIGINALARTIST is the album artist except on compilations.
+	other := func(sortAtom, custom string) string {
+		if v := tags[sortAtom]; v != "" || custom == "" {
+			return v
+		}
+		return tags[custom]
+	}
+	otherArtist := other("soaa", "ORIGINALARTIST")
+	if tags["cpil"] == "1" {
+		otherArtist = tags["soaa"]
+		if artist == core.Config.CompilationArtist {
+			// compilation-artist is the same in both languages.
+			otherArtist = artist
+		}
+	}
+	albumName, albumNameAlt, okAlbum := folderLanguage(tags["©alb"], other("soal", "ORIGINALALBUM"))
+	artistName, artistNameAlt, okArtist := folderLanguage(artist, otherArtist)
+	songName, songNameAlt, okSong := folderLanguage(tags["©nam"], other("sonm", "ORIGINALTITLE"))
+	// Composer is always named in the primary language.
+	composer := tags["©wrt"]
+	if c := other("soco", "ORIGINALCOMPOSER"); c != "" && core.Config.TagLanguage == "secondary" {
+		composer = c
+	}
+	f := naming.Fields{
+		AlbumName:     core.LimitString(albumName),
+		AlbumNameAlt:  core.LimitString(albumNameAlt),
+		ArtistName:    core.LimitString(artistName),
+		ArtistNameAlt: core.LimitString(artistNameAlt),
+		UrlArtistName: core.LimitString(artistName),
+		AlbumArtist:   core.LimitString(artistName),
+		Compilation:   tags["cpil"] == "1",
+		ArtistId:      tags["atID"],
+		ReleaseDate:   tags["©day"],
+		UPC:           tags["UPC"],
+		Copyright:     tags["cprt"],
+		Genre:         tags["©gen"],
+		SongId:        tags["cnID"],
+		SongName:      core.LimitString(songName),
+		SongNameAlt:   core.LimitString(songNameAlt),
+		SongArtist:    tags["©ART"],
+		Composer:      composer,
+		SongNumer:     fmt.Sprintf("%02d", track),
+		TrackNumber:   track,
+		DiscNumber:    max(disc, 1),
+		DiscCount:     max(discs, 1),
+		TrackCount:    tracks,
+	}
+	if len(f.ReleaseDate) >= 4 {
+		f.ReleaseYear = f.ReleaseDate[:4]
+	}
+	if id := tags["plID"]; id != "" && id != "0" {
+		f.AlbumId = id
+	} else if m := albumIdInName.FindStringSubmatch(filepath.Base(t.albumDir)); m != nil {
+		f.AlbumId = m[1]
+	} else if m := playlistIdInName.FindStringSubmatch(filepath.Base(t.albumDir)); m != nil {
+		f.PlaylistId = m[1]
+		f.PlaylistName = f.AlbumName
+		f.ArtistName, f.UrlArtistName = "Apple Music", "Apple Music"
+		f.DiscNumber, f.DiscCount = 1, 1
+	}
+	if !okAlbum || !okSong || (!okArtist && f.PlaylistId == "") {
+		t.unnamed = "文件夹语言与标签语言不同，但文件中没有另一种语言的名称"
+	}
+	if core.Config.DiscLayout == "flat" {
+		f.SongNumer = f.DiscTrack()
+	}
+	// classicalItems tags classical tracks with their work and movement, and
+	// with the performers taken from the credits.
+	classical := tags["shwm"] == "1" || tags["©wrk"] != "" || tags["CONDUCTOR"] != "" || tags["ORCHESTRA"] != "" || tags["SOLOISTS"] != ""
+	if classical {
+		f.Work = core.LimitString(tags["©wrk"])
+		f.Movement = core.LimitString(tags["©mvn"])
+		f.MovementNumber, _ = strconv.Atoi(tags["©mvi"])
+		f.MovementCount, _ = strconv.Atoi(tags["©mvc"])
+		f.Conductor, f.Orchestra = tags["CONDUCTOR"], tags["ORCHESTRA"]
+		f.Soloists = strings.ReplaceAll(tags["SOLOISTS"], "; ", ", ")
+	}
+	t.fields = f
+
+	t.facts = routing.Facts{
+		Type:        "song",
+		Source:      "album",
+		Explicit:    t.rating == "1",
+		Codec:       labelCodec(t.codec),
+		Compilation: f.Compilation,
+		Classical:   classical,
+	}
+	if f.PlaylistId != "" {
+		t.facts.Source = "playlist"
+	}
+	if f.Genre != "" {
+		t.facts.Genres = []string{f.Genre}
+	}
+	t.facts.Quality, t.facts.BitDepth = qualityFacts(t.facts.Codec, t.quality)
+	if t.facts.Quality == "" {
+		t.facts.Quality = "lossless"
+	}
+	return t
+}
+
+// folderLanguage returns the folder-language name of a tag and the name in
+// the other language, as localized does when downloading, from the tagged
+// name and the other-language name languageItems stored. The other name is
+// stored whenever it was fetched, so ok is false when folder-language is not
+// tag-language and it is missing.
+func folderLanguage(tagged, other string) (name, alt string, ok bool) {
+	swap := (core.Config.FolderLanguage == "secondary") != (core.Config.TagLanguage == "secondary")
+	if swap && other == "" {
+		return tagged, "", false
+	}
+	name, alt = localized(tagged, other, swap)
+	return name, alt, true
+}
+
+// applyAlbumFields sets the album-level quality, codec and tag of every
+// track of one album: the best ALAC quality found, and the explicit or clean
+// choice when any track carries that rating. Apple Digital Master is not
+// tagged, so the master choice cannot be recovered. The track with the
+// longest title sizes the album folders, as when downloading. AlbumComposer
+// is the composer of the most tracks, and an album with a classical track is
+// classical as a whole, as markClassical has it; playlist tracks stay as
+// they are.
+func applyAlbumFields(album []*libraryTrack) {
+	quality, codec := album[0].quality, album[0].codec
+	best := 0.0
+	hasExplicit, hasClean := false, false
+	longest := album[0].fields
+	composers := make(map[string]int)
+	albumComposer := ""
+	classical := false
+	for _, t := range album {
+		if len(t.fields.SongName) > len(longest.SongName) {
+			longest = t.fields
+		}
+		if c := t.fields.Composer; c != "" {
+			composers[c]++
+			if composers[c] > composers[albumComposer] {
+				albumComposer = c
+			}
+		}
+		classical = classical || t.facts.Classical
+		var bits int
+		var kHz float64
+		if _, err := fmt.Sscanf(t.quality, "%dB-%fkHz", &bits, &kHz); err == nil && float64(bits)*1000+kHz > best {
+			best = float64(bits)*1000 + kHz
+			quality, codec = t.quality, t.codec
+		}
+		hasExplicit = hasExplicit || t.rating == "1"
+		hasClean = hasClean || t.rating == "2"
+	}
+	tag := ""
+	if hasExplicit && core.Config.ExplicitChoice != "" {
+		tag = core.Config.ExplicitChoice
+	} else if hasClean && core.Config.CleanChoice != "" {
+		tag = core.Config.CleanChoice
+	}
+	longest.AlbumComposer = core.LimitString(albumComposer)
+	for _, t := range album {
+		t.fields.Quality, t.fields.Codec, t.fields.Tag = quality, codec, tag
+		t.fields.AlbumComposer = longest.AlbumComposer
+		t.longest = longest
+		if t.fields.PlaylistId == "" {
+			t.facts.Classical = t.facts.Classical || classical
+		}
+	}
+}
+
+// targetPath renders the path the track would be downloaded to today, or
+// the reason it cannot be. The save folder of the track's format stands for
+// root; a route that sends the track to a root of its own is followed.
+func (t *libraryTrack) targetPath(root string) (path, reason string) {
+	format := codecFormat(t.facts.Codec)
+	layout := routeLayout(format, t.facts)
+	if filepath.Clean(layout.Root) == filepath.Clean(formatSaveFolder(format)) {
+		layout.Root = root
+	} else if abs, err := filepath.Abs(layout.Root); err == nil {
+		layout.Root = abs
+	}
+	folderFormat := layout.AlbumFolderFormat
+	if t.fields.PlaylistId != "" {
+		folderFormat = layout.PlaylistFolderFormat
+	}
+	if t.fields.SongName == "" || t.fields.AlbumName == "" {
+		return "", "缺少标题或专辑标签"
+	}
+	if t.unnamed != "" {
+		return "", t.unnamed
+	}
+	// Fields the tags cannot supply would render as empty or different
+	// names, so a format that uses them leaves the track where it is.
+	for _, field := range []struct {
+		name    string
+		missing bool
+	}{
+		{"AlbumId", t.fields.AlbumId == ""},
+		{"ArtistId", t.fields.ArtistId == ""},
+		{"SongId", t.fields.SongId == ""},
+		{"UPC", t.fields.UPC == ""},
+		// Not tagged: the label and the linked album artists.
+		{"RecordLabel", true},
+		{"Artists", true},
+		{"PrimaryArtist", true},
+		{"FeaturedArtists", true},
+	} {
+		if !field.missing {
+			continue
+		}
+		for _, format := range []string{layout.ArtistFolderFormat, folderFormat, layout.SongFileFormat} {
+			if naming.Uses(format, field.name) {
+				return "", fmt.Sprintf("命名格式用到了 %s，但无法从文件标签或原文件夹名得到", field.name)
+			}
+		}
+	}
+
+	song := t.fields
+	song.Quality, song.Codec, song.Tag = t.quality, t.codec, ""
+	switch {
+	case t.rating == "1" && core.Config.ExplicitChoice != "":
+		song.Tag = core.Config.ExplicitChoice
+	case t.rating == "2" && core.Config.CleanChoice != "":
+		song.Tag = core.Config.CleanChoice
+	}
+	fileName := renderName(layout.SongFileFormat, song) + strings.ToLower(filepath.Ext(t.path))
+
+	discDir := discFolderName(t.fields.DiscCount, t.fields.DiscNumber)
+	artistDir, albumDir := albumDirs(layout, t.fields, t.longest)
+	_, path = albumPath(layout.Root, artistDir, albumDir, discDir, fileName)
+	return path, ""
+}
+
+// codecFormat is the output format a file of a route codec was saved in.
+// The tags do not tell the AAC variants apart, so AAC is taken as aac-type.
+func codecFormat(codec string) string {
+	switch codec {
+	case "atmos", "dolby-audio":
+		return "atmos"
+	case "aac":
+		return configAacType()
+	}
+	return "alac"
+}
+
+// labelCodec maps the codec label of the SOURCE_CODEC tag back to the codec a
+// route can match on.
+func labelCodec(label string) string {
+	switch label {
+	case "ALAC":
+		return "alac"
+	case "ATMOS":
+		return "atmos"
+	case "AC3":
+		return "dolby-audio"
+	}
+	return "aac"
+}
+
+// splitPair parses a trkn or disk value such as "3/12".
+func splitPair(s string) (n, total int) {
+	a, b, _ := strings.Cut(s, "/")
+	n, _ = strconv.Atoi(a)
+	total, _ = strconv.Atoi(b)
+	return n, total
+}
+
+// applyMoves makes the moves in order, journaling each one before the next
+// is made, so a failed run can still be undone. Files that are the target of
+// another move are first moved aside to a temporary name, so a swap or chain
+// never overwrites a file that has yet to move; the journal records both
+// steps.
+func applyMoves(moves []reorgMove, journal string) error {
+	f, err := os.OpenFile(journal, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	targets := make(map[string]bool, len(moves))
+	for _, m := range moves {
+		targets[m.To] = true
+	}
+	var staged, rest []reorgMove
+	for _, m := range moves {
+		if targets[m.From] {
+			tmp := m.From + ".reorganize"
+			staged = append(staged, reorgMove{From: m.From, To: tmp})
+			m.From = tmp
+		}
+		rest = append(rest, m)
+	}
+	for _, m := range append(staged, rest...) {
+		if err := moveFile(m); err != nil {
+			return err
+		}
+		line, _ := json.Marshal(m)
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// moveFile renames m.From to m.To, or copies and removes it when they are on
+// different file systems, as a route root may be.
+func moveFile(m reorgMove) error {
+	if err := os.MkdirAll(filepath.Dir(m.To), os.ModePerm); err != nil {
+		return err
+	}
+	err := os.Rename(m.From, m.To)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(m.From, m.To); err != nil {
+		os.Remove(m.To)
+		return err
+	}
+	return os.Remove(m.From)
+}
+
+// removeEmptyDirs removes dirs and their parents up to root once they are
+// empty.
+func removeEmptyDirs(root string, dirs []string) {
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, dir := range slices.Compact(dirs) {
+		for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+}
+
+func printReorganize(report ReorganizeReport, jsonOutput bool) {
+	if jsonOutput {
+		out, _ := json.Marshal(report)
+		fmt.Println(string(out))
+		return
+	}
+
+	rel := func(p string) string {
+		if r, err := filepath.Rel(report.Root, p); err == nil {
+			return r
+		}
+		return p
+	}
+	if len(report.Moves) > 0 {
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"From", "To"})
+		table.SetAutoWrapText(false)
+		for _, m := range report.Moves {
+			table.Append([]string{rel(m.From), rel(m.To)})
+		}
+		table.Render()
+	}
+	if len(report.Skipped) > 0 {
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Skipped", "Reason"})
+		table.SetAutoWrapText(false)
+		for _, s := range report.Skipped {
+			table.Append([]string{rel(s.Path), s.Reason})
+		}
+		table.Render()
+	}
+
+	switch {
+	case report.DryRun:
+		fmt.Printf("dry-run: 将移动 %d 个文件，跳过 %d 个，未做任何修改\n", len(report.Moves), len(report.Skipped))
+	case len(report.Moves) == 0:
+		fmt.Printf("没有需要移动的文件，跳过 %d 个\n", len(report.Skipped))
+	case report.Status == "reorganize-undo":
+		fmt.Printf("已还原 %d 个文件，跳过 %d 个\n", len(report.Moves), len(report.Skipped))
+	default:
+		fmt.Printf("已移动 %d 个文件，跳过 %d 个。撤销: --undo %s\n", len(report.Moves), len(report.Skipped), report.Journal)
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"log/slog"
+	"main/internal/core"
+	"main/internal/history"
+	"main/internal/loudness"
+	"main/internal/metadata"
+	"main/utils/structs"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// tagLoudness writes ReplayGain 2.0 tags and iTunNORM to the finished
+// tracks of an album or playlist; paths maps track numbers in meta to
+// their files. Only AAC and ALAC files are measured; an Atmos or AC-3 file
+// that codec fallback saved is left untagged. Album gain is written only
+// for a whole album whose audio tracks all have a file. Tracks the history
+// already has a measurement of are not decoded again, unless album gain is
+// needed and the history has none, and files whose tags already hold the
+// measurements are left alone. It returns the new measurements to record in
+// the history, or nil when there are none.
+func tagLoudness(meta *structs.AutoGenerated, albumId, format string, paths map[int]string, whole bool, logger *slog.Logger) *history.Loudness {
+	if !core.Config.ReplayGain || len(paths) == 0 {
+		return nil
+	}
+	tracks := meta.Data[0].Relationships.Tracks.Data
+	var nums []int
+	for num, path := range paths {
+		if codec, _, err := metadata.ReadCodec(path); err != nil || (codec != "ALAC" && codec != "AAC") {
+			logger.Debug("loudness not measured", "track", num, "codec", codec, "err", err)
+			continue
+		}
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+	for i, t := range tracks {
+		if !slices.Contains(nums, i+1) && t.Type != "music-videos" {
+			whole = false
+		}
+	}
+	if len(nums) == 0 {
+		return nil
+	}
+
+	gains := &history.Loudness{Tracks: make(map[string]history.Gain)}
+	cached := core.History.Loudness(albumId, format)
+	var measure []int
+	for _, num := range nums {
+		id := tracks[num-1].ID
+		if cached != nil {
+			if g, ok := cached.Tracks[id]; ok {
+				gains.Tracks[id] = g
+				continue
+			}
+		}
+		measure = append(measure, num)
+	}
+	if whole {
+		if cached != nil && cached.Album != nil {
+			gains.Album = cached.Album
+		} else {
+			// Album gain pools the gating blocks of every track, which the
+			// history does not keep.
+			measure = nums
+		}
+	}
+
+	var measured *history.Loudness
+	if len(measure) > 0 {
+		measureAlbum := whole && gains.Album == nil
+		measured = measureLoudness(tracks, measure, paths, &measureAlbum, logger)
+		for id, g := range measured.Tracks {
+			gains.Tracks[id] = g
+		}
+		if measured.Album != nil {
+			gains.Album = measured.Album
+		}
+	} else {
+		logger.Debug("loudness taken from history", "tracks", len(nums))
+	}
+
+	for _, num := range nums {
+		g, ok := gains.Tracks[tracks[num-1].ID]
+		if !ok {
+			continue
+		}
+		gain := loudness.Gain(g.LUFS)
+		items := []metadata.Item{
+			{Name: "----:replaygain_track_gain", Value: loudness.FormatGain(gain)},
+			{Name: "----:replaygain_track_peak", Value: loudness.FormatPeak(g.Peak)},
+			{Name: "----:iTunNORM", Value: loudness.SoundCheck(gain, g.Peak)},
+		}
+		if whole && gains.Album != nil {
+			items = append(items,
+				metadata.Item{Name: "----:replaygain_album_gain", Value: loudness.FormatGain(loudness.Gain(gains.Album.LUFS))},
+				metadata.Item{Name: "----:replaygain_album_peak", Value: loudness.FormatPeak(gains.Album.Peak)},
+			)
+		}
+		if tagged(paths[num], items) {
+			continue
+		}
+		if err := metadata.WriteItems(paths[num], items); err != nil {
+			logger.Warn("replaygain tags failed", "track", num, "err", err)
+		}
+	}
+	if measured == nil || len(measured.Tracks) == 0 {
+		return nil
+	}
+	return measured
+}
+
+// tagged reports whether the file at path already has every item.
+func tagged(path string, items []metadata.Item) bool {
+	tags, err := metadata.ReadTags(path)
+	if err != nil {
+		return false
+	}
+	for _, item := range items {
+		if tags[strings.TrimPrefix(item.Name, "----:")] != item.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// measureLoudness decodes and measures the tracks, a few at a time. When a
+// track fails the album cannot be measured, so whole is cleared.
+func measureLoudness(tracks []structs.TrackData, nums []int, paths map[int]string, whole *bool, logger *slog.Logger) *history.Loudness {
+	results := make([]loudness.Result, len(nums))
+	failed := make([]bool, len(nums))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, runtime.NumCPU())
+	for i, num := range nums {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			r, err := loudness.Analyze(paths[num])
+			if err != nil {
+				logger.Warn("loudness analysis failed", "track", num, "err", err)
+				failed[i] = true
+				return
+			}
+			results[i] = r
+		}()
+	}
+	wg.Wait()
+
+	gains := &history.Loudness{Tracks: make(map[string]history.Gain)}
+	for i, num := range nums {
+		if failed[i] {
+			*whole = false
+			continue
+		}
+		gains.Tracks[tracks[num-1].ID] = history.Gain{LUFS: results[i].Loudness, Peak: results[i].Peak}
+	}
+	if *whole {
+		album := loudness.Album(results)
+		gains.Album = &history.Gain{LUFS: album.Loudness, Peak: album.Peak}
+	}
+	return gains
+}
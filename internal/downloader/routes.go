@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"fmt"
+	"main/internal/classical"
+	"main/internal/core"
+	"main/internal/naming"
+	"main/internal/routing"
+	"main/internal/utils"
+	"main/utils/structs"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// routeLayout returns the root and naming formats for an item saved in format,
+// after applying compilation-folder-format to compilations, the
+// classical-naming preset to classical items and then the first output route
+// that matches facts. The composer-first artist folder is not used for
+// playlists. The format is added to the album and playlist folder names when
+// needsSuffix says so, so that one format does not find the files of another
+// and skip them.
+func routeLayout(format string, facts routing.Facts) routing.Layout {
+	defaults := routing.Layout{
+		Root:                 formatSaveFolder(format),
+		ArtistFolderFormat:   core.Config.ArtistFolderFormat,
+		AlbumFolderFormat:    core.Config.AlbumFolderFormat,
+		PlaylistFolderFormat: core.Config.PlaylistFolderFormat,
+		SongFileFormat:       core.Config.SongFileFormat,
+	}
+	if facts.Compilation && core.Config.CompilationFolderFormat != "" {
+		defaults.ArtistFolderFormat = core.Config.CompilationFolderFormat
+	}
+	if preset, ok := classical.Presets[core.Config.ClassicalNaming]; ok && facts.Classical {
+		if preset.ArtistFolderFormat != "" && facts.Source == "album" {
+			defaults.ArtistFolderFormat = preset.ArtistFolderFormat
+		}
+		if preset.SongFileFormat != "" {
+			defaults.SongFileFormat = preset.SongFileFormat
+		}
+	}
+	layout := routing.Resolve(core.Config.OutputRoutes, defaults, facts)
+	suffix := " [" + strings.ToUpper(format) + "]"
+	if needsSuffix(format, layout.Root, layout.AlbumFolderFormat, layout.SongFileFormat) {
+		layout.AlbumFolderFormat += suffix
+	}
+	if needsSuffix(format, layout.Root, layout.PlaylistFolderFormat, layout.SongFileFormat) {
+		layout.PlaylistFolderFormat += suffix
+	}
+	return layout
+}
+
+// needsSuffix reports whether folders of format under root need the format
+// in their name. It depends on config.yaml only, never on the formats of the
+// current run, so a library is named the same however it was downloaded.
+// ALAC keeps the plain names. An AAC variant other than aac-type always
+// shares its root with aac-type. Any other format needs the suffix when
+// another format can be saved under root and neither folderFormat nor
+// songFormat uses {Codec}.
+func needsSuffix(format, root, folderFormat, songFormat string) bool {
+	switch {
+	case format == "alac":
+		return false
+	case isAacFormat(format) && format != configAacType():
+		return true
+	case naming.Uses(folderFormat, "Codec") || naming.Uses(songFormat, "Codec"):
+		return false
+	}
+	for _, other := range []string{"alac", "atmos", "aac"} {
+		if other != formatFamily(format) && slices.Contains(formatRoots(other), filepath.Clean(root)) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatRoots are the roots a format family can be saved under: its save
+// folder and the root of every output route that does not exclude its codec.
+func formatRoots(family string) []string {
+	roots := []string{filepath.Clean(formatSaveFolder(family))}
+	for _, r := range core.Config.OutputRoutes {
+		if r.Root != "" && (len(r.Codec) == 0 || slices.ContainsFunc(r.Codec, func(c string) bool { return formatFamily(codecFormat(c)) == family })) {
+			roots = append(roots, filepath.Clean(r.Root))
+		}
+	}
+	return roots
+}
+
+// albumFacts are the routing facts shared by every item of an album or
+// playlist. Codec and quality are left for the caller.
+func albumFacts(meta *structs.AutoGenerated, albumId, storefront string) routing.Facts {
+	f := routing.Facts{
+		Genres:      meta.Data[0].Attributes.GenreNames,
+		Type:        "song",
+		Source:      "album",
+		Storefront:  storefront,
+		Explicit:    meta.Data[0].Attributes.ContentRating == "explicit",
+		Classical:   slices.ContainsFunc(meta.Data[0].Relationships.Tracks.Data, func(t structs.TrackData) bool { return t.Classical }),
+		Compilation: isCompilation(meta),
+	}
+	if strings.Contains(albumId, "pl.") {
+		f.Source = "playlist"
+	}
+	return f
+}
+
+// trackFacts narrows the album facts down to one track.
+func trackFacts(track structs.TrackData, meta *structs.AutoGenerated, albumId, storefront string) routing.Facts {
+	f := albumFacts(meta, albumId, storefront)
+	if len(track.Attributes.GenreNames) > 0 {
+		f.Genres = track.Attributes.GenreNames
+	}
+	if track.Type == "music-videos" {
+		f.Type = "music-video"
+	}
+	f.Explicit = track.Attributes.ContentRating == "explicit"
+	f.Classical = track.Classical
+	return f
+}
+
+// codecFamily maps a chain codec to the codec a route can match on.
+func codecFamily(codec string) string {
+	switch {
+	case strings.HasPrefix(codec, "alac"):
+		return "alac"
+	case strings.HasPrefix(codec, "aac"):
+		return "aac"
+	}
+	return codec
+}
+
+// qualityFacts classifies an ALAC quality string such as "24B-96.0kHz".
+// Anything that is not ALAC is lossy.
+func qualityFacts(codec, rawQuality string) (quality string, bitDepth int) {
+	if codecFamily(codec) != "alac" {
+		return "lossy", 0
+	}
+	var kHz float64
+	if _, err := fmt.Sscanf(rawQuality, "%dB-%fkHz", &bitDepth, &kHz); err != nil {
+		return "", 0
+	}
+	if kHz > 48 {
+		return "hi-res", bitDepth
+	}
+	return "lossless", bitDepth
+}
+
+// albumQualityFacts fills in the codec and quality of an album saved in
+// format. rawQuality is the best ALAC variant of the album, if it was probed.
+func albumQualityFacts(f routing.Facts, meta *structs.AutoGenerated, format, rawQuality string) routing.Facts {
+	f.Codec = codecFamily(format)
+	f.Quality, f.BitDepth = qualityFacts(format, rawQuality)
+	if f.Quality == "" {
+		f.Quality = "lossless"
+		for _, t := range meta.Data[0].Relationships.Tracks.Data {
+			if utils.Contains(t.Attributes.AudioTraits, "hi-res-lossless") && *core.Alac_max > 48000 {
+				f.Quality = "hi-res"
+				break
+			}
+		}
+	}
+	return f
+}
+
+// SingleMVLayout is the layout of a music video downloaded from its own URL.
+// It is saved under the ALAC root unless a route says otherwise.
+func SingleMVLayout(storefront string, genres []string, contentRating string) routing.Layout {
+	return routeLayout("alac", routing.Facts{
+		Genres:     genres,
+		Type:       "music-video",
+		Source:     "album",
+		Storefront: storefront,
+		Explicit:   contentRating == "explicit",
+	})
+}
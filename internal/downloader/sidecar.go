@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"log/slog"
+	"main/internal/core"
+	"main/internal/musicbrainz"
+	"main/internal/nfo"
+	"main/utils/structs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	htmlTag    = regexp.MustCompile("<[^>]*>")
+	blankLines = regexp.MustCompile(`\n{2,}`)
+
+	// artistNfoMu serialises the updates of artist.nfo by albums of the
+	// same artist saved at the same time.
+	artistNfoMu sync.Mutex
+)
+
+// albumReview is the editorial notes of the album without markup, followed
+// by the Qobuz description, each marked with its source. It is the comment
+// of every track and the review in album.nfo.
+func albumReview(meta *structs.AutoGenerated, qobuzDesc string) string {
+	var review string
+	if notes := meta.Data[0].Attributes.EditorialNotes; notes != nil && notes.Standard != "" {
+		text := htmlTag.ReplaceAllString(notes.Standard, "")
+		if text = strings.TrimSpace(blankLines.ReplaceAllString(text, "\n")); text != "" {
+			review = "©Copyright Apple Music：" + text
+		}
+	}
+	if qobuzDesc != "" {
+		if review != "" {
+			review += "\n——————————————————\n"
+		}
+		review += "©Copyright Qobuz：" + qobuzDesc
+	}
+	return review
+}
+
+// sidecarAlbum collects what album.nfo and album.json say about an album.
+// Names are in tag-language, like the tags. MusicBrainz IDs are looked up by
+// UPC with musicbrainz-lookup on.
+func sidecarAlbum(meta *structs.AutoGenerated, albumId, qobuzDesc string, logger *slog.Logger) *nfo.Album {
+	attrs := meta.Data[0].Attributes
+	var songs []structs.TrackData
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.Type != "music-videos" {
+			songs = append(songs, t)
+		}
+	}
+	var first structs.TrackData
+	if len(songs) > 0 {
+		first = songs[0]
+	}
+	names := trackTagNames(meta, first)
+	a := &nfo.Album{
+		ID:          albumId,
+		URL:         attrs.URL,
+		Title:       names.album,
+		Artist:      names.albumArtist,
+		ReleaseDate: attrs.ReleaseDate,
+		Label:       attrs.RecordLabel,
+		UPC:         attrs.Upc,
+		Copyright:   attrs.Copyright,
+		Single:      attrs.IsSingle,
+		Compilation: isCompilation(meta),
+		Review:      albumReview(meta, qobuzDesc),
+		DiscCount:   discCount(meta, albumId),
+	}
+	for _, g := range attrs.GenreNames {
+		// Apple adds the catch-all "Music" to every album.
+		if g != "Music" {
+			a.Genres = append(a.Genres, g)
+		}
+	}
+	switch {
+	case a.Compilation && core.Config.CompilationArtist != "":
+		a.Artists = []nfo.Artist{{Name: core.Config.CompilationArtist}}
+	case len(meta.Data[0].Relationships.Artists.Data) > 0:
+		for _, artist := range meta.Data[0].Relationships.Artists.Data {
+			a.Artists = append(a.Artists, nfo.Artist{ID: artist.ID, Name: artist.Attributes.Name})
+		}
+	default:
+		a.Artists = []nfo.Artist{{Name: names.albumArtist}}
+	}
+	for _, t := range songs {
+		n := trackTagNames(meta, t)
+		artist, _ := localized(t.Attributes.ArtistName, t.Secondary.ArtistName, core.Config.TagLanguage == "secondary")
+		a.Tracks = append(a.Tracks, nfo.Track{
+			ID:         t.ID,
+			Disc:       t.Attributes.DiscNumber,
+			Number:     t.Attributes.TrackNumber,
+			Title:      n.title,
+			Artist:     artist,
+			Composer:   n.composer,
+			ISRC:       t.Attributes.Isrc,
+			DurationMs: t.Attributes.DurationInMillis,
+			Explicit:   t.Attributes.ContentRating == "explicit",
+		})
+	}
+
+	if core.Config.MusicBrainzLookup {
+		release, err := musicbrainz.LookupBarcode(attrs.Upc, len(songs))
+		if err != nil {
+			logger.Warn("musicbrainz lookup failed", "upc", attrs.Upc, "err", err)
+		}
+		if release != nil {
+			a.MusicBrainzAlbumID, a.MusicBrainzReleaseGroupID = release.ID, release.ReleaseGroupID
+			for i := range a.Artists {
+				a.Artists[i].MusicBrainzID = release.ArtistID(a.Artists[i].Name)
+			}
+			for i := range a.Tracks {
+				a.Tracks[i].MusicBrainzTrackID = release.RecordingID(a.Tracks[i].Disc, a.Tracks[i].Number)
+			}
+		}
+	}
+	for i := range a.Artists {
+		if a.Artists[i].MusicBrainzID == "" && strings.EqualFold(a.Artists[i].Name, "Various Artists") {
+			a.Artists[i].MusicBrainzID = musicbrainz.VariousArtistsID
+		}
+	}
+	return a
+}
+
+// writeSidecars writes album.nfo and album.json into the album folder, as
+// nfo and album-json ask, and adds the album to artist.nfo in the artist
+// folder. There is no artist.nfo when albums are not grouped in artist
+// folders.
+func writeSidecars(a *nfo.Album, singerFolder, albumFolder string, artistFolder bool, logger *slog.Logger) {
+	write := func(path string, render func() ([]byte, error)) {
+		b, err := render()
+		if err == nil {
+			err = os.WriteFile(path, b, 0644)
+		}
+		if err != nil {
+			logger.Warn("sidecar file failed", "path", path, "err", err)
+		}
+	}
+	if core.Config.Nfo {
+		write(filepath.Join(albumFolder, "album.nfo"), func() ([]byte, error) { return nfo.AlbumNFO(*a) })
+		if artistFolder && len(a.Artists) > 0 {
+			path := filepath.Join(singerFolder, "artist.nfo")
+			artistNfoMu.Lock()
+			write(path, func() ([]byte, error) {
+				existing, err := os.ReadFile(path)
+				if err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+				return nfo.ArtistNFO(existing, a.Artists[0], *a)
+			})
+			artistNfoMu.Unlock()
+		}
+	}
+	if core.Config.AlbumJSON {
+		write(filepath.Join(albumFolder, "album.json"), func() ([]byte, error) { return nfo.JSON(*a) })
+	}
+}
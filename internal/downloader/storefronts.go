@@ -0,0 +1,284 @@
+package downloader
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"main/internal/api"
+	"main/internal/core"
+	"main/internal/errs"
+	"main/internal/utils"
+	"main/utils/ampapi"
+	"main/utils/structs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// storefrontAlbum is an album as the catalog of one storefront carries it.
+type storefrontAlbum struct {
+	Storefront string `json:"storefront"`
+	AlbumID    string `json:"albumId,omitempty"`
+	Tracks     int    `json:"tracks"`
+	Missing    int    `json:"missing"`
+	HiRes      int    `json:"hiRes"`
+	Lossless   int    `json:"lossless"`
+	Atmos      int    `json:"atmos"`
+	Error      string `json:"error,omitempty"`
+
+	err    error
+	tracks map[string]structs.TrackData // playable tracks by trackKey
+}
+
+// storefrontResolution is the result of the cross-storefront resolver for
+// one album: the album in every configured storefront, the album's own
+// storefront first.
+type storefrontResolution struct {
+	Albums []storefrontAlbum
+}
+
+// ripAccount is the account an album's metadata is read with. When the
+// cross-storefront resolver will run, an album of a storefront without an
+// account is read with the first account, without the mismatch warning,
+// since the resolver picks the accounts per track. Playlists and runs
+// without the resolver keep the usual lookup.
+func ripAccount(albumId, storefront string) (*structs.Account, error) {
+	if !core.Config.CrossStorefront || strings.Contains(albumId, "pl.") || len(core.Config.Accounts) == 0 {
+		return core.GetAccountForStorefront(storefront)
+	}
+	for i := range core.Config.Accounts {
+		if strings.EqualFold(core.Config.Accounts[i].Storefront, storefront) {
+			return &core.Config.Accounts[i], nil
+		}
+	}
+	return &core.Config.Accounts[0], nil
+}
+
+// resolveStorefronts looks the album up in every storefront that has an
+// account. Regions are matched by UPC, falling back to the same album ID.
+func resolveStorefronts(meta *structs.AutoGenerated, albumId, storefront string, logger *slog.Logger) *storefrontResolution {
+	home := strings.ToLower(storefront)
+	r := &storefrontResolution{Albums: []storefrontAlbum{newStorefrontAlbum(home, albumId, meta, nil)}}
+
+	var seen []string
+	for _, acc := range core.Config.Accounts {
+		sf := strings.ToLower(acc.Storefront)
+		if sf == "" || sf == home || slices.Contains(seen, sf) {
+			continue
+		}
+		seen = append(seen, sf)
+
+		regionId := albumId
+		if upc := meta.Data[0].Attributes.Upc; upc != "" {
+			resp, err := ampapi.GetAlbumsByUpc(sf, upc, core.Config.Language, core.DeveloperToken)
+			if err == nil && len(resp.Data) > 0 {
+				regionId = resp.Data[0].ID
+			} else {
+				logger.Debug("album not found by UPC", "storefront", sf, "upc", upc, "err", err)
+			}
+		}
+		regionMeta, err := api.GetMeta(regionId, &acc, sf)
+		if err == nil && len(regionMeta.Data) == 0 {
+			err = errs.New(errs.CodeGeoUnavailable, "empty album metadata")
+		}
+		if err != nil {
+			logger.Info("album unavailable in storefront", "storefront", sf, "albumId", regionId, "err", err)
+			r.Albums = append(r.Albums, newStorefrontAlbum(sf, "", nil, err))
+			continue
+		}
+		r.Albums = append(r.Albums, newStorefrontAlbum(sf, regionId, regionMeta, nil))
+	}
+	return r
+}
+
+func newStorefrontAlbum(sf, albumId string, meta *structs.AutoGenerated, err error) storefrontAlbum {
+	a := storefrontAlbum{Storefront: sf, AlbumID: albumId, err: err, tracks: make(map[string]structs.TrackData)}
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	for _, t := range meta.Data[0].Relationships.Tracks.Data {
+		if t.Attributes.PlayParams.ID == "" {
+			continue
+		}
+		a.tracks[trackKey(t)] = t
+		if t.Type == "music-videos" {
+			continue
+		}
+		a.Tracks++
+		switch {
+		case utils.Contains(t.Attributes.AudioTraits, "hi-res-lossless"):
+			a.HiRes++
+		case utils.Contains(t.Attributes.AudioTraits, "lossless"):
+			a.Lossless++
+		}
+		if utils.Contains(t.Attributes.AudioTraits, "atmos") {
+			a.Atmos++
+		}
+	}
+	a.Missing = max(meta.Data[0].Attributes.TrackCount-len(a.tracks), 0)
+	return a
+}
+
+// trackKey identifies a track across storefronts: by ISRC, or by its disc
+// and track number when the ISRC is not known.
+func trackKey(t structs.TrackData) string {
+	if t.Attributes.Isrc != "" {
+		return t.Attributes.Isrc
+	}
+	return fmt.Sprintf("%d-%d", t.Attributes.DiscNumber, t.Attributes.TrackNumber)
+}
+
+// fillMissing adds the songs that the album's own storefront lacks from the
+// first other storefront that carries them, in disc and track order. It
+// returns the number of songs added.
+func (r *storefrontResolution) fillMissing(meta *structs.AutoGenerated) int {
+	tracks := &meta.Data[0].Relationships.Tracks.Data
+	have := make(map[string]bool)
+	for _, t := range *tracks {
+		have[trackKey(t)] = true
+	}
+	added := 0
+	for _, a := range r.Albums[1:] {
+		for key, t := range a.tracks {
+			if have[key] || t.Type == "music-videos" {
+				continue
+			}
+			have[key] = true
+			t.Source = structs.TrackSource{Storefront: a.Storefront, ID: t.ID}
+			*tracks = append(*tracks, t)
+			added++
+		}
+	}
+	if added > 0 {
+		slices.SortStableFunc(*tracks, func(a, b structs.TrackData) int {
+			return cmp.Or(cmp.Compare(a.Attributes.DiscNumber, b.Attributes.DiscNumber), cmp.Compare(a.Attributes.TrackNumber, b.Attributes.TrackNumber))
+		})
+	}
+	return added
+}
+
+// trackRank orders the versions of a track for format: higher is better.
+func trackRank(t structs.TrackData, format string) int {
+	traits := t.Attributes.AudioTraits
+	switch {
+	case format == "atmos":
+		if utils.Contains(traits, "atmos") {
+			return 2
+		}
+	case isAacFormat(format):
+	case utils.Contains(traits, "hi-res-lossless") && *core.Alac_max > 48000:
+		return 3
+	case utils.Contains(traits, "lossless"):
+		return 2
+	}
+	return 1
+}
+
+// pick chooses the storefronts a song is downloaded from in format: the one
+// with the best version first, the album's own storefront on a tie. It
+// returns the accounts of every storefront that carries the song, the best
+// storefront's accounts first, and for each account the source to set on
+// the track while that account downloads it.
+func (r *storefrontResolution) pick(track structs.TrackData, format string) ([]structs.Account, []structs.TrackSource, error) {
+	key := trackKey(track)
+	type candidate struct {
+		album *storefrontAlbum
+		track structs.TrackData
+		rank  int
+	}
+	var candidates []candidate
+	for i := range r.Albums {
+		a := &r.Albums[i]
+		if t, ok := a.tracks[key]; ok {
+			candidates = append(candidates, candidate{a, t, trackRank(t, format)})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, errs.New(errs.CodeGeoUnavailable, "没有任何区域提供此曲目")
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int { return b.rank - a.rank })
+
+	var accounts []structs.Account
+	var sources []structs.TrackSource
+	for _, c := range candidates {
+		var source structs.TrackSource
+		if c.album != &r.Albums[0] {
+			source = structs.TrackSource{Storefront: c.album.Storefront, ID: c.track.ID}
+		}
+		for _, acc := range core.Config.Accounts {
+			if strings.ToLower(acc.Storefront) == c.album.Storefront {
+				accounts = append(accounts, acc)
+				sources = append(sources, source)
+			}
+		}
+	}
+	if len(accounts) == 0 {
+		return nil, nil, errs.New(errs.CodeGeoUnavailable, "提供此曲目的区域没有可用账户")
+	}
+	return accounts, sources, nil
+}
+
+// precheck replaces the first-track precheck: an account works when its
+// storefront carries at least one of the selected songs.
+func (r *storefrontResolution) precheck(meta *structs.AutoGenerated, selected []int) ([]structs.Account, []accountCheck, error) {
+	var working []structs.Account
+	var checks []accountCheck
+	var lastErr error
+	for _, acc := range core.Config.Accounts {
+		var err error
+		i := slices.IndexFunc(r.Albums, func(a storefrontAlbum) bool { return a.Storefront == strings.ToLower(acc.Storefront) })
+		switch {
+		case i < 0:
+			err = errs.New(errs.CodeGeoUnavailable, "账户区域未被解析")
+		case r.Albums[i].err != nil:
+			err = r.Albums[i].err
+		default:
+			err = errs.New(errs.CodeGeoUnavailable, "此区域没有所选曲目")
+			for _, n := range selected {
+				if _, ok := r.Albums[i].tracks[trackKey(meta.Data[0].Relationships.Tracks.Data[n-1])]; ok {
+					err = nil
+					break
+				}
+			}
+		}
+		checks = append(checks, newAccountCheck(acc, err))
+		if err == nil {
+			working = append(working, acc)
+		} else {
+			lastErr = err
+		}
+	}
+	if len(working) == 0 {
+		if lastErr == nil {
+			lastErr = errs.New(errs.CodeGeoUnavailable, "所有区域均无法提供此专辑")
+		}
+		return nil, checks, fmt.Errorf("所有账户均无法访问此专辑，任务中止: %w", lastErr)
+	}
+	return working, checks, nil
+}
+
+// print shows what every storefront carries.
+func (r *storefrontResolution) print() {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Storefront", "Album ID", "Tracks", "Missing", "Hi-Res", "Lossless", "Atmos"})
+	for _, a := range r.Albums {
+		if a.err != nil {
+			table.Append([]string{strings.ToUpper(a.Storefront), a.Error, "-", "-", "-", "-", "-"})
+			continue
+		}
+		table.Append([]string{strings.ToUpper(a.Storefront), a.AlbumID, fmt.Sprint(a.Tracks), fmt.Sprint(a.Missing), fmt.Sprint(a.HiRes), fmt.Sprint(a.Lossless), fmt.Sprint(a.Atmos)})
+	}
+	table.Render()
+}
+
+// catalogEntry returns the song ID and storefront the audio of track is
+// fetched from.
+func catalogEntry(track structs.TrackData, storefront string) (id, sf string) {
+	if track.Source.Storefront != "" {
+		return track.Source.ID, track.Source.Storefront
+	}
+	return track.ID, storefront
+}
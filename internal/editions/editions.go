@@ -0,0 +1,232 @@
+// Package editions groups the editions of one release (standard, deluxe,
+// remastered, clean and explicit versions, the same album in another
+// storefront) and picks one per group by a configurable policy.
+//
+// Two albums belong to the same group when any of these holds:
+//
+//   - same normalized title, artist and kind (album or single/EP), and when
+//     the tracks of both are known, at least one shared ISRC
+//   - same UPC family: the same GTIN written as UPC-A, EAN-13 or GTIN-14
+//   - the ISRCs of their tracks overlap by at least half (Jaccard index)
+package editions
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Quality levels of an edition.
+const (
+	AAC = iota
+	Lossless
+	HiRes
+)
+
+// Edition is one catalog album.
+type Edition struct {
+	ID            string
+	Name          string
+	Artist        string
+	Single        bool // single or EP; never grouped by title with albums
+	ReleaseDate   string
+	ContentRating string
+	UPC           string
+	TrackCount    int
+	ISRCs         []string
+	Quality       int
+}
+
+// Rules are the policy rules, applied in order as tie-breakers.
+var Rules = []string{"most-tracks", "highest-quality", "explicit", "clean", "earliest", "latest"}
+
+// DefaultPolicy is used when edition-policy is empty.
+var DefaultPolicy = Policy{"most-tracks", "highest-quality", "earliest"}
+
+// Policy ranks the editions of a group; the first rule that tells two
+// editions apart decides.
+type Policy []string
+
+// ParsePolicy reads a comma separated list of rules.
+func ParsePolicy(s string) (Policy, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultPolicy, nil
+	}
+	var p Policy
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if !slices.Contains(Rules, rule) {
+			return nil, fmt.Errorf("未知的版本选择规则 %q，可选: %s", rule, strings.Join(Rules, ", "))
+		}
+		p = append(p, rule)
+	}
+	return p, nil
+}
+
+// compare returns a negative number when a is the better edition, and the
+// rule that decided.
+func (p Policy) compare(a, b Edition) (int, string) {
+	for _, rule := range p {
+		var c int
+		switch rule {
+		case "most-tracks":
+			c = cmp.Compare(b.TrackCount, a.TrackCount)
+		case "highest-quality":
+			c = cmp.Compare(b.Quality, a.Quality)
+		case "explicit", "clean":
+			c = cmp.Compare(rank(b.ContentRating == rule), rank(a.ContentRating == rule))
+		case "earliest":
+			c = strings.Compare(a.ReleaseDate, b.ReleaseDate)
+		case "latest":
+			c = strings.Compare(b.ReleaseDate, a.ReleaseDate)
+		}
+		if c != 0 {
+			return c, rule
+		}
+	}
+	return 0, ""
+}
+
+func rank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Skip is an edition that lost to another edition of its group.
+type Skip struct {
+	Index  int    // into the editions passed to Dedup
+	Kept   int    // the edition that was kept instead
+	Match  string // why the two are the same release
+	Rule   string // the policy rule that decided, empty on a full tie
+	Reason string // Match and Rule for display
+}
+
+// Dedup groups editions and keeps the best of each group. It returns the
+// indexes of the kept editions in input order and the skipped ones.
+func Dedup(editions []Edition, policy Policy) (kept []int, skipped []Skip) {
+	parent := make([]int, len(editions))
+	match := make([]string, len(editions))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range editions {
+		for j := i + 1; j < len(editions); j++ {
+			if why := sameRelease(editions[i], editions[j]); why != "" {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[rj] = ri
+					if match[j] == "" {
+						match[j] = why
+					}
+					if match[i] == "" {
+						match[i] = why
+					}
+				}
+			}
+		}
+	}
+
+	best := make(map[int]int)
+	for i := range editions {
+		root := find(i)
+		if b, ok := best[root]; !ok {
+			best[root] = i
+		} else if c, _ := policy.compare(editions[i], editions[b]); c < 0 {
+			best[root] = i
+		}
+	}
+	for i := range editions {
+		b := best[find(i)]
+		if b == i {
+			kept = append(kept, i)
+			continue
+		}
+		_, rule := policy.compare(editions[b], editions[i])
+		why := sameRelease(editions[b], editions[i])
+		if why == "" {
+			why = match[i] // grouped through a third edition
+		}
+		reason := why
+		if rule != "" {
+			reason += ", 按 " + rule + " 保留 " + editions[b].ID
+		} else {
+			reason += ", 保留 " + editions[b].ID
+		}
+		skipped = append(skipped, Skip{Index: i, Kept: b, Match: why, Rule: rule, Reason: reason})
+	}
+	return kept, skipped
+}
+
+// sameRelease returns why a and b are editions of one release, or "".
+func sameRelease(a, b Edition) string {
+	if a.UPC != "" && gtin(a.UPC) == gtin(b.UPC) {
+		return "同一 UPC"
+	}
+	overlap := isrcOverlap(a.ISRCs, b.ISRCs)
+	// A title match alone would merge distinct albums that share a name, so
+	// it needs a shared recording when both track lists are known.
+	knownTracks := len(a.ISRCs) > 0 && len(b.ISRCs) > 0
+	if a.Single == b.Single && strings.EqualFold(a.Artist, b.Artist) && NormalizeTitle(a.Name) == NormalizeTitle(b.Name) && (!knownTracks || overlap > 0) {
+		return "同名"
+	}
+	if overlap >= 0.5 {
+		return fmt.Sprintf("ISRC 重合 %.0f%%", overlap*100)
+	}
+	return ""
+}
+
+// gtin normalizes a UPC-A, EAN-13 or GTIN-14 code to the same digits.
+func gtin(code string) string {
+	return strings.TrimLeft(code, "0")
+}
+
+// isrcOverlap is the Jaccard index of two ISRC lists.
+func isrcOverlap(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	set := make(map[string]bool, len(a))
+	for _, isrc := range a {
+		set[isrc] = true
+	}
+	shared, union := 0, len(set)
+	seen := make(map[string]bool, len(b))
+	for _, isrc := range b {
+		if seen[isrc] {
+			continue
+		}
+		seen[isrc] = true
+		if set[isrc] {
+			shared++
+		} else {
+			union++
+		}
+	}
+	return float64(shared) / float64(union)
+}
+
+var (
+	typeSuffix     = regexp.MustCompile(`(?i)\s+-\s+(single|ep)$`)
+	editionBracket = regexp.MustCompile(`(?i)\s*[(\[][^)\]]*(deluxe|remaster|expanded|edition|anniversary|bonus|special|explicit|clean)[^)\]]*[)\]]`)
+	spaces         = regexp.MustCompile(`\s+`)
+)
+
+// NormalizeTitle strips the parts of a release title that differ between
+// editions of the same release: " - Single" / " - EP" and bracketed
+// edition notes such as "(Deluxe Edition)" or "[2011 Remaster]". A bare
+// "Version" is kept, since "(Taylor's Version)" names a release of its own.
+func NormalizeTitle(name string) string {
+	name = typeSuffix.ReplaceAllString(name, "")
+	name = editionBracket.ReplaceAllString(name, "")
+	return strings.ToLower(strings.TrimSpace(spaces.ReplaceAllString(name, " ")))
+}
@@ -0,0 +1,176 @@
+// Package errs defines the error classes shared by api, runv14, runv3 and
+// downloader, so callers can branch on them with errors.Is / errors.As and the
+// CLI can turn them into stable exit codes and JSON "code" fields.
+package errs
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Code identifies a class of failure. The string value is what appears in the
+// "code" field of --json-output events.
+type Code string
+
+const (
+	CodeUnknown                Code = "unknown"
+	CodeConfig                 Code = "config-invalid"
+	CodeInvalidURL             Code = "invalid-url"
+	CodeTokenInvalid           Code = "token-invalid"
+	CodeGeoUnavailable         Code = "geo-unavailable"
+	CodeCodecUnavailable       Code = "codec-unavailable"
+	CodeManifestMissing        Code = "manifest-missing"
+	CodeDecryptPortUnreachable Code = "decrypt-port-unreachable"
+	CodeDecryptFailed          Code = "decrypt-failed"
+	CodeNetwork                Code = "network"
+	CodeTaggingFailed          Code = "tagging-failed"
+	CodeIntegrityFailed        Code = "integrity-failed"
+	CodeDiskFull               Code = "disk-full"
+	CodeDependencyMissing      Code = "dependency-missing"
+	CodeNotFound               Code = "not-found"
+)
+
+// Process exit codes. ExitMixed is used when a run produced failures of more
+// than one class.
+const (
+	ExitOK                     = 0
+	ExitUnknown                = 1
+	ExitConfig                 = 2
+	ExitInvalidURL             = 3
+	ExitTokenInvalid           = 4
+	ExitGeoUnavailable         = 5
+	ExitCodecUnavailable       = 6
+	ExitManifestMissing        = 7
+	ExitDecryptPortUnreachable = 8
+	ExitDecryptFailed          = 9
+	ExitNetwork                = 10
+	ExitTaggingFailed          = 11
+	ExitIntegrityFailed        = 12
+	ExitDiskFull               = 13
+	ExitDependencyMissing      = 14
+	ExitNotFound               = 15
+	ExitMixed                  = 20
+)
+
+var exitCodes = map[Code]int{
+	CodeUnknown:                ExitUnknown,
+	CodeConfig:                 ExitConfig,
+	CodeInvalidURL:             ExitInvalidURL,
+	CodeTokenInvalid:           ExitTokenInvalid,
+	CodeGeoUnavailable:         ExitGeoUnavailable,
+	CodeCodecUnavailable:       ExitCodecUnavailable,
+	CodeManifestMissing:        ExitManifestMissing,
+	CodeDecryptPortUnreachable: ExitDecryptPortUnreachable,
+	CodeDecryptFailed:          ExitDecryptFailed,
+	CodeNetwork:                ExitNetwork,
+	CodeTaggingFailed:          ExitTaggingFailed,
+	CodeIntegrityFailed:        ExitIntegrityFailed,
+	CodeDiskFull:               ExitDiskFull,
+	CodeDependencyMissing:      ExitDependencyMissing,
+	CodeNotFound:               ExitNotFound,
+}
+
+// Error is a classified error. Msg is a human readable context message and Err
+// the underlying cause, either of which may be empty.
+type Error struct {
+	Code Code
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Msg != "" && e.Err != nil:
+		return e.Msg + ": " + e.Err.Error()
+	case e.Msg != "":
+		return e.Msg
+	case e.Err != nil:
+		return e.Err.Error()
+	}
+	return string(e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel of the same class, so that
+// errors.Is(err, errs.ErrGeoUnavailable) matches any geo-unavailable error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Msg == "" && t.Err == nil && t.Code == e.Code
+}
+
+// Sentinels for errors.Is.
+var (
+	ErrConfig                 = &Error{Code: CodeConfig}
+	ErrInvalidURL             = &Error{Code: CodeInvalidURL}
+	ErrTokenInvalid           = &Error{Code: CodeTokenInvalid}
+	ErrGeoUnavailable         = &Error{Code: CodeGeoUnavailable}
+	ErrCodecUnavailable       = &Error{Code: CodeCodecUnavailable}
+	ErrManifestMissing        = &Error{Code: CodeManifestMissing}
+	ErrDecryptPortUnreachable = &Error{Code: CodeDecryptPortUnreachable}
+	ErrDecryptFailed          = &Error{Code: CodeDecryptFailed}
+	ErrNetwork                = &Error{Code: CodeNetwork}
+	ErrTaggingFailed          = &Error{Code: CodeTaggingFailed}
+	ErrIntegrityFailed        = &Error{Code: CodeIntegrityFailed}
+	ErrDiskFull               = &Error{Code: CodeDiskFull}
+	ErrDependencyMissing      = &Error{Code: CodeDependencyMissing}
+	ErrNotFound               = &Error{Code: CodeNotFound}
+)
+
+// New returns a classified error with a message and no cause.
+func New(code Code, msg string) error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// Wrap classifies err under code. It returns nil when err is nil.
+func Wrap(code Code, err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Msg: msg, Err: err}
+}
+
+// CodeOf returns the class of err. Unclassified errors are inspected for
+// well-known system conditions (disk full, network failures) before falling
+// back to CodeUnknown.
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return CodeDiskFull
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return CodeNetwork
+	}
+	return CodeUnknown
+}
+
+// ParseCode looks up a class by its string value, as written in config.
+func ParseCode(s string) (Code, bool) {
+	c := Code(s)
+	_, ok := exitCodes[c]
+	return c, ok
+}
+
+// ExitCode maps a class to its documented process exit code.
+func ExitCode(code Code) int {
+	if code == "" {
+		return ExitOK
+	}
+	if c, ok := exitCodes[code]; ok {
+		return c
+	}
+	return ExitUnknown
+}
@@ -0,0 +1,207 @@
+// Package history keeps the download history: one JSON line per album and
+// output format that finished without errors. Later runs use it to skip
+// albums that are already in the library. Playlists and partial downloads
+// only add a partial line when they have loudness measurements to keep.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry is one finished album in one format.
+type Entry struct {
+	AlbumID    string    `json:"albumId"`
+	UPC        string    `json:"upc,omitempty"`
+	Storefront string    `json:"storefront"`
+	Artist     string    `json:"artist"`
+	Album      string    `json:"album"`
+	Format     string    `json:"format"`
+	Tracks     int       `json:"tracks"`
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+	Loudness   *Loudness `json:"loudness,omitempty"`
+	// Partial entries keep the loudness of a playlist or of some tracks of an
+	// album; they do not count as downloaded.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Loudness is the ReplayGain analysis of an entry, kept so that tagging the
+// album again does not decode it again.
+type Loudness struct {
+	Album  *Gain           `json:"album,omitempty"` // only when the whole album was measured
+	Tracks map[string]Gain `json:"tracks"`          // by catalog track ID
+}
+
+// Gain is the integrated loudness in LUFS and the true peak, 1 being full
+// scale, of a track or an album.
+type Gain struct {
+	LUFS float64 `json:"lufs"`
+	Peak float64 `json:"peak"`
+}
+
+// Store is an opened history file. A nil *Store is an empty history that
+// records nothing, so callers need not check whether history is enabled.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	entries []Entry
+	ids     map[string]bool // by key(albumId, format)
+	upcs    map[string]bool // by key(upc, format)
+}
+
+func key(id, format string) string {
+	return id + "#" + format
+}
+
+// Open reads the history file at path. A missing file is an empty history;
+// lines that cannot be parsed are logged and ignored.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, ids: make(map[string]bool), upcs: make(map[string]bool)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			slog.Warn("ignoring unreadable history line", "file", path, "line", n, "err", err)
+			continue
+		}
+		s.index(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) index(e Entry) {
+	s.entries = append(s.entries, e)
+	if e.Partial {
+		return
+	}
+	if e.AlbumID != "" {
+		s.ids[key(e.AlbumID, e.Format)] = true
+	}
+	if e.UPC != "" {
+		s.upcs[key(e.UPC, e.Format)] = true
+	}
+}
+
+// Has reports whether the album was downloaded before in every one of
+// formats, by catalog ID or, as the same album has a different ID in every
+// storefront, by UPC.
+func (s *Store) Has(albumId, upc string, formats []string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, format := range formats {
+		if !s.ids[key(albumId, format)] && (upc == "" || !s.upcs[key(upc, format)]) {
+			return false
+		}
+	}
+	return len(formats) > 0
+}
+
+// Recorded reports whether the album has an entry in format.
+func (s *Store) Recorded(albumId, format string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[key(albumId, format)]
+}
+
+// Loudness returns the analysis recorded for an album or playlist in a
+// format, the last measurement of each track and of the album taken from
+// every entry, or nil when there is none.
+func (s *Store) Loudness(albumId, format string) *Loudness {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l *Loudness
+	for _, e := range s.entries {
+		if e.AlbumID != albumId || e.Format != format || e.Loudness == nil {
+			continue
+		}
+		if l == nil {
+			l = &Loudness{Tracks: make(map[string]Gain)}
+		}
+		if e.Loudness.Album != nil {
+			l.Album = e.Loudness.Album
+		}
+		for id, g := range e.Loudness.Tracks {
+			l.Tracks[id] = g
+		}
+	}
+	return l
+}
+
+// Entries returns a copy of every entry in file order.
+func (s *Store) Entries() []Entry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Entry(nil), s.entries...)
+}
+
+// Add appends e to the history file.
+func (s *Store) Add(e Entry) error {
+	if s == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.index(e)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Package logging configures the process-wide log/slog logger.
+//
+// Records go to stderr (never stdout, which carries --json-output events and
+// the progress bars) and, when --log-file is set, to a file as well. While
+// progress bars are drawn console records are held back and printed once the
+// bars finish, so they do not tear them. Known secrets are masked before
+// anything is written.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const redacted = "***"
+
+// sensitiveKeys are attribute keys whose values are always masked.
+var sensitiveKeys = []string{"token", "password", "authorization", "cookie", "secret"}
+
+var (
+	console = &consoleWriter{w: os.Stderr}
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// ParseLevel converts a --log-level value to a slog.Level.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q (debug, info, warn, error)", s)
+}
+
+// Setup installs the default logger. The log file, if any, stays open for the
+// lifetime of the process.
+func Setup(level string, logFile string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+	handlers := []slog.Handler{slog.NewTextHandler(console, opts)}
+
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, slog.NewJSONHandler(f, opts))
+	}
+	slog.SetDefault(slog.New(fanout(handlers)))
+	return nil
+}
+
+// AddSecret registers a value that must never appear in log output, such as a
+// media-user-token read from config.
+func AddSecret(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		if len(v) >= 6 {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// HoldConsole queues console output until ReleaseConsole is called. It is
+// used while an mpb.Progress is drawing on the terminal. The log file is
+// written as usual.
+func HoldConsole() {
+	console.hold()
+}
+
+// ReleaseConsole prints the queued console output and writes straight to
+// stderr again.
+func ReleaseConsole() {
+	console.release()
+}
+
+func isSensitive(key string) bool {
+	k := strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func scrub(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	return s
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+// consoleWriter serialises writes to the console, which every album running
+// at the same time logs to, and buffers them while the console is held.
+type consoleWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	held bool
+	buf  bytes.Buffer
+}
+
+func (c *consoleWriter) hold() {
+	c.mu.Lock()
+	c.held = true
+	c.mu.Unlock()
+}
+
+func (c *consoleWriter) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = false
+	if c.buf.Len() > 0 {
+		c.w.Write(c.buf.Bytes())
+		c.buf.Reset()
+	}
+}
+
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.held {
+		return c.buf.Write(p)
+	}
+	return c.w.Write(p)
+}
+
+// multiHandler sends every record to all of its handlers.
+type multiHandler []slog.Handler
+
+func fanout(hs []slog.Handler) slog.Handler {
+	if len(hs) == 1 {
+		return hs[0]
+	}
+	return multiHandler(hs)
+}
+
+func (m multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
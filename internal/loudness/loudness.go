@@ -0,0 +1,225 @@
+// Package loudness measures integrated loudness and true peak as EBU R128
+// specifies them (ITU-R BS.1770-4), per track and per album, and turns
+// them into ReplayGain 2.0 and iTunes Sound Check values.
+package loudness
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"main/internal/audio"
+	"main/internal/metadata"
+)
+
+// Reference is the ReplayGain 2.0 reference loudness in LUFS.
+const Reference = -18.0
+
+// Floor is the loudness of a track with no block above the absolute gate,
+// such as silence.
+const Floor = -70.0
+
+// Result is the measurement of a track or an album.
+type Result struct {
+	Loudness float64 // integrated loudness in LUFS
+	Peak     float64 // true peak as a linear sample value, 1 being full scale
+
+	blocks []float64 // mean square of each 400 ms block, for Album
+}
+
+// Gain is the ReplayGain in dB for an integrated loudness in LUFS.
+func Gain(lufs float64) float64 {
+	return Reference - lufs
+}
+
+// Meter measures one track. Channels are weighted equally, as for the mono
+// and stereo streams of the catalog.
+type Meter struct {
+	channels int
+	filters  []kWeighting
+	peaks    []*truePeak
+
+	step  int        // samples per channel in a 100 ms sub-block
+	count int        // samples per channel in the current sub-block
+	sum   float64    // sum of squares in the current sub-block
+	subs  [3]float64 // the previous three sub-blocks, oldest first
+	nsubs int
+
+	blocks []float64
+}
+
+// NewMeter returns a meter for interleaved audio of the given format.
+func NewMeter(f audio.Format) *Meter {
+	m := &Meter{channels: f.Channels, step: max(f.SampleRate/10, 1)}
+	for range f.Channels {
+		m.filters = append(m.filters, newKWeighting(float64(f.SampleRate)))
+		m.peaks = append(m.peaks, newTruePeak(f.SampleRate))
+	}
+	return m
+}
+
+// Write adds interleaved samples, a whole number of frames.
+func (m *Meter) Write(samples []float64) {
+	for i := 0; i+m.channels <= len(samples); i += m.channels {
+		for c := range m.channels {
+			x := samples[i+c]
+			m.peaks[c].add(x)
+			y := m.filters[c].filter(x)
+			m.sum += y * y
+		}
+		if m.count++; m.count == m.step {
+			m.endSubBlock()
+		}
+	}
+}
+
+// endSubBlock completes a 100 ms sub-block. Gating blocks are 400 ms long
+// and overlap by 75%, so each sub-block completes one.
+func (m *Meter) endSubBlock() {
+	if m.nsubs == 3 {
+		total := m.subs[0] + m.subs[1] + m.subs[2] + m.sum
+		m.blocks = append(m.blocks, total/float64(4*m.step))
+		m.subs[0], m.subs[1] = m.subs[1], m.subs[2]
+		m.subs[2] = m.sum
+	} else {
+		m.subs[m.nsubs] = m.sum
+		m.nsubs++
+	}
+	m.sum, m.count = 0, 0
+}
+
+// Result returns the measurement of everything written so far.
+func (m *Meter) Result() Result {
+	r := Result{blocks: m.blocks, Loudness: integrated(m.blocks)}
+	for _, p := range m.peaks {
+		r.Peak = max(r.Peak, p.peak)
+	}
+	return r
+}
+
+// Album measures the tracks of an album as one programme: the gating blocks
+// of every track are pooled, and the peak is the highest track peak. The
+// results must come from a Meter, not from a cache.
+func Album(tracks []Result) Result {
+	var album Result
+	for _, t := range tracks {
+		album.blocks = append(album.blocks, t.blocks...)
+		album.Peak = max(album.Peak, t.Peak)
+	}
+	album.Loudness = integrated(album.blocks)
+	return album
+}
+
+// integrated applies the absolute gate of -70 LUFS and the relative gate
+// of 10 LU below the loudness of the blocks that pass it.
+func integrated(blocks []float64) float64 {
+	absolute := energy(Floor)
+	mean := func(gate float64) (float64, bool) {
+		var sum float64
+		n := 0
+		for _, b := range blocks {
+			if b > gate {
+				sum += b
+				n++
+			}
+		}
+		return sum / float64(n), n > 0
+	}
+	m, ok := mean(absolute)
+	if !ok {
+		return Floor
+	}
+	m, ok = mean(max(absolute, m/10))
+	if !ok {
+		return Floor
+	}
+	return loudness(m)
+}
+
+func loudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+func energy(lufs float64) float64 {
+	return math.Pow(10, (lufs+0.691)/10)
+}
+
+// Analyze decodes the audio of the file at path and measures it. The
+// priming and padding samples of an AAC track, as its iTunSMPB tag or else
+// its edit list gives them, are left out.
+func Analyze(path string) (Result, error) {
+	s, err := audio.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer s.Close()
+	f := s.Format()
+	if f.Channels == 0 || f.SampleRate == 0 {
+		return Result{}, fmt.Errorf("invalid audio format %+v", f)
+	}
+	priming, samples := playedRange(path)
+	m := NewMeter(f)
+	buf := make([]float64, 4096*f.Channels)
+	var pos uint64 // frames read so far
+	for {
+		n, err := s.Read(buf)
+		frames := uint64(n / f.Channels)
+		from := min(max(priming, pos), pos+frames) - pos
+		to := pos + frames
+		if samples > 0 {
+			to = min(to, priming+samples)
+		}
+		if to = max(to, pos) - pos; to > from {
+			m.Write(buf[from*uint64(f.Channels) : to*uint64(f.Channels)])
+		}
+		pos += frames
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return m.Result(), nil
+}
+
+// playedRange returns the priming samples of the file at path and how many
+// samples are played after them, 0 meaning all of them.
+func playedRange(path string) (priming, samples uint64) {
+	if tags, err := metadata.ReadTags(path); err == nil {
+		if smpb, ok := tags["iTunSMPB"]; ok {
+			if g, err := metadata.ParseSMPB(smpb); err == nil {
+				return uint64(g.Priming), g.Samples
+			}
+		}
+	}
+	if g, ok, err := metadata.ReadGapless(path); err == nil && ok {
+		return uint64(g.Priming), g.Samples
+	}
+	return 0, 0
+}
+
+// FormatGain formats a ReplayGain tag value in dB.
+func FormatGain(gain float64) string {
+	return fmt.Sprintf("%.2f dB", gain)
+}
+
+// FormatPeak formats a ReplayGain peak tag value.
+func FormatPeak(peak float64) string {
+	return fmt.Sprintf("%.6f", peak)
+}
+
+// SoundCheck returns the iTunNORM value that applies gain in dB on Apple
+// players. Its ten fields are the volume adjustment as 1000 and 2500 times
+// the inverse power ratio, twice each for left and right, two statistics
+// fields Apple players ignore, the peak on a 16-bit scale for left and
+// right, and two more ignored fields.
+func SoundCheck(gain, peak float64) string {
+	adjust := func(base float64) uint32 {
+		return uint32(min(math.Round(base*math.Pow(10, -gain/10)), 65534))
+	}
+	p := uint32(min(math.Round(peak*32768), math.MaxUint32))
+	v1000, v2500 := adjust(1000), adjust(2500)
+	return fmt.Sprintf(" %08X %08X %08X %08X %08X %08X %08X %08X %08X %08X", v1000, v1000, v2500, v2500, 0, 0, p, p, 0, 0)
+}
@@ -0,0 +1,369 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Gapless is the encoder delay and padding of an audio track, in samples.
+type Gapless struct {
+	Priming   uint32 // samples before the audio, skipped by the edit list
+	Remainder uint32 // padding samples after the audio
+	Samples   uint64 // samples played, without priming and remainder
+}
+
+// SMPB formats g as an iTunSMPB value.
+func (g Gapless) SMPB() string {
+	return fmt.Sprintf(" 00000000 %08X %08X %016X 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000", g.Priming, g.Remainder, g.Samples)
+}
+
+// ParseSMPB reads an iTunSMPB value.
+func ParseSMPB(s string) (Gapless, error) {
+	var zero uint32
+	var g Gapless
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%x %x %x %x", &zero, &g.Priming, &g.Remainder, &g.Samples); err != nil {
+		return Gapless{}, fmt.Errorf("invalid iTunSMPB %q: %w", s, err)
+	}
+	return g, nil
+}
+
+// ReadGapless reads the priming and remainder of the first audio track of
+// an MP4 file from its edit list, and the total sample count from its
+// sample table or, in fragmented files, from the track runs. ok is false
+// when the file has no edit list that trims any samples.
+func ReadGapless(path string) (g Gapless, ok bool, err error) {
+	g, ok, _, err = readGapless(path)
+	return g, ok, err
+}
+
+// readGapless is ReadGapless that also returns how many samples one unit of
+// the movie timescale, in which the edit list is kept, amounts to.
+func readGapless(path string) (g Gapless, ok bool, tick uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Gapless{}, false, 0, err
+	}
+	defer f.Close()
+	moov, err := findTopLevelBox(f, "moov")
+	if err != nil {
+		return Gapless{}, false, 0, err
+	}
+	trak, trackID := audioTrak(moov)
+	if trak == nil {
+		return Gapless{}, false, 0, errors.New("no audio track")
+	}
+	movieScale := timescale(childBox(moov, "mvhd"))
+	mdia := childBox(trak, "mdia")
+	mediaScale := timescale(childBox(mdia, "mdhd"))
+	if movieScale == 0 || mediaScale == 0 {
+		return Gapless{}, false, 0, errors.New("missing timescale")
+	}
+
+	segment, mediaTime, found := firstEdit(childBox(childBox(trak, "edts"), "elst"))
+	if !found || mediaTime < 0 {
+		return Gapless{}, false, 0, nil
+	}
+
+	total := sttsDuration(childBox(childBox(childBox(mdia, "minf"), "stbl"), "stts"))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Gapless{}, false, 0, err
+	}
+	fragments, err := fragmentDuration(f, trackID, trexDuration(childBox(moov, "mvex"), trackID))
+	if err != nil {
+		return Gapless{}, false, 0, err
+	}
+	total += fragments
+
+	g.Priming = uint32(mediaTime)
+	available := total - min(total, uint64(mediaTime))
+	g.Samples = available
+	if segment > 0 {
+		g.Samples = min(available, (segment*uint64(mediaScale)+uint64(movieScale)/2)/uint64(movieScale))
+	}
+	g.Remainder = uint32(available - g.Samples)
+	tick = (uint64(mediaScale) + uint64(movieScale) - 1) / uint64(movieScale)
+	return g, g.Priming > 0 || g.Remainder > 0, tick, nil
+}
+
+// VerifyGapless checks that the iTunSMPB tag of an MP4 file agrees with its
+// edit list. The played sample counts may differ by the rounding of the
+// movie timescale. Files without iTunSMPB pass.
+func VerifyGapless(path string) error {
+	tags, err := ReadTags(path)
+	if err != nil {
+		return err
+	}
+	smpb, found := tags["iTunSMPB"]
+	if !found {
+		return nil
+	}
+	want, err := ParseSMPB(smpb)
+	if err != nil {
+		return err
+	}
+	got, ok, tick, err := readGapless(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("iTunSMPB has priming %d and remainder %d but the edit list trims nothing", want.Priming, want.Remainder)
+	}
+	diff := max(got.Samples, want.Samples) - min(got.Samples, want.Samples)
+	if got.Priming != want.Priming || diff > tick {
+		return fmt.Errorf("edit list skips %d and plays %d samples, iTunSMPB has %d and %d", got.Priming, got.Samples, want.Priming, want.Samples)
+	}
+	return nil
+}
+
+// WriteEditList sets the edit list of the first audio track of an MP4 file
+// to play g.Samples samples after g.Priming, and the track and movie
+// durations to match.
+func WriteEditList(path string, g Gapless) error {
+	return rewriteMoov(path, func(moov []byte) ([]byte, error) {
+		movieScale := timescale(childBox(moov, "mvhd"))
+		var out []byte
+		var movieDuration uint64
+		done := false
+		for _, b := range boxes(moov) {
+			if b.typ == "mvhd" {
+				continue // written last, once the track durations are known
+			}
+			if b.typ != "trak" || done || !isAudioTrak(b.payload) {
+				if b.typ == "trak" {
+					movieDuration = max(movieDuration, tkhdDuration(childBox(b.payload, "tkhd")))
+				}
+				out = append(out, makeBox(b.typ, b.payload)...)
+				continue
+			}
+			mediaScale := timescale(childBox(childBox(b.payload, "mdia"), "mdhd"))
+			if movieScale == 0 || mediaScale == 0 {
+				return nil, errors.New("missing timescale")
+			}
+			segment := (g.Samples*uint64(movieScale) + uint64(mediaScale)/2) / uint64(mediaScale)
+			movieDuration = max(movieDuration, segment)
+			// elst version 1: segment_duration, media_time, media_rate 1.0
+			elst := []byte{1, 0, 0, 0, 0, 0, 0, 1}
+			elst = binary.BigEndian.AppendUint64(elst, segment)
+			elst = binary.BigEndian.AppendUint64(elst, uint64(g.Priming))
+			elst = append(elst, 0, 1, 0, 0)
+			edts := makeBox("elst", elst)
+			// edts goes right after tkhd.
+			var trak []byte
+			for _, c := range boxes(b.payload) {
+				switch c.typ {
+				case "edts":
+				case "tkhd":
+					tkhd, err := withDuration(c.payload, 28, 20, segment)
+					if err != nil {
+						return nil, err
+					}
+					trak = append(trak, makeBox(c.typ, tkhd)...)
+					trak = append(trak, makeBox("edts", edts)...)
+				default:
+					trak = append(trak, makeBox(c.typ, c.payload)...)
+				}
+			}
+			out = append(out, makeBox("trak", trak)...)
+			done = true
+		}
+		if !done {
+			return nil, errors.New("no audio track")
+		}
+		mvhd, err := withDuration(childBox(moov, "mvhd"), 24, 16, movieDuration)
+		if err != nil {
+			return nil, err
+		}
+		return makeBox("moov", append(makeBox("mvhd", mvhd), out...)), nil
+	})
+}
+
+// withDuration returns a copy of a tkhd or mvhd payload with its duration
+// set to d. The duration is at off1 in version 1 boxes and at off0 in
+// version 0 ones, where a d too large for 32 bits is an error.
+func withDuration(p []byte, off1, off0 int, d uint64) ([]byte, error) {
+	p = slices.Clone(p)
+	switch {
+	case len(p) >= off1+8 && p[0] == 1:
+		binary.BigEndian.PutUint64(p[off1:], d)
+	case len(p) >= off0+4 && p[0] == 0:
+		if d > math.MaxUint32 {
+			return nil, fmt.Errorf("duration %d does not fit a version 0 header", d)
+		}
+		binary.BigEndian.PutUint32(p[off0:], uint32(d))
+	default:
+		return nil, errors.New("invalid header box")
+	}
+	return p, nil
+}
+
+// tkhdDuration reads the duration of a tkhd payload.
+func tkhdDuration(p []byte) uint64 {
+	if len(p) >= 36 && p[0] == 1 {
+		return binary.BigEndian.Uint64(p[28:36])
+	}
+	if len(p) >= 24 {
+		return uint64(binary.BigEndian.Uint32(p[20:24]))
+	}
+	return 0
+}
+
+func isAudioTrak(trak []byte) bool {
+	hdlr := childBox(childBox(trak, "mdia"), "hdlr")
+	return len(hdlr) >= 12 && string(hdlr[8:12]) == "soun"
+}
+
+// audioTrak returns the first audio trak of a moov payload and its track ID.
+func audioTrak(moov []byte) ([]byte, uint32) {
+	for _, b := range boxes(moov) {
+		if b.typ != "trak" || !isAudioTrak(b.payload) {
+			continue
+		}
+		tkhd := childBox(b.payload, "tkhd")
+		if len(tkhd) < 24 {
+			return b.payload, 0
+		}
+		if tkhd[0] == 1 {
+			return b.payload, binary.BigEndian.Uint32(tkhd[20:24])
+		}
+		return b.payload, binary.BigEndian.Uint32(tkhd[12:16])
+	}
+	return nil, 0
+}
+
+// timescale reads the timescale of an mvhd or mdhd payload.
+func timescale(p []byte) uint32 {
+	if len(p) >= 24 && p[0] == 1 {
+		return binary.BigEndian.Uint32(p[20:24])
+	}
+	if len(p) >= 16 {
+		return binary.BigEndian.Uint32(p[12:16])
+	}
+	return 0
+}
+
+// firstEdit returns the first edit of an elst payload that is not an empty
+// edit.
+func firstEdit(elst []byte) (segment uint64, mediaTime int64, ok bool) {
+	if len(elst) < 8 {
+		return 0, 0, false
+	}
+	version := elst[0]
+	n := int(binary.BigEndian.Uint32(elst[4:8]))
+	p := elst[8:]
+	for i := 0; i < n; i++ {
+		if version == 1 {
+			if len(p) < 20 {
+				return 0, 0, false
+			}
+			segment, mediaTime = binary.BigEndian.Uint64(p[0:8]), int64(binary.BigEndian.Uint64(p[8:16]))
+			p = p[20:]
+		} else {
+			if len(p) < 12 {
+				return 0, 0, false
+			}
+			segment, mediaTime = uint64(binary.BigEndian.Uint32(p[0:4])), int64(int32(binary.BigEndian.Uint32(p[4:8])))
+			p = p[12:]
+		}
+		if mediaTime != -1 {
+			return segment, mediaTime, true
+		}
+	}
+	return 0, 0, false
+}
+
+func sttsDuration(stts []byte) uint64 {
+	if len(stts) < 8 {
+		return 0
+	}
+	var total uint64
+	n := int(binary.BigEndian.Uint32(stts[4:8]))
+	for i, p := 0, stts[8:]; i < n && len(p) >= 8; i, p = i+1, p[8:] {
+		total += uint64(binary.BigEndian.Uint32(p[0:4])) * uint64(binary.BigEndian.Uint32(p[4:8]))
+	}
+	return total
+}
+
+// trexDuration is the default sample duration of a track in fragments.
+func trexDuration(mvex []byte, trackID uint32) uint32 {
+	for _, b := range boxes(mvex) {
+		if b.typ == "trex" && len(b.payload) >= 16 && binary.BigEndian.Uint32(b.payload[4:8]) == trackID {
+			return binary.BigEndian.Uint32(b.payload[12:16])
+		}
+	}
+	return 0
+}
+
+// fragmentDuration adds up the sample durations of a track in the moof
+// boxes of r.
+func fragmentDuration(r io.ReadSeeker, trackID, defaultDuration uint32) (uint64, error) {
+	var total uint64
+	for {
+		moof, err := findTopLevelBox(r, "moof")
+		if err != nil {
+			// Past the last fragment, or not fragmented.
+			return total, nil
+		}
+		for _, traf := range boxes(moof) {
+			if traf.typ != "traf" {
+				continue
+			}
+			tfhd := childBox(traf.payload, "tfhd")
+			if len(tfhd) < 8 || binary.BigEndian.Uint32(tfhd[4:8]) != trackID {
+				continue
+			}
+			duration := defaultDuration
+			flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff
+			pos := 8
+			if flags&0x01 != 0 {
+				pos += 8 // base data offset
+			}
+			if flags&0x02 != 0 {
+				pos += 4 // sample description index
+			}
+			if flags&0x08 != 0 && len(tfhd) >= pos+4 {
+				duration = binary.BigEndian.Uint32(tfhd[pos : pos+4])
+			}
+			for _, trun := range boxes(traf.payload) {
+				if trun.typ == "trun" {
+					total += trunDuration(trun.payload, duration)
+				}
+			}
+		}
+	}
+}
+
+func trunDuration(trun []byte, defaultDuration uint32) uint64 {
+	if len(trun) < 8 {
+		return 0
+	}
+	flags := binary.BigEndian.Uint32(trun[0:4]) & 0xffffff
+	n := uint64(binary.BigEndian.Uint32(trun[4:8]))
+	if flags&0x100 == 0 {
+		return n * uint64(defaultDuration)
+	}
+	pos := 8
+	if flags&0x01 != 0 {
+		pos += 4 // data offset
+	}
+	if flags&0x04 != 0 {
+		pos += 4 // first sample flags
+	}
+	size := 0
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			size += 4
+		}
+	}
+	var total uint64
+	for i := uint64(0); i < n && len(trun) >= pos+4; i++ {
+		total += uint64(binary.BigEndian.Uint32(trun[pos : pos+4]))
+		pos += size
+	}
+	return total
+}
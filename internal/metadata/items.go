@@ -0,0 +1,309 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Item is one iTunes metadata item for WriteItems.
+type Item struct {
+	// Name is the atom type, such as "©wrk" or "cpil", or "----:NAME" for a
+	// freeform com.apple.iTunes item.
+	Name string
+	// Value is a string, or an integer item as uint8, uint16 or uint32. A
+	// nil Value removes the item.
+	Value any
+}
+
+const freeformPrefix = "----:"
+
+// WriteItems adds items to the ilst of an MP4 file, replacing items of the
+// same name, for the atoms MP4Box -itags cannot write. When items repeat a
+// name the last one wins. The file is rewritten in place; when moov is
+// before mdat the chunk offsets in stco and co64 are moved by the change in
+// moov size.
+func WriteItems(path string, items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return rewriteMoov(path, func(moov []byte) ([]byte, error) {
+		return withItems(moov, items)
+	})
+}
+
+// rewriteMoov replaces the moov box of an MP4 file with the box edit
+// returns for its payload, through a temporary file.
+func rewriteMoov(path string, edit func(moov []byte) ([]byte, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	start, end, moov, err := locateMoov(f, info.Size())
+	if err != nil {
+		return err
+	}
+	newMoov, err := edit(moov)
+	if err != nil {
+		return err
+	}
+	delta := int64(len(newMoov)) - (end - start)
+	if delta != 0 && end < info.Size() {
+		shiftChunkOffsets(newMoov[8:], end, delta)
+	}
+
+	tmp := path + ".moov"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.CopyN(out, f, start); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Write(newMoov); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+// locateMoov returns the file offsets of the moov box and its payload.
+func locateMoov(r io.ReadSeeker, size int64) (start, end int64, payload []byte, err error) {
+	var hdr [16]byte
+	for pos := int64(0); pos+8 <= size; {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0, 0, nil, err
+		}
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			return 0, 0, nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		headerLen := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - pos
+		case 1:
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return 0, 0, nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			headerLen = 16
+		}
+		if boxSize < headerLen || pos+boxSize > size {
+			return 0, 0, nil, fmt.Errorf("invalid box size %d at %d", boxSize, pos)
+		}
+		if string(hdr[4:8]) == "moov" {
+			if headerLen != 8 {
+				return 0, 0, nil, errors.New("64-bit moov box is not supported")
+			}
+			payload := make([]byte, boxSize-headerLen)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return 0, 0, nil, err
+			}
+			return pos, pos + boxSize, payload, nil
+		}
+		pos += boxSize
+	}
+	return 0, 0, nil, errors.New("moov box not found")
+}
+
+// withItems returns the moov box, header included, with items in its ilst.
+// Missing udta, meta and ilst boxes are created.
+func withItems(moov []byte, items []Item) ([]byte, error) {
+	var newItems [][]byte
+	for i, item := range items {
+		if item.Value == nil || slices.ContainsFunc(items[i+1:], func(later Item) bool { return later.Name == item.Name }) {
+			continue
+		}
+		b, err := itemBox(item)
+		if err != nil {
+			return nil, err
+		}
+		newItems = append(newItems, b)
+	}
+
+	udta := childBox(moov, "udta")
+	meta := childBox(udta, "meta")
+	var metaHeader []byte // version and flags of a full meta box
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		metaHeader, meta = meta[:4], meta[4:]
+	} else if meta == nil {
+		metaHeader = []byte{0, 0, 0, 0}
+	}
+
+	var ilst []byte
+	for _, b := range boxes(childBox(meta, "ilst")) {
+		if !replaced(b, items) {
+			ilst = append(ilst, makeBox(b.typ, b.payload)...)
+		}
+	}
+	for _, b := range newItems {
+		ilst = append(ilst, b...)
+	}
+
+	newMeta := append([]byte(nil), metaHeader...)
+	if childBox(meta, "hdlr") == nil {
+		// hdlr: version/flags, pre_defined, handler "mdir", reserved "appl", 0, 0, empty name
+		hdlr := make([]byte, 25)
+		copy(hdlr[8:12], "mdir")
+		copy(hdlr[12:16], "appl")
+		newMeta = append(newMeta, makeBox("hdlr", hdlr)...)
+	}
+	newMeta = append(newMeta, replaceChild(meta, "ilst", ilst)...)
+	newUdta := replaceChild(udta, "meta", newMeta)
+	return makeBox("moov", replaceChild(moov, "udta", newUdta)), nil
+}
+
+// replaced reports whether an existing ilst item is overwritten by items.
+func replaced(b box, items []Item) bool {
+	for _, item := range items {
+		if name, ok := strings.CutPrefix(item.Name, freeformPrefix); ok {
+			if b.typ == "----" && freeformName(b.payload) == name {
+				return true
+			}
+		} else if b.typ == item.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func freeformName(payload []byte) string {
+	if name := childBox(payload, "name"); len(name) > 4 {
+		return string(name[4:])
+	}
+	return ""
+}
+
+// replaceChild returns the container payload with its first child of type
+// typ replaced by payload, or with the child appended when there is none.
+func replaceChild(container []byte, typ string, payload []byte) []byte {
+	var out []byte
+	done := false
+	for _, b := range boxes(container) {
+		if b.typ == typ && !done {
+			out = append(out, makeBox(typ, payload)...)
+			done = true
+			continue
+		}
+		out = append(out, makeBox(b.typ, b.payload)...)
+	}
+	if !done {
+		out = append(out, makeBox(typ, payload)...)
+	}
+	return out
+}
+
+func itemBox(item Item) ([]byte, error) {
+	var class uint32
+	var value []byte
+	switch v := item.Value.(type) {
+	case string:
+		class, value = 1, []byte(v)
+	case uint8:
+		class, value = 21, []byte{v}
+	case uint16:
+		class, value = 21, binary.BigEndian.AppendUint16(nil, v)
+	case uint32:
+		class, value = 21, binary.BigEndian.AppendUint32(nil, v)
+	default:
+		return nil, fmt.Errorf("unsupported value %T for item %s", item.Value, item.Name)
+	}
+	data := binary.BigEndian.AppendUint32(nil, class)
+	data = append(data, 0, 0, 0, 0)
+	data = makeBox("data", append(data, value...))
+
+	if name, ok := strings.CutPrefix(item.Name, freeformPrefix); ok {
+		payload := makeBox("mean", append([]byte{0, 0, 0, 0}, "com.apple.iTunes"...))
+		payload = append(payload, makeBox("name", append([]byte{0, 0, 0, 0}, name...))...)
+		return makeBox("----", append(payload, data...)), nil
+	}
+	if len([]rune(item.Name)) != 4 {
+		return nil, fmt.Errorf("invalid atom name %q", item.Name)
+	}
+	return makeBox(item.Name, data), nil
+}
+
+// makeBox encodes a box; typ is Latin-1, so "©nam" is four bytes.
+func makeBox(typ string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	for _, r := range typ {
+		b = append(b, byte(r))
+	}
+	return append(b, payload...)
+}
+
+// shiftChunkOffsets adds delta to every chunk offset at or after from in the
+// stco and co64 boxes of a moov payload, in place.
+func shiftChunkOffsets(moov []byte, from, delta int64) {
+	walk(moov, func(typ string, payload []byte) {
+		if len(payload) < 8 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(payload[4:8]))
+		entries := payload[8:]
+		switch typ {
+		case "stco":
+			for i := 0; i < n && 4*i+4 <= len(entries); i++ {
+				p := entries[4*i:]
+				if off := int64(binary.BigEndian.Uint32(p)); off >= from {
+					binary.BigEndian.PutUint32(p, uint32(off+delta))
+				}
+			}
+		case "co64":
+			for i := 0; i < n && 8*i+8 <= len(entries); i++ {
+				p := entries[8*i:]
+				if off := int64(binary.BigEndian.Uint64(p)); off >= from {
+					binary.BigEndian.PutUint64(p, uint64(off+delta))
+				}
+			}
+		}
+	})
+}
+
+// walk calls fn for every box below the sample table containers of a moov
+// payload. The payloads share memory with p.
+func walk(p []byte, fn func(typ string, payload []byte)) {
+	for len(p) >= 8 {
+		size := int(binary.BigEndian.Uint32(p[0:4]))
+		if size < 8 || size > len(p) {
+			return
+		}
+		typ, payload := latin1(p[4:8]), p[8:size]
+		switch typ {
+		case "trak", "mdia", "minf", "stbl":
+			walk(payload, fn)
+		default:
+			fn(typ, payload)
+		}
+		p = p[size:]
+	}
+}
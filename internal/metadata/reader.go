@@ -0,0 +1,242 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ReadTags returns the iTunes metadata items of an MP4 file by atom name:
+// "©nam", "aART", "trkn", "cnID", and so on. Text items are returned as is,
+// integer items in decimal, trkn and disk as "n/total", and freeform
+// ----:mean:name items under their name. Only the moov box is read.
+func ReadTags(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	moov, err := findTopLevelBox(f, "moov")
+	if err != nil {
+		return nil, err
+	}
+	udta := childBox(moov, "udta")
+	if udta == nil {
+		return map[string]string{}, nil
+	}
+	meta := childBox(udta, "meta")
+	if meta == nil {
+		return map[string]string{}, nil
+	}
+	// meta is a full box in MP4 files but a plain container in QuickTime ones.
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		meta = meta[4:]
+	}
+	ilst := childBox(meta, "ilst")
+	tags := make(map[string]string)
+	for _, item := range boxes(ilst) {
+		if item.typ == "----" {
+			var name string
+			var value []byte
+			for _, c := range boxes(item.payload) {
+				switch c.typ {
+				case "name":
+					if len(c.payload) > 4 {
+						name = string(c.payload[4:])
+					}
+				case "data":
+					value = c.payload
+				}
+			}
+			if name != "" && len(value) >= 8 {
+				tags[name] = string(value[8:])
+			}
+			continue
+		}
+		data := childBox(item.payload, "data")
+		if len(data) < 8 {
+			continue
+		}
+		class := binary.BigEndian.Uint32(data[0:4]) & 0xffffff
+		value := data[8:]
+		switch {
+		case item.typ == "trkn" || item.typ == "disk":
+			if len(value) >= 6 {
+				tags[item.typ] = fmt.Sprintf("%d/%d", binary.BigEndian.Uint16(value[2:4]), binary.BigEndian.Uint16(value[4:6]))
+			}
+		case class == 1:
+			tags[item.typ] = string(value)
+		case class == 21 || class == 0:
+			if n, ok := beInt(value); ok {
+				tags[item.typ] = strconv.FormatInt(n, 10)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// ReadCodec returns the codec of the first audio track of an MP4 file, as
+// the SOURCE_CODEC label it would be tagged with, from its sample entry. For
+// ALAC the quality is read from the decoder config, e.g. "24B-96.0kHz"; other
+// codecs have none. It serves files saved before the codec was tagged.
+func ReadCodec(path string) (codec, quality string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	moov, err := findTopLevelBox(f, "moov")
+	if err != nil {
+		return "", "", err
+	}
+	trak, _ := audioTrak(moov)
+	if trak == nil {
+		return "", "", errors.New("no audio track")
+	}
+	stsd := childBox(childBox(childBox(childBox(trak, "mdia"), "minf"), "stbl"), "stsd")
+	if len(stsd) < 8 {
+		return "", "", errors.New("missing stsd box")
+	}
+	entries := boxes(stsd[8:])
+	if len(entries) == 0 {
+		return "", "", errors.New("missing sample entry")
+	}
+	entry := entries[0]
+	switch entry.typ {
+	case "alac":
+		// The audio sample entry is 28 bytes; the alac config box follows,
+		// with the bit depth at 5 and the sample rate at 20 after its
+		// version and flags.
+		if len(entry.payload) > 28 {
+			if cfg := childBox(entry.payload[28:], "alac"); len(cfg) >= 28 {
+				rate := binary.BigEndian.Uint32(cfg[24:28])
+				quality = fmt.Sprintf("%dB-%.1fkHz", cfg[9], float64(rate)/1000.0)
+			}
+		}
+		return "ALAC", quality, nil
+	case "mp4a":
+		return "AAC", "", nil
+	case "ec-3":
+		return "ATMOS", "", nil
+	case "ac-3":
+		return "AC3", "", nil
+	}
+	return "", "", fmt.Errorf("unknown sample entry %s", entry.typ)
+}
+
+type box struct {
+	typ     string
+	payload []byte
+}
+
+// findTopLevelBox seeks through the top-level boxes of r, from the current
+// offset, and reads the payload of the first one of type typ. A box larger
+// than what is left of the file is an error.
+func findTopLevelBox(r io.ReadSeeker, typ string) ([]byte, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("%s box not found", typ)
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		headerLen := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			headerLen = 16
+		}
+		if size != 0 && size < headerLen {
+			return nil, fmt.Errorf("invalid box size %d", size)
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if size-headerLen > end-pos {
+			return nil, fmt.Errorf("%s box size %d runs past the end of the file", latin1(hdr[4:8]), size)
+		}
+		if string(hdr[4:8]) == typ {
+			if size == 0 {
+				return io.ReadAll(r)
+			}
+			payload := make([]byte, size-headerLen)
+			_, err := io.ReadFull(r, payload)
+			return payload, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("%s box not found", typ)
+		}
+		if _, err := r.Seek(size-headerLen, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// boxes splits a container payload into its child boxes.
+func boxes(p []byte) []box {
+	var out []box
+	for len(p) >= 8 {
+		size := int(binary.BigEndian.Uint32(p[0:4]))
+		if size == 0 {
+			size = len(p)
+		}
+		if size < 8 || size > len(p) {
+			break
+		}
+		out = append(out, box{typ: latin1(p[4:8]), payload: p[8:size]})
+		p = p[size:]
+	}
+	return out
+}
+
+func childBox(p []byte, typ string) []byte {
+	for _, b := range boxes(p) {
+		if b.typ == typ {
+			return b.payload
+		}
+	}
+	return nil
+}
+
+func beInt(p []byte) (int64, bool) {
+	switch len(p) {
+	case 1:
+		return int64(int8(p[0])), true
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(p))), true
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(p))), true
+	case 8:
+		return int64(binary.BigEndian.Uint64(p)), true
+	}
+	return 0, false
+}
+
+// latin1 decodes an atom type, where © is the single byte 0xA9.
+func latin1(p []byte) string {
+	r := make([]rune, len(p))
+	for i, b := range p {
+		r[i] = rune(b)
+	}
+	return string(r)
+}
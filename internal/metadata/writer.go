@@ -3,18 +3,14 @@ package metadata
 import (
 	"errors"
 	"io"
-	"main/utils/structs"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 
 	"main/internal/core"
 	"main/internal/utils"
-
-	"github.com/zhaarey/go-mp4tag"
 )
 
 func WriteCover(sanAlbumFolder, name string, url string) (string, error) {
@@ -79,130 +75,3 @@ func WriteLyrics(sanAlbumFolder, filename string, lrc string) error {
 	}
 	return nil
 }
-
-func WriteMP4Tags(trackPath, lrc, qobuzDesc string, meta *structs.AutoGenerated, trackNum, trackTotal int) error {
-	index := trackNum - 1
-
-	t := &mp4tag.MP4Tags{
-		Title:      meta.Data[0].Relationships.Tracks.Data[index].Attributes.Name,
-		TitleSort:  meta.Data[0].Relationships.Tracks.Data[index].Attributes.Name,
-		Artist:     meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName,
-		ArtistSort: meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName,
-		Custom: map[string]string{
-			"PERFORMER":   meta.Data[0].Relationships.Tracks.Data[index].Attributes.ArtistName,
-			"RELEASETIME": meta.Data[0].Relationships.Tracks.Data[index].Attributes.ReleaseDate,
-			"ISRC":        meta.Data[0].Relationships.Tracks.Data[index].Attributes.Isrc,
-			"LABEL":       meta.Data[0].Attributes.RecordLabel,
-			"UPC":         meta.Data[0].Attributes.Upc,
-		},
-		Composer:     meta.Data[0].Relationships.Tracks.Data[index].Attributes.ComposerName,
-		ComposerSort: meta.Data[0].Relationships.Tracks.Data[index].Attributes.ComposerName,
-		Date:         meta.Data[0].Attributes.ReleaseDate,
-		CustomGenre:  meta.Data[0].Relationships.Tracks.Data[index].Attributes.GenreNames[0],
-		Copyright:    meta.Data[0].Attributes.Copyright,
-		Publisher:    meta.Data[0].Attributes.RecordLabel,
-		Lyrics:       lrc,
-	}
-
-	var appleDesc string
-	var finalComment string
-
-	if meta.Data[0].Attributes.EditorialNotes != nil && meta.Data[0].Attributes.EditorialNotes.Standard != "" {
-		reHTML := regexp.MustCompile("<[^>]*>")
-		textWithoutHTML := reHTML.ReplaceAllString(meta.Data[0].Attributes.EditorialNotes.Standard, "")
-		reNewlines := regexp.MustCompile(`\n{2,}`)
-		appleDesc = strings.TrimSpace(reNewlines.ReplaceAllString(textWithoutHTML, "\n"))
-	}
-
-	cleanedQobuzDesc := qobuzDesc
-
-	if appleDesc != "" {
-		finalComment = "©Copyright Apple Music：" + appleDesc
-	}
-	if cleanedQobuzDesc != "" {
-		if finalComment != "" {
-			finalComment += "\n——————————————————\n"
-		}
-		finalComment += "©Copyright Qobuz：" + cleanedQobuzDesc
-	}
-
-	if finalComment != "" {
-		t.Comment = finalComment
-	}
-
-	if !strings.Contains(meta.Data[0].ID, "pl.") {
-		albumID, err := strconv.ParseUint(meta.Data[0].ID, 10, 32)
-		if err == nil {
-			t.ItunesAlbumID = int32(albumID)
-		}
-	}
-
-	if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-		if len(meta.Data[0].Relationships.Tracks.Data[index].Relationships.Artists.Data) > 0 {
-			artistID, err := strconv.ParseUint(meta.Data[0].Relationships.Tracks.Data[index].Relationships.Artists.Data[0].ID, 10, 32)
-			if err == nil {
-				t.ItunesArtistID = int32(artistID)
-			}
-		}
-	}
-
-	if strings.Contains(meta.Data[0].ID, "pl.") && !core.Config.UseSongInfoForPlaylist {
-		t.DiscNumber = 1
-		t.DiscTotal = 1
-		t.TrackNumber = int16(trackNum)
-		t.TrackTotal = int16(trackTotal)
-		t.Album = meta.Data[0].Attributes.Name
-		t.AlbumSort = meta.Data[0].Attributes.Name
-		t.AlbumArtist = meta.Data[0].Attributes.ArtistName
-		t.AlbumArtistSort = meta.Data[0].Attributes.ArtistName
-	} else if strings.Contains(meta.Data[0].ID, "pl.") && core.Config.UseSongInfoForPlaylist {
-		t.DiscNumber = int16(meta.Data[0].Relationships.Tracks.Data[index].Attributes.DiscNumber)
-		t.DiscTotal = int16(meta.Data[0].Relationships.Tracks.Data[trackTotal-1].Attributes.DiscNumber)
-		t.TrackNumber = int16(meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber)
-		t.TrackTotal = int16(trackTotal)
-		t.Album = meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName
-		t.AlbumSort = meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName
-		t.AlbumArtist = meta.Data[0].Relationships.Tracks.Data[index].Relationships.Albums.Data[0].Attributes.ArtistName
-		t.AlbumArtistSort = meta.Data[0].Relationships.Tracks.Data[index].Relationships.Albums.Data[0].Attributes.ArtistName
-	} else {
-		currentDisc := meta.Data[0].Relationships.Tracks.Data[index].Attributes.DiscNumber
-		maxDisc := 0
-		tracksOnDisc := 0
-		for _, tr := range meta.Data[0].Relationships.Tracks.Data {
-			if tr.Attributes.DiscNumber > maxDisc {
-				maxDisc = tr.Attributes.DiscNumber
-			}
-			if tr.Attributes.DiscNumber == currentDisc {
-				tracksOnDisc++
-			}
-		}
-
-		t.DiscNumber = int16(meta.Data[0].Relationships.Tracks.Data[index].Attributes.DiscNumber)
-		t.DiscTotal = int16(maxDisc)
-		t.TrackNumber = int16(meta.Data[0].Relationships.Tracks.Data[index].Attributes.TrackNumber)
-		t.TrackTotal = int16(tracksOnDisc)
-		t.Album = meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName
-		t.AlbumSort = meta.Data[0].Relationships.Tracks.Data[index].Attributes.AlbumName
-		t.AlbumArtist = meta.Data[0].Attributes.ArtistName
-		t.AlbumArtistSort = meta.Data[0].Attributes.ArtistName
-	}
-
-	if meta.Data[0].Relationships.Tracks.Data[index].Attributes.ContentRating == "explicit" {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryExplicit
-	} else if meta.Data[0].Relationships.Tracks.Data[index].Attributes.ContentRating == "clean" {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryClean
-	} else {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
-	}
-
-	mp4, err := mp4tag.Open(trackPath)
-	if err != nil {
-		return err
-	}
-	defer mp4.Close()
-	err = mp4.Write(t, []string{})
-	if err != nil {
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,191 @@
+// Package musicbrainz looks up the MusicBrainz IDs of a release by its
+// barcode, for the sidecar files written next to an album. The web service
+// allows one request per second per client, which every call here waits for.
+package musicbrainz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"main/internal/errs"
+)
+
+const (
+	baseURL  = "https://musicbrainz.org/ws/2"
+	appName  = "apple-music-downloader/1.0"
+	interval = time.Second
+)
+
+// Contact is the e-mail address or URL sent in the User-Agent, which the
+// web service asks of every client so that it can reach its operator.
+var Contact string
+
+// VariousArtistsID is the special purpose artist MusicBrainz credits
+// compilations to.
+const VariousArtistsID = "89ad4ac3-39f7-470e-963a-56509c546377"
+
+var (
+	httpClient = &http.Client{Timeout: 15 * time.Second}
+
+	mu   sync.Mutex
+	last time.Time
+)
+
+// Release is what MusicBrainz knows about a release.
+type Release struct {
+	ID             string
+	ReleaseGroupID string
+	Artists        []Artist // the artist credit, in order
+	Tracks         []Track
+}
+
+// Artist is a credited artist and its MusicBrainz ID.
+type Artist struct {
+	ID   string
+	Name string
+}
+
+// Track is a track of the release. RecordingID is what taggers call the
+// MusicBrainz track ID.
+type Track struct {
+	ID          string
+	RecordingID string
+	Disc        int
+	Position    int
+}
+
+// RecordingID returns the recording of the track at position on disc, or
+// "" when the release has no such track.
+func (r *Release) RecordingID(disc, position int) string {
+	for _, t := range r.Tracks {
+		if t.Disc == disc && t.Position == position {
+			return t.RecordingID
+		}
+	}
+	return ""
+}
+
+// ArtistID returns the ID of the credited artist called name, compared
+// case-insensitively, or "".
+func (r *Release) ArtistID(name string) string {
+	for _, a := range r.Artists {
+		if strings.EqualFold(a.Name, name) {
+			return a.ID
+		}
+	}
+	return ""
+}
+
+type artistCredit []struct {
+	Name   string `json:"name"`
+	Artist struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"artist"`
+}
+
+type searchResponse struct {
+	Releases []struct {
+		ID         string `json:"id"`
+		Score      int    `json:"score"`
+		TrackCount int    `json:"track-count"`
+	} `json:"releases"`
+}
+
+type releaseResponse struct {
+	ID           string `json:"id"`
+	ReleaseGroup struct {
+		ID string `json:"id"`
+	} `json:"release-group"`
+	ArtistCredit artistCredit `json:"artist-credit"`
+	Media        []struct {
+		Position int `json:"position"`
+		Tracks   []struct {
+			ID        string `json:"id"`
+			Position  int    `json:"position"`
+			Recording struct {
+				ID string `json:"id"`
+			} `json:"recording"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+// LookupBarcode finds the release with barcode, preferring one with
+// trackCount tracks when several releases share it. It returns nil without
+// an error when MusicBrainz has no release with the barcode.
+func LookupBarcode(barcode string, trackCount int) (*Release, error) {
+	if barcode == "" {
+		return nil, nil
+	}
+	var found searchResponse
+	query := url.Values{"query": {"barcode:" + barcode}, "fmt": {"json"}, "limit": {"5"}}
+	if err := get("/release/?"+query.Encode(), &found); err != nil {
+		return nil, err
+	}
+	id := ""
+	for _, r := range found.Releases {
+		if r.Score < 100 {
+			continue
+		}
+		if id == "" || r.TrackCount == trackCount {
+			id = r.ID
+		}
+		if r.TrackCount == trackCount {
+			break
+		}
+	}
+	if id == "" {
+		return nil, nil
+	}
+
+	var rel releaseResponse
+	query = url.Values{"inc": {"recordings artist-credits release-groups"}, "fmt": {"json"}}
+	if err := get("/release/"+id+"?"+query.Encode(), &rel); err != nil {
+		return nil, err
+	}
+	r := &Release{ID: rel.ID, ReleaseGroupID: rel.ReleaseGroup.ID}
+	for _, c := range rel.ArtistCredit {
+		r.Artists = append(r.Artists, Artist{ID: c.Artist.ID, Name: c.Artist.Name})
+	}
+	for _, m := range rel.Media {
+		for _, t := range m.Tracks {
+			r.Tracks = append(r.Tracks, Track{ID: t.ID, RecordingID: t.Recording.ID, Disc: m.Position, Position: t.Position})
+		}
+	}
+	return r, nil
+}
+
+// get fetches path from the web service into v, no sooner than a second
+// after the previous request.
+func get(path string, v any) error {
+	mu.Lock()
+	if wait := interval - time.Since(last); wait > 0 {
+		time.Sleep(wait)
+	}
+	last = time.Now()
+	mu.Unlock()
+
+	req, err := http.NewRequest("GET", baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s ( %s )", appName, Contact))
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errs.Wrap(errs.CodeNetwork, err, "musicbrainz")
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return errs.New(errs.CodeNetwork, "musicbrainz: "+resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("musicbrainz: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,355 @@
+// Package naming renders the folder and file name formats of config.yaml.
+//
+// A format is a text/template. Formats without "{{" use the original token
+// syntax, where {AlbumName} is shorthand for {{.AlbumName}}, so existing
+// configs keep working:
+//
+//	{AlbumName}_AM({AlbumId})
+//	{{.ArtistName}} - {{.AlbumName}}{{wrap " [" "]" .Tag}}
+//	{{.DiscTrack}}. {{width 60 .SongName}}
+//	{{date "2006" .ReleaseDate}} - {{upper .FirstArtist}}
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fields are the values a format can use. Album fields are also set when a
+// track or music video is named; song fields are empty in folder formats.
+type Fields struct {
+	AlbumId       string
+	AlbumName     string
+	ArtistName    string
+	UrlArtistName string
+	ArtistId      string
+	Artists       []string // album artists, primary first
+	ReleaseDate   string   // YYYY-MM-DD
+	ReleaseYear   string
+	UPC           string
+	RecordLabel   string
+	Copyright     string
+	Genre         string
+	PlaylistId    string
+	PlaylistName  string
+	Quality       string
+	Codec         string
+	Tag           string
+	AlbumComposer string // composer of most tracks
+	AlbumNameAlt  string // AlbumName in the other metadata language, if it differs
+	ArtistNameAlt string
+	AlbumArtist   string // compilation-artist on compilations, ArtistName otherwise
+	Compilation   bool
+
+	SongId      string
+	SongName    string
+	SongArtist  string
+	Composer    string
+	SongNumer   string // two-digit track number, kept under its historic name
+	TrackNumber int
+	DiscNumber  int
+	DiscCount   int
+	TrackCount  int    // tracks on this disc
+	SongNameAlt string // SongName in the other metadata language, if it differs
+
+	// Classical tracks; empty otherwise.
+	Work           string
+	Movement       string
+	MovementNumber int
+	MovementCount  int
+	Conductor      string
+	Orchestra      string
+	Soloists       string // joined with ", "
+}
+
+// FirstArtist is the first name in ArtistName, which Apple joins with
+// ", " and " & ".
+func (f Fields) FirstArtist() string {
+	return firstArtist(f.ArtistName)
+}
+
+// PrimaryArtist is the first linked album artist, or FirstArtist when the
+// album has no artist relationships.
+func (f Fields) PrimaryArtist() string {
+	if len(f.Artists) > 0 && f.Artists[0] != "" {
+		return f.Artists[0]
+	}
+	return f.FirstArtist()
+}
+
+// FeaturedArtists are the album artists after PrimaryArtist, joined with
+// ", ". They come from the artist relationships when the album has them, so
+// a duo linked as one artist is not split.
+func (f Fields) FeaturedArtists() string {
+	if len(f.Artists) > 0 {
+		return strings.Join(f.Artists[1:], ", ")
+	}
+	return strings.Join(SplitArtists(f.ArtistName)[1:], ", ")
+}
+
+// DiscTrack numbers a track as 01, or as 1-01 on multi-disc albums.
+func (f Fields) DiscTrack() string {
+	if f.DiscCount > 1 {
+		return fmt.Sprintf("%d-%02d", f.DiscNumber, f.TrackNumber)
+	}
+	return fmt.Sprintf("%02d", f.TrackNumber)
+}
+
+var (
+	artistSeparators = regexp.MustCompile(`, | & `)
+	// featSeparators also split off featured artists. They are kept out of
+	// FirstArtist, so existing {FirstArtist} folders keep their names.
+	featSeparators = regexp.MustCompile(`, | & | (?i:feat\.|ft\.|featuring) `)
+)
+
+// SplitArtists splits a joined artist name such as "A, B & C feat. D" into
+// its names, primary first.
+func SplitArtists(s string) []string {
+	return featSeparators.Split(s, -1)
+}
+
+func firstArtist(s string) string {
+	return artistSeparators.Split(s, 2)[0]
+}
+
+var funcs = template.FuncMap{
+	"pad":     pad,
+	"width":   width,
+	"wrap":    wrap,
+	"default": orDefault,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"title":   title,
+	"trim":    strings.TrimSpace,
+	"date":    date,
+	"first":   firstArtist,
+}
+
+// pad left-pads a number or string with zeros to n characters.
+func pad(n int, v any) string {
+	s := fmt.Sprint(v)
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat("0", n-len(s)) + s
+}
+
+// width cuts s to at most n characters.
+func width(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// wrap surrounds s with prefix and suffix, or returns "" when s is empty.
+func wrap(prefix, suffix, s string) string {
+	if s == "" {
+		return ""
+	}
+	return prefix + s + suffix
+}
+
+func orDefault(def, s string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// title upper-cases the first letter of every word.
+func title(s string) string {
+	r := []rune(s)
+	for i := range r {
+		if i == 0 || unicode.IsSpace(r[i-1]) || r[i-1] == '(' || r[i-1] == '-' {
+			r[i] = unicode.ToTitle(r[i])
+		}
+	}
+	return string(r)
+}
+
+// date reformats a YYYY-MM-DD or YYYY release date with a Go time layout.
+// Unparsable dates are returned unchanged.
+func date(layout, s string) string {
+	for _, in := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(in, s); err == nil {
+			return t.Format(layout)
+		}
+	}
+	return s
+}
+
+var legacyToken = regexp.MustCompile(`\{(\w+)\}`)
+
+var cache sync.Map // format -> *template.Template
+
+// Parse compiles format, translating the token syntax when needed.
+func Parse(format string) (*template.Template, error) {
+	if t, ok := cache.Load(format); ok {
+		return t.(*template.Template), nil
+	}
+	text := format
+	if !strings.Contains(format, "{{") {
+		text = legacyToken.ReplaceAllString(format, "{{.$1}}")
+	}
+	t, err := template.New("").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	cache.Store(format, t)
+	return t, nil
+}
+
+// Validate parses format and runs it on sample fields, so unknown fields and
+// wrong function arguments are reported when the config is loaded.
+func Validate(format string) error {
+	t, err := Parse(format)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	return t.Execute(&b, sample)
+}
+
+// Render executes format. Formats are validated at config load, so an error
+// here means a function failed on unusual input; it is returned with whatever
+// was rendered before it.
+func Render(format string, f Fields) (string, error) {
+	if format == "" {
+		return "", nil
+	}
+	t, err := Parse(format)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, f)
+	return b.String(), err
+}
+
+// Uses reports whether format refers to the field or method name, as
+// {Codec} or {{.Codec}} does for "Codec". A format that does not parse uses
+// nothing.
+func Uses(format, name string) bool {
+	t, err := Parse(format)
+	if err != nil || t.Tree == nil {
+		return false
+	}
+	return uses(t.Tree.Root, name)
+}
+
+func uses(node parse.Node, name string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if uses(c, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return uses(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if uses(c, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if uses(a, name) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == name
+	case *parse.ChainNode:
+		return uses(n.Node, name)
+	case *parse.IfNode:
+		return uses(n.Pipe, name) || uses(n.List, name) || uses(n.ElseList, name)
+	case *parse.RangeNode:
+		return uses(n.Pipe, name) || uses(n.List, name) || uses(n.ElseList, name)
+	case *parse.WithNode:
+		return uses(n.Pipe, name) || uses(n.List, name) || uses(n.ElseList, name)
+	}
+	return false
+}
+
+var sample = Fields{
+	AlbumId:       "1234567890",
+	AlbumName:     "Album",
+	ArtistName:    "Artist A & Artist B",
+	UrlArtistName: "Artist A",
+	ArtistId:      "987654321",
+	Artists:       []string{"Artist A", "Artist B"},
+	ReleaseDate:   "2024-01-31",
+	ReleaseYear:   "2024",
+	UPC:           "000000000000",
+	Genre:         "Pop",
+	Quality:       "24B-192.0kHz",
+	Codec:         "ALAC",
+	Tag:           "[E]",
+	SongId:        "1234567891",
+	SongName:      "Song",
+	SongNumer:     "01",
+	TrackNumber:   1,
+	DiscNumber:    1,
+	DiscCount:     2,
+	TrackCount:    10,
+	SongArtist:    "Artist A",
+	Composer:      "Composer",
+	PlaylistId:    "pl.0000",
+	PlaylistName:  "Playlist",
+	RecordLabel:   "Label",
+	Copyright:     "℗ 2024 Label",
+	AlbumComposer: "Composer",
+	AlbumNameAlt:  "アルバム",
+	ArtistNameAlt: "アーティスト",
+	AlbumArtist:   "Artist A & Artist B",
+	SongNameAlt:   "ソング",
+
+	Work:           "Symphony No. 5 in C Minor, Op. 67",
+	Movement:       "I. Allegro con brio",
+	MovementNumber: 1,
+	MovementCount:  4,
+	Conductor:      "Conductor",
+	Orchestra:      "Orchestra",
+	Soloists:       "Soloist A, Soloist B",
+}
+
+var discToken = regexp.MustCompile(`\{n(?::(\d+))?\}`)
+
+// DiscFolder renders a disc folder format such as "Disc {n}" or "CD{n:02}",
+// where {n:02} pads the disc number to two digits.
+func DiscFolder(format string, n int) string {
+	return discToken.ReplaceAllStringFunc(format, func(tok string) string {
+		w := discToken.FindStringSubmatch(tok)[1]
+		if w == "" {
+			return fmt.Sprint(n)
+		}
+		width, _ := strconv.Atoi(w)
+		return fmt.Sprintf("%0*d", width, n)
+	})
+}
+
+// ValidateDiscFolder reports a disc folder format without a {n} token, which
+// would put every disc into the same folder.
+func ValidateDiscFolder(format string) error {
+	if !discToken.MatchString(format) {
+		return fmt.Errorf("disc folder format %q has no {n} token", format)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Package nfo renders the sidecar metadata written next to an album: the
+// album.nfo and artist.nfo files that Kodi, Jellyfin and Plex read, in the
+// Kodi schema, and a generic album.json.
+package nfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Album is the metadata of an album. It is written as is to album.json.
+type Album struct {
+	ID          string   `json:"id"` // Apple Music album ID
+	URL         string   `json:"url,omitempty"`
+	Title       string   `json:"title"`
+	Artist      string   `json:"artist"` // album artist, as tagged
+	Artists     []Artist `json:"artists"`
+	ReleaseDate string   `json:"releaseDate,omitempty"` // YYYY-MM-DD
+	Label       string   `json:"label,omitempty"`
+	UPC         string   `json:"upc,omitempty"`
+	Copyright   string   `json:"copyright,omitempty"`
+	Genres      []string `json:"genres,omitempty"`
+	Single      bool     `json:"single"`
+	Compilation bool     `json:"compilation"`
+	Review      string   `json:"review,omitempty"`
+	DiscCount   int      `json:"discCount"`
+	Tracks      []Track  `json:"tracks"`
+
+	MusicBrainzAlbumID        string `json:"musicbrainzAlbumId,omitempty"`
+	MusicBrainzReleaseGroupID string `json:"musicbrainzReleaseGroupId,omitempty"`
+}
+
+// Artist is an album artist.
+type Artist struct {
+	ID            string `json:"id,omitempty"` // Apple Music artist ID
+	Name          string `json:"name"`
+	MusicBrainzID string `json:"musicbrainzArtistId,omitempty"`
+}
+
+// Track is a track of an album.
+type Track struct {
+	ID         string `json:"id"`
+	Disc       int    `json:"disc"`
+	Number     int    `json:"number"`
+	Title      string `json:"title"`
+	Artist     string `json:"artist"`
+	Composer   string `json:"composer,omitempty"`
+	ISRC       string `json:"isrc,omitempty"`
+	DurationMs int    `json:"durationMs"`
+	Explicit   bool   `json:"explicit,omitempty"`
+
+	MusicBrainzTrackID string `json:"musicbrainzTrackId,omitempty"` // the recording
+}
+
+// Year is the year of the release date, or "".
+func (a Album) Year() string {
+	if len(a.ReleaseDate) >= 4 {
+		return a.ReleaseDate[:4]
+	}
+	return ""
+}
+
+type kodiAlbum struct {
+	XMLName                   xml.Name     `xml:"album"`
+	Title                     string       `xml:"title"`
+	MusicBrainzAlbumID        string       `xml:"musicbrainzalbumid,omitempty"`
+	MusicBrainzReleaseGroupID string       `xml:"musicbrainzreleasegroupid,omitempty"`
+	ArtistDesc                string       `xml:"artistdesc"`
+	Genres                    []string     `xml:"genre"`
+	Compilation               bool         `xml:"compilation"`
+	Review                    string       `xml:"review,omitempty"`
+	ReleaseType               string       `xml:"releasetype"`
+	ReleaseDate               string       `xml:"releasedate,omitempty"`
+	Year                      string       `xml:"year,omitempty"`
+	Label                     string       `xml:"label,omitempty"`
+	Barcode                   string       `xml:"barcode,omitempty"`
+	Credits                   []kodiCredit `xml:"albumArtistCredits"`
+	Tracks                    []kodiTrack  `xml:"track"`
+}
+
+type kodiCredit struct {
+	Artist              string `xml:"artist"`
+	MusicBrainzArtistID string `xml:"musicBrainzArtistID,omitempty"`
+}
+
+type kodiTrack struct {
+	MusicBrainzTrackID string `xml:"musicBrainzTrackID,omitempty"`
+	Disc               int    `xml:"disc,omitempty"`
+	Position           int    `xml:"position"`
+	Title              string `xml:"title"`
+	Duration           string `xml:"duration"`
+}
+
+type kodiArtist struct {
+	XMLName             xml.Name      `xml:"artist"`
+	Name                string        `xml:"name"`
+	MusicBrainzArtistID string        `xml:"musicBrainzArtistID,omitempty"`
+	Genres              []string      `xml:"genre"`
+	Albums              []kodiRelease `xml:"album"`
+}
+
+// kodiRelease is an entry of the discography in artist.nfo.
+type kodiRelease struct {
+	Title                     string `xml:"title"`
+	Year                      string `xml:"year,omitempty"`
+	MusicBrainzReleaseGroupID string `xml:"musicbrainzreleasegroupid,omitempty"`
+}
+
+// AlbumNFO renders album.nfo. The disc of a track is only given on
+// multi-disc albums; Kodi ignores it and numbers by position.
+func AlbumNFO(a Album) ([]byte, error) {
+	k := kodiAlbum{
+		Title:                     a.Title,
+		MusicBrainzAlbumID:        a.MusicBrainzAlbumID,
+		MusicBrainzReleaseGroupID: a.MusicBrainzReleaseGroupID,
+		ArtistDesc:                a.Artist,
+		Genres:                    a.Genres,
+		Compilation:               a.Compilation,
+		Review:                    a.Review,
+		ReleaseType:               "album",
+		ReleaseDate:               a.ReleaseDate,
+		Year:                      a.Year(),
+		Label:                     a.Label,
+		Barcode:                   a.UPC,
+	}
+	if a.Single {
+		k.ReleaseType = "single"
+	}
+	for _, artist := range a.Artists {
+		k.Credits = append(k.Credits, kodiCredit{Artist: artist.Name, MusicBrainzArtistID: artist.MusicBrainzID})
+	}
+	for _, t := range a.Tracks {
+		kt := kodiTrack{MusicBrainzTrackID: t.MusicBrainzTrackID, Position: t.Number, Title: t.Title, Duration: Duration(t.DurationMs)}
+		if a.DiscCount > 1 {
+			kt.Disc = t.Disc
+		}
+		k.Tracks = append(k.Tracks, kt)
+	}
+	return marshal(k)
+}
+
+// ArtistNFO renders the artist.nfo of artist with a as its only album, or
+// adds a to the discography of existing, the current artist.nfo. Everything
+// else in existing is kept as it is, so files edited by a media server
+// survive. It returns existing unchanged when a is already listed.
+func ArtistNFO(existing []byte, artist Artist, a Album) ([]byte, error) {
+	release := kodiRelease{Title: a.Title, Year: a.Year(), MusicBrainzReleaseGroupID: a.MusicBrainzReleaseGroupID}
+	if len(bytes.TrimSpace(existing)) == 0 {
+		return marshal(kodiArtist{Name: artist.Name, MusicBrainzArtistID: artist.MusicBrainzID, Genres: a.Genres, Albums: []kodiRelease{release}})
+	}
+
+	var current kodiArtist
+	if err := xml.Unmarshal(existing, &current); err != nil {
+		return nil, fmt.Errorf("artist.nfo: %w", err)
+	}
+	for _, r := range current.Albums {
+		if strings.EqualFold(r.Title, release.Title) && (r.Year == "" || r.Year == release.Year) {
+			return existing, nil
+		}
+	}
+	end := bytes.LastIndex(existing, []byte("</artist>"))
+	if end < 0 {
+		return nil, errors.New("artist.nfo: no </artist>")
+	}
+	entry, err := xml.MarshalIndent(struct {
+		XMLName xml.Name `xml:"album"`
+		kodiRelease
+	}{kodiRelease: release}, "  ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.Write(bytes.TrimRight(existing[:end], " \t\r\n"))
+	b.WriteString("\n")
+	b.Write(entry)
+	b.WriteString("\n")
+	b.Write(existing[end:])
+	return b.Bytes(), nil
+}
+
+// JSON renders album.json.
+func JSON(a Album) ([]byte, error) {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Duration formats milliseconds as m:ss, or h:mm:ss from an hour on, the
+// way Kodi writes track durations.
+func Duration(ms int) string {
+	s := (ms + 500) / 1000
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func marshal(v any) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), b...), '\n'), nil
+}
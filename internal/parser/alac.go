@@ -0,0 +1,242 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"main/internal/core"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/grafov/m3u8"
+)
+
+// initProbeBytes is how much of the first segment is fetched to find moov.
+const initProbeBytes = 16384
+
+// audioSampleEntryHeaderLen is the fixed part of an AudioSampleEntry before
+// its child boxes (reserved, data reference index, channels, sample size, rate).
+const audioSampleEntryHeaderLen = 28
+
+// AlacInfo is the real stream format read from an ALAC magic cookie.
+type AlacInfo struct {
+	BitDepth   int
+	Channels   int
+	SampleRate int
+	AvgBitRate int
+}
+
+var (
+	alacCache sync.Map // variant playlist URL -> alacProbe
+
+	probeClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+// alacProbe is the cached outcome of probing one variant playlist.
+type alacProbe struct {
+	info *AlacInfo
+	err  error
+}
+
+// ProbeAlac reads the init segment of an ALAC variant playlist and returns the
+// values from its alac box. Results, failures included, are cached per
+// playlist URL for the rest of the run, so a variant that cannot be read is
+// not requested again for every track and format.
+func ProbeAlac(variantUrl string) (*AlacInfo, error) {
+	if v, ok := alacCache.Load(variantUrl); ok {
+		p := v.(alacProbe)
+		return p.info, p.err
+	}
+	info, err := probeAlac(variantUrl)
+	alacCache.Store(variantUrl, alacProbe{info, err})
+	return info, err
+}
+
+func probeAlac(variantUrl string) (*AlacInfo, error) {
+	initUrl, start, end, err := initSegmentRange(variantUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", initUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAlacInit(data)
+}
+
+// initSegmentRange resolves where the init segment of a media playlist lives.
+// Apple serves each variant as one file, so without EXT-X-MAP the head of the
+// first segment is used.
+func initSegmentRange(variantUrl string) (string, int64, int64, error) {
+	base, err := url.Parse(variantUrl)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	resp, err := probeClient.Get(variantUrl)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, 0, errors.New(resp.Status)
+	}
+	from, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	if err != nil || listType != m3u8.MEDIA {
+		return "", 0, 0, errors.New("m3u8 not of media type")
+	}
+	media := from.(*m3u8.MediaPlaylist)
+
+	var uri string
+	start, end := int64(0), int64(initProbeBytes-1)
+	if media.Map != nil && media.Map.URI != "" {
+		uri = media.Map.URI
+		if media.Map.Limit > 0 {
+			start, end = media.Map.Offset, media.Map.Offset+media.Map.Limit-1
+		}
+	} else if len(media.Segments) > 0 && media.Segments[0] != nil {
+		uri = media.Segments[0].URI
+	} else {
+		return "", 0, 0, errors.New("no segments in media playlist")
+	}
+	ref, err := base.Parse(uri)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return ref.String(), start, end, nil
+}
+
+// parseAlacInit walks the top-level boxes of an init segment and decodes the
+// ALAC magic cookie from moov/trak/mdia/minf/stbl/stsd.
+func parseAlacInit(data []byte) (*AlacInfo, error) {
+	r := bytes.NewReader(data)
+	var pos uint64
+	for r.Len() > 0 {
+		box, err := mp4.DecodeBox(pos, r)
+		if err != nil {
+			return nil, fmt.Errorf("decode init segment: %w", err)
+		}
+		pos += box.Size()
+		moov, ok := box.(*mp4.MoovBox)
+		if !ok {
+			continue
+		}
+		for _, trak := range moov.Traks {
+			if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil || trak.Mdia.Minf.Stbl.Stsd == nil {
+				continue
+			}
+			for _, entry := range trak.Mdia.Minf.Stbl.Stsd.Children {
+				if info := alacFromSampleEntry(entry); info != nil {
+					return info, nil
+				}
+			}
+		}
+		return nil, errors.New("no alac sample entry in moov")
+	}
+	return nil, errors.New("moov not found in init segment")
+}
+
+// alacFromSampleEntry finds the alac config box in an encrypted (enca) or
+// clear (alac) sample entry. mp4ff does not know ALAC, so the clear sample
+// entry and the config box both arrive as UnknownBox.
+func alacFromSampleEntry(entry mp4.Box) *AlacInfo {
+	switch e := entry.(type) {
+	case *mp4.AudioSampleEntryBox:
+		for _, child := range e.Children {
+			if u, ok := child.(*mp4.UnknownBox); ok && u.Type() == "alac" {
+				return parseAlacCookie(u.Payload())
+			}
+		}
+	case *mp4.UnknownBox:
+		payload := e.Payload()
+		if e.Type() != "alac" || len(payload) < audioSampleEntryHeaderLen+8 {
+			return nil
+		}
+		inner := payload[audioSampleEntryHeaderLen:]
+		size := binary.BigEndian.Uint32(inner[0:4])
+		if string(inner[4:8]) != "alac" || int(size) > len(inner) || size < 8 {
+			return nil
+		}
+		return parseAlacCookie(inner[8:size])
+	}
+	return nil
+}
+
+// parseAlacCookie decodes an ALACSpecificConfig preceded by version/flags.
+func parseAlacCookie(p []byte) *AlacInfo {
+	if len(p) < 28 {
+		return nil
+	}
+	return &AlacInfo{
+		BitDepth:   int(p[9]),
+		Channels:   int(p[13]),
+		AvgBitRate: int(binary.BigEndian.Uint32(p[20:24])),
+		SampleRate: int(binary.BigEndian.Uint32(p[24:28])),
+	}
+}
+
+// probeAlacVariants reads the init segments of all ALAC variants of master
+// at once with verify-alac-quality on, so that alacVariantFormat finds them
+// in the cache instead of probing one variant after the other.
+func probeAlacVariants(masterUrl *url.URL, master *m3u8.MasterPlaylist) {
+	if !core.Config.VerifyAlacQuality {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, variant := range master.Variants {
+		if variant.Codecs != "alac" {
+			continue
+		}
+		variantUrl, err := masterUrl.Parse(variant.URI)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ProbeAlac(variantUrl.String())
+		}()
+	}
+	wg.Wait()
+}
+
+// alacVariantFormat returns the sample rate and bit depth of an ALAC variant.
+// The values come from the group ID (audio-alac-stereo-<rate>-<depth>) unless
+// verify-alac-quality is on and the init segment could be read.
+func alacVariantFormat(masterUrl *url.URL, variant *m3u8.Variant) (sampleRate, bitDepth int, verified bool) {
+	split := strings.Split(variant.Audio, "-")
+	if len(split) >= 2 {
+		sampleRate, _ = strconv.Atoi(split[len(split)-2])
+		bitDepth, _ = strconv.Atoi(split[len(split)-1])
+	}
+	if core.Config.VerifyAlacQuality && masterUrl != nil {
+		variantUrl, err := masterUrl.Parse(variant.URI)
+		if err == nil {
+			if info, err := ProbeAlac(variantUrl.String()); err == nil && info.SampleRate > 0 {
+				return info.SampleRate, info.BitDepth, true
+			}
+		}
+	}
+	return sampleRate, bitDepth, false
+}
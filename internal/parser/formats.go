@@ -0,0 +1,128 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format describes the best variant of one audio format in a master m3u8.
+type Format struct {
+	Available  bool   `json:"available"`
+	BitDepth   int    `json:"bitDepth,omitempty"`
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Bitrate    int    `json:"bitrate,omitempty"` // kbps
+	Quality    string `json:"quality,omitempty"`
+	Verified   bool   `json:"verified,omitempty"` // read from the alac box, not the group ID
+}
+
+// Formats is the availability of every audio format for one track.
+type Formats struct {
+	AAC        Format `json:"aac"`
+	Lossless   Format `json:"lossless"`
+	HiRes      Format `json:"hiRes"`
+	Atmos      Format `json:"atmos"`
+	DolbyAudio Format `json:"dolbyAudio"`
+}
+
+// FormatNames lists the formats in display order, by their JSON key.
+var FormatNames = []string{"aac", "lossless", "hiRes", "atmos", "dolbyAudio"}
+
+// Get returns the format with the given JSON key.
+func (f *Formats) Get(name string) Format {
+	switch name {
+	case "aac":
+		return f.AAC
+	case "lossless":
+		return f.Lossless
+	case "hiRes":
+		return f.HiRes
+	case "atmos":
+		return f.Atmos
+	case "dolbyAudio":
+		return f.DolbyAudio
+	}
+	return Format{}
+}
+
+// Merge keeps, for every format, the better of f and o.
+func (f *Formats) Merge(o *Formats) {
+	better := func(a, b Format) Format {
+		if !a.Available {
+			return b
+		}
+		if b.Available && (b.SampleRate > a.SampleRate || b.BitDepth > a.BitDepth || b.Bitrate > a.Bitrate) {
+			return b
+		}
+		return a
+	}
+	f.AAC = better(f.AAC, o.AAC)
+	f.Lossless = better(f.Lossless, o.Lossless)
+	f.HiRes = better(f.HiRes, o.HiRes)
+	f.Atmos = better(f.Atmos, o.Atmos)
+	f.DolbyAudio = better(f.DolbyAudio, o.DolbyAudio)
+}
+
+// ProbeFormats reads a master m3u8 and reports the highest quality variant of
+// each format, regardless of alac-max / atmos-max.
+func ProbeFormats(b string) (*Formats, error) {
+	masterUrl, master, err := fetchMaster(b)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Formats{}
+	for _, variant := range master.Variants {
+		split := strings.Split(variant.Audio, "-")
+		last, _ := strconv.Atoi(split[len(split)-1])
+		kbps := int(variant.AverageBandwidth / 1000)
+		if kbps == 0 {
+			kbps = int(variant.Bandwidth / 1000)
+		}
+
+		switch {
+		case variant.Codecs == "mp4a.40.2":
+			if len(split) < 3 {
+				continue
+			}
+			bitrate, _ := strconv.Atoi(split[2])
+			if bitrate > f.AAC.Bitrate {
+				f.AAC = Format{Available: true, Bitrate: bitrate, Quality: fmt.Sprintf("%d kbps", bitrate)}
+			}
+		case variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos"):
+			// Atmos variants are named like audio-atmos-2768, where the leading 2 is not part of the bitrate.
+			bitrate := last
+			if s := split[len(split)-1]; len(s) == 4 && s[0] == '2' {
+				bitrate, _ = strconv.Atoi(s[1:])
+			}
+			if bitrate > f.Atmos.Bitrate {
+				f.Atmos = Format{Available: true, Bitrate: bitrate, Quality: fmt.Sprintf("%d kbps", bitrate)}
+			}
+		case variant.Codecs == "ac-3":
+			if last > f.DolbyAudio.Bitrate {
+				f.DolbyAudio = Format{Available: true, Bitrate: last, Quality: fmt.Sprintf("%d kbps", last)}
+			}
+		case variant.Codecs == "alac":
+			if len(split) < 3 {
+				continue
+			}
+			sampleRate, bitDepth, verified := alacVariantFormat(masterUrl, variant)
+			alac := Format{
+				Available:  true,
+				BitDepth:   bitDepth,
+				SampleRate: sampleRate,
+				Bitrate:    kbps,
+				Quality:    fmt.Sprintf("%dbit/%.1fkHz", bitDepth, float64(sampleRate)/1000.0),
+				Verified:   verified,
+			}
+			target := &f.Lossless
+			if sampleRate > 48000 {
+				target = &f.HiRes
+			}
+			if sampleRate > target.SampleRate || (sampleRate == target.SampleRate && bitDepth > target.BitDepth) {
+				*target = alac
+			}
+		}
+	}
+	return f, nil
+}
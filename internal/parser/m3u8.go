@@ -7,18 +7,17 @@ import (
 	"fmt"
 	"io"
 	"main/internal/core"
+	"main/internal/errs"
 	"main/utils/structs"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/grafov/m3u8"
-	"github.com/olekukonko/tablewriter"
 )
 
 // ExtractMvAudio extracts the best audio stream URL from a music video's master m3u8
@@ -126,185 +125,117 @@ func CheckM3u8(b string, f string, account *structs.Account) (string, error) {
 	return EnhancedHls, nil
 }
 
-func formatAvailability(available bool, quality string) string {
-	if !available {
-		return "Not Available"
-	}
-	return quality
-}
-
-// ExtractMedia extracts the best media stream URL and quality info from a master m3u8
-func ExtractMedia(b string, more_mode bool) (string, string, string, error) {
+// fetchMaster downloads and decodes a master m3u8, probing its ALAC variants
+// when verify-alac-quality is on.
+func fetchMaster(b string) (*url.URL, *m3u8.MasterPlaylist, error) {
 	masterUrl, err := url.Parse(b)
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, err
 	}
 	resp, err := http.Get(b)
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", "", "", errors.New(resp.Status)
+		return nil, nil, errors.New(resp.Status)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", "", "", err
+		return nil, nil, err
 	}
-	masterString := string(body)
-	from, listType, err := m3u8.DecodeFrom(strings.NewReader(masterString), true)
+	from, listType, err := m3u8.DecodeFrom(bytes.NewReader(body), true)
 	if err != nil || listType != m3u8.MASTER {
-		return "", "", "", errors.New("m3u8 not of master type")
+		return nil, nil, errors.New("m3u8 not of master type")
 	}
 	master := from.(*m3u8.MasterPlaylist)
-	var streamUrl *url.URL
-	sort.Slice(master.Variants, func(i, j int) bool {
-		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
-	})
+	probeAlacVariants(masterUrl, master)
+	return masterUrl, master, nil
+}
 
-	var hasAAC, hasLossless, hasHiRes, hasAtmos, hasDolbyAudio bool
-	var aacQuality, losslessQuality, hiResQuality, atmosQuality, dolbyAudioQuality string
+// Master is a decoded master m3u8 with its variants sorted by bandwidth, best
+// first. It is fetched once and then asked for each codec of a fallback chain.
+type Master struct {
+	url      *url.URL
+	playlist *m3u8.MasterPlaylist
+}
 
-	for _, variant := range master.Variants {
-		if variant.Codecs == "mp4a.40.2" { // AAC
-			hasAAC = true
-			split := strings.Split(variant.Audio, "-")
-			if len(split) >= 3 {
-				bitrate, _ := strconv.Atoi(split[2])
-				currentBitrate := 0
-				if aacQuality != "" {
-					fmt.Sscanf(aacQuality, "%d kbps", &currentBitrate)
-				}
-				if bitrate > currentBitrate {
-					aacQuality = fmt.Sprintf("%d kbps", bitrate)
-				}
-			}
-		} else if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") { // Dolby Atmos
-			hasAtmos = true
-			split := strings.Split(variant.Audio, "-")
-			if len(split) > 0 {
-				bitrateStr := split[len(split)-1]
-				if len(bitrateStr) == 4 && bitrateStr[0] == '2' {
-					bitrateStr = bitrateStr[1:]
-				}
-				bitrate, _ := strconv.Atoi(bitrateStr)
-				currentBitrate := 0
-				if atmosQuality != "" {
-					fmt.Sscanf(atmosQuality, "%d kbps", &currentBitrate)
-				}
-				if bitrate > currentBitrate {
-					atmosQuality = fmt.Sprintf("%d kbps", bitrate)
-				}
-			}
-		} else if variant.Codecs == "alac" { // ALAC (Lossless or Hi-Res)
-			split := strings.Split(variant.Audio, "-")
-			if len(split) >= 3 {
-				bitDepth := split[len(split)-1]
-				sampleRate := split[len(split)-2]
-				sampleRateInt, _ := strconv.Atoi(sampleRate)
-				if sampleRateInt > 48000 { // Hi-Res
-					hasHiRes = true
-					hiResQuality = fmt.Sprintf("%sbit/%.1fkHz", bitDepth, float64(sampleRateInt)/1000.0)
-				} else { // Standard Lossless
-					hasLossless = true
-					losslessQuality = fmt.Sprintf("%sbit/%.1fkHz", bitDepth, float64(sampleRateInt)/1000.0)
-				}
-			}
-		} else if variant.Codecs == "ac-3" { // Dolby Audio
-			hasDolbyAudio = true
-			split := strings.Split(variant.Audio, "-")
-			if len(split) > 0 {
-				bitrate, _ := strconv.Atoi(split[len(split)-1])
-				dolbyAudioQuality = fmt.Sprintf("%d kbps", bitrate)
-			}
-		}
+// FetchMaster downloads and decodes the master m3u8 b.
+func FetchMaster(b string) (*Master, error) {
+	masterUrl, master, err := fetchMaster(b)
+	if err != nil {
+		return nil, err
 	}
+	sort.Slice(master.Variants, func(i, j int) bool {
+		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
+	})
+	return &Master{url: masterUrl, playlist: master}, nil
+}
 
-	var qualityForDisplay string
-	if hasHiRes {
-		qualityForDisplay = hiResQuality
-	} else if hasLossless {
-		qualityForDisplay = losslessQuality
-	} else if hasAtmos {
-		qualityForDisplay = "Dolby Atmos"
-	} else if hasDolbyAudio {
-		qualityForDisplay = "Dolby Audio"
-	} else if hasAAC {
-		qualityForDisplay = "AAC"
+// SelectVariant picks the variant for one codec of a fallback chain: atmos,
+// alac-hires, alac, aac, aac-binaural or aac-downmix. It never substitutes
+// another codec; it returns a codec-unavailable error instead. actual is the
+// codec that was selected, which is dolby-audio when an atmos request is
+// served by an ac-3 stream.
+func (m *Master) SelectVariant(codec string) (streamUrl string, quality string, actual string, err error) {
+	u, quality, actual := selectVariant(m.url, m.playlist, codec)
+	if u == nil {
+		return "", "", "", errs.New(errs.CodeCodecUnavailable, codec+" unavailable")
 	}
+	return u.String(), quality, actual, nil
+}
 
-	if core.Debug_mode && more_mode {
-		fmt.Println("\nDebug: All Available Variants:")
-		var data [][]string
-		for _, variant := range master.Variants {
-			data = append(data, []string{variant.Codecs, variant.Audio, fmt.Sprint(variant.Bandwidth)})
-		}
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Codec", "Audio", "Bandwidth"})
-		table.SetRowLine(true)
-		table.AppendBulk(data)
-		table.Render()
-
-		fmt.Println("Available Audio Formats:")
-		fmt.Println("------------------------")
-		fmt.Printf("AAC             : %s\n", formatAvailability(hasAAC, aacQuality))
-		fmt.Printf("Lossless        : %s\n", formatAvailability(hasLossless, losslessQuality))
-		fmt.Printf("Hi-Res Lossless : %s\n", formatAvailability(hasHiRes, hiResQuality))
-		fmt.Printf("Dolby Atmos     : %s\n", formatAvailability(hasAtmos, atmosQuality))
-		fmt.Printf("Dolby Audio     : %s\n", formatAvailability(hasDolbyAudio, dolbyAudioQuality))
-		fmt.Println("------------------------")
-
-		return "", "", "", nil
-	}
-	var qualityForFilename string
+// selectVariant walks variants sorted by bandwidth and returns the first one
+// matching codec within alac-max / atmos-max.
+func selectVariant(masterUrl *url.URL, master *m3u8.MasterPlaylist, codec string) (*url.URL, string, string) {
 	for _, variant := range master.Variants {
-		if core.Dl_atmos {
+		switch codec {
+		case "atmos":
 			if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") {
 				split := strings.Split(variant.Audio, "-")
 				length_int, err := strconv.Atoi(split[len(split)-1])
 				if err == nil && length_int <= *core.Atmos_max {
-					streamUrl, _ = masterUrl.Parse(variant.URI)
-					qualityForFilename = fmt.Sprintf("%s kbps", split[len(split)-1])
-					break
+					streamUrl, _ := masterUrl.Parse(variant.URI)
+					return streamUrl, fmt.Sprintf("%s kbps", split[len(split)-1]), "atmos"
 				}
-			} else if variant.Codecs == "ac-3" {
-				streamUrl, _ = masterUrl.Parse(variant.URI)
+			}
+		case "dolby-audio":
+			if variant.Codecs == "ac-3" {
+				streamUrl, _ := masterUrl.Parse(variant.URI)
 				split := strings.Split(variant.Audio, "-")
-				qualityForFilename = fmt.Sprintf("%s kbps", split[len(split)-1])
-				break
+				return streamUrl, fmt.Sprintf("%s kbps", split[len(split)-1]), "dolby-audio"
+			}
+		case "alac", "alac-hires":
+			if variant.Codecs != "alac" {
+				continue
 			}
-		} else if core.Dl_aac {
+			length_int, bitDepth, _ := alacVariantFormat(masterUrl, variant)
+			if length_int <= 0 || length_int > *core.Alac_max {
+				continue
+			}
+			if (codec == "alac" && length_int > 48000) || (codec == "alac-hires" && length_int <= 48000) {
+				continue
+			}
+			actual := "alac"
+			if length_int > 48000 {
+				actual = "alac-hires"
+			}
+			streamUrl, _ := masterUrl.Parse(variant.URI)
+			KHZ := float64(length_int) / 1000.0
+			return streamUrl, fmt.Sprintf("%dB-%.1fkHz", bitDepth, KHZ), actual
+		default:
 			if variant.Codecs == "mp4a.40.2" {
 				aacregex := regexp.MustCompile(`audio-stereo-\d+`)
 				replaced := aacregex.ReplaceAllString(variant.Audio, "aac")
-				if replaced == *core.Aac_type {
-					streamUrl, _ = masterUrl.Parse(variant.URI)
+				if replaced == codec {
+					streamUrl, _ := masterUrl.Parse(variant.URI)
 					split := strings.Split(variant.Audio, "-")
-					qualityForFilename = fmt.Sprintf("%s kbps", split[2])
-					break
+					return streamUrl, fmt.Sprintf("%s kbps", split[2]), codec
 				}
 			}
-		} else {
-			if variant.Codecs == "alac" {
-				split := strings.Split(variant.Audio, "-")
-				length_int, err := strconv.Atoi(split[len(split)-2])
-				if err == nil && length_int <= *core.Alac_max {
-					streamUrl, _ = masterUrl.Parse(variant.URI)
-					KHZ := float64(length_int) / 1000.0
-					qualityForFilename = fmt.Sprintf("%sB-%.1fkHz", split[len(split)-1], KHZ)
-					break
-				}
-			}
-		}
-	}
-	if streamUrl == nil {
-		if len(master.Variants) > 0 {
-			streamUrl, _ = masterUrl.Parse(master.Variants[0].URI)
-		} else {
-			return "", "", qualityForDisplay, errors.New("no variants found in playlist")
 		}
 	}
-	return streamUrl.String(), qualityForFilename, qualityForDisplay, nil
+	return nil, "", ""
 }
 
 // ExtractVideo extracts the best video stream URL from a master m3u8
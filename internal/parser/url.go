@@ -2,6 +2,7 @@ package parser
 
 import (
 	"regexp"
+	"strings"
 )
 
 // CheckUrl validates and extracts info from a standard album URL
@@ -64,3 +65,39 @@ func CheckUrlArtist(url string) (string, string) {
 	}
 }
 
+
+var (
+	isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}\d{7}$`)
+	upcPattern  = regexp.MustCompile(`^\d{12,14}$`)
+)
+
+// CheckIdentifier recognizes an ISRC or UPC/EAN, bare or written as
+// "isrc:..." / "upc:..." / "ean:...". For lines copied from a spreadsheet
+// only the first comma, semicolon or tab separated field is looked at. It
+// returns "isrc" or "upc" and the normalized code, or two empty strings.
+func CheckIdentifier(s string) (string, string) {
+	if i := strings.IndexAny(s, ",;\t"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.Trim(strings.TrimSpace(s), `"'`)
+	kind := ""
+	if prefix, rest, ok := strings.Cut(s, ":"); ok {
+		switch strings.ToLower(prefix) {
+		case "isrc":
+			kind = "isrc"
+		case "upc", "ean":
+			kind = "upc"
+		default:
+			return "", ""
+		}
+		s = strings.TrimSpace(rest)
+	}
+	code := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	switch {
+	case (kind == "" || kind == "isrc") && isrcPattern.MatchString(code):
+		return "isrc", code
+	case (kind == "" || kind == "upc") && upcPattern.MatchString(code):
+		return "upc", code
+	}
+	return "", ""
+}
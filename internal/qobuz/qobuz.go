@@ -321,21 +321,21 @@ func GetQobuzExtras(artistName, albumName string) (string, []PDFExtra, error) {
 	return description, pdfs, nil
 }
 
-func DownloadPDF(pdf PDFExtra, saveFolder string) error {
+func DownloadPDF(pdf PDFExtra, saveFolder string) (string, error) {
 	req, err := http.NewRequest("GET", pdf.URL, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
 	req.Header.Set("User-Agent", userAgent)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download PDF, status: %s", resp.Status)
+		return "", fmt.Errorf("failed to download PDF, status: %s", resp.Status)
 	}
 
 	var filename string
@@ -345,7 +345,7 @@ func DownloadPDF(pdf PDFExtra, saveFolder string) error {
 		filename += ".pdf"
 	}
 
-	filename = core.ForbiddenNames.ReplaceAllString(filename, "_")
+	filename = core.Sanitizer.Name(filename)
 
 	base := strings.TrimSuffix(filename, filepath.Ext(filename))
 	ext := filepath.Ext(filename)
@@ -354,7 +354,7 @@ func DownloadPDF(pdf PDFExtra, saveFolder string) error {
 	for i := 1; ; i++ {
 		exists, err := utils.FileExists(savePath)
 		if err != nil {
-			return err
+			return "", err
 		}
 		if !exists {
 			break
@@ -365,13 +365,13 @@ func DownloadPDF(pdf PDFExtra, saveFolder string) error {
 
 	f, err := os.Create(savePath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer f.Close()
 
 	_, err = io.Copy(f, resp.Body)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return savePath, nil
 }
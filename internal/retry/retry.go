@@ -0,0 +1,199 @@
+// Package retry turns the retry section of config.yaml into a policy that
+// decides, per error class, whether a failed attempt is repeated on the same
+// account, moved to the next account, or given up on, and how long to wait in
+// between.
+package retry
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"main/internal/errs"
+	"main/utils/structs"
+)
+
+// Action is what the caller should do after a failed attempt.
+type Action int
+
+const (
+	// SameAccount retries with the account that just failed.
+	SameAccount Action = iota
+	// SwitchAccount moves on to the next working account.
+	SwitchAccount
+	// FailFast gives up immediately; retrying cannot help.
+	FailFast
+)
+
+func (a Action) String() string {
+	switch a {
+	case SameAccount:
+		return "same-account"
+	case SwitchAccount:
+		return "switch-account"
+	}
+	return "fail-fast"
+}
+
+const (
+	defaultMaxAttempts      = 3
+	defaultMaxTotalAttempts = 6
+	defaultChunkAttempts    = 5
+	defaultBaseDelay        = 2 * time.Second
+	defaultMaxDelay         = 30 * time.Second
+	defaultJitter           = 0.2
+)
+
+var defaultActions = map[errs.Code]Action{
+	errs.CodeUnknown:                SameAccount,
+	errs.CodeNetwork:                SameAccount,
+	errs.CodeDecryptFailed:          SameAccount,
+	errs.CodeTaggingFailed:          SameAccount,
+	errs.CodeIntegrityFailed:        SameAccount,
+	errs.CodeTokenInvalid:           SwitchAccount,
+	errs.CodeDecryptPortUnreachable: SwitchAccount,
+	errs.CodeManifestMissing:        SwitchAccount,
+	errs.CodeGeoUnavailable:         FailFast,
+	errs.CodeCodecUnavailable:       FailFast,
+	errs.CodeConfig:                 FailFast,
+	errs.CodeInvalidURL:             FailFast,
+	errs.CodeDiskFull:               FailFast,
+	errs.CodeDependencyMissing:      FailFast,
+	errs.CodeNotFound:               FailFast,
+}
+
+// Policy is an immutable retry policy. The zero value is not usable; build
+// one with New.
+type Policy struct {
+	maxAttempts      int
+	maxTotalAttempts int
+	chunkAttempts    int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	jitter           float64
+	actions          map[errs.Code]Action
+}
+
+// Validate reports unknown error classes and out-of-range values in c.
+func Validate(c structs.RetryConfig) error {
+	for _, list := range [][]string{c.SameAccount, c.SwitchAccount, c.FailFast} {
+		for _, name := range list {
+			if _, ok := errs.ParseCode(name); !ok {
+				return fmt.Errorf("retry: unknown error class %q", name)
+			}
+		}
+	}
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter > 1) {
+		return fmt.Errorf("retry: jitter must be between 0 and 1, got %v", *c.Jitter)
+	}
+	if c.MaxDelayMs > 0 && c.BaseDelayMs > c.MaxDelayMs {
+		return fmt.Errorf("retry: base-delay-ms (%d) is larger than max-delay-ms (%d)", c.BaseDelayMs, c.MaxDelayMs)
+	}
+	return nil
+}
+
+// New builds a policy from config, filling unset fields with defaults. A
+// jitter of 0 turns jitter off; only a missing jitter takes the default.
+// Classes listed in config override the default action for that class.
+func New(c structs.RetryConfig) *Policy {
+	p := &Policy{
+		maxAttempts:      orInt(c.MaxAttempts, defaultMaxAttempts),
+		maxTotalAttempts: orInt(c.MaxTotalAttempts, defaultMaxTotalAttempts),
+		chunkAttempts:    orInt(c.ChunkAttempts, defaultChunkAttempts),
+		baseDelay:        orDuration(c.BaseDelayMs, defaultBaseDelay),
+		maxDelay:         orDuration(c.MaxDelayMs, defaultMaxDelay),
+		jitter:           defaultJitter,
+		actions:          make(map[errs.Code]Action, len(defaultActions)),
+	}
+	if c.Jitter != nil {
+		p.jitter = *c.Jitter
+	}
+	for code, a := range defaultActions {
+		p.actions[code] = a
+	}
+	set := func(names []string, a Action) {
+		for _, name := range names {
+			if code, ok := errs.ParseCode(name); ok {
+				p.actions[code] = a
+			}
+		}
+	}
+	set(c.SameAccount, SameAccount)
+	set(c.SwitchAccount, SwitchAccount)
+	set(c.FailFast, FailFast)
+	return p
+}
+
+// MaxAttempts is the number of attempts allowed on a single account.
+func (p *Policy) MaxAttempts() int { return p.maxAttempts }
+
+// MaxTotalAttempts caps attempts for one track across all accounts.
+func (p *Policy) MaxTotalAttempts() int { return p.maxTotalAttempts }
+
+// ChunkAttempts is the number of attempts for one byte range of a file.
+func (p *Policy) ChunkAttempts() int { return p.chunkAttempts }
+
+// Action classifies err and returns what to do next.
+func (p *Policy) Action(err error) Action {
+	if a, ok := p.actions[errs.CodeOf(err)]; ok {
+		return a
+	}
+	return SameAccount
+}
+
+// Delay returns the wait before retry number attempt (1-based): exponential
+// backoff from the base delay, capped at the max delay, with +/- jitter.
+func (p *Policy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(p.baseDelay) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.maxDelay) {
+		d = float64(p.maxDelay)
+	}
+	if p.jitter > 0 {
+		d += d * p.jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Sleep waits for Delay(attempt).
+func (p *Policy) Sleep(attempt int) {
+	time.Sleep(p.Delay(attempt))
+}
+
+// Do calls fn until it succeeds, the policy says to fail fast, or attempts
+// are used up. fn receives the 1-based attempt number. onRetry, if not nil,
+// is called before each wait.
+func (p *Policy) Do(attempts int, fn func(attempt int) error, onRetry func(attempt int, err error)) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts || p.Action(err) == FailFast {
+			break
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+		p.Sleep(attempt)
+	}
+	return err
+}
+
+func orInt(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func orDuration(ms int, def time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return def
+}
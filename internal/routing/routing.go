@@ -0,0 +1,139 @@
+// Package routing picks the save root and naming formats of an album, track
+// or music video from the output-routes section of config.yaml. Routes are
+// tried in order and the first one whose conditions all hold wins; fields it
+// leaves empty keep the global setting.
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"main/utils/structs"
+)
+
+// Values accepted by the enumerated route conditions.
+var (
+	Types     = []string{"song", "music-video"}
+	Sources   = []string{"album", "playlist"}
+	Codecs    = []string{"alac", "atmos", "dolby-audio", "aac"}
+	Qualities = []string{"hi-res", "lossless", "lossy"}
+)
+
+// Facts is what is known about the item being saved when its route is chosen.
+type Facts struct {
+	Genres      []string
+	Type        string // song or music-video
+	Source      string // album or playlist
+	Storefront  string
+	Explicit    bool
+	Codec       string // one of Codecs, empty when not known yet
+	Quality     string // one of Qualities, empty when not known yet
+	BitDepth    int    // 0 when not lossless or not known
+	Classical   bool   // marked classical by classical-mode
+	Compilation bool   // a compilation album
+}
+
+// Layout is the root and naming formats an item is saved with.
+type Layout struct {
+	Route                string // name of the matching route, empty for the defaults
+	Root                 string
+	ArtistFolderFormat   string
+	AlbumFolderFormat    string
+	PlaylistFolderFormat string
+	SongFileFormat       string
+}
+
+// Validate reports unknown condition values and routes that set nothing.
+func Validate(routes []structs.OutputRoute) error {
+	for i, r := range routes {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if r.Type != "" && !slices.Contains(Types, r.Type) {
+			return fmt.Errorf("output-routes %s: unknown type %q, expected one of %s", name, r.Type, strings.Join(Types, ", "))
+		}
+		if r.Source != "" && !slices.Contains(Sources, r.Source) {
+			return fmt.Errorf("output-routes %s: unknown source %q, expected one of %s", name, r.Source, strings.Join(Sources, ", "))
+		}
+		for _, c := range r.Codec {
+			if !slices.Contains(Codecs, c) {
+				return fmt.Errorf("output-routes %s: unknown codec %q, expected one of %s", name, c, strings.Join(Codecs, ", "))
+			}
+		}
+		for _, q := range r.Quality {
+			if !slices.Contains(Qualities, q) {
+				return fmt.Errorf("output-routes %s: unknown quality %q, expected one of %s", name, q, strings.Join(Qualities, ", "))
+			}
+		}
+		if r.Root == "" && r.ArtistFolderFormat == "" && r.AlbumFolderFormat == "" && r.PlaylistFolderFormat == "" && r.SongFileFormat == "" {
+			return fmt.Errorf("output-routes %s: sets neither a root nor a format", name)
+		}
+	}
+	return nil
+}
+
+// Resolve returns defaults overridden by the first route that matches f.
+func Resolve(routes []structs.OutputRoute, defaults Layout, f Facts) Layout {
+	for i, r := range routes {
+		if !Matches(r, f) {
+			continue
+		}
+		l := defaults
+		l.Route = r.Name
+		if l.Route == "" {
+			l.Route = fmt.Sprintf("#%d", i+1)
+		}
+		if r.Root != "" {
+			l.Root = r.Root
+		}
+		if r.ArtistFolderFormat != "" {
+			l.ArtistFolderFormat = r.ArtistFolderFormat
+		}
+		if r.AlbumFolderFormat != "" {
+			l.AlbumFolderFormat = r.AlbumFolderFormat
+		}
+		if r.PlaylistFolderFormat != "" {
+			l.PlaylistFolderFormat = r.PlaylistFolderFormat
+		}
+		if r.SongFileFormat != "" {
+			l.SongFileFormat = r.SongFileFormat
+		}
+		return l
+	}
+	return defaults
+}
+
+// Matches reports whether every condition set on r holds for f. Genres and
+// storefronts compare case-insensitively; a condition on a fact that is not
+// known yet does not match.
+func Matches(r structs.OutputRoute, f Facts) bool {
+	if len(r.Genre) > 0 && !slices.ContainsFunc(r.Genre, func(g string) bool {
+		return slices.ContainsFunc(f.Genres, func(fg string) bool { return strings.EqualFold(g, fg) })
+	}) {
+		return false
+	}
+	if r.Type != "" && r.Type != f.Type {
+		return false
+	}
+	if r.Source != "" && r.Source != f.Source {
+		return false
+	}
+	if len(r.Storefront) > 0 && !slices.ContainsFunc(r.Storefront, func(s string) bool { return strings.EqualFold(s, f.Storefront) }) {
+		return false
+	}
+	if r.Explicit != nil && *r.Explicit != f.Explicit {
+		return false
+	}
+	if len(r.Codec) > 0 && !slices.Contains(r.Codec, f.Codec) {
+		return false
+	}
+	if len(r.Quality) > 0 && !slices.Contains(r.Quality, f.Quality) {
+		return false
+	}
+	if len(r.BitDepth) > 0 && !slices.Contains(r.BitDepth, f.BitDepth) {
+		return false
+	}
+	return true
+}
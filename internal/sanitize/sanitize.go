@@ -0,0 +1,232 @@
+// Package sanitize turns rendered names into path components that the target
+// file system accepts. A profile decides which characters are replaced,
+// whether Windows rules (reserved device names, trailing dots and spaces)
+// apply, and how long one component may be.
+package sanitize
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"main/utils/structs"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Profile describes the naming rules of one kind of target.
+type Profile struct {
+	Forbidden    string // characters replaced besides control characters
+	WindowsRules bool   // trailing dots/spaces and reserved device names
+	ASCII        bool   // transliterate to ASCII
+	MaxBytes     int    // per component in UTF-8 bytes, 0 for no limit
+	MaxUnits     int    // per component in UTF-16 code units, 0 for no limit
+}
+
+const windowsForbidden = `/\<>:"|?*`
+
+// Profiles are the built-in profiles, by their config name.
+var Profiles = map[string]Profile{
+	// ext4, APFS, btrfs and friends: only "/" and NUL are illegal.
+	"posix": {Forbidden: "/", MaxBytes: 255},
+	// NTFS as seen through Windows APIs.
+	"windows": {Forbidden: windowsForbidden, WindowsRules: true, MaxUnits: 255},
+	// Samba shares on a Linux host: Windows clients' rules on a 255-byte file system.
+	"smb": {Forbidden: windowsForbidden, WindowsRules: true, MaxBytes: 255},
+	// exFAT: same character set as Windows, 255 UTF-16 units.
+	"exfat": {Forbidden: windowsForbidden, WindowsRules: true, MaxUnits: 255},
+	// Windows rules on plain ASCII names, for players and file systems that
+	// mishandle anything else.
+	"ascii-transliterate": {Forbidden: windowsForbidden, WindowsRules: true, ASCII: true, MaxBytes: 255},
+}
+
+// Normalizations are the values accepted by normalization.
+var Normalizations = []string{"nfc", "nfd", "none"}
+
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Sanitizer applies one profile. The zero value is not usable; build one
+// with New.
+type Sanitizer struct {
+	profile     Profile
+	form        string
+	replacement string
+	replacer    *strings.Replacer
+}
+
+// New builds a sanitizer from config, filling unset fields with the windows
+// profile, NFC and "_".
+func New(c structs.SanitizeConfig) (*Sanitizer, error) {
+	name := c.Profile
+	if name == "" {
+		name = "windows"
+	}
+	p, ok := Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("sanitize: unknown profile %q", name)
+	}
+	if c.MaxComponentBytes > 0 {
+		p.MaxBytes = c.MaxComponentBytes
+	}
+
+	s := &Sanitizer{profile: p, form: c.Normalization, replacement: c.Replacement}
+	if s.form == "" {
+		s.form = "nfc"
+	}
+	if !slices.Contains(Normalizations, s.form) {
+		return nil, fmt.Errorf("sanitize: unknown normalization %q", s.form)
+	}
+	if s.replacement == "" {
+		s.replacement = "_"
+	}
+	if strings.ContainsAny(s.replacement, p.Forbidden) || s.replacement == "." {
+		return nil, fmt.Errorf("sanitize: replacement %q is not allowed by profile %s", s.replacement, name)
+	}
+
+	if len(c.Replace) > 0 {
+		var pairs []string
+		keys := make([]string, 0, len(c.Replace))
+		for k := range c.Replace {
+			keys = append(keys, k)
+		}
+		// Longest first, so "..." wins over ".".
+		slices.SortFunc(keys, func(a, b string) int { return len(b) - len(a) })
+		for _, k := range keys {
+			if k == "" {
+				return nil, fmt.Errorf("sanitize: empty key in replace map")
+			}
+			pairs = append(pairs, k, c.Replace[k])
+		}
+		s.replacer = strings.NewReplacer(pairs...)
+	}
+	return s, nil
+}
+
+// Name makes one path component safe: it normalizes, applies the replace
+// map, transliterates, replaces illegal characters and enforces the
+// profile's length limit. An extension after the last dot is kept when the
+// name has to be shortened. An empty name stays empty.
+func (s *Sanitizer) Name(name string) string {
+	if name == "" {
+		return ""
+	}
+	switch s.form {
+	case "nfc":
+		name = norm.NFC.String(name)
+	case "nfd":
+		name = norm.NFD.String(name)
+	}
+	if s.replacer != nil {
+		name = s.replacer.Replace(name)
+	}
+	if s.profile.ASCII {
+		name = transliterate(name, s.replacement)
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(s.profile.Forbidden, r) {
+			b.WriteString(s.replacement)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	name = s.Fit(b.String())
+
+	if s.profile.WindowsRules {
+		// CON, nul.txt and "COM1 .lrc" all open a device on Windows.
+		base := strings.SplitN(name, ".", 2)[0]
+		if slices.Contains(reservedNames, strings.ToUpper(strings.TrimRight(base, " "))) {
+			name = s.Fit(base + s.replacement + name[len(base):])
+		}
+	}
+	if name == "" {
+		return s.replacement
+	}
+	return name
+}
+
+// extensions are the media and sidecar extensions Fit keeps. Any other final
+// dot-segment, as in "feat. Vincent" or "Vol.2", is part of the name.
+var extensions = []string{".m4a", ".mp4", ".lrc", ".ttml", ".jpg", ".jpeg", ".png", ".pdf", ".nfo", ".json", ".txt"}
+
+// Fit shortens name to the profile's component limit, keeping a known
+// extension, and drops trailing dots and spaces where Windows rules apply. It
+// does not replace characters, so it is safe to call on an already sanitized
+// name.
+func (s *Sanitizer) Fit(name string) string {
+	ext := filepath.Ext(name)
+	if !slices.Contains(extensions, strings.ToLower(ext)) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	for !s.fits(stem+ext) && stem != "" {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	if s.profile.WindowsRules {
+		stem = strings.TrimRight(stem, ". ")
+		if ext == "" {
+			return stem
+		}
+	}
+	return stem + ext
+}
+
+// Truncate cuts n bytes off the end of name without splitting a character.
+// It returns "" when name is not longer than n.
+func Truncate(name string, n int) string {
+	if n <= 0 {
+		return name
+	}
+	if len(name) <= n {
+		return ""
+	}
+	cut := len(name) - n
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut]
+}
+
+func (s *Sanitizer) fits(name string) bool {
+	if s.profile.MaxBytes > 0 && len(name) > s.profile.MaxBytes {
+		return false
+	}
+	if s.profile.MaxUnits > 0 && len(utf16.Encode([]rune(name))) > s.profile.MaxUnits {
+		return false
+	}
+	return true
+}
+
+var asciiFolds = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'þ': "th", 'Þ': "Th", 'ð': "d", 'Ð': "D",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-",
+}
+
+// transliterate drops accents and folds common letters to ASCII. Characters
+// without an ASCII form become replacement.
+func transliterate(name, replacement string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+		case asciiFolds[r] != "":
+			b.WriteString(asciiFolds[r])
+		default:
+			b.WriteString(replacement)
+		}
+	}
+	return b.String()
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"main/internal/core"
+	"main/internal/logging"
 	"main/internal/utils"
 	"main/utils/runv14"
 	"main/utils/structs"
@@ -50,6 +51,7 @@ func NewProgressUI(wg *sync.WaitGroup) *ProgressUI {
 	} else {
 		p = mpb.New(mpb.WithOutput(os.Stdout), mpb.WithWidth(60))
 	}
+	logging.HoldConsole()
 	return &ProgressUI{
 		p:    p,
 		wg:   wg,
@@ -305,6 +307,7 @@ func (pui *ProgressUI) Abort(trackIndex int, status string) {
 
 func (pui *ProgressUI) Wait() {
 	pui.p.Wait()
+	logging.ReleaseConsole()
 }
 
 func SelectTracks(meta *structs.AutoGenerated, storefront, urlArg_i string) []int {
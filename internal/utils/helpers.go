@@ -6,25 +6,35 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"main/internal/core"
+	"main/internal/sanitize"
 )
 
+// trackNumberPrefix is the leading track number of a file name, kept when
+// the name is shortened.
+var trackNumberPrefix = regexp.MustCompile(`^(\d+[\s.-]*)`)
+
 // EnsureSafePath truncates path components to ensure the total path length does not exceed the limit
-func EnsureSafePath(basePath, artistDir, albumDir, fileName string) (string, string, string) {
+// discDir is counted but never shortened.
+func EnsureSafePath(basePath, artistDir, albumDir, discDir, fileName string) (string, string, string) {
+	// Lengths are in bytes; sanitize.Truncate never splits a character and
+	// Fit applies the per-component limit of the sanitize profile. Folders
+	// keep at least their first character.
 	truncate := func(s string, n int) string {
-		if n <= 0 {
-			return s
-		}
-		runes := []rune(s)
-		if len(runes) <= n {
-			return ""
+		_, first := utf8.DecodeRuneInString(s)
+		if out := core.Sanitizer.Fit(sanitize.Truncate(s, min(n, len(s)-first))); out != "" {
+			return out
 		}
-		return string(runes[:len(runes)-n])
+		return core.Sanitizer.Name(s[:first])
 	}
+	artistDir = core.Sanitizer.Fit(artistDir)
+	albumDir = core.Sanitizer.Fit(albumDir)
+	fileName = core.Sanitizer.Fit(fileName)
 
 	for {
-		currentPath := filepath.Join(basePath, artistDir, albumDir, fileName)
+		currentPath := filepath.Join(basePath, artistDir, albumDir, discDir, fileName)
 		if len(currentPath) <= core.MaxPathLength {
 			break
 		}
@@ -35,8 +45,7 @@ func EnsureSafePath(basePath, artistDir, albumDir, fileName string) (string, str
 
 		var prefixPart string
 		var namePart string
-		re := regexp.MustCompile(`^(\d+[\s.-]*)`)
-		matches := re.FindStringSubmatch(stem)
+		matches := trackNumberPrefix.FindStringSubmatch(stem)
 
 		if len(matches) > 1 {
 			prefixPart = matches[1]
@@ -52,17 +61,19 @@ func EnsureSafePath(basePath, artistDir, albumDir, fileName string) (string, str
 			if shortenAmount > canShorten {
 				shortenAmount = canShorten
 			}
-			namePart = truncate(namePart, shortenAmount)
+			namePart = sanitize.Truncate(namePart, shortenAmount)
 
 			if namePart == "" {
 				prefixPart = strings.TrimRight(prefixPart, " .-")
 			}
 
-			fileName = prefixPart + namePart + ext
+			// Fit the whole name, so the extension counts towards the
+			// per-component limit.
+			fileName = core.Sanitizer.Fit(prefixPart + namePart + ext)
 			continue
 		}
 
-		if len(albumDir) > 1 { // 至少保留一个字符
+		if utf8.RuneCountInString(albumDir) > 1 { // 至少保留一个字符
 			canShorten := len(albumDir)
 			shortenAmount := overage
 			if shortenAmount > canShorten {
@@ -72,7 +83,7 @@ func EnsureSafePath(basePath, artistDir, albumDir, fileName string) (string, str
 			continue
 		}
 
-		if len(artistDir) > 1 { // 至少保留一个字符
+		if utf8.RuneCountInString(artistDir) > 1 { // 至少保留一个字符
 			canShorten := len(artistDir)
 			shortenAmount := overage
 			if shortenAmount > canShorten {
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 	"sync"
 
@@ -15,19 +17,24 @@ import (
 	"main/internal/api"
 	"main/internal/core"
 	"main/internal/downloader"
+	"main/internal/errs"
+	"main/internal/logging"
+	"main/internal/naming"
 	"main/internal/parser"
 )
 
 var jsonOutput bool
 
-func printJSONError(message string) {
+func printJSONError(message string, err error) {
 	type JsonError struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
+		Status  string    `json:"status"`
+		Message string    `json:"message"`
+		Code    errs.Code `json:"code,omitempty"`
 	}
 	errJSON, _ := json.Marshal(JsonError{
 		Status:  "error",
 		Message: message,
+		Code:    errs.CodeOf(err),
 	})
 	fmt.Println(string(errJSON))
 }
@@ -40,34 +47,41 @@ func handleSingleMV(urlRaw string) {
 	accountForMV, err := core.GetAccountForStorefront(storefront)
 	if err != nil {
 		if jsonOutput {
-			printJSONError(fmt.Sprintf("MV 下载失败: %v", err))
+			printJSONError(fmt.Sprintf("MV 下载失败: %v", err), err)
 		} else {
 			fmt.Printf("MV 下载失败: %v\n", err)
 		}
 		core.SharedLock.Lock()
 		core.Counter.Error++
 		core.SharedLock.Unlock()
+		core.RecordFailure(err)
 		return
 	}
 
-	core.SharedLock.Lock()
-	core.Counter.Total++
-	core.SharedLock.Unlock()
+	if !core.Dry_run {
+		core.SharedLock.Lock()
+		core.Counter.Total++
+		core.SharedLock.Unlock()
+	}
 	if len(accountForMV.MediaUserToken) <= 50 {
 		core.SharedLock.Lock()
 		core.Counter.Error++
 		core.SharedLock.Unlock()
+		err := errs.New(errs.CodeTokenInvalid, "MV 下载失败: media-user-token 无效")
+		core.RecordFailure(err)
 		if jsonOutput {
-			printJSONError("MV 下载失败: media-user-token 无效")
+			printJSONError(err.Error(), err)
 		}
 		return
 	}
-	if _, err := exec.LookPath("mp4decrypt"); err != nil {
+	if _, err := exec.LookPath("mp4decrypt"); err != nil && !core.Dry_run {
 		core.SharedLock.Lock()
 		core.Counter.Error++
 		core.SharedLock.Unlock()
+		err = errs.Wrap(errs.CodeDependencyMissing, err, "MV 下载失败: 未找到 mp4decrypt")
+		core.RecordFailure(err)
 		if jsonOutput {
-			printJSONError("MV 下载失败: 未找到 mp4decrypt")
+			printJSONError("MV 下载失败: 未找到 mp4decrypt", err)
 		}
 		return
 	}
@@ -76,13 +90,27 @@ func handleSingleMV(urlRaw string) {
 	if err != nil {
 		errMsg := fmt.Sprintf("获取 MV 信息失败: %v", err)
 		if jsonOutput {
-			printJSONError(errMsg)
+			printJSONError(errMsg, err)
 		} else {
 			fmt.Println(errMsg)
 		}
 		core.SharedLock.Lock()
 		core.Counter.Error++
 		core.SharedLock.Unlock()
+		core.RecordFailure(err)
+		return
+	}
+
+	mvAttrs := mvInfo.Data[0].Attributes
+	layout := downloader.SingleMVLayout(storefront, mvAttrs.GenreNames, mvAttrs.ContentRating)
+	artistName := core.LimitString(mvAttrs.ArtistName)
+	artistFolder, err := naming.Render(layout.ArtistFolderFormat, naming.Fields{ArtistName: artistName, UrlArtistName: artistName})
+	if err != nil {
+		slog.Warn("render name failed", "format", layout.ArtistFolderFormat, "err", err)
+	}
+	sanitizedArtistFolder := core.Sanitizer.Name(artistFolder)
+	if core.Dry_run {
+		downloader.PrintMVDryRun(mvInfo, albumId, storefront, layout.Root, sanitizedArtistFolder, layout.Route, accountForMV, jsonOutput)
 		return
 	}
 
@@ -104,23 +132,15 @@ func handleSingleMV(urlRaw string) {
 		fmt.Println(string(statusJSON))
 	}
 
-	var artistFolder string
-	if core.Config.ArtistFolderFormat != "" {
-		artistFolder = strings.NewReplacer(
-			"{UrlArtistName}", core.LimitString(mvInfo.Data[0].Attributes.ArtistName),
-			"{ArtistName}", core.LimitString(mvInfo.Data[0].Attributes.ArtistName),
-			"{ArtistId}", "",
-		).Replace(core.Config.ArtistFolderFormat)
-	}
-	sanitizedArtistFolder := core.ForbiddenNames.ReplaceAllString(artistFolder, "_")
-	_, err = downloader.MvDownloader(albumId, core.Config.AlacSaveFolder, sanitizedArtistFolder, "", storefront, nil, accountForMV, nil, jsonOutput)
+	_, err = downloader.MvDownloader(albumId, layout.Root, sanitizedArtistFolder, "", "", storefront, nil, accountForMV, nil, jsonOutput)
 
 	if err != nil {
 		core.SharedLock.Lock()
 		core.Counter.Error++
 		core.SharedLock.Unlock()
+		core.RecordFailure(err)
 		if jsonOutput {
-			printJSONError(fmt.Sprintf("MV 下载失败: %v", err))
+			printJSONError(fmt.Sprintf("MV 下载失败: %v", err), err)
 		}
 		return
 	}
@@ -174,20 +194,22 @@ func processURL(urlRaw string, wg *sync.WaitGroup, semaphore chan struct{}, curr
 		if err != nil {
 			errMsg := fmt.Sprintf("获取歌曲信息失败 for %s: %v", urlRaw, err)
 			if jsonOutput {
-				printJSONError(errMsg)
+				printJSONError(errMsg, err)
 			} else {
 				fmt.Println(errMsg)
 			}
+			core.RecordFailure(err)
 			return
 		}
 		urlRaw, err = api.GetUrlSong(urlRaw, accountForSong)
 		if err != nil {
 			errMsg := fmt.Sprintf("获取歌曲链接失败 for %s: %v", urlRaw, err)
 			if jsonOutput {
-				printJSONError(errMsg)
+				printJSONError(errMsg, err)
 			} else {
 				fmt.Println(errMsg)
 			}
+			core.RecordFailure(err)
 			return
 		}
 		core.Dl_song = true
@@ -200,23 +222,25 @@ func processURL(urlRaw string, wg *sync.WaitGroup, semaphore chan struct{}, curr
 	}
 
 	if albumId == "" {
-		errMsg := fmt.Sprintf("无效的URL: %s", urlRaw)
+		err := errs.New(errs.CodeInvalidURL, fmt.Sprintf("无效的URL: %s", urlRaw))
 		if jsonOutput {
-			printJSONError(errMsg)
+			printJSONError(err.Error(), err)
 		} else {
-			fmt.Println(errMsg)
+			fmt.Println(err)
 		}
+		core.RecordFailure(err)
 		return
 	}
 
 	parse, err := url.Parse(urlRaw)
 	if err != nil {
-		errMsg := fmt.Sprintf("解析URL失败 %s: %v", urlRaw, err)
+		err = errs.Wrap(errs.CodeInvalidURL, err, "解析URL失败 "+urlRaw)
 		if jsonOutput {
-			printJSONError(errMsg)
+			printJSONError(err.Error(), err)
 		} else {
-			log.Println(errMsg)
+			log.Println(err)
 		}
+		core.RecordFailure(err)
 		return
 	}
 	var urlArg_i = parse.Query().Get("i")
@@ -225,10 +249,11 @@ func processURL(urlRaw string, wg *sync.WaitGroup, semaphore chan struct{}, curr
 	if err != nil {
 		errMsg := fmt.Sprintf("专辑下载失败: %s -> %v", urlRaw, err)
 		if jsonOutput {
-			printJSONError(errMsg)
+			printJSONError(errMsg, err)
 		} else {
 			fmt.Println(errMsg)
 		}
+		core.RecordFailure(err)
 	} else {
 		if totalTasks > 1 && !jsonOutput {
 			fmt.Printf("[%d/%d] 任务完成: %s\n", currentTask, totalTasks, urlRaw)
@@ -238,9 +263,18 @@ func processURL(urlRaw string, wg *sync.WaitGroup, semaphore chan struct{}, curr
 
 func runDownloads(initialUrls []string, isBatch bool) {
 	var finalUrls []string
+	var identifiers []api.IdentifierMatch
 
 	for _, urlRaw := range initialUrls {
-		if strings.Contains(urlRaw, "/artist/") {
+		if kind, code := parser.CheckIdentifier(urlRaw); kind != "" {
+			m := api.ResolveIdentifier(kind, code)
+			identifiers = append(identifiers, m)
+			if m.URL != "" {
+				finalUrls = append(finalUrls, m.URL)
+			} else {
+				core.RecordFailure(errs.New(errs.CodeNotFound, fmt.Sprintf("%s %s: %s", kind, code, m.Error)))
+			}
+		} else if strings.Contains(urlRaw, "/artist/") {
 			if !jsonOutput {
 				fmt.Printf("正在解析歌手页面: %s\n", urlRaw)
 			}
@@ -250,13 +284,13 @@ func runDownloads(initialUrls []string, isBatch bool) {
 				if !jsonOutput {
 					fmt.Printf("获取歌手名称失败 for %s: %v\n", urlRaw, err)
 				}
+				core.RecordFailure(err)
 				continue
 			}
 
-			core.Config.ArtistFolderFormat = strings.NewReplacer(
-				"{UrlArtistName}", core.LimitString(urlArtistName),
-				"{ArtistId}", urlArtistID,
-			).Replace(core.Config.ArtistFolderFormat)
+			if core.UrlArtistName == "" {
+				core.UrlArtistName, core.UrlArtistId = urlArtistName, urlArtistID
+			}
 
 			albumArgs, err := api.CheckArtist(urlRaw, artistAccount, "albums")
 			if err != nil {
@@ -286,6 +320,16 @@ func runDownloads(initialUrls []string, isBatch bool) {
 		}
 	}
 
+	if len(identifiers) > 0 {
+		api.PrintIdentifierReport(identifiers, jsonOutput)
+	}
+
+	if core.Config.EditionDedup {
+		var skipped []api.EditionSkip
+		finalUrls, skipped = api.DedupEditions(finalUrls, core.EditionPolicy)
+		api.PrintEditionReport(skipped, core.EditionPolicy, jsonOutput)
+	}
+
 	if len(finalUrls) == 0 {
 		if !jsonOutput {
 			fmt.Println("队列中没有有效的链接可供下载。")
@@ -293,6 +337,13 @@ func runDownloads(initialUrls []string, isBatch bool) {
 		return
 	}
 
+	if core.Dry_run && !jsonOutput {
+		fmt.Printf("--- dry-run: 已解析 %d 个链接 ---\n", len(finalUrls))
+		for i, u := range finalUrls {
+			fmt.Printf("%d. %s\n", i+1, u)
+		}
+	}
+
 	numThreads := 1
 	if isBatch && core.Config.TxtDownloadThreads > 1 {
 		numThreads = core.Config.TxtDownloadThreads
@@ -315,6 +366,69 @@ func runDownloads(initialUrls []string, isBatch bool) {
 	wg.Wait()
 }
 
+// runReorganize moves the files under the given library roots, or under the
+// configured save folders, to the paths the current config gives them.
+func runReorganize(roots []string) {
+	var err error
+	if core.Undo_journal != "" {
+		err = downloader.UndoReorganize(core.Undo_journal, jsonOutput)
+	} else {
+		if len(roots) == 0 {
+			for _, dir := range []string{core.Config.AlacSaveFolder, core.Config.AtmosSaveFolder, core.Config.AacSaveFolder} {
+				if info, statErr := os.Stat(dir); statErr == nil && info.IsDir() && !slices.Contains(roots, dir) {
+					roots = append(roots, dir)
+				}
+			}
+		}
+		for _, root := range roots {
+			if !jsonOutput {
+				fmt.Printf("--- reorganize: %s ---\n", root)
+			}
+			if err = downloader.Reorganize(root, jsonOutput); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("整理文件失败: %v", err)
+		if jsonOutput {
+			printJSONError(errMsg, err)
+		} else {
+			fmt.Println(errMsg)
+		}
+		os.Exit(errs.ExitCode(errs.CodeOf(err)))
+	}
+}
+
+// isListFile reports whether an input names a file of links or ISRC/UPC
+// codes, one per line.
+func isListFile(input string) bool {
+	lower := strings.ToLower(input)
+	return strings.HasSuffix(lower, ".txt") || strings.HasSuffix(lower, ".csv")
+}
+
+// readListFile returns the non-empty lines of a list file, exiting when it
+// cannot be read.
+func readListFile(path string) []string {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Printf("错误: 文件不存在 %s\n", path)
+		os.Exit(errs.ExitInvalidURL)
+	}
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("读取文件 %s 失败: %v\n", path, err)
+		os.Exit(errs.ExitInvalidURL)
+	}
+	var urls []string
+	for _, line := range strings.Split(string(fileBytes), "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine != "" {
+			urls = append(urls, trimmedLine)
+		}
+	}
+	return urls
+}
+
 func main() {
 	core.InitFlags()
 	pflag.BoolVar(&jsonOutput, "json-output", false, "启用JSON输出 (供给桌面App使用)")
@@ -322,36 +436,58 @@ func main() {
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "用法: %s [选项] [url1 url2 ...]\n", os.Args[0])
 		fmt.Println("如果没有提供URL，程序将进入交互模式。")
+		fmt.Fprintf(os.Stderr, "整理已下载的文件: %s reorganize [--dry-run] [目录 ...]，撤销: %s reorganize --undo <日志文件>\n", os.Args[0], os.Args[0])
 		fmt.Println("选项:")
 		pflag.PrintDefaults()
 	}
 
 	pflag.Parse()
 
+	if err := logging.Setup(core.LogLevel, core.LogFile); err != nil {
+		errMsg := fmt.Sprintf("初始化日志失败: %v", err)
+		if jsonOutput {
+			printJSONError(errMsg, errs.ErrConfig)
+		} else {
+			fmt.Println(errMsg)
+		}
+		os.Exit(errs.ExitConfig)
+	}
+
 	err := core.LoadConfig(core.ConfigPath)
 	if err != nil {
 		if os.IsNotExist(err) && core.ConfigPath == "config.yaml" {
 			errMsg := "错误: 默认配置文件 config.yaml 未找到。"
 			if jsonOutput {
-				printJSONError(errMsg)
+				printJSONError(errMsg, errs.ErrConfig)
 			} else {
 				fmt.Println(errMsg)
 				pflag.Usage()
 			}
-			return
+			os.Exit(errs.ExitConfig)
 		}
 		errMsg := fmt.Sprintf("加载配置文件 %s 失败: %v", core.ConfigPath, err)
 		if jsonOutput {
-			printJSONError(errMsg)
+			printJSONError(errMsg, errs.ErrConfig)
 		} else {
 			fmt.Println(errMsg)
 		}
-		return
+		os.Exit(errs.ExitConfig)
 	}
 
 	if core.OutputPath != "" {
 		core.Config.AlacSaveFolder = core.OutputPath
 		core.Config.AtmosSaveFolder = core.OutputPath
+		core.Config.AacSaveFolder = core.OutputPath
+		for i := range core.Config.OutputRoutes {
+			if core.Config.OutputRoutes[i].Root != "" {
+				core.Config.OutputRoutes[i].Root = core.OutputPath
+			}
+		}
+	}
+
+	if args := pflag.Args(); len(args) > 0 && args[0] == "reorganize" {
+		runReorganize(args[1:])
+		return
 	}
 
 	token, err := api.GetToken()
@@ -361,23 +497,24 @@ func main() {
 		} else {
 			errMsg := "获取开发者 token 失败。"
 			if jsonOutput {
-				printJSONError(errMsg)
+				printJSONError(errMsg, err)
 			} else {
 				fmt.Println(errMsg)
 			}
-			return
+			os.Exit(errs.ExitCode(errs.CodeOf(err)))
 		}
 	}
 	core.DeveloperToken = token
+	logging.AddSecret(token)
 
 	args := pflag.Args()
 	if len(args) == 0 {
 		if jsonOutput {
-			printJSONError("JSON 模式下不支持交互式输入")
-			return
+			printJSONError("JSON 模式下不支持交互式输入", errs.ErrConfig)
+			os.Exit(errs.ExitConfig)
 		}
 
-		fmt.Print("请输入专辑链接或txt文件路径: ")
+		fmt.Print("请输入专辑链接、ISRC/UPC 或txt文件路径: ")
 		reader := bufio.NewReader(os.Stdin)
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
@@ -387,31 +524,23 @@ func main() {
 			return
 		}
 
-		if strings.HasSuffix(strings.ToLower(input), ".txt") {
-			if _, err := os.Stat(input); err == nil {
-				fileBytes, err := os.ReadFile(input)
-				if err != nil {
-					fmt.Printf("读取文件 %s 失败: %v\n", input, err)
-					return
-				}
-				lines := strings.Split(string(fileBytes), "\n")
-				var urls []string
-				for _, line := range lines {
-					trimmedLine := strings.TrimSpace(line)
-					if trimmedLine != "" {
-						urls = append(urls, trimmedLine)
-					}
-				}
-				runDownloads(urls, true)
-			} else {
-				fmt.Printf("错误: 文件不存在 %s\n", input)
-				return
-			}
+		if isListFile(input) {
+			runDownloads(readListFile(input), true)
 		} else {
 			runDownloads([]string{input}, false)
 		}
 	} else {
-		runDownloads(args, false)
+		var inputs []string
+		isBatch := false
+		for _, arg := range args {
+			if isListFile(arg) {
+				inputs = append(inputs, readListFile(arg)...)
+				isBatch = true
+			} else {
+				inputs = append(inputs, arg)
+			}
+		}
+		runDownloads(inputs, isBatch)
 	}
 
 	if !jsonOutput {
@@ -419,5 +548,8 @@ func main() {
 		if core.Counter.Error > 0 {
 			fmt.Println("部分任务在执行过程中出错，请检查上面的日志记录")
 		}
+		downloader.PrintFallbackSummary()
+		downloader.PrintRatingSummary()
 	}
+	os.Exit(core.ExitCode())
 }
@@ -0,0 +1,70 @@
+package ampapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var filterClient = &http.Client{Timeout: 15 * time.Second}
+
+// GetSongsByIsrc returns the songs with the given ISRC in storefront's
+// catalog, with their albums. A recording that is on several albums matches
+// once per album.
+func GetSongsByIsrc(storefront string, isrc string, language string, token string) (*SongResp, error) {
+	obj := new(SongResp)
+	if err := getFiltered(storefront, "songs", "isrc", isrc, "albums", language, token, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// GetAlbumsByUpc returns the albums with the given UPC or EAN in
+// storefront's catalog.
+func GetAlbumsByUpc(storefront string, upc string, language string, token string) (*AlbumResp, error) {
+	obj := new(AlbumResp)
+	if err := getFiltered(storefront, "albums", "upc", upc, "", language, token, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// getFiltered runs a catalog filter[<filter>]=<value> request for kind,
+// including the related resources in include if not empty, and decodes the
+// response into obj.
+func getFiltered(storefront, kind, filter, value, include, language, token string, obj any) error {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/%s", storefront, kind), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set(fmt.Sprintf("filter[%s]", filter), value)
+	if include != "" {
+		query.Set("include", include)
+	}
+	query.Set("l", language)
+	req.URL.RawQuery = query.Encode()
+	do, err := filterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return errors.New(do.Status)
+	}
+	return json.NewDecoder(do.Body).Decode(obj)
+}
@@ -97,9 +97,14 @@ type SongRespData struct {
 			ID   string `json:"id"`
 			Kind string `json:"kind"`
 		} `json:"playParams"`
-		TrackNumber  int    `json:"trackNumber"`
-		AudioLocale  string `json:"audioLocale"`
-		ComposerName string `json:"composerName"`
+		TrackNumber    int    `json:"trackNumber"`
+		AudioLocale    string `json:"audioLocale"`
+		ComposerName   string `json:"composerName"`
+		WorkName       string `json:"workName"`
+		MovementName   string `json:"movementName"`
+		MovementNumber int    `json:"movementNumber"`
+		MovementCount  int    `json:"movementCount"`
+		Attribution    string `json:"attribution"`
 	} `json:"attributes"`
 	Relationships struct {
 		Artists struct {
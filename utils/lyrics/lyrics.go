@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"main/internal/core"
 	"main/internal/translator"
 	"net/http"
@@ -181,7 +182,7 @@ func TtmlToLrc(ttml string, enableTranslation bool) (string, error) {
 			translationLock.Lock()
 			transEngine, err := translator.New(core.Config)
 			if err == nil {
-				fmt.Printf(" [纯文本歌词] 正在翻译 %d 行...\n", len(rawLines))
+				slog.Info("translating plain lyrics", "lines", len(rawLines))
 				translatedTexts, err := transEngine.Translate(rawLines, core.Config.TranslationLanguage)
 				if err == nil && len(translatedTexts) == len(rawLines) {
 					for i, line := range rawLines {
@@ -194,7 +195,7 @@ func TtmlToLrc(ttml string, enableTranslation bool) (string, error) {
 					return strings.Join(finalOutput, "\n"), nil
 				} else {
 					if err != nil {
-						fmt.Printf(" [纯文本翻译失败] %v\n", err)
+						slog.Warn("plain lyrics translation failed", "err", err)
 					}
 				}
 			}
@@ -355,9 +356,13 @@ func TtmlToLrc(ttml string, enableTranslation bool) (string, error) {
 			time.Sleep(200 * time.Millisecond)
 
 			transEngine, err := translator.New(core.Config)
-			if err == nil {
+			if err != nil {
+				slog.Warn("translator unavailable", "err", err)
+			} else {
 				translatedTexts, err := transEngine.Translate(textsToTranslate, core.Config.TranslationLanguage)
-				if err == nil {
+				if err != nil {
+					slog.Warn("lyrics translation failed", "err", err)
+				} else {
 					transIndex := 0
 					for i := range lines {
 						if strings.TrimSpace(lines[i].Text) != "" {
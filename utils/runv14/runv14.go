@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -16,6 +17,9 @@ import (
 	"sync"
 	"time"
 
+	"main/internal/core"
+	"main/internal/errs"
+	"main/internal/retry"
 	"main/utils/structs"
 
 	"github.com/Eyevinn/mp4ff/mp4"
@@ -126,13 +130,35 @@ func getRemoteFileSize(fileUrl string, header http.Header, httpClient *http.Clie
 	}
 	return size, nil
 }
-func downloadChunk(wg *sync.WaitGroup, errChan chan error, progressBytes chan int64, fileUrl string, header http.Header, tempFile *os.File, chunkIndex int, start, end int64, Config structs.ConfigSet, httpClient *http.Client) {
+
+// downloadChunk fetches bytes [start, end] into tempFile. When a request
+// fails part way, only the remaining range is requested again, up to the
+// policy's chunk attempts.
+func downloadChunk(wg *sync.WaitGroup, errChan chan error, progressBytes chan int64, fileUrl string, header http.Header, tempFile *os.File, chunkIndex int, start, end int64, Config structs.ConfigSet, httpClient *http.Client, policy *retry.Policy) {
 	defer wg.Done()
 
+	var written int64
+	err := policy.Do(policy.ChunkAttempts(), func(attempt int) error {
+		if start+written > end {
+			return nil
+		}
+		n, err := downloadRange(progressBytes, fileUrl, header, tempFile, chunkIndex, start+written, end, attempt > 1, Config, httpClient)
+		written += n
+		return err
+	}, func(attempt int, err error) {
+		slog.Debug("chunk failed, resuming remaining range", "chunk", chunkIndex, "from", start+written, "to", end, "attempt", attempt, "err", err)
+	})
+	if err != nil {
+		errChan <- err
+	}
+}
+
+// downloadRange writes one ranged response at offset start and returns the
+// number of bytes written, which is non-zero even when the body breaks off.
+func downloadRange(progressBytes chan int64, fileUrl string, header http.Header, tempFile *os.File, chunkIndex int, start, end int64, resumed bool, Config structs.ConfigSet, httpClient *http.Client) (int64, error) {
 	req, err := http.NewRequest("GET", fileUrl, nil)
 	if err != nil {
-		errChan <- fmt.Errorf("chunk %d: failed to create request: %w", chunkIndex, err)
-		return
+		return 0, fmt.Errorf("chunk %d: failed to create request: %w", chunkIndex, err)
 	}
 
 	req.Header = header.Clone()
@@ -140,16 +166,14 @@ func downloadChunk(wg *sync.WaitGroup, errChan chan error, progressBytes chan in
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		errChan <- fmt.Errorf("chunk %d: request failed: %w", chunkIndex, err)
-		return
+		return 0, fmt.Errorf("chunk %d: request failed: %w", chunkIndex, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusPartialContent {
 
-		if !(chunkIndex > 0 && resp.StatusCode == http.StatusOK) {
-			errChan <- fmt.Errorf("chunk %d: server returned non-206 status: %s", chunkIndex, resp.Status)
-			return
+		if resumed || !(chunkIndex > 0 && resp.StatusCode == http.StatusOK) {
+			return 0, errs.New(errs.CodeNetwork, fmt.Sprintf("chunk %d: server returned non-206 status: %s", chunkIndex, resp.Status))
 		}
 	}
 
@@ -160,8 +184,7 @@ func downloadChunk(wg *sync.WaitGroup, errChan chan error, progressBytes chan in
 		if n > 0 {
 			_, writeErr := tempFile.WriteAt(buffer[:n], start+writtenBytes)
 			if writeErr != nil {
-				errChan <- fmt.Errorf("chunk %d: failed to write to temp file: %w", chunkIndex, writeErr)
-				return
+				return writtenBytes, fmt.Errorf("chunk %d: failed to write to temp file: %w", chunkIndex, writeErr)
 			}
 			writtenBytes += int64(n)
 			progressBytes <- int64(n)
@@ -170,10 +193,10 @@ func downloadChunk(wg *sync.WaitGroup, errChan chan error, progressBytes chan in
 			break
 		}
 		if readErr != nil {
-			errChan <- fmt.Errorf("chunk %d: failed to read body stream: %w", chunkIndex, readErr)
-			return
+			return writtenBytes, errs.Wrap(errs.CodeNetwork, readErr, fmt.Sprintf("chunk %d: failed to read body stream", chunkIndex))
 		}
 	}
+	return writtenBytes, nil
 }
 func downloadFileInChunks(fileUrl string, header http.Header, totalSize int64, numChunks int, progressChan chan ProgressUpdate, Config structs.ConfigSet, httpClient *http.Client) (*os.File, error) {
 	tempFile, err := os.CreateTemp("", "amdl-*.tmp")
@@ -182,6 +205,7 @@ func downloadFileInChunks(fileUrl string, header http.Header, totalSize int64, n
 	}
 
 	chunkSize := totalSize / int64(numChunks)
+	policy := core.RetryPolicy
 	var wg sync.WaitGroup
 	errChan := make(chan error, numChunks)
 	progressBytes := make(chan int64, numChunks*10)
@@ -220,7 +244,7 @@ func downloadFileInChunks(fileUrl string, header http.Header, totalSize int64, n
 			end = totalSize - 1
 		}
 		wg.Add(1)
-		go downloadChunk(&wg, errChan, progressBytes, fileUrl, header, tempFile, i, start, end, Config, httpClient)
+		go downloadChunk(&wg, errChan, progressBytes, fileUrl, header, tempFile, i, start, end, Config, httpClient, policy)
 	}
 
 	wg.Wait()
@@ -254,12 +278,12 @@ func Run(adamId string, playlistUrl string, outfile string, account *structs.Acc
 
 	segments, err := parseMediaPlaylist(do.Body)
 	if err != nil {
-		return err
+		return errs.Wrap(errs.CodeManifestMissing, err, "parse media playlist")
 	}
 	do.Body.Close()
 
 	if len(segments) == 0 || segments[0] == nil {
-		return errors.New("no segments extracted from playlist")
+		return errs.New(errs.CodeManifestMissing, "no segments extracted from playlist")
 	}
 	if segments[0].Limit <= 0 {
 		return errors.New("non-byterange playlists are currently unsupported")
@@ -300,7 +324,7 @@ func Run(adamId string, playlistUrl string, outfile string, account *structs.Acc
 	addr := account.DecryptM3u8Port
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		return err
+		return errs.Wrap(errs.CodeDecryptPortUnreachable, err, "decrypt port "+addr)
 	}
 	defer Close(conn)
 	err = downloadAndDecryptFile(conn, readTempFile, totalSize, outfile, adamId, segments, Config, progressChan)
@@ -334,10 +358,11 @@ func downloadAndDecryptFile(conn net.Conn, in io.Reader, totalSize int64, outfil
 
 	tracks, err := TransformInit(init)
 	if err != nil {
-		return err
+		return errs.Wrap(errs.CodeDecryptFailed, err, "transform init")
 	}
 	err = sanitizeInit(init)
 	if err != nil {
+		slog.Warn("init segment not sanitized", "adamId", adamId, "err", err)
 	}
 	err = init.Encode(outBuf)
 	if err != nil {
@@ -402,7 +427,7 @@ func downloadAndDecryptFile(conn net.Conn, in io.Reader, totalSize int64, outfil
 		}
 		err = DecryptFragment(frag, tracks, rw)
 		if err != nil {
-			return fmt.Errorf("decryptFragment: %w", err)
+			return errs.Wrap(errs.CodeDecryptFailed, err, "decryptFragment")
 		}
 		err = frag.Encode(outBuf)
 		if err != nil {
@@ -22,7 +22,7 @@ type CDM struct {
 	clientID   []byte
 	sessionID  [32]byte
 
-	widevineCencHeader      WidevineCencHeader
+	widevineCencHeader      *WidevineCencHeader
 	signedDeviceCertificate SignedDeviceCertificate
 	privacyMode             bool
 }
@@ -69,7 +69,7 @@ func NewCDM(privateKey string, clientID []byte, initData []byte) (CDM, error) {
 		privateKey: keyParsed,
 		clientID:   clientID,
 
-		widevineCencHeader: widevineCencHeader,
+		widevineCencHeader: &widevineCencHeader,
 
 		sessionID: sessionID,
 	}, nil
@@ -115,7 +115,7 @@ func (c *CDM) GetLicenseRequest() ([]byte, error) {
 		licenseRequest.Type = &v
 	}
 
-	licenseRequest.Msg.ContentId.CencId.Pssh = &c.widevineCencHeader
+	licenseRequest.Msg.ContentId.CencId.Pssh = c.widevineCencHeader
 
 	{
 		v := LicenseType_DEFAULT
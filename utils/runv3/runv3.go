@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"main/internal/core"
+	"main/internal/errs"
 	cdm "main/utils/runv3/cdm"
 	key "main/utils/runv3/key"
 	"net"
@@ -150,7 +152,7 @@ func BeforeRequest(cl *requests.Client, preCtx context.Context, method string, h
 	options[0].Json = jsondata
 	resp, err = cl.Request(preCtx, method, href, options...)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("license request failed", "adamId", preCtx.Value("adamId"), "err", err)
 	}
 
 	return
@@ -178,12 +180,12 @@ func GetWebplayback(adamId string, authtoken string, mutoken string, mvmode bool
 	}
 	jsonData, err := json.Marshal(postData)
 	if err != nil {
-		fmt.Println("Error encoding JSON:", err)
+		slog.Error("webPlayback: encode request", "adamId", adamId, "err", err)
 		return "", "", err
 	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(jsonData)))
 	if err != nil {
-		fmt.Println("Error creating request:", err)
+		slog.Error("webPlayback: create request", "adamId", adamId, "err", err)
 		return "", "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
@@ -195,14 +197,14 @@ func GetWebplayback(adamId string, authtoken string, mutoken string, mvmode bool
 	resp, err := getHijackedClient().Do(req)
 
 	if err != nil {
-		fmt.Println("Error sending request:", err)
+		slog.Error("webPlayback: send request", "adamId", adamId, "err", err)
 		return "", "", err
 	}
 	defer resp.Body.Close()
 	obj := new(Songlist)
 	err = json.NewDecoder(resp.Body).Decode(&obj)
 	if err != nil {
-		fmt.Println("json err:", err)
+		slog.Error("webPlayback: decode response", "adamId", adamId, "err", err)
 		return "", "", err
 	}
 	if len(obj.List) > 0 {
@@ -221,7 +223,7 @@ func GetWebplayback(adamId string, authtoken string, mutoken string, mvmode bool
 			continue
 		}
 	}
-	return "", "", errors.New("Unavailable")
+	return "", "", errs.New(errs.CodeGeoUnavailable, "Unavailable")
 }
 
 type Songlist struct {
@@ -276,17 +278,18 @@ func extractKidBase64(b string, mvmode bool) (string, string, error) {
 				}
 			}
 		} else {
-			fmt.Println("No key information found")
+			slog.Warn("no key information found in playlist", "url", b)
 		}
 	} else {
-		fmt.Println("Not a media playlist")
+		slog.Warn("not a media playlist", "url", b)
 	}
 	return kidbase64, urlBuilder.String(), nil
 }
 func extsong(b string) bytes.Buffer {
 	resp, err := getHijackedClient().Get(b)
 	if err != nil {
-		fmt.Printf("下载文件失败: %v\n", err)
+		slog.Error("download song file", "err", err)
+		return bytes.Buffer{}
 	}
 	defer resp.Body.Close()
 	var buffer bytes.Buffer
@@ -333,7 +336,7 @@ func Run(adamId string, trackpath string, authtoken string, mutoken string, mvmo
 	ctx = context.WithValue(ctx, "adamId", adamId)
 	pssh, err := getPSSH("", kidBase64)
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("build pssh", "adamId", adamId, "err", err)
 		return "", err
 	}
 	headers := map[string]interface{}{
@@ -355,14 +358,14 @@ func Run(adamId string, trackpath string, authtoken string, mutoken string, mvmo
 	if strings.Contains(adamId, "ra.") {
 		keystr, keybt, err = key.GetKey(ctx, "https://play.itunes.apple.com/WebObjects/MZPlay.woa/web/radio/versions/1/license", pssh, nil)
 		if err != nil {
-			fmt.Println(err)
-			return "", err
+			slog.Error("get key", "adamId", adamId, "err", err)
+			return "", errs.Wrap(errs.CodeDecryptFailed, err, "license")
 		}
 	} else {
 		keystr, keybt, err = key.GetKey(ctx, "https://play.itunes.apple.com/WebObjects/MZPlay.woa/wa/acquireWebPlaybackLicense", pssh, nil)
 		if err != nil {
-			fmt.Println(err)
-			return "", err
+			slog.Error("get key", "adamId", adamId, "err", err)
+			return "", errs.Wrap(errs.CodeDecryptFailed, err, "license")
 		}
 	}
 	if mvmode {
@@ -376,20 +379,20 @@ func Run(adamId string, trackpath string, authtoken string, mutoken string, mvmo
 	err = DecryptMP4(&body, keybt, &buffer)
 	if err != nil {
 		//fmt.Print("Decryption failed\n")
-		return "", err
+		return "", errs.Wrap(errs.CodeDecryptFailed, err, "")
 	} else {
 		//fmt.Print("Decrypted\n")
 	}
 	ofh, err := os.Create(trackpath)
 	if err != nil {
-		fmt.Printf("创建文件失败: %v\n", err)
+		slog.Error("create output file", "path", trackpath, "err", err)
 		return "", err
 	}
 	defer ofh.Close()
 
 	_, err = ofh.Write(buffer.Bytes())
 	if err != nil {
-		fmt.Printf("写入文件失败: %v\n", err)
+		slog.Error("write output file", "path", trackpath, "err", err)
 		return "", err
 	}
 	return "", nil
@@ -408,25 +411,25 @@ func downloadSegment(url string, index int, wg *sync.WaitGroup, segmentsChan cha
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Printf("错误(分段 %d): 创建请求失败: %v\n", index, err)
+		slog.Error("segment: create request", "segment", index, "err", err)
 		return
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("错误(分段 %d): 下载失败: %v\n", index, err)
+		slog.Error("segment: download", "segment", index, "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("错误(分段 %d): 服务器返回状态码 %d\n", index, resp.StatusCode)
+		slog.Error("segment: unexpected status", "segment", index, "status", resp.StatusCode)
 		return
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("错误(分段 %d): 读取数据失败: %v\n", index, err)
+		slog.Error("segment: read body", "segment", index, "err", err)
 		return
 	}
 
@@ -442,7 +445,7 @@ func fileWriter(wg *sync.WaitGroup, segmentsChan <-chan Segment, outputFile io.W
 		if segment.Index == nextIndex {
 			_, err := outputFile.Write(segment.Data)
 			if err != nil {
-				fmt.Printf("错误(分段 %d): 写入文件失败: %v\n", segment.Index, err)
+				slog.Error("segment: write", "segment", segment.Index, "err", err)
 			}
 			nextIndex++
 
@@ -454,7 +457,7 @@ func fileWriter(wg *sync.WaitGroup, segmentsChan <-chan Segment, outputFile io.W
 
 				_, err := outputFile.Write(data)
 				if err != nil {
-					fmt.Printf("错误(分段 %d): 从缓冲区写入文件失败: %v\n", nextIndex, err)
+					slog.Error("segment: write buffered", "segment", nextIndex, "err", err)
 				}
 
 				delete(segmentBuffer, nextIndex)
@@ -467,7 +470,7 @@ func fileWriter(wg *sync.WaitGroup, segmentsChan <-chan Segment, outputFile io.W
 	}
 
 	if nextIndex != totalSegments {
-		fmt.Printf("警告: 写入完成，但似乎有分段丢失。期望 %d 个, 实际写入 %d 个。\n", totalSegments, nextIndex)
+		slog.Warn("segments missing after write", "expected", totalSegments, "written", nextIndex)
 	}
 }
 
@@ -477,7 +480,7 @@ func ExtMvData(keyAndUrls string, savePath string) error {
 	urls := segments[1:]
 	tempFile, err := os.CreateTemp("", "enc_mv_data-*.mp4")
 	if err != nil {
-		fmt.Printf("创建文件失败：%v\n", err)
+		slog.Error("create temp file", "err", err)
 		return err
 	}
 	defer os.Remove(tempFile.Name())
@@ -510,7 +513,10 @@ func ExtMvData(keyAndUrls string, savePath string) error {
 	outlog, err := cmd1.CombinedOutput()
 	if err != nil {
 
-		return fmt.Errorf("decrypt failed: %w, output: %s", err, string(outlog))
+		if errors.Is(err, exec.ErrNotFound) {
+			return errs.Wrap(errs.CodeDependencyMissing, err, "mp4decrypt")
+		}
+		return errs.Wrap(errs.CodeDecryptFailed, err, fmt.Sprintf("decrypt failed, output: %s", string(outlog)))
 	} else {
 
 	}
@@ -1,4 +1,7 @@
 package structs
+
+import "log/slog"
+
 type EditorialNotes struct {
 	Standard string `json:"standard"`
 }
@@ -12,6 +15,15 @@ type Account struct {
 	GetM3u8Port        string `yaml:"get-m3u8-port"`
 }
 
+// LogValue keeps tokens out of log records: only the name and storefront are
+// logged when an Account is passed as a slog attribute.
+func (a Account) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", a.Name),
+		slog.String("storefront", a.Storefront),
+	)
+}
+
 type ConfigSet struct {
 	Accounts                []Account `yaml:"accounts"`
 	Language                string    `yaml:"language"`
@@ -27,10 +39,13 @@ type ConfigSet struct {
 	CoverFormat             string    `yaml:"cover-format"`
 	AlacSaveFolder          string    `yaml:"alac-save-folder"`
 	AtmosSaveFolder         string    `yaml:"atmos-save-folder"`
+	AacSaveFolder           string    `yaml:"aac-save-folder"`
 	AlbumFolderFormat       string    `yaml:"album-folder-format"`
 	PlaylistFolderFormat    string    `yaml:"playlist-folder-format"`
 	ArtistFolderFormat      string    `yaml:"artist-folder-format"`
 	SongFileFormat          string    `yaml:"song-file-format"`
+	DiscLayout              string    `yaml:"disc-layout"`
+	DiscFolderFormat        string    `yaml:"disc-folder-format"`
 	ExplicitChoice          string    `yaml:"explicit-choice"`
 	CleanChoice             string    `yaml:"clean-choice"`
 	AppleMasterChoice       string    `yaml:"apple-master-choice"`
@@ -40,6 +55,9 @@ type ConfigSet struct {
 	AacType                 string    `yaml:"aac-type"`
 	AlacMax                 int       `yaml:"alac-max"`
 	AtmosMax                int       `yaml:"atmos-max"`
+	VerifyAlacQuality       bool      `yaml:"verify-alac-quality"`
+	CodecFallback           []string  `yaml:"codec-fallback"`
+	OutputRoutes            []OutputRoute `yaml:"output-routes"`
 	LimitMax                int       `yaml:"limit-max"`
 	UseSongInfoForPlaylist  bool      `yaml:"use-songinfo-for-playlist"`
 	DlAlbumcoverForPlaylist bool      `yaml:"dl-albumcover-for-playlist"`
@@ -63,6 +81,30 @@ type ConfigSet struct {
 	EnableCdnOverride       bool      `yaml:"enable-cdn-override"`
 	CdnIp                   string    `yaml:"cdn-ip"`
 	GlobalDecryption        bool      `yaml:"global-decryption"`
+	CrossStorefront         bool      `yaml:"cross-storefront"`
+	ArtistFilter            string    `yaml:"artist-filter"`
+	HistoryFile             string    `yaml:"history-file"`
+	EditionDedup            bool      `yaml:"edition-dedup"`
+	EditionPolicy           string    `yaml:"edition-policy"`
+	ContentRating           string    `yaml:"content-rating"`
+	ClassicalMode           string    `yaml:"classical-mode"`
+	ClassicalNaming         string    `yaml:"classical-naming"`
+	SecondaryLanguage       string    `yaml:"secondary-language"`
+	SecondaryLanguageTags   string    `yaml:"secondary-language-tags"`
+	TagLanguage             string    `yaml:"tag-language"`
+	FolderLanguage          string    `yaml:"folder-language"`
+	Credits                 bool      `yaml:"credits"`
+	CreditsFile             bool      `yaml:"credits-file"`
+	CreditsTags             map[string]string `yaml:"credits-tags"`
+	Gapless                 bool      `yaml:"gapless"`
+	ReplayGain              bool      `yaml:"replaygain"`
+	CompilationArtist       string    `yaml:"compilation-artist"`
+	CompilationMinArtists   int       `yaml:"compilation-min-artists"`
+	CompilationFolderFormat string    `yaml:"compilation-folder-format"`
+	Nfo                     bool      `yaml:"nfo"`
+	AlbumJSON               bool      `yaml:"album-json"`
+	MusicBrainzLookup       bool      `yaml:"musicbrainz-lookup"`
+	MusicBrainzContact      string    `yaml:"musicbrainz-contact"`
 	EnableTranslation       bool      `yaml:"enable-translation"`
     TranslationLanguage     string    `yaml:"translation-language"`
     TranslationTarget       string    `yaml:"translation-target"`
@@ -72,6 +114,52 @@ type ConfigSet struct {
     Microsoft               MicrosoftConfig `yaml:"microsoft"`
     Google                  GoogleConfig    `yaml:"google"`
     LibreTranslate          LibreTranslateConfig `json:"libre_translate" yaml:"libre_translate"`
+	Retry                   RetryConfig          `yaml:"retry"`
+	Sanitize                SanitizeConfig       `yaml:"sanitize"`
+}
+
+// RetryConfig is the retry policy shared by track downloads, chunk downloads
+// and extras. Zero values fall back to the defaults in internal/retry.
+type RetryConfig struct {
+	MaxAttempts      int      `yaml:"max-attempts"`
+	MaxTotalAttempts int      `yaml:"max-total-attempts"`
+	ChunkAttempts    int      `yaml:"chunk-attempts"`
+	BaseDelayMs      int      `yaml:"base-delay-ms"`
+	MaxDelayMs       int      `yaml:"max-delay-ms"`
+	Jitter           *float64 `yaml:"jitter"` // unset: default; 0: off
+	SameAccount      []string `yaml:"same-account"`
+	SwitchAccount    []string `yaml:"switch-account"`
+	FailFast         []string `yaml:"fail-fast"`
+}
+
+// OutputRoute sends the albums, tracks and music videos that match all of its
+// conditions to Root, named with its own formats. Empty conditions match
+// anything and empty formats keep the global ones.
+type OutputRoute struct {
+	Name                 string   `yaml:"name"`
+	Genre                []string `yaml:"genre"`
+	Type                 string   `yaml:"type"`   // song, music-video
+	Source               string   `yaml:"source"` // album, playlist
+	Storefront           []string `yaml:"storefront"`
+	Explicit             *bool    `yaml:"explicit"`
+	Codec                []string `yaml:"codec"`   // alac, atmos, dolby-audio, aac
+	Quality              []string `yaml:"quality"` // hi-res, lossless, lossy
+	BitDepth             []int    `yaml:"bit-depth"`
+	Root                 string   `yaml:"root"`
+	ArtistFolderFormat   string   `yaml:"artist-folder-format"`
+	AlbumFolderFormat    string   `yaml:"album-folder-format"`
+	PlaylistFolderFormat string   `yaml:"playlist-folder-format"`
+	SongFileFormat       string   `yaml:"song-file-format"`
+}
+
+// SanitizeConfig selects how rendered names are made safe for the target
+// file system. Zero values fall back to the defaults in internal/sanitize.
+type SanitizeConfig struct {
+	Profile           string            `yaml:"profile"`
+	Normalization     string            `yaml:"normalization"`
+	Replacement       string            `yaml:"replacement"`
+	Replace           map[string]string `yaml:"replace"`
+	MaxComponentBytes int               `yaml:"max-component-bytes"`
 }
 
 type LibreTranslateConfig struct {
@@ -281,10 +369,26 @@ type TrackData struct {
 			ID   string `json:"id"`
 			Kind string `json:"kind"`
 		} `json:"playParams"`
-		TrackNumber  int    `json:"trackNumber"`
-		AudioLocale  string `json:"audioLocale"`
-		ComposerName string `json:"composerName"`
+		TrackNumber    int    `json:"trackNumber"`
+		AudioLocale    string `json:"audioLocale"`
+		ComposerName   string `json:"composerName"`
+		WorkName       string `json:"workName"`
+		MovementName   string `json:"movementName"`
+		MovementNumber int    `json:"movementNumber"`
+		MovementCount  int    `json:"movementCount"`
+		Attribution    string `json:"attribution"`
 	} `json:"attributes"`
+	// Classical is set by classical-mode. Classical tracks get work,
+	// movement and performer atoms and the classical-naming preset.
+	Classical bool `json:"-"`
+	// Credits are the performers and other contributors of the recording,
+	// fetched for classical tracks and with credits.
+	Credits []Credit `json:"-"`
+	// Secondary are the names in secondary-language, when it is set.
+	Secondary LocalizedNames `json:"-"`
+	// Source is set by the cross-storefront resolver when the audio is
+	// fetched from another storefront than the album's.
+	Source        TrackSource `json:"-"`
 	Relationships struct {
 		Artists struct {
 			Href string `json:"href"`
@@ -304,6 +408,29 @@ type TrackData struct {
 	} `json:"relationships"`
 }
 
+// LocalizedNames are the names of an album or track in a second catalog
+// language. Empty names are not known in that language.
+type LocalizedNames struct {
+	Name         string
+	ArtistName   string
+	AlbumName    string
+	ComposerName string
+}
+
+// Credit is a person or ensemble credited on a song, with its roles as
+// the catalog names them, such as "Conductor" or "Violin".
+type Credit struct {
+	Name     string
+	Category string
+	Roles    []string
+}
+
+// TrackSource is the catalog entry a track's audio is fetched from.
+type TrackSource struct {
+	Storefront string
+	ID         string
+}
+
 type AlbumData struct {
 	ID         string `json:"id"`
 	Type       string `json:"type"`
@@ -392,6 +519,8 @@ type AutoGenerated struct {
 			// Added EditorialNotes field here.
 			EditorialNotes *EditorialNotes `json:"editorialNotes"`
 		} `json:"attributes"`
+		// Secondary are the album names in secondary-language, when it is set.
+		Secondary     LocalizedNames `json:"-"`
 		Relationships struct {
 			RecordLabels struct {
 				Href string        `json:"href"`
@@ -421,67 +550,9 @@ type AutoGenerated struct {
 }
 
 type AutoGeneratedTrack struct {
-	Href string `json:"href"`
-	Next string `json:"next"`
-	Data []struct {
-		ID         string `json:"id"`
-		Type       string `json:"type"`
-		Href       string `json:"href"`
-		Attributes struct {
-			Previews []struct {
-				URL string `json:"url"`
-			} `json:"previews"`
-			Artwork struct {
-				Width      int    `json:"width"`
-				Height     int    `json:"height"`
-				URL        string `json:"url"`
-				BgColor    string `json:"bgColor"`
-				TextColor1 string `json:"textColor1"`
-				TextColor2 string `json:"textColor2"`
-				TextColor3 string `json:"textColor3"`
-				TextColor4 string `json:"textColor4"`
-			} `json:"artwork"`
-			ArtistName           string   `json:"artistName"`
-			URL                  string   `json:"url"`
-			DiscNumber           int      `json:"discNumber"`
-			GenreNames           []string `json:"genreNames"`
-			HasTimeSyncedLyrics  bool     `json:"hasTimeSyncedLyrics"`
-			IsMasteredForItunes  bool     `json:"isMasteredForItunes"`
-			IsAppleDigitalMaster bool     `json:"isAppleDigitalMaster"`
-			ContentRating        string   `json:"contentRating"`
-			DurationInMillis     int      `json:"durationInMillis"`
-			ReleaseDate          string   `json:"releaseDate"`
-			Name                 string   `json:"name"`
-			Isrc                 string   `json:"isrc"`
-			AudioTraits          []string `json:"audioTraits"`
-			HasLyrics            bool     `json:"hasLyrics"`
-			AlbumName            string   `json:"albumName"`
-			PlayParams           struct {
-				ID   string `json:"id"`
-				Kind string `json:"kind"`
-			} `json:"playParams"`
-			TrackNumber  int    `json:"trackNumber"`
-			AudioLocale  string `json:"audioLocale"`
-			ComposerName string `json:"composerName"`
-		} `json:"attributes"`
-		Relationships struct {
-			Artists struct {
-				Href string `json:"href"`
-				Data []struct {
-					ID         string `json:"id"`
-					Type       string `json:"type"`
-					Href       string `json:"href"`
-					Attributes struct {
-						Name string `json:"name"`
-					} `json:"attributes"`
-				} `json:"data"`
-			} `json:"artists"`
-			Albums struct {
-				Href string      `json:"href"`
-				Data []AlbumData `json:"data"`
-			}
-		} `json:"relationships"`
-	} `json:"data"`
+	Href string      `json:"href"`
+	Next string      `json:"next"`
+	Data []TrackData `json:"data"`
 }
 
 type AutoGeneratedArtist struct {
@@ -523,9 +594,13 @@ type AutoGeneratedArtist struct {
 				ID   string `json:"id"`
 				Kind string `json:"kind"`
 			} `json:"playParams"`
-			TrackNumber  int    `json:"trackNumber"`
-			AudioLocale  string `json:"audioLocale"`
-			ComposerName string `json:"composerName"`
+			TrackNumber   int    `json:"trackNumber"`
+			AudioLocale   string `json:"audioLocale"`
+			ComposerName  string `json:"composerName"`
+			TrackCount    int    `json:"trackCount"`
+			IsSingle      bool   `json:"isSingle"`
+			IsCompilation bool   `json:"isCompilation"`
+			Upc           string `json:"upc"`
 		} `json:"attributes"`
 	} `json:"data"`
 }